@@ -6,11 +6,13 @@ import (
 	"log/slog"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/nsf/jsondiff"
 
 	"github.com/kralicky/protoconfig/server"
 	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/kvutil"
 	"github.com/kralicky/protoconfig/util"
 	"github.com/kralicky/protoconfig/util/fieldmask"
 	"google.golang.org/protobuf/reflect/protopath"
@@ -94,18 +96,10 @@ func (s *Controller[T]) Start(ctx context.Context) error {
 		panic("bug: Run called twice")
 	}
 	s.runContext = ctx
-	var rev int64
-	_, err := s.tracker.ActiveStore().Get(ctx, storage.WithRevisionOut(&rev))
-	if err != nil {
-		if !storage.IsNotFound(err) {
-			return err
-		}
-	}
-	w, err := s.tracker.ActiveStore().Watch(ctx, storage.WithRevision(rev))
+	w, err := s.watchActiveStore(ctx)
 	if err != nil {
 		return err
 	}
-	s.traceLog("controller starting", "revision", rev)
 	go func() {
 		for {
 			cfg, ok := <-w
@@ -113,13 +107,56 @@ func (s *Controller[T]) Start(ctx context.Context) error {
 				s.traceLog("controller watch channel closed")
 				return
 			}
-			s.traceLog("controller received watch event")
-			s.handleWatchEvent(cfg)
+			switch cfg.EventType {
+			case storage.WatchEventPut, storage.WatchEventDelete:
+				s.traceLog("controller received watch event")
+				s.handleWatchEvent(cfg)
+			case storage.WatchEventError:
+				// The watch could not be resumed, which means that events were
+				// missed. Start over from the current revision; the current value
+				// will be sent as the first event of the new watch.
+				if s.logger != nil {
+					s.logger.With("error", cfg.Err).Warn("controller watch terminated, restarting from the current revision")
+				}
+				for {
+					w, err = s.watchActiveStore(ctx)
+					if err == nil {
+						break
+					}
+					if ctx.Err() != nil {
+						return
+					}
+					if s.logger != nil {
+						s.logger.With("error", err).Error("failed to restart controller watch")
+					}
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(time.Second):
+					}
+				}
+			}
 		}
 	}()
 	return nil
 }
 
+func (s *Controller[T]) watchActiveStore(ctx context.Context) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error) {
+	var rev int64
+	_, err := s.tracker.ActiveStore().Get(ctx, storage.WithRevisionOut(&rev))
+	if err != nil {
+		if !storage.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	w, err := kvutil.ResumeWatch(ctx, s.tracker.ActiveStore().Watch, storage.WithRevision(rev))
+	if err != nil {
+		return nil, err
+	}
+	s.traceLog("controller starting", "revision", rev)
+	return w, nil
+}
+
 func (s *Controller[T]) handleWatchEvent(cfg storage.WatchEvent[storage.KeyRevision[T]]) {
 	s.reactiveMessagesMu.Lock()
 	defer s.reactiveMessagesMu.Unlock()
@@ -10,6 +10,7 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/samber/lo"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/protobuf/reflect/protopath"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/types/known/fieldmaskpb"
@@ -18,6 +19,7 @@ import (
 	"github.com/kralicky/protoconfig/reactive"
 	"github.com/kralicky/protoconfig/server"
 	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/faulty"
 	"github.com/kralicky/protoconfig/storage/inmemory"
 	"github.com/kralicky/protoconfig/test/ext"
 	"github.com/kralicky/protoconfig/test/testutil"
@@ -270,6 +272,56 @@ var _ = Describe("Reactive Controller", Label("unit"), Ordered, func() {
 		})
 	})
 
+	When("the active store is unreliable", func() {
+		It("should recover from watch failures and converge to the latest value", func(ctx SpecContext) {
+			defaultStore := inmemory.NewValueStore[*ext.SampleConfiguration](util.ProtoClone)
+			activeStore := inmemory.NewValueStore[*ext.SampleConfiguration](util.ProtoClone)
+			injector := faulty.NewInjector(
+				faulty.WithSeed(GinkgoRandomSeed()),
+				faulty.WithErrorRate(codes.Unavailable, 0.2),
+				faulty.WithWatchCloseRate(0.2),
+				faulty.WithWatchDuplicateRate(0.2),
+			)
+			injector.Disable()
+			ctrl = reactive.NewController(server.NewDefaultingConfigTracker(defaultStore, faulty.NewValueStore(activeStore, injector), flagutil.LoadDefaults))
+			ctx2, ca := context.WithCancel(context.Background())
+			Expect(ctrl.Start(ctx2)).To(Succeed())
+			DeferCleanup(ca)
+			injector.Enable()
+
+			msg := &ext.SampleConfiguration{}
+			w := ctrl.Reactive(msg.ProtoPath().StringField()).Watch(ctx)
+
+			var v protoreflect.Value
+			drain := func() string {
+				for {
+					select {
+					case v = <-w:
+					default:
+						return v.String()
+					}
+				}
+			}
+
+			// keep writing until faults have been injected, since how many events
+			// the watch sees depends on how quickly the controller reads them
+			var n int
+			Eventually(func() faulty.Stats {
+				drain()
+				Expect(activeStore.Put(ctx, &ext.SampleConfiguration{
+					StringField: lo.ToPtr(fmt.Sprint(n)),
+				})).To(Succeed())
+				n++
+				return injector.Stats()
+			}).WithTimeout(10 * time.Second).WithPolling(time.Millisecond).Should(And(
+				HaveField("ClosedWatches", BeNumerically(">", 0)),
+				HaveField("DuplicatedEvents", BeNumerically(">", 0)),
+			))
+
+			Eventually(drain).WithTimeout(10 * time.Second).Should(Equal(fmt.Sprint(n - 1)))
+		})
+	})
+
 	When("a value is changed", func() {
 		When("it only has watchers on parent paths", func() {
 			It("should update the parent reactive message", func(ctx SpecContext) {
@@ -2,13 +2,19 @@ package server
 
 import (
 	"context"
+	"slices"
 	"sync"
 
+	"github.com/kralicky/protoconfig/storage"
 	"github.com/samber/lo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// Deprecated: use [storage.Driver] instead.
 type Builder[T any] func(ctx context.Context, opts ...Option) (T, error)
 
+// Deprecated: use [storage.DriverRegistry] instead.
 type Cache[T any] interface {
 	Register(name string, builder Builder[T])
 	Unregister(name string)
@@ -17,8 +23,17 @@ type Cache[T any] interface {
 	Range(func(name string, builder Builder[T]))
 }
 
+// Adapts a driver registry to the [Cache] interface. Builders registered
+// through the cache are returned as-is by Get, and are also registered with
+// the registry as drivers without options, unless their names are not valid
+// driver names (see [storage.IsValidDriverName]). Drivers registered directly
+// with the registry are returned as builders which open a store from a URI
+// with no host, path or options; such builders do not accept any options.
 type driverCache[T any] struct {
-	lock     sync.RWMutex
+	// serializes overwriting registrations, which unregister the previous
+	// driver first
+	lock     sync.Mutex
+	registry *storage.DriverRegistry[T]
 	builders map[string]Builder[T]
 }
 
@@ -27,6 +42,16 @@ func (dc *driverCache[D]) Register(name string, builder Builder[D]) {
 	defer dc.lock.Unlock()
 
 	dc.builders[name] = builder
+	if !storage.IsValidDriverName(name) {
+		return
+	}
+	dc.registry.Unregister(name)
+	dc.registry.Register(storage.Driver[D]{
+		Name: name,
+		Build: func(ctx context.Context, _ storage.DriverConfig) (D, error) {
+			return builder(ctx)
+		},
+	})
 }
 
 func (dc *driverCache[D]) Unregister(name string) {
@@ -34,34 +59,89 @@ func (dc *driverCache[D]) Unregister(name string) {
 	defer dc.lock.Unlock()
 
 	delete(dc.builders, name)
+	dc.registry.Unregister(name)
 }
 
 func (dc *driverCache[D]) Get(name string) (Builder[D], bool) {
-	dc.lock.RLock()
-	defer dc.lock.RUnlock()
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
 
-	builder, ok := dc.builders[name]
-	return builder, ok
+	return dc.getLocked(name)
+}
+
+func (dc *driverCache[D]) getLocked(name string) (Builder[D], bool) {
+	builder, cached := dc.builders[name]
+	if !storage.IsValidDriverName(name) {
+		return builder, cached
+	}
+	if _, ok := dc.registry.Lookup(name); !ok {
+		return nil, false
+	}
+	if cached {
+		return builder, true
+	}
+	return func(ctx context.Context, opts ...Option) (D, error) {
+		if len(opts) > 0 {
+			var zero D
+			return zero, status.Errorf(codes.InvalidArgument, "driver %q does not accept options; open it with a store uri instead", name)
+		}
+		return dc.registry.Open(ctx, name+"://")
+	}, true
 }
 
 func (dc *driverCache[D]) List() []string {
-	dc.lock.RLock()
-	defer dc.lock.RUnlock()
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
 
-	return lo.Keys(dc.builders)
+	return dc.listLocked()
+}
+
+func (dc *driverCache[D]) listLocked() []string {
+	names := lo.Map(dc.registry.Drivers(), func(d storage.Driver[D], _ int) string {
+		return d.Name
+	})
+	for name := range dc.builders {
+		if !storage.IsValidDriverName(name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
 }
 
 func (dc *driverCache[D]) Range(fn func(name string, builder Builder[D])) {
-	dc.lock.RLock()
-	defer dc.lock.RUnlock()
+	dc.lock.Lock()
+	type entry struct {
+		name    string
+		builder Builder[D]
+	}
+	var entries []entry
+	for _, name := range dc.listLocked() {
+		if builder, ok := dc.getLocked(name); ok {
+			entries = append(entries, entry{name, builder})
+		}
+	}
+	dc.lock.Unlock()
 
-	for name, builder := range dc.builders {
-		fn(name, builder)
+	for _, e := range entries {
+		fn(e.name, e.builder)
 	}
 }
 
+// Returns a cache backed by a new, empty driver registry.
+//
+// Deprecated: use [storage.NewDriverRegistry] instead.
 func NewCache[T any]() Cache[T] {
+	return NewRegistryCache(storage.NewDriverRegistry[T]())
+}
+
+// Returns a cache backed by the given driver registry, such as
+// [storage.KeyValueStoreDrivers].
+//
+// Deprecated: use the registry directly instead.
+func NewRegistryCache[T any](registry *storage.DriverRegistry[T]) Cache[T] {
 	return &driverCache[T]{
-		builders: make(map[string]Builder[T]),
+		registry: registry,
+		builders: map[string]Builder[T]{},
 	}
 }
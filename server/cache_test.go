@@ -7,9 +7,12 @@ import (
 	"sync"
 
 	"github.com/kralicky/protoconfig/server"
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/test/testutil"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/samber/lo"
+	"google.golang.org/grpc/codes"
 )
 
 var _ = Describe("Cache", Label("unit"), func() {
@@ -113,4 +116,56 @@ var _ = Describe("Cache", Label("unit"), func() {
 		}
 		wg.Wait()
 	})
+
+	It("should pass options to registered builders", func(ctx SpecContext) {
+		var received []server.Option
+		driverCache.Register("driver", func(_ context.Context, opts ...server.Option) (driverStub, error) {
+			received = opts
+			return driverStub(len(opts)), nil
+		})
+		builder, ok := driverCache.Get("driver")
+		Expect(ok).To(BeTrue())
+		opts := []server.Option{server.NewOption("key", 1), server.NewOption("key", 1)}
+		Expect(builder(ctx, opts...)).To(Equal(driverStub(2)))
+		Expect(received).To(HaveLen(2))
+	})
+
+	It("should accept names which are not valid driver names", func(ctx SpecContext) {
+		for _, name := range []string{"Legacy", "legacy_driver", "1driver"} {
+			Expect(func() {
+				driverCache.Register(name, driverBuilders["driver1"])
+			}).NotTo(Panic())
+			builder, ok := driverCache.Get(name)
+			Expect(ok).To(BeTrue())
+			Expect(reflect.ValueOf(builder)).To(Equal(reflect.ValueOf(driverBuilders["driver1"])))
+		}
+		Expect(driverCache.List()).To(ConsistOf("Legacy", "legacy_driver", "1driver"))
+
+		driverCache.Unregister("Legacy")
+		_, ok := driverCache.Get("Legacy")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should share drivers with the registry it is backed by", func(ctx SpecContext) {
+		registry := storage.NewDriverRegistry[driverStub]()
+		registry.Register(storage.Driver[driverStub]{
+			Name: "registered",
+			Build: func(context.Context, storage.DriverConfig) (driverStub, error) {
+				return driverStub(-1), nil
+			},
+		})
+		cache := server.NewRegistryCache(registry)
+
+		builder, ok := cache.Get("registered")
+		Expect(ok).To(BeTrue())
+		Expect(builder(ctx)).To(Equal(driverStub(-1)))
+
+		By("rejecting options for drivers registered with the registry")
+		_, err := builder(ctx, server.NewOption("key", 1))
+		Expect(err).To(testutil.MatchStatusCode(codes.InvalidArgument))
+
+		cache.Register("cached", driverBuilders["driver1"])
+		Expect(registry.Open(ctx, "cached://")).To(Equal(driverStub(1)))
+		Expect(cache.List()).To(Equal([]string{"cached", "registered"}))
+	})
 })
@@ -139,6 +139,19 @@ func (ct *DefaultingConfigTracker[T]) ActiveStore() storage.ValueStoreT[T] {
 	return ct.activeStore
 }
 
+func (ct *DefaultingConfigTracker[T]) DefaultStore() storage.ValueStoreT[T] {
+	return ct.defaultStore
+}
+
+// If the tracker was created using [NewDefaultingActiveKeyedConfigTracker],
+// returns the key-value store containing the active config for every key.
+func (ct *DefaultingConfigTracker[T]) KeyedActiveStore() (storage.KeyValueStoreT[T], bool) {
+	if ks, ok := ct.activeStore.(*contextKeyedValueStore[T]); ok {
+		return ks.base, true
+	}
+	return nil, false
+}
+
 // Returns the active config if it has been set, otherwise returns a "not found" error.
 // An optional revision can be provided to get the config at a specific revision.
 func (ct *DefaultingConfigTracker[T]) Get(ctx context.Context, atRevision ...*corev1.Revision) (T, error) {
@@ -246,7 +259,7 @@ func (ct *DefaultingConfigTracker[T]) getConfigOrDefaultLocked(ctx context.Conte
 		// rejected as a default config.
 		if defaultErr != nil {
 			if !storage.IsNotFound(defaultErr) {
-				return defaultValue, 0, fmt.Errorf("error looking up default config: %w", activeErr)
+				return defaultValue, 0, fmt.Errorf("error looking up default config: %w", defaultErr)
 			}
 			return ct.newDefaultSpec(), 0, nil
 		}
@@ -2,16 +2,20 @@ package server_test
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/kralicky/protoconfig/server"
 	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/faulty"
 	"github.com/kralicky/protoconfig/storage/inmemory"
 	conformance_server "github.com/kralicky/protoconfig/test/conformance/server"
 	"github.com/kralicky/protoconfig/test/ext"
+	"github.com/kralicky/protoconfig/test/testutil"
 	"github.com/kralicky/protoconfig/util"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/samber/lo"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
@@ -25,6 +29,53 @@ func newKeyValueStore() storage.KeyValueStoreT[*ext.SampleConfiguration] {
 
 var _ = Describe("Defaulting Config Tracker", Label("unit"), conformance_server.DefaultingConfigTrackerTestSuite(newValueStore, newValueStore))
 
+var _ = Describe("Defaulting Config Tracker with unreliable stores", Label("unit"), func() {
+	var defaultInjector, activeInjector *faulty.Injector
+	var activeStore storage.ValueStoreT[*ext.SampleConfiguration]
+	var tracker *server.DefaultingConfigTracker[*ext.SampleConfiguration]
+	BeforeEach(func() {
+		defaultInjector = faulty.NewInjector(faulty.WithSeed(GinkgoRandomSeed()), faulty.WithErrorRate(codes.Unavailable, 1))
+		activeInjector = faulty.NewInjector(faulty.WithSeed(GinkgoRandomSeed()), faulty.WithErrorRate(codes.Unavailable, 0.3), faulty.WithErrorRate(codes.Aborted, 0.3))
+		defaultInjector.Disable()
+		activeInjector.Disable()
+		activeStore = newValueStore()
+		tracker = server.NewDefaultingConfigTracker(
+			faulty.NewValueStore(newValueStore(), defaultInjector),
+			faulty.NewValueStore(activeStore, activeInjector),
+			func(*ext.SampleConfiguration) {},
+		)
+	})
+
+	It("should not fall back to the defaults if the default store is unavailable", func(ctx SpecContext) {
+		Expect(tracker.SetDefault(ctx, &ext.SampleConfiguration{StringField: lo.ToPtr("default")})).To(Succeed())
+		defaultInjector.Enable()
+
+		_, err := tracker.GetActiveOrDefault(ctx)
+		Expect(err).To(testutil.MatchStatusCode(codes.Unavailable))
+	})
+
+	It("should only apply changes once, when retrying failed writes", func(ctx SpecContext) {
+		activeInjector.Enable()
+		for i := 0; i < 20; i++ {
+			Eventually(func() error {
+				return tracker.Apply(ctx, &ext.SampleConfiguration{StringField: lo.ToPtr(fmt.Sprint(i))})
+			}).Should(Succeed())
+		}
+		Expect(activeInjector.Stats().Errors).To(And(
+			HaveKeyWithValue(codes.Unavailable, BeNumerically(">", 0)),
+			HaveKeyWithValue(codes.Aborted, BeNumerically(">", 0)),
+		))
+
+		history, err := activeStore.History(ctx, storage.IncludeValues(true))
+		Expect(err).NotTo(HaveOccurred())
+		values := make([]string, len(history))
+		for i, rev := range history {
+			values[i] = rev.Value().GetStringField()
+		}
+		Expect(values).To(Equal(lo.Times(20, func(i int) string { return fmt.Sprint(i) })))
+	})
+})
+
 type testContextKey struct {
 	*ext.SampleGetRequest
 }
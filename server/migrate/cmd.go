@@ -0,0 +1,150 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kralicky/protoconfig/server"
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/spf13/cobra"
+	"github.com/ttacon/chalk"
+)
+
+// Creates a config tracker from a store opened using a driver registry.
+// The tracker must be created in the same way as the server creates it, so
+// that the migration copies the same keys the server reads from.
+type TrackerFunc[T server.ConfigType[T], S any] func(store S) (*server.DefaultingConfigTracker[T], error)
+
+// Builds a migrate command given a use string, the registry of drivers used
+// to open stores, and a function that creates a config tracker from an
+// opened store.
+//
+//	migrate.BuildCmd("migrate", storage.KeyValueStoreDrivers, func(kv storage.KeyValueStore) (*server.DefaultingConfigTracker[*X], error) {
+//	  ...
+//	})
+//
+// Source and target stores are opened from the URIs given by the --from and
+// --to flags (see [storage.DriverRegistry.Open]). If an opened store
+// implements [io.Closer], it is closed once the command completes.
+func BuildCmd[T server.ConfigType[T], S any](use string, drivers *storage.DriverRegistry[S], trackerFunc TrackerFunc[T, S]) *cobra.Command {
+	var (
+		from, to string
+		dryRun   bool
+	)
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: `Copy the active and default configurations to a different storage driver.`,
+		Long: `
+Copy the active and default configurations, along with their revision history,
+to a different storage driver.
+
+Revision numbers are assigned by the target driver, and will not match the
+revisions in the source. The mapping between old and new revisions is printed
+once the migration is complete.
+
+If a previous migration was interrupted, running the same command again will
+resume where it left off. Configurations which already exist in the target and
+were not created by a previous migration will not be overwritten; in that case,
+the command fails before anything is written.
+
+Once all configurations have been copied, the latest revision of each one is
+compared between the source and target to verify the migration.
+
+Use --dry-run to print the pending changes without writing anything.
+
+Stores are specified as URIs of the form <driver>://...?<option>=<value>.
+Available drivers:
+`[1:] + driversUsage(drivers),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			source, closeSource, err := openStores(cmd.Context(), drivers, from, trackerFunc)
+			if err != nil {
+				return fmt.Errorf("failed to open source: %w", err)
+			}
+			defer closeSource()
+			target, closeTarget, err := openStores(cmd.Context(), drivers, to, trackerFunc)
+			if err != nil {
+				return fmt.Errorf("failed to open target: %w", err)
+			}
+			defer closeTarget()
+
+			report, err := Migrate(cmd.Context(), source, target,
+				WithDryRun(dryRun),
+				WithProgressHandler(func(kr KeyResult) {
+					printResult(cmd, kr, dryRun)
+				}),
+			)
+			if err != nil {
+				return err
+			}
+			if dryRun {
+				pending := 0
+				for _, kr := range report.Keys {
+					pending += kr.Pending()
+				}
+				if pending == 0 {
+					cmd.Println(chalk.Green.Color("No changes to apply."))
+				} else {
+					cmd.Printf("%d changes would be copied.\n", pending)
+				}
+				return nil
+			}
+			for _, kr := range report.Keys {
+				for _, m := range kr.Revisions {
+					cmd.Printf("%s: revision %d => %d\n", kr, m.OldRevision, m.NewRevision)
+				}
+			}
+			cmd.Println(chalk.Green.Color("Migration complete; all configurations match."))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&from, "from", "", "uri of the source store")
+	cmd.Flags().StringVar(&to, "to", "", "uri of the target store")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "print the pending changes without writing anything")
+	cmd.MarkFlagRequired("from")
+	cmd.MarkFlagRequired("to")
+	return cmd
+}
+
+func driversUsage[S any](drivers *storage.DriverRegistry[S]) string {
+	var sb strings.Builder
+	for _, driver := range drivers.Drivers() {
+		sb.WriteString("\n")
+		sb.WriteString(driver.Usage())
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func openStores[T server.ConfigType[T], S any](ctx context.Context, drivers *storage.DriverRegistry[S], uri string, trackerFunc TrackerFunc[T, S]) (Stores[T], func(), error) {
+	store, err := drivers.Open(ctx, uri)
+	if err != nil {
+		return Stores[T]{}, nil, err
+	}
+	closeStore := func() {
+		if c, ok := any(store).(io.Closer); ok {
+			c.Close()
+		}
+	}
+	tracker, err := trackerFunc(store)
+	if err != nil {
+		closeStore()
+		return Stores[T]{}, nil, err
+	}
+	return TrackerStores(tracker), closeStore, nil
+}
+
+func printResult(cmd *cobra.Command, kr KeyResult, dryRun bool) {
+	switch {
+	case kr.Records == 0:
+		cmd.Printf("%s: not set\n", kr)
+	case dryRun && kr.Pending() == 0, !dryRun && kr.Copied == 0:
+		cmd.Printf("%s: %d changes already copied\n", kr, kr.Skipped)
+	case dryRun:
+		cmd.Printf("%s: %s\n", kr, chalk.Yellow.Color(fmt.Sprintf("%d changes to copy (%d already copied)", kr.Pending(), kr.Skipped)))
+	default:
+		cmd.Printf("%s: %s\n", kr, chalk.Green.Color(fmt.Sprintf("copied %d changes (%d already copied)", kr.Copied, kr.Skipped)))
+	}
+}
@@ -0,0 +1,396 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/kralicky/protoconfig/server"
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/backup"
+	"github.com/kralicky/protoconfig/storage/kvutil"
+	"github.com/kralicky/protoconfig/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// The stores containing the persistent state of a config tracker.
+type Stores[T server.ConfigType[T]] struct {
+	Default storage.ValueStoreT[T]
+	// Set if the tracker has a single active config.
+	Active storage.ValueStoreT[T]
+	// Set instead of Active if the tracker has an active config for each key.
+	KeyedActive storage.KeyValueStoreT[T]
+}
+
+// Returns the stores used by the config tracker.
+func TrackerStores[T server.ConfigType[T]](ct *server.DefaultingConfigTracker[T]) Stores[T] {
+	stores := Stores[T]{
+		Default: ct.DefaultStore(),
+	}
+	if keyed, ok := ct.KeyedActiveStore(); ok {
+		stores.KeyedActive = keyed
+	} else {
+		stores.Active = ct.ActiveStore()
+	}
+	return stores
+}
+
+type MigrateOptions struct {
+	dryRun     bool
+	onProgress func(KeyResult)
+}
+
+type MigrateOption func(*MigrateOptions)
+
+func (o *MigrateOptions) apply(opts ...MigrateOption) {
+	for _, op := range opts {
+		op(o)
+	}
+}
+
+// If enabled, the migration is planned and reported, but nothing is written
+// to the target stores and the result is not verified.
+func WithDryRun(dryRun bool) MigrateOption {
+	return func(o *MigrateOptions) {
+		o.dryRun = dryRun
+	}
+}
+
+// Sets a function which is called with the result for each key once it has
+// been migrated (or planned, if running in dry-run mode).
+func WithProgressHandler(handler func(KeyResult)) MigrateOption {
+	return func(o *MigrateOptions) {
+		o.onProgress = handler
+	}
+}
+
+// The result of migrating a single config: the default config, the active
+// config, or the active config for a single key.
+type KeyResult struct {
+	Target server.Target
+	// The key of the active config, if the active store is keyed.
+	Key string
+	// The number of records in the history of the config in the source store,
+	// including the deletes between each time it was reset.
+	Records int
+	// The number of records which were already present in the target store,
+	// because a previous migration was interrupted.
+	Skipped int
+	// The number of records copied to the target store. Always 0 in dry-run
+	// mode.
+	Copied int
+	// Maps each revision in the source store to the corresponding revision in
+	// the target store, for every record which has been copied, including
+	// those which were skipped.
+	Revisions []backup.RevisionMapping
+}
+
+// Returns the number of records which have not yet been copied.
+func (r KeyResult) Pending() int {
+	return r.Records - r.Skipped - r.Copied
+}
+
+func (r KeyResult) String() string {
+	name := r.Target.String()
+	if r.Key != "" {
+		name = fmt.Sprintf("%s[%s]", name, r.Key)
+	}
+	return name
+}
+
+type Report struct {
+	DryRun bool
+	Keys   []KeyResult
+}
+
+// Copies the default and active configs, along with their full revision
+// history, from the source stores to the target stores. Revision numbers will
+// differ between the two; the mapping from old to new revisions is included
+// in the report. If the source active store is keyed, the target must be as
+// well, and vice versa.
+//
+// Histories are copied in the same way as [backup.Export] and [backup.Import],
+// and are subject to the same limitations. The source stores should not be
+// modified while the migration is in progress.
+//
+// Before anything is written, the history of each config in the target store
+// is compared to its history in the source store. If it is a prefix of the
+// source history, which is the case if a previous migration was interrupted,
+// the remaining records are copied and the rest are skipped. Otherwise, a
+// FailedPrecondition error is returned, and nothing is written. Histories
+// are compared even if the config is currently deleted in either store, so a
+// migration which was interrupted immediately after copying a delete can also
+// be resumed.
+//
+// Once all configs have been copied, the latest value of each config in the
+// target stores is compared to the source stores, and an error is returned if
+// any of them do not match. If an error occurs, the report contains the
+// results for all configs migrated so far.
+func Migrate[T server.ConfigType[T]](ctx context.Context, source, target Stores[T], opts ...MigrateOption) (*Report, error) {
+	options := MigrateOptions{}
+	options.apply(opts...)
+
+	if (source.KeyedActive == nil) != (target.KeyedActive == nil) {
+		return nil, status.Error(codes.InvalidArgument, "source and target active stores must both be keyed, or both be unkeyed")
+	}
+	pairs, err := storePairs(ctx, source, target)
+	if err != nil {
+		return nil, err
+	}
+
+	plans := make([]*plan[T], 0, len(pairs))
+	for _, p := range pairs {
+		pl, err := p.plan(ctx)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, pl)
+	}
+
+	report := &Report{DryRun: options.dryRun}
+	for _, pl := range plans {
+		if !options.dryRun {
+			if err := pl.apply(ctx); err != nil {
+				report.Keys = append(report.Keys, pl.result)
+				return report, fmt.Errorf("failed to migrate %s: %w", pl.result, err)
+			}
+		}
+		report.Keys = append(report.Keys, pl.result)
+		if options.onProgress != nil {
+			options.onProgress(pl.result)
+		}
+	}
+	if options.dryRun {
+		return report, nil
+	}
+
+	if err := verify(ctx, target, pairs); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// A single config in the source store, and the corresponding config in the
+// target store.
+type storePair[T server.ConfigType[T]] struct {
+	target server.Target
+	key    string
+	source storage.ValueStoreT[T]
+	dest   storage.ValueStoreT[T]
+}
+
+func storePairs[T server.ConfigType[T]](ctx context.Context, source, target Stores[T]) ([]storePair[T], error) {
+	pairs := []storePair[T]{{
+		target: server.Target_Default,
+		source: source.Default,
+		dest:   target.Default,
+	}}
+	if source.KeyedActive == nil {
+		return append(pairs, storePair[T]{
+			target: server.Target_Active,
+			source: source.Active,
+			dest:   target.Active,
+		}), nil
+	}
+
+	sourceKeys, err := source.KeyedActive.ListKeys(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list source keys: %w", err)
+	}
+	targetKeys, err := target.KeyedActive.ListKeys(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list target keys: %w", err)
+	}
+	for _, key := range targetKeys {
+		if !slices.Contains(sourceKeys, key) {
+			return nil, status.Errorf(codes.FailedPrecondition, "target contains key %q which does not exist in the source", key)
+		}
+	}
+	slices.Sort(sourceKeys)
+	for _, key := range sourceKeys {
+		pairs = append(pairs, storePair[T]{
+			target: server.Target_Active,
+			key:    key,
+			source: kvutil.WithKey(source.KeyedActive, key),
+			dest:   kvutil.WithKey(target.KeyedActive, key),
+		})
+	}
+	return pairs, nil
+}
+
+type plan[T server.ConfigType[T]] struct {
+	dest    storage.ValueStoreT[T]
+	pending []backup.Record
+	result  KeyResult
+}
+
+var marshalOptions = proto.MarshalOptions{Deterministic: true}
+
+// Returns the records in the history of the config, with values encoded in
+// their wire format so that they can be compared. If the config has been
+// deleted, the records end with the delete. Returns nil if the config has no
+// history.
+func records[T server.ConfigType[T]](ctx context.Context, key string, store storage.ValueStoreT[T]) ([]backup.Record, error) {
+	history := func(opts ...storage.HistoryOpt) ([]storage.KeyRevision[[]byte], error) {
+		history, err := store.History(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+		encoded := make([]storage.KeyRevision[[]byte], len(history))
+		for i, rev := range history {
+			impl := storage.CopyKeyRevision[[]byte](rev, nil)
+			impl.K = key
+			if value := rev.Value(); value.ProtoReflect().IsValid() {
+				impl.V, err = marshalOptions.Marshal(value)
+				if err != nil {
+					return nil, err
+				}
+			}
+			encoded[i] = impl
+		}
+		return encoded, nil
+	}
+	recs, err := backup.KeyRecords(ctx, key, history)
+	if !storage.IsNotFound(err) {
+		return recs, err
+	}
+
+	// The config does not currently exist, but it may have been deleted.
+	bound, err := revisionBound(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	recs, err = backup.DeletedKeyRecords(ctx, key, history, bound)
+	if storage.IsNotFound(err) {
+		return nil, nil
+	}
+	return recs, err
+}
+
+// Returns a revision which is not older than the current revision of the
+// store. Since stores do not report their current revision directly, this
+// searches for a revision at which Get fails with an OutOfRange error, which
+// stores return for future revisions. Some stores only do so for keys which
+// exist, in which case a revision far in the future is returned.
+func revisionBound[T any](ctx context.Context, store storage.ValueStoreT[T]) (int64, error) {
+	const maxBound = int64(1) << 62
+	for revision := int64(1); revision < maxBound; revision *= 2 {
+		_, err := store.Get(ctx, storage.WithRevision(revision))
+		switch {
+		case err == nil, storage.IsNotFound(err), storage.IsCompacted(err):
+		case status.Code(err) == codes.OutOfRange:
+			return revision, nil
+		default:
+			return 0, err
+		}
+	}
+	return maxBound, nil
+}
+
+func (p storePair[T]) plan(ctx context.Context) (*plan[T], error) {
+	result := KeyResult{
+		Target: p.target,
+		Key:    p.key,
+	}
+	sourceRecords, err := records(ctx, p.key, p.source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history of %s from source: %w", result, err)
+	}
+	targetRecords, err := records(ctx, p.key, p.dest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history of %s from target: %w", result, err)
+	}
+	if len(targetRecords) > len(sourceRecords) {
+		return nil, status.Errorf(codes.FailedPrecondition, "target history of %s does not match the source", result)
+	}
+	for i, tr := range targetRecords {
+		sr := sourceRecords[i]
+		if tr.Type != sr.Type || !bytes.Equal(tr.Value, sr.Value) {
+			return nil, status.Errorf(codes.FailedPrecondition, "target history of %s does not match the source", result)
+		}
+		if sr.Type == backup.RecordPut {
+			mapping := backup.RevisionMapping{
+				Key:         p.key,
+				OldRevision: sr.Revision,
+				NewRevision: tr.Revision,
+			}
+			if sr.Timestamp != nil {
+				mapping.Timestamp = *sr.Timestamp
+			}
+			result.Revisions = append(result.Revisions, mapping)
+		}
+	}
+	result.Records = len(sourceRecords)
+	result.Skipped = len(targetRecords)
+	return &plan[T]{
+		dest:    p.dest,
+		pending: sourceRecords[len(targetRecords):],
+		result:  result,
+	}, nil
+}
+
+func (p *plan[T]) apply(ctx context.Context) error {
+	for _, rec := range p.pending {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		mapping, err := backup.ApplyRecord(rec, func(value []byte, opts ...storage.PutOpt) error {
+			decoded := util.NewMessage[T]()
+			if err := proto.Unmarshal(value, decoded); err != nil {
+				return err
+			}
+			return p.dest.Put(ctx, decoded, opts...)
+		}, func() error {
+			return p.dest.Delete(ctx)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to copy revision %d: %w", rec.Revision, err)
+		}
+		if mapping != nil {
+			p.result.Revisions = append(p.result.Revisions, *mapping)
+		}
+		p.result.Copied++
+	}
+	return nil
+}
+
+// Checks that the latest value of each config matches between the source
+// and target stores, and that the target does not contain any additional
+// keys.
+func verify[T server.ConfigType[T]](ctx context.Context, target Stores[T], pairs []storePair[T]) error {
+	var errs []error
+	for _, p := range pairs {
+		name := KeyResult{Target: p.target, Key: p.key}.String()
+		sourceValue, sourceErr := p.source.Get(ctx)
+		targetValue, targetErr := p.dest.Get(ctx)
+		switch {
+		case sourceErr != nil && !storage.IsNotFound(sourceErr):
+			errs = append(errs, fmt.Errorf("%s: failed to read source: %w", name, sourceErr))
+		case targetErr != nil && !storage.IsNotFound(targetErr):
+			errs = append(errs, fmt.Errorf("%s: failed to read target: %w", name, targetErr))
+		case storage.IsNotFound(sourceErr) != storage.IsNotFound(targetErr):
+			errs = append(errs, fmt.Errorf("%s: exists in only one of the source and target", name))
+		case sourceErr == nil && !proto.Equal(sourceValue, targetValue):
+			errs = append(errs, fmt.Errorf("%s: latest values do not match", name))
+		}
+	}
+	if target.KeyedActive != nil {
+		targetKeys, err := target.KeyedActive.ListKeys(ctx, "")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list target keys: %w", err))
+		}
+		for _, key := range targetKeys {
+			if !slices.ContainsFunc(pairs, func(p storePair[T]) bool { return p.key == key }) {
+				errs = append(errs, fmt.Errorf("%s: exists in only one of the source and target", KeyResult{Target: server.Target_Active, Key: key}))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return status.Errorf(codes.DataLoss, "verification failed: %v", errors.Join(errs...))
+	}
+	return nil
+}
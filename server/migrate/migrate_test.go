@@ -0,0 +1,354 @@
+package migrate_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/kralicky/protoconfig/server"
+	"github.com/kralicky/protoconfig/server/migrate"
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/inmemory"
+	"github.com/kralicky/protoconfig/storage/kvutil"
+	"github.com/kralicky/protoconfig/test/ext"
+	"github.com/kralicky/protoconfig/test/testutil"
+	"github.com/kralicky/protoconfig/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/samber/lo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func newKeyedStores() migrate.Stores[*ext.SampleConfiguration] {
+	return migrate.Stores[*ext.SampleConfiguration]{
+		Default:     inmemory.NewValueStore[*ext.SampleConfiguration](util.ProtoClone),
+		KeyedActive: inmemory.NewKeyValueStore[*ext.SampleConfiguration](util.ProtoClone),
+	}
+}
+
+func sample(s string) *ext.SampleConfiguration {
+	return &ext.SampleConfiguration{StringField: lo.ToPtr(s)}
+}
+
+func historyValues(store storage.ValueStoreT[*ext.SampleConfiguration]) []string {
+	hist, err := store.History(context.Background(), storage.IncludeValues(true))
+	if storage.IsNotFound(err) {
+		return nil
+	}
+	Expect(err).NotTo(HaveOccurred())
+	values := make([]string, len(hist))
+	for i, h := range hist {
+		values[i] = h.Value().GetStringField()
+	}
+	return values
+}
+
+// Fails all puts after the first n.
+func failAfter(n int, base storage.ValueStoreT[*ext.SampleConfiguration]) storage.ValueStoreT[*ext.SampleConfiguration] {
+	return kvutil.ValueStoreAdapter[*ext.SampleConfiguration]{
+		PutFunc: func(ctx context.Context, value *ext.SampleConfiguration, opts ...storage.PutOpt) error {
+			if n == 0 {
+				return errors.New("interrupted")
+			}
+			n--
+			return base.Put(ctx, value, opts...)
+		},
+		GetFunc:     base.Get,
+		WatchFunc:   base.Watch,
+		DeleteFunc:  base.Delete,
+		HistoryFunc: base.History,
+	}
+}
+
+var _ = Describe("Migrate", Label("unit"), func() {
+	var src migrate.Stores[*ext.SampleConfiguration]
+	BeforeEach(func(ctx SpecContext) {
+		src = newKeyedStores()
+		for i := 0; i < 3; i++ {
+			Expect(src.Default.Put(ctx, sample(fmt.Sprint("default", i)))).To(Succeed())
+		}
+		Expect(src.KeyedActive.Put(ctx, "a", sample("a0"))).To(Succeed())
+		Expect(src.KeyedActive.Put(ctx, "a", sample("a1"))).To(Succeed())
+		Expect(src.KeyedActive.Delete(ctx, "a")).To(Succeed())
+		Expect(src.KeyedActive.Put(ctx, "b", sample("b0"))).To(Succeed())
+		Expect(src.KeyedActive.Put(ctx, "a", sample("a2"))).To(Succeed())
+		Expect(src.KeyedActive.Put(ctx, "b", sample("b1"))).To(Succeed())
+	})
+
+	It("should copy all configs and their history", func(ctx SpecContext) {
+		dst := newKeyedStores()
+		var progress []string
+		report, err := migrate.Migrate(ctx, src, dst, migrate.WithProgressHandler(func(kr migrate.KeyResult) {
+			progress = append(progress, kr.String())
+		}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(progress).To(Equal([]string{"Default", "Active[a]", "Active[b]"}))
+
+		Expect(report.Keys).To(HaveLen(3))
+		Expect(report.Keys[0].Records).To(Equal(3))
+		Expect(report.Keys[1].Records).To(Equal(4))
+		Expect(report.Keys[2].Records).To(Equal(2))
+		for _, kr := range report.Keys {
+			Expect(kr.Copied).To(Equal(kr.Records))
+			Expect(kr.Skipped).To(BeZero())
+			Expect(kr.Pending()).To(BeZero())
+		}
+
+		Expect(historyValues(dst.Default)).To(Equal([]string{"default0", "default1", "default2"}))
+		Expect(historyValues(kvutil.WithKey(dst.KeyedActive, "a"))).To(Equal([]string{"a2"}))
+		Expect(historyValues(kvutil.WithKey(dst.KeyedActive, "b"))).To(Equal([]string{"b0", "b1"}))
+
+		By("preserving the history of earlier lifecycles")
+		a := report.Keys[1]
+		Expect(a.Revisions).To(HaveLen(3))
+		value, err := dst.KeyedActive.Get(ctx, "a", storage.WithRevision(a.Revisions[0].NewRevision))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.GetStringField()).To(Equal("a0"))
+
+		By("mapping each source revision to the target revision")
+		for _, kr := range report.Keys {
+			store := kvutil.WithKey(src.KeyedActive, kr.Key)
+			targetStore := kvutil.WithKey(dst.KeyedActive, kr.Key)
+			if kr.Target == server.Target_Default {
+				store, targetStore = src.Default, dst.Default
+			}
+			for _, m := range kr.Revisions {
+				old, err := store.Get(ctx, storage.WithRevision(m.OldRevision))
+				Expect(err).NotTo(HaveOccurred())
+				migrated, err := targetStore.Get(ctx, storage.WithRevision(m.NewRevision))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(proto.Equal(old, migrated)).To(BeTrue())
+			}
+		}
+
+		By("doing nothing when run again")
+		report, err = migrate.Migrate(ctx, src, dst)
+		Expect(err).NotTo(HaveOccurred())
+		for _, kr := range report.Keys {
+			Expect(kr.Copied).To(BeZero())
+			Expect(kr.Skipped).To(Equal(kr.Records))
+		}
+	})
+
+	It("should copy unkeyed active stores", func(ctx SpecContext) {
+		src := migrate.Stores[*ext.SampleConfiguration]{
+			Default: inmemory.NewValueStore[*ext.SampleConfiguration](util.ProtoClone),
+			Active:  inmemory.NewValueStore[*ext.SampleConfiguration](util.ProtoClone),
+		}
+		Expect(src.Active.Put(ctx, sample("x"))).To(Succeed())
+		dst := migrate.Stores[*ext.SampleConfiguration]{
+			Default: inmemory.NewValueStore[*ext.SampleConfiguration](util.ProtoClone),
+			Active:  inmemory.NewValueStore[*ext.SampleConfiguration](util.ProtoClone),
+		}
+		report, err := migrate.Migrate(ctx, src, dst)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Keys).To(HaveLen(2))
+		Expect(report.Keys[0].Records).To(BeZero())
+		Expect(historyValues(dst.Default)).To(BeEmpty())
+		Expect(historyValues(dst.Active)).To(Equal([]string{"x"}))
+	})
+
+	It("should obtain the stores from a config tracker", func() {
+		def := inmemory.NewValueStore[*ext.SampleConfiguration](util.ProtoClone)
+		active := inmemory.NewKeyValueStore[*ext.SampleConfiguration](util.ProtoClone)
+		stores := migrate.TrackerStores(server.NewDefaultingActiveKeyedConfigTracker(def, active, func(*ext.SampleConfiguration) {}))
+		Expect(stores.Default).To(BeIdenticalTo(def))
+		Expect(stores.KeyedActive).To(BeIdenticalTo(active))
+		Expect(stores.Active).To(BeNil())
+
+		activeValue := inmemory.NewValueStore[*ext.SampleConfiguration](util.ProtoClone)
+		stores = migrate.TrackerStores(server.NewDefaultingConfigTracker(def, activeValue, func(*ext.SampleConfiguration) {}))
+		Expect(stores.Active).To(BeIdenticalTo(activeValue))
+		Expect(stores.KeyedActive).To(BeNil())
+	})
+
+	When("running in dry-run mode", func() {
+		It("should report pending changes without writing anything", func(ctx SpecContext) {
+			dst := newKeyedStores()
+			report, err := migrate.Migrate(ctx, src, dst, migrate.WithDryRun(true))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.DryRun).To(BeTrue())
+			Expect(report.Keys).To(HaveLen(3))
+			for _, kr := range report.Keys {
+				Expect(kr.Copied).To(BeZero())
+				Expect(kr.Pending()).To(Equal(kr.Records))
+			}
+			Expect(historyValues(dst.Default)).To(BeEmpty())
+			keys, err := dst.KeyedActive.ListKeys(ctx, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keys).To(BeEmpty())
+		})
+	})
+
+	When("a previous migration was interrupted", func() {
+		It("should resume where it left off", func(ctx SpecContext) {
+			dst := newKeyedStores()
+			interrupted := dst
+			interrupted.Default = failAfter(2, dst.Default)
+			_, err := migrate.Migrate(ctx, src, interrupted)
+			Expect(err).To(MatchError(ContainSubstring("interrupted")))
+			Expect(historyValues(dst.Default)).To(Equal([]string{"default0", "default1"}))
+
+			By("resuming after a partially copied key")
+			report, err := migrate.Migrate(ctx, src, dst, migrate.WithDryRun(true))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Keys[0].Skipped).To(Equal(2))
+			Expect(report.Keys[0].Pending()).To(Equal(1))
+
+			report, err = migrate.Migrate(ctx, src, dst)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Keys[0].Skipped).To(Equal(2))
+			Expect(report.Keys[0].Copied).To(Equal(1))
+			Expect(report.Keys[0].Revisions).To(HaveLen(3))
+			Expect(historyValues(dst.Default)).To(Equal([]string{"default0", "default1", "default2"}))
+			Expect(historyValues(kvutil.WithKey(dst.KeyedActive, "b"))).To(Equal([]string{"b0", "b1"}))
+		})
+
+		It("should resume after a copied delete", func(ctx SpecContext) {
+			dst := newKeyedStores()
+			Expect(dst.KeyedActive.Put(ctx, "a", sample("a0"))).To(Succeed())
+			Expect(dst.KeyedActive.Put(ctx, "a", sample("a1"))).To(Succeed())
+			Expect(dst.KeyedActive.Delete(ctx, "a")).To(Succeed())
+
+			report, err := migrate.Migrate(ctx, src, dst)
+			Expect(err).NotTo(HaveOccurred())
+			a := report.Keys[1]
+			Expect(a.Key).To(Equal("a"))
+			Expect(a.Skipped).To(Equal(3))
+			Expect(a.Copied).To(Equal(1))
+			Expect(a.Revisions).To(HaveLen(3))
+			Expect(historyValues(kvutil.WithKey(dst.KeyedActive, "a"))).To(Equal([]string{"a2"}))
+			value, err := dst.KeyedActive.Get(ctx, "a", storage.WithRevision(a.Revisions[1].NewRevision))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value.GetStringField()).To(Equal("a1"))
+		})
+	})
+
+	When("the target contains unrelated data", func() {
+		It("should fail without writing anything", func(ctx SpecContext) {
+			dst := newKeyedStores()
+			Expect(dst.Default.Put(ctx, sample("other"))).To(Succeed())
+			_, err := migrate.Migrate(ctx, src, dst)
+			Expect(err).To(testutil.MatchStatusCode(codes.FailedPrecondition))
+			keys, err := dst.KeyedActive.ListKeys(ctx, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keys).To(BeEmpty())
+		})
+
+		It("should fail if the target contains a deleted config", func(ctx SpecContext) {
+			dst := newKeyedStores()
+			Expect(dst.KeyedActive.Put(ctx, "a", sample("other"))).To(Succeed())
+			Expect(dst.KeyedActive.Delete(ctx, "a")).To(Succeed())
+			_, err := migrate.Migrate(ctx, src, dst)
+			Expect(err).To(testutil.MatchStatusCode(codes.FailedPrecondition))
+			Expect(historyValues(dst.Default)).To(BeEmpty())
+		})
+
+		It("should fail if the target contains additional keys", func(ctx SpecContext) {
+			dst := newKeyedStores()
+			Expect(dst.KeyedActive.Put(ctx, "c", sample("c0"))).To(Succeed())
+			_, err := migrate.Migrate(ctx, src, dst)
+			Expect(err).To(testutil.MatchStatusCode(codes.FailedPrecondition))
+			Expect(historyValues(dst.Default)).To(BeEmpty())
+		})
+	})
+
+	When("the latest values do not match after copying", func() {
+		It("should fail verification", func(ctx SpecContext) {
+			dst := newKeyedStores()
+			modifying := dst
+			modifying.Default = kvutil.ValueStoreAdapter[*ext.SampleConfiguration]{
+				PutFunc: func(ctx context.Context, value *ext.SampleConfiguration, opts ...storage.PutOpt) error {
+					value.StringField = lo.ToPtr("modified")
+					return dst.Default.Put(ctx, value, opts...)
+				},
+				GetFunc:     dst.Default.Get,
+				WatchFunc:   dst.Default.Watch,
+				DeleteFunc:  dst.Default.Delete,
+				HistoryFunc: dst.Default.History,
+			}
+			_, err := migrate.Migrate(ctx, src, modifying)
+			Expect(err).To(testutil.MatchStatusCode(codes.DataLoss))
+			Expect(err.Error()).To(ContainSubstring("Default: latest values do not match"))
+		})
+	})
+
+	It("should reject mismatched store layouts", func(ctx SpecContext) {
+		dst := migrate.Stores[*ext.SampleConfiguration]{
+			Default: inmemory.NewValueStore[*ext.SampleConfiguration](util.ProtoClone),
+			Active:  inmemory.NewValueStore[*ext.SampleConfiguration](util.ProtoClone),
+		}
+		_, err := migrate.Migrate(ctx, src, dst)
+		Expect(err).To(testutil.MatchStatusCode(codes.InvalidArgument))
+	})
+})
+
+var _ = Describe("Migrate Command", Label("unit"), func() {
+	var (
+		stores  map[string]migrate.Stores[*ext.SampleConfiguration]
+		drivers *storage.DriverRegistry[migrate.Stores[*ext.SampleConfiguration]]
+	)
+	BeforeEach(func(ctx SpecContext) {
+		stores = map[string]migrate.Stores[*ext.SampleConfiguration]{
+			"source": newKeyedStores(),
+			"target": newKeyedStores(),
+		}
+		Expect(stores["source"].Default.Put(ctx, sample("d0"))).To(Succeed())
+		Expect(stores["source"].KeyedActive.Put(ctx, "a", sample("a0"))).To(Succeed())
+		drivers = storage.NewDriverRegistry[migrate.Stores[*ext.SampleConfiguration]]()
+		drivers.Register(storage.Driver[migrate.Stores[*ext.SampleConfiguration]]{
+			Name: "migrate-test",
+			Build: func(_ context.Context, conf storage.DriverConfig) (migrate.Stores[*ext.SampleConfiguration], error) {
+				s, ok := stores[conf.URI.Host]
+				if !ok {
+					return s, status.Errorf(codes.InvalidArgument, "unknown stores %q", conf.URI.Host)
+				}
+				return s, nil
+			},
+		})
+	})
+
+	run := func(ctx context.Context, args ...string) (string, error) {
+		cmd := migrate.BuildCmd("migrate", drivers, func(s migrate.Stores[*ext.SampleConfiguration]) (*server.DefaultingConfigTracker[*ext.SampleConfiguration], error) {
+			return server.NewDefaultingActiveKeyedConfigTracker(s.Default, s.KeyedActive, func(*ext.SampleConfiguration) {}), nil
+		})
+		var out bytes.Buffer
+		cmd.SetOut(&out)
+		cmd.SetErr(&out)
+		cmd.SetArgs(args)
+		err := cmd.ExecuteContext(ctx)
+		return out.String(), err
+	}
+
+	It("should migrate between registered drivers", func(ctx SpecContext) {
+		args := []string{"--from", "migrate-test://source", "--to", "migrate-test://target"}
+		out, err := run(ctx, append(args, "--dry-run")...)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(ContainSubstring("2 changes would be copied"))
+		Expect(historyValues(stores["target"].Default)).To(BeEmpty())
+
+		out, err = run(ctx, args...)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(ContainSubstring("Migration complete"))
+		Expect(historyValues(stores["target"].Default)).To(Equal([]string{"d0"}))
+		Expect(historyValues(kvutil.WithKey(stores["target"].KeyedActive, "a"))).To(Equal([]string{"a0"}))
+
+		out, err = run(ctx, append(args, "--dry-run")...)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(ContainSubstring("No changes to apply"))
+	})
+
+	It("should fail for unknown drivers", func(ctx SpecContext) {
+		_, err := run(ctx, "--from", "nonexistent://", "--to", "migrate-test://target")
+		Expect(err).To(MatchError(ContainSubstring(`unknown storage driver "nonexistent"`)))
+	})
+
+	It("should fail for invalid options", func(ctx SpecContext) {
+		_, err := run(ctx, "--from", "migrate-test://source?foo=bar", "--to", "migrate-test://target")
+		Expect(err).To(testutil.MatchStatusCode(codes.InvalidArgument))
+		Expect(err).To(MatchError(ContainSubstring(`unknown option "foo"`)))
+	})
+})
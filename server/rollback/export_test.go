@@ -0,0 +1,3 @@
+package rollback
+
+var AskOne = &askOne
@@ -24,6 +24,9 @@ import (
 	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
+// Prompts the user for input. Replaced in tests, which have no terminal.
+var askOne = survey.AskOne
+
 // Builds a rollback command given a use string and a function that returns a
 // new typed client from a (generated) service context injector.
 //
@@ -236,7 +239,7 @@ the secret values will not change from the current configuration.
 				}
 
 				var confirm string
-				if err := survey.AskOne(&survey.Select{
+				if err := askOne(&survey.Select{
 					Message: message,
 					Options: []string{
 						yes,
@@ -260,7 +263,7 @@ the secret values will not change from the current configuration.
 				case yes:
 					if dryRunResp.GetValidationErrors() != nil {
 						var confirm bool
-						if err := survey.AskOne(&survey.Confirm{
+						if err := askOne(&survey.Confirm{
 							Message: "This will bypass validation checks. The configuration may not function correctly. Are you sure?",
 							Default: false,
 						}, &confirm); err != nil {
@@ -291,7 +294,7 @@ the secret values will not change from the current configuration.
 					_, err = client.SetDefault(cmd.Context(), setReq)
 				}
 				if err != nil {
-					cmd.PrintErrln("rollback failed:", err)
+					return fmt.Errorf("rollback failed: %w", err)
 				}
 				cmd.Printf("successfully rolled back to revision %d\n", getRequest.GetRevision().GetRevision())
 				return nil
@@ -0,0 +1,187 @@
+package rollback_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/AlecAivazis/survey/v2"
+	"github.com/kralicky/protoconfig/server"
+	"github.com/kralicky/protoconfig/server/rollback"
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/faulty"
+	"github.com/kralicky/protoconfig/storage/inmemory"
+	"github.com/kralicky/protoconfig/test/ext"
+	"github.com/kralicky/protoconfig/test/testutil"
+	"github.com/kralicky/protoconfig/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/samber/lo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+type testServer = server.BaseConfigServer[
+	*ext.SampleGetRequest,
+	*ext.SampleSetRequest,
+	*ext.SampleResetRequest,
+	*ext.SampleHistoryRequest,
+	*ext.SampleConfigurationHistoryResponse,
+	*ext.SampleConfiguration,
+]
+
+// Calls the config server directly, without going through grpc.
+type testClient struct {
+	server *testServer
+}
+
+var _ ext.ConfigClient = testClient{}
+
+func (c testClient) GetDefault(ctx context.Context, in *ext.SampleGetRequest, _ ...grpc.CallOption) (*ext.SampleConfiguration, error) {
+	return c.server.GetDefault(ctx, in)
+}
+
+func (c testClient) SetDefault(ctx context.Context, in *ext.SampleSetRequest, _ ...grpc.CallOption) (*emptypb.Empty, error) {
+	return c.server.SetDefault(ctx, in)
+}
+
+func (c testClient) Get(ctx context.Context, in *ext.SampleGetRequest, _ ...grpc.CallOption) (*ext.SampleConfiguration, error) {
+	return c.server.Get(ctx, in)
+}
+
+func (c testClient) Set(ctx context.Context, in *ext.SampleSetRequest, _ ...grpc.CallOption) (*emptypb.Empty, error) {
+	return c.server.Set(ctx, in)
+}
+
+func (c testClient) ResetDefault(ctx context.Context, in *emptypb.Empty, _ ...grpc.CallOption) (*emptypb.Empty, error) {
+	return c.server.ResetDefault(ctx, in)
+}
+
+func (c testClient) Reset(ctx context.Context, in *ext.SampleResetRequest, _ ...grpc.CallOption) (*emptypb.Empty, error) {
+	return c.server.Reset(ctx, in)
+}
+
+func (c testClient) DryRun(ctx context.Context, in *ext.SampleDryRunRequest, _ ...grpc.CallOption) (*ext.SampleDryRunResponse, error) {
+	res, err := c.server.ServerDryRun(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return &ext.SampleDryRunResponse{
+		Current:          res.Current,
+		Modified:         res.Modified,
+		ValidationErrors: res.ValidationErrors.ToProto(),
+	}, nil
+}
+
+func (c testClient) History(ctx context.Context, in *ext.SampleHistoryRequest, _ ...grpc.CallOption) (*ext.SampleConfigurationHistoryResponse, error) {
+	return c.server.History(ctx, in)
+}
+
+var _ = Describe("Rollback", Label("unit"), func() {
+	var activeStore storage.ValueStoreT[*ext.SampleConfiguration]
+	var faultOpts []faulty.Option
+	var revisions []int64
+	var runRollback func(ctx context.Context, args ...string) error
+
+	BeforeEach(func(ctx SpecContext) {
+		activeStore = inmemory.NewValueStore[*ext.SampleConfiguration](util.ProtoClone)
+		faultOpts = []faulty.Option{faulty.WithSeed(GinkgoRandomSeed())}
+		revisions = nil
+		for _, value := range []string{"foo", "bar"} {
+			var rev int64
+			Expect(activeStore.Put(ctx, &ext.SampleConfiguration{
+				StringField: lo.ToPtr(value),
+			}, storage.WithRevisionOut(&rev))).To(Succeed())
+			revisions = append(revisions, rev)
+		}
+	})
+
+	JustBeforeEach(func() {
+		var srv *testServer
+		srv = srv.Build(
+			inmemory.NewValueStore[*ext.SampleConfiguration](util.ProtoClone),
+			faulty.NewValueStore(activeStore, faulty.NewInjector(faultOpts...)),
+			func(*ext.SampleConfiguration) {},
+		)
+		runRollback = func(ctx context.Context, args ...string) error {
+			cmd := rollback.BuildCmd("rollback", ext.ConfigContextInjector)
+			cmd.SetContext(ext.ConfigContextInjector.ContextWithClient(ctx, testClient{server: srv}))
+			cmd.SetArgs(args)
+			cmd.SetIn(strings.NewReader(""))
+			cmd.SetOut(io.Discard)
+			cmd.SetErr(io.Discard)
+			return cmd.Execute()
+		}
+	})
+
+	expectUnchanged := func(ctx context.Context) {
+		var rev int64
+		conf, err := activeStore.Get(ctx, storage.WithRevisionOut(&rev))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.GetStringField()).To(Equal("bar"))
+		Expect(rev).To(Equal(revisions[1]))
+	}
+
+	When("the store is unavailable", func() {
+		BeforeEach(func() {
+			faultOpts = append(faultOpts, faulty.WithErrorRate(codes.Unavailable, 1))
+		})
+		It("should return the error without modifying the configuration", func(ctx SpecContext) {
+			err := runRollback(ctx, "--revision", fmt.Sprint(revisions[0]))
+			Expect(err).To(testutil.MatchStatusCode(codes.Unavailable))
+			expectUnchanged(ctx)
+		})
+	})
+
+	When("the store is slow", func() {
+		BeforeEach(func() {
+			faultOpts = append(faultOpts, faulty.WithLatency(10*time.Millisecond, 50*time.Millisecond))
+		})
+		It("should detect that the configuration is already at the target revision", func(ctx SpecContext) {
+			err := runRollback(ctx, "--revision", fmt.Sprint(revisions[1]))
+			Expect(err).To(MatchError(ContainSubstring("already at revision")))
+			expectUnchanged(ctx)
+		})
+		It("should stop if the request times out", func() {
+			ctx, ca := context.WithTimeout(context.Background(), 5*time.Millisecond)
+			defer ca()
+			err := runRollback(ctx, "--revision", fmt.Sprint(revisions[0]))
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+			expectUnchanged(context.Background())
+		})
+	})
+
+	When("writes conflict", func() {
+		BeforeEach(func() {
+			faultOpts = append(faultOpts, faulty.WithErrorRate(codes.Aborted, 1))
+		})
+		It("should not write to the store before the rollback is confirmed", func(ctx SpecContext) {
+			// there is no terminal to confirm the rollback with, so the command
+			// fails at the confirmation prompt after a successful dry-run
+			err := runRollback(ctx, "--revision", fmt.Sprint(revisions[0]))
+			Expect(err).To(HaveOccurred())
+			Expect(storage.IsConflict(err)).To(BeFalse())
+			expectUnchanged(ctx)
+		})
+		It("should return the error if the confirmed rollback fails", func(ctx SpecContext) {
+			askOne := *rollback.AskOne
+			DeferCleanup(func() { *rollback.AskOne = askOne })
+			*rollback.AskOne = func(_ survey.Prompt, response any, _ ...survey.AskOpt) error {
+				switch response := response.(type) {
+				case *string:
+					*response = "Yes"
+				case *bool:
+					*response = true
+				}
+				return nil
+			}
+			err := runRollback(ctx, "--revision", fmt.Sprint(revisions[0]))
+			Expect(err).To(MatchError(ContainSubstring("rollback failed")))
+			Expect(storage.IsConflict(err)).To(BeTrue())
+			expectUnchanged(ctx)
+		})
+	})
+})
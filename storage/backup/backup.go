@@ -0,0 +1,549 @@
+package backup
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/kralicky/protoconfig/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Archive format version written by [Writer]. Archives with a newer version
+// are rejected by [NewReader].
+const ArchiveVersion = 1
+
+// An archive is a stream of newline-delimited JSON objects. The first object
+// is a Header, and each following object is a [Record]. Records are sorted in
+// the order in which they should be replayed.
+type Header struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exportedAt"`
+}
+
+type RecordType string
+
+const (
+	RecordPut    RecordType = "put"
+	RecordDelete RecordType = "delete"
+)
+
+type Record struct {
+	Type RecordType `json:"type"`
+	Key  string     `json:"key"`
+	// For put records, the revision of the value in the exported store. For
+	// delete records, the revision of the delete, or the revision of the last
+	// put before the key was deleted if the store cannot return deleted
+	// history (see [storage.IncludeDeleted]).
+	Revision int64 `json:"revision"`
+	// The timestamp of the revision in the exported store, if known. Only set
+	// for put records.
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	// Only set for put records.
+	Value []byte `json:"value,omitempty"`
+}
+
+// Writes an archive to an underlying writer.
+type Writer struct {
+	enc *json.Encoder
+	bw  *bufio.Writer
+}
+
+// Returns a new archive writer, and writes the archive header.
+func NewWriter(w io.Writer) (*Writer, error) {
+	bw := bufio.NewWriter(w)
+	aw := &Writer{
+		enc: json.NewEncoder(bw),
+		bw:  bw,
+	}
+	if err := aw.enc.Encode(Header{
+		Version:    ArchiveVersion,
+		ExportedAt: time.Now(),
+	}); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+func (w *Writer) Write(r Record) error {
+	return w.enc.Encode(r)
+}
+
+// Flushes any buffered data to the underlying writer.
+func (w *Writer) Flush() error {
+	return w.bw.Flush()
+}
+
+// Reads an archive from an underlying reader.
+type Reader struct {
+	dec    *json.Decoder
+	header Header
+}
+
+// Returns a new archive reader, and reads the archive header.
+func NewReader(r io.Reader) (*Reader, error) {
+	ar := &Reader{
+		dec: json.NewDecoder(bufio.NewReader(r)),
+	}
+	if err := ar.dec.Decode(&ar.header); err != nil {
+		return nil, fmt.Errorf("failed to read archive header: %w", err)
+	}
+	if ar.header.Version < 1 || ar.header.Version > ArchiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", ar.header.Version)
+	}
+	return ar, nil
+}
+
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Returns the next record in the archive, or io.EOF if there are no more
+// records.
+func (r *Reader) Next() (Record, error) {
+	var rec Record
+	if err := r.dec.Decode(&rec); err != nil {
+		if errors.Is(err, io.EOF) {
+			return Record{}, io.EOF
+		}
+		return Record{}, fmt.Errorf("failed to read archive record: %w", err)
+	}
+	switch rec.Type {
+	case RecordPut, RecordDelete:
+	default:
+		return Record{}, fmt.Errorf("invalid archive record: unknown type %q", rec.Type)
+	}
+	if rec.Key == "" {
+		return Record{}, errors.New("invalid archive record: missing key")
+	}
+	return rec, nil
+}
+
+type ExportOptions struct {
+	logger *slog.Logger
+}
+
+type ExportOption func(*ExportOptions)
+
+func (o *ExportOptions) apply(opts ...ExportOption) {
+	for _, op := range opts {
+		op(o)
+	}
+}
+
+// Sets the logger used to report history which could not be exported.
+// Defaults to slog.Default().
+func WithLogger(logger *slog.Logger) ExportOption {
+	return func(o *ExportOptions) {
+		o.logger = logger
+	}
+}
+
+// Writes every key in the store, along with its history, to an archive.
+//
+// Keys which are currently deleted are exported along with the records of
+// their deletion, and the history of each key includes every lifecycle the
+// store has retained, with the deletes that separate them. If the store
+// cannot list deleted keys or return deleted history, a warning is logged and
+// the history which can be found is exported; see [KeyRecords].
+//
+// Only the keys and revisions of the records are held in memory while they
+// are sorted. Values are read from the store as each record is written, so
+// the export fails if a revision is compacted while the export is running.
+func Export(ctx context.Context, store storage.KeyValueStore, w io.Writer, opts ...ExportOption) error {
+	options := ExportOptions{
+		logger: slog.Default(),
+	}
+	options.apply(opts...)
+
+	keys, err := store.ListKeys(ctx, "", storage.IncludeDeleted(true))
+	if status.Code(err) == codes.Unimplemented {
+		options.logger.Warn("store cannot list deleted keys, keys which are currently deleted will not be exported")
+		keys, err = store.ListKeys(ctx, "")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list keys: %w", err)
+	}
+	var records []Record
+	for _, key := range keys {
+		keyRecords, err := KeyRecords(ctx, key, func(opts ...storage.HistoryOpt) ([]storage.KeyRevision[[]byte], error) {
+			return store.History(ctx, key, append(opts, storage.IncludeValues(false))...)
+		}, WithLogger(options.logger))
+		if err != nil {
+			if storage.IsNotFound(err) {
+				continue // deleted after listing
+			}
+			return fmt.Errorf("failed to export key %q: %w", key, err)
+		}
+		records = append(records, keyRecords...)
+	}
+	SortRecords(records)
+
+	aw, err := NewWriter(w)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if rec.Type == RecordPut {
+			rec.Value, err = store.Get(ctx, rec.Key, storage.WithRevision(rec.Revision))
+			if err != nil {
+				return fmt.Errorf("failed to export key %q at revision %d: %w", rec.Key, rec.Revision, err)
+			}
+		}
+		if err := aw.Write(rec); err != nil {
+			return err
+		}
+	}
+	return aw.Flush()
+}
+
+// Returns the records for a single key, using the given function to look up
+// the key's history. The records are in the order they should be replayed,
+// and end with the delete of the key if it is currently deleted. Returns a
+// NotFound error if the key has no history.
+//
+// The history is read using [storage.IncludeDeleted]. If the store returns an
+// Unimplemented error, earlier lifecycles of the key are instead searched for
+// using [storage.WithRevision]; a warning is then logged if any are found,
+// since the revisions of their deletes are not known, and lifecycles between
+// the ones found may be missing.
+func KeyRecords(
+	ctx context.Context,
+	key string,
+	history func(...storage.HistoryOpt) ([]storage.KeyRevision[[]byte], error),
+	opts ...ExportOption,
+) ([]Record, error) {
+	options := ExportOptions{
+		logger: slog.Default(),
+	}
+	options.apply(opts...)
+
+	hist, err := history(storage.IncludeValues(true), storage.IncludeDeleted(true))
+	if status.Code(err) == codes.Unimplemented {
+		current, err := history(storage.IncludeValues(true))
+		if err != nil {
+			return nil, err
+		}
+		return searchKeyRecords(ctx, key, history, current, false, options.logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return historyRecords(key, hist)
+}
+
+// Like [KeyRecords], but for a key which has been deleted. The revision must
+// be the current revision of the store (or any later revision). It is only
+// used if the store cannot return deleted history, in which case the key's
+// last lifecycle is searched for before it. Returns a NotFound error if the
+// key has no history, or if its history is not available.
+func DeletedKeyRecords(
+	ctx context.Context,
+	key string,
+	history func(...storage.HistoryOpt) ([]storage.KeyRevision[[]byte], error),
+	revision int64,
+	opts ...ExportOption,
+) ([]Record, error) {
+	options := ExportOptions{
+		logger: slog.Default(),
+	}
+	options.apply(opts...)
+
+	hist, err := history(storage.IncludeValues(true), storage.IncludeDeleted(true))
+	if status.Code(err) != codes.Unimplemented {
+		if err != nil {
+			return nil, err
+		}
+		return historyRecords(key, hist)
+	}
+	last, err := previousLifecycle(history, revision+1)
+	if err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, storage.ErrNotFound
+	}
+	return searchKeyRecords(ctx, key, history, last, true, options.logger)
+}
+
+// Returns the records for a history including deleted revisions. Tombstones
+// at the start of the history are dropped, since the values they delete have
+// been compacted.
+func historyRecords(key string, hist []storage.KeyRevision[[]byte]) ([]Record, error) {
+	for len(hist) > 0 && hist[0].IsTombstone() {
+		hist = hist[1:]
+	}
+	if len(hist) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	records := make([]Record, 0, len(hist))
+	for _, rev := range hist {
+		if rev.IsTombstone() {
+			records = append(records, Record{
+				Type:     RecordDelete,
+				Key:      key,
+				Revision: rev.Revision(),
+			})
+			continue
+		}
+		records = append(records, putRecord(key, rev))
+	}
+	return records, nil
+}
+
+func putRecord(key string, rev storage.KeyRevision[[]byte]) Record {
+	rec := Record{
+		Type:     RecordPut,
+		Key:      key,
+		Revision: rev.Revision(),
+		Value:    rev.Value(),
+	}
+	if ts := rev.Timestamp(); !ts.IsZero() {
+		rec.Timestamp = &ts
+	}
+	return rec
+}
+
+// Returns the records for the given lifecycle of the key, and the lifecycles
+// before it which can be found using previousLifecycle. Used for stores which
+// cannot return deleted history.
+func searchKeyRecords(
+	ctx context.Context,
+	key string,
+	history func(...storage.HistoryOpt) ([]storage.KeyRevision[[]byte], error),
+	last []storage.KeyRevision[[]byte],
+	deleted bool,
+	logger *slog.Logger,
+) ([]Record, error) {
+	lifecycles := [][]storage.KeyRevision[[]byte]{last}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		prev, err := previousLifecycle(history, lifecycles[0][0].Revision())
+		if err != nil {
+			return nil, err
+		}
+		if prev == nil {
+			break
+		}
+		lifecycles = append([][]storage.KeyRevision[[]byte]{prev}, lifecycles...)
+	}
+	if len(lifecycles) > 1 || deleted {
+		logger.Warn("store cannot return deleted history, deletes are recorded at the revision of the last put before them and lifecycles between the exported ones may be missing",
+			"key", key,
+			"lifecycles", len(lifecycles),
+		)
+	}
+
+	var records []Record
+	for i, lc := range lifecycles {
+		for _, rev := range lc {
+			records = append(records, putRecord(key, rev))
+		}
+		if i < len(lifecycles)-1 || deleted {
+			records = append(records, Record{
+				Type:     RecordDelete,
+				Key:      key,
+				Revision: lc[len(lc)-1].Revision(),
+			})
+		}
+	}
+	return records, nil
+}
+
+// Returns the full history of the key from before it was last deleted, given
+// the creation revision of its current history, or nil if there is no earlier
+// history available. Because the revision at which the key was deleted is not
+// known, this searches backwards for a revision at which the key existed, then
+// searches forwards for the last revision before it was deleted. If the key
+// was deleted and re-created more than once between the revision that was
+// found and the creation revision, the intermediate histories are skipped.
+func previousLifecycle(
+	history func(...storage.HistoryOpt) ([]storage.KeyRevision[[]byte], error),
+	createRevision int64,
+) ([]storage.KeyRevision[[]byte], error) {
+	// Returns the history at the given revision, or nil if the key did not
+	// exist at that revision or only exists in its current history.
+	historyAt := func(revision int64) ([]storage.KeyRevision[[]byte], error) {
+		hist, err := history(storage.IncludeValues(true), storage.WithRevision(revision))
+		if err != nil {
+			if storage.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if len(hist) == 0 || hist[0].Revision() >= createRevision {
+			return nil, nil
+		}
+		return hist, nil
+	}
+
+	var found []storage.KeyRevision[[]byte]
+	lo, hi := int64(0), createRevision
+	for step := int64(1); lo == 0 && hi > 1; step *= 2 {
+		probe := max(createRevision-step, 1)
+		hist, err := historyAt(probe)
+		if err != nil {
+			if storage.IsCompacted(err) || status.Code(err) == codes.Unimplemented {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if hist != nil {
+			found, lo = hist, probe
+		} else {
+			hi = probe
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		hist, err := historyAt(mid)
+		if err != nil {
+			return nil, err
+		}
+		if hist != nil {
+			found, lo = hist, mid
+		} else {
+			hi = mid
+		}
+	}
+	return found, nil
+}
+
+// Sorts records in the order they should be replayed: by revision, then by
+// key, with puts ordered before deletes of the same key and revision.
+func SortRecords(records []Record) {
+	slices.SortStableFunc(records, func(a, b Record) int {
+		return cmp.Or(
+			cmp.Compare(a.Revision, b.Revision),
+			cmp.Compare(a.Key, b.Key),
+			cmp.Compare(recordTypeOrder(a.Type), recordTypeOrder(b.Type)),
+		)
+	})
+}
+
+func recordTypeOrder(t RecordType) int {
+	if t == RecordDelete {
+		return 1
+	}
+	return 0
+}
+
+// Maps a revision of a key in an exported store to the corresponding revision
+// in the store it was imported into.
+type RevisionMapping struct {
+	Key         string    `json:"key"`
+	OldRevision int64     `json:"oldRevision"`
+	NewRevision int64     `json:"newRevision"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+type ImportResult struct {
+	// One entry for each put record that was imported, in the order they were
+	// imported.
+	Revisions []RevisionMapping
+}
+
+// Returns the new revision of the given key corresponding to its revision in
+// the exported store.
+func (r *ImportResult) Lookup(key string, oldRevision int64) (int64, bool) {
+	for _, m := range r.Revisions {
+		if m.Key == key && m.OldRevision == oldRevision {
+			return m.NewRevision, true
+		}
+	}
+	return 0, false
+}
+
+// Replays all records in an archive into the store, in order. Revision
+// numbers in the store will differ from those in the archive; the returned
+// result contains the mapping from old to new revisions. Timestamps cannot be
+// preserved, but are included in the mapping.
+//
+// Keys in the archive must not already exist in the store. If an error
+// occurs, the records imported so far are not rolled back, and the partial
+// result is returned along with the error.
+func Import(ctx context.Context, r io.Reader, store storage.KeyValueStore) (*ImportResult, error) {
+	ar, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	result := &ImportResult{}
+	seen := map[string]struct{}{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		rec, err := ar.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return result, nil
+			}
+			return result, err
+		}
+		if _, ok := seen[rec.Key]; !ok {
+			seen[rec.Key] = struct{}{}
+			if _, err := store.Get(ctx, rec.Key); err == nil {
+				return result, status.Errorf(codes.AlreadyExists, "key %q already exists", rec.Key)
+			} else if !storage.IsNotFound(err) {
+				return result, err
+			}
+		}
+		mapping, err := ApplyRecord(rec, func(value []byte, opts ...storage.PutOpt) error {
+			return store.Put(ctx, rec.Key, value, opts...)
+		}, func() error {
+			return store.Delete(ctx, rec.Key)
+		})
+		if err != nil {
+			return result, fmt.Errorf("failed to import key %q at revision %d: %w", rec.Key, rec.Revision, err)
+		}
+		if mapping != nil {
+			result.Revisions = append(result.Revisions, *mapping)
+		}
+	}
+}
+
+// Applies a single record using the given put and delete functions. For put
+// records, returns the mapping from the record's revision to the new
+// revision.
+func ApplyRecord(
+	rec Record,
+	put func([]byte, ...storage.PutOpt) error,
+	del func() error,
+) (*RevisionMapping, error) {
+	switch rec.Type {
+	case RecordPut:
+		var newRevision int64
+		if err := put(rec.Value, storage.WithRevisionOut(&newRevision)); err != nil {
+			return nil, err
+		}
+		mapping := &RevisionMapping{
+			Key:         rec.Key,
+			OldRevision: rec.Revision,
+			NewRevision: newRevision,
+		}
+		if rec.Timestamp != nil {
+			mapping.Timestamp = *rec.Timestamp
+		}
+		return mapping, nil
+	case RecordDelete:
+		if err := del(); err != nil && !storage.IsNotFound(err) {
+			return nil, err
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown record type %q", rec.Type)
+	}
+}
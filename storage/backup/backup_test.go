@@ -0,0 +1,211 @@
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/backup"
+	"github.com/kralicky/protoconfig/storage/drivers/file"
+	"github.com/kralicky/protoconfig/storage/inmemory"
+	"github.com/kralicky/protoconfig/test/testutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func historyValues(hist []storage.KeyRevision[[]byte]) []string {
+	values := make([]string, len(hist))
+	for i, h := range hist {
+		values[i] = string(h.Value())
+	}
+	return values
+}
+
+// A store which cannot list deleted keys or return deleted history.
+type noDeletedHistoryStore struct {
+	storage.KeyValueStore
+}
+
+func (s noDeletedHistoryStore) ListKeys(ctx context.Context, prefix string, opts ...storage.ListOpt) ([]string, error) {
+	options := storage.ListKeysOptions{}
+	options.Apply(opts...)
+	if options.IncludeDeleted {
+		return nil, status.Errorf(codes.Unimplemented, "listing deleted keys is not supported")
+	}
+	return s.KeyValueStore.ListKeys(ctx, prefix, opts...)
+}
+
+func (s noDeletedHistoryStore) History(ctx context.Context, key string, opts ...storage.HistoryOpt) ([]storage.KeyRevision[[]byte], error) {
+	options := storage.HistoryOptions{}
+	options.Apply(opts...)
+	if options.IncludeDeleted {
+		return nil, status.Errorf(codes.Unimplemented, "deleted history is not supported")
+	}
+	return s.KeyValueStore.History(ctx, key, opts...)
+}
+
+var _ = Describe("Backup", Label("unit"), func() {
+	DescribeTable("exporting and importing a store",
+		func(ctx SpecContext, newStore func() storage.KeyValueStore) {
+			src := newStore()
+			var cRev int64
+			for i := 0; i < 3; i++ {
+				Expect(src.Put(ctx, "a", []byte(fmt.Sprint("a", i)))).To(Succeed())
+				Expect(src.Put(ctx, "b/1", []byte(fmt.Sprint("b", i)))).To(Succeed())
+			}
+			Expect(src.Put(ctx, "c", []byte("c0"))).To(Succeed())
+			Expect(src.Put(ctx, "c", []byte("c1"), storage.WithRevisionOut(&cRev))).To(Succeed())
+			Expect(src.Delete(ctx, "c")).To(Succeed())
+			for i := 0; i < 5; i++ {
+				Expect(src.Put(ctx, "e", []byte(fmt.Sprint("e", i)))).To(Succeed())
+			}
+			Expect(src.Put(ctx, "c", []byte("c2"))).To(Succeed())
+			Expect(src.Put(ctx, "d", []byte("d0"))).To(Succeed())
+			Expect(src.Delete(ctx, "d")).To(Succeed())
+
+			var buf bytes.Buffer
+			Expect(backup.Export(ctx, src, &buf)).To(Succeed())
+
+			dst := inmemory.NewKeyValueStore(bytes.Clone)
+			result, err := backup.Import(ctx, &buf, dst)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Revisions).To(HaveLen(15))
+
+			keys, err := dst.ListKeys(ctx, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keys).To(ConsistOf("a", "b/1", "c", "e"))
+
+			for _, key := range []string{"a", "b/1", "c", "e"} {
+				srcHist, err := src.History(ctx, key, storage.IncludeValues(true))
+				Expect(err).NotTo(HaveOccurred())
+				dstHist, err := dst.History(ctx, key, storage.IncludeValues(true))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(historyValues(dstHist)).To(Equal(historyValues(srcHist)))
+				for i := range srcHist {
+					newRev, ok := result.Lookup(key, srcHist[i].Revision())
+					Expect(ok).To(BeTrue())
+					Expect(newRev).To(Equal(dstHist[i].Revision()))
+				}
+			}
+
+			By("preserving history from before the key was deleted")
+			newRev, ok := result.Lookup("c", cRev)
+			Expect(ok).To(BeTrue())
+			hist, err := dst.History(ctx, "c", storage.WithRevision(newRev), storage.IncludeValues(true))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(historyValues(hist)).To(Equal([]string{"c0", "c1"}))
+
+			By("exporting keys which are currently deleted")
+			_, err = dst.Get(ctx, "d")
+			Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+			hist, err = dst.History(ctx, "d", storage.IncludeDeleted(true), storage.IncludeValues(true))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hist).To(HaveLen(2))
+			Expect(string(hist[0].Value())).To(Equal("d0"))
+			Expect(hist[1].IsTombstone()).To(BeTrue())
+		},
+		Entry("in-memory", func() storage.KeyValueStore {
+			return inmemory.NewKeyValueStore(bytes.Clone)
+		}),
+		Entry("file", func() storage.KeyValueStore {
+			store, err := file.NewFileKeyValueStore(GinkgoT().TempDir())
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(store.Close)
+			return store
+		}),
+	)
+
+	DescribeTable("exporting keys which are deleted and re-created repeatedly",
+		func(ctx SpecContext, newStore func() storage.KeyValueStore) {
+			src := newStore()
+			for i := 0; i < 3; i++ {
+				Expect(src.Put(ctx, "a", []byte(fmt.Sprint("a", i)))).To(Succeed())
+				Expect(src.Put(ctx, "a", []byte(fmt.Sprint("a", i, "'")))).To(Succeed())
+				Expect(src.Delete(ctx, "a")).To(Succeed())
+			}
+			Expect(src.Put(ctx, "a", []byte("a3"))).To(Succeed())
+
+			var buf bytes.Buffer
+			Expect(backup.Export(ctx, src, &buf)).To(Succeed())
+			ar, err := backup.NewReader(&buf)
+			Expect(err).NotTo(HaveOccurred())
+			var records []string
+			for {
+				rec, err := ar.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				Expect(err).NotTo(HaveOccurred())
+				records = append(records, fmt.Sprintf("%s %s", rec.Type, rec.Value))
+			}
+			Expect(records).To(Equal([]string{
+				"put a0", "put a0'", "delete ",
+				"put a1", "put a1'", "delete ",
+				"put a2", "put a2'", "delete ",
+				"put a3",
+			}))
+		},
+		Entry("in-memory", func() storage.KeyValueStore {
+			return inmemory.NewKeyValueStore(bytes.Clone)
+		}),
+		Entry("file", func() storage.KeyValueStore {
+			store, err := file.NewFileKeyValueStore(GinkgoT().TempDir())
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(store.Close)
+			return store
+		}),
+	)
+
+	When("the store cannot return deleted history", func() {
+		It("should export the history it can find and log warnings", func(ctx SpecContext) {
+			src := noDeletedHistoryStore{inmemory.NewKeyValueStore(bytes.Clone)}
+			Expect(src.Put(ctx, "a", []byte("a0"))).To(Succeed())
+			Expect(src.Delete(ctx, "a")).To(Succeed())
+			Expect(src.Put(ctx, "a", []byte("a1"))).To(Succeed())
+			Expect(src.Put(ctx, "b", []byte("b0"))).To(Succeed())
+			Expect(src.Put(ctx, "d", []byte("d0"))).To(Succeed())
+			Expect(src.Delete(ctx, "d")).To(Succeed())
+
+			var logs bytes.Buffer
+			var buf bytes.Buffer
+			Expect(backup.Export(ctx, src, &buf, backup.WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))).To(Succeed())
+			Expect(logs.String()).To(ContainSubstring("keys which are currently deleted will not be exported"))
+			Expect(logs.String()).To(ContainSubstring("key=a"))
+			Expect(logs.String()).NotTo(ContainSubstring("key=b"))
+
+			dst := inmemory.NewKeyValueStore(bytes.Clone)
+			_, err := backup.Import(ctx, &buf, dst)
+			Expect(err).NotTo(HaveOccurred())
+			hist, err := dst.History(ctx, "a", storage.IncludeDeleted(true), storage.IncludeValues(true))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(historyValues(hist)).To(Equal([]string{"a0", "", "a1"}))
+			_, err = dst.History(ctx, "d", storage.IncludeDeleted(true))
+			Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+		})
+	})
+
+	It("should not import keys that already exist", func(ctx SpecContext) {
+		src := inmemory.NewKeyValueStore(bytes.Clone)
+		Expect(src.Put(ctx, "a", []byte("1"))).To(Succeed())
+		var buf bytes.Buffer
+		Expect(backup.Export(ctx, src, &buf)).To(Succeed())
+
+		_, err := backup.Import(ctx, &buf, src)
+		Expect(err).To(testutil.MatchStatusCode(codes.AlreadyExists))
+	})
+
+	It("should reject unsupported archives", func(ctx SpecContext) {
+		_, err := backup.Import(ctx, strings.NewReader(`{"version":2}`+"\n"), inmemory.NewKeyValueStore(bytes.Clone))
+		Expect(err).To(MatchError(ContainSubstring("unsupported archive version")))
+
+		_, err = backup.Import(ctx, strings.NewReader(`{"version":1}`+"\n"+`{"type":"foo","key":"a"}`+"\n"), inmemory.NewKeyValueStore(bytes.Clone))
+		Expect(err).To(MatchError(ContainSubstring("unknown type")))
+	})
+})
@@ -0,0 +1,326 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type DriverOptionType int
+
+const (
+	DriverOptionString DriverOptionType = iota
+	DriverOptionBool
+	DriverOptionInt
+	DriverOptionDuration
+)
+
+func (t DriverOptionType) String() string {
+	switch t {
+	case DriverOptionString:
+		return "string"
+	case DriverOptionBool:
+		return "bool"
+	case DriverOptionInt:
+		return "int"
+	case DriverOptionDuration:
+		return "duration"
+	default:
+		return fmt.Sprintf("DriverOptionType(%d)", int(t))
+	}
+}
+
+func (t DriverOptionType) parse(value string) (any, error) {
+	switch t {
+	case DriverOptionBool:
+		return strconv.ParseBool(value)
+	case DriverOptionInt:
+		return strconv.Atoi(value)
+	case DriverOptionDuration:
+		return time.ParseDuration(value)
+	default:
+		return value, nil
+	}
+}
+
+// Describes an option accepted by a driver. Options are passed to the driver
+// as query parameters in the store URI.
+type DriverOption struct {
+	Name        string
+	Type        DriverOptionType
+	Description string
+	// If set, the option is required and has no default value.
+	Required bool
+	// The value used if the option is not set. Must be empty if the option is
+	// required.
+	Default string
+}
+
+// A Driver builds stores of type S from URIs whose scheme matches the name
+// of the driver, for example:
+//
+//	memory://
+//	file:///var/lib/cfg
+//	etcd://host:2379/prefix?tls=true
+type Driver[S any] struct {
+	// The URI scheme handled by the driver.
+	Name string
+	// A short description of the driver, and how the host and path of the URI
+	// are interpreted.
+	Description string
+	// The options accepted by the driver. Any other query parameters in the
+	// URI are rejected.
+	Options []DriverOption
+	// Builds a store from a validated configuration. Errors caused by an
+	// invalid URI should have the InvalidArgument status code.
+	Build func(ctx context.Context, conf DriverConfig) (S, error)
+}
+
+// Returns a human-readable description of the driver and its options.
+func (d Driver[S]) Usage() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s://", d.Name)
+	if d.Description != "" {
+		fmt.Fprintf(&sb, "\n  %s", d.Description)
+	}
+	for _, opt := range d.Options {
+		fmt.Fprintf(&sb, "\n  %s (%s)", opt.Name, opt.Type)
+		if opt.Description != "" {
+			fmt.Fprintf(&sb, ": %s", opt.Description)
+		}
+		switch {
+		case opt.Required:
+			sb.WriteString(" [required]")
+		case opt.Default != "":
+			fmt.Fprintf(&sb, " [default: %s]", opt.Default)
+		}
+	}
+	return sb.String()
+}
+
+func (d Driver[S]) option(name string) (DriverOption, bool) {
+	return lo.Find(d.Options, func(opt DriverOption) bool {
+		return opt.Name == name
+	})
+}
+
+// Parses and validates the query parameters of the URI against the options
+// of the driver.
+func (d Driver[S]) configure(uri *url.URL) (DriverConfig, error) {
+	conf := DriverConfig{
+		URI:    uri,
+		values: map[string]any{},
+	}
+	query, err := url.ParseQuery(uri.RawQuery)
+	if err != nil {
+		return DriverConfig{}, status.Errorf(codes.InvalidArgument, "%s: malformed query: %v", d.Name, err)
+	}
+	for name, values := range query {
+		opt, ok := d.option(name)
+		if !ok {
+			known := lo.Map(d.Options, func(opt DriverOption, _ int) string { return opt.Name })
+			if len(known) == 0 {
+				return DriverConfig{}, status.Errorf(codes.InvalidArgument, "%s: unknown option %q (this driver has no options)", d.Name, name)
+			}
+			return DriverConfig{}, status.Errorf(codes.InvalidArgument, "%s: unknown option %q (available options: %s)", d.Name, name, strings.Join(known, ", "))
+		}
+		if len(values) > 1 {
+			return DriverConfig{}, status.Errorf(codes.InvalidArgument, "%s: option %q specified more than once", d.Name, name)
+		}
+		value, err := opt.Type.parse(values[0])
+		if err != nil {
+			return DriverConfig{}, status.Errorf(codes.InvalidArgument, "%s: option %q: invalid %s %q", d.Name, name, opt.Type, values[0])
+		}
+		conf.values[name] = value
+	}
+	for _, opt := range d.Options {
+		if _, ok := conf.values[opt.Name]; ok {
+			continue
+		}
+		if opt.Required {
+			return DriverConfig{}, status.Errorf(codes.InvalidArgument, "%s: missing required option %q", d.Name, opt.Name)
+		}
+		if opt.Default != "" {
+			// defaults are validated when the driver is registered
+			conf.values[opt.Name], _ = opt.Type.parse(opt.Default)
+		}
+	}
+	return conf, nil
+}
+
+// The configuration passed to [Driver.Build]. The accessor methods return
+// the value of the option with the given name, its default value if it was
+// not set, or the zero value if it has no default. They panic if the option
+// has a different type.
+type DriverConfig struct {
+	// The URI the store was opened with.
+	URI    *url.URL
+	values map[string]any
+}
+
+// Reports whether the option was set, or has a default value.
+func (c DriverConfig) Has(name string) bool {
+	_, ok := c.values[name]
+	return ok
+}
+
+func (c DriverConfig) String(name string) string {
+	return driverConfigValue[string](c, name)
+}
+
+func (c DriverConfig) Bool(name string) bool {
+	return driverConfigValue[bool](c, name)
+}
+
+func (c DriverConfig) Int(name string) int {
+	return driverConfigValue[int](c, name)
+}
+
+func (c DriverConfig) Duration(name string) time.Duration {
+	return driverConfigValue[time.Duration](c, name)
+}
+
+func driverConfigValue[V any](c DriverConfig, name string) V {
+	value, ok := c.values[name]
+	if !ok {
+		return lo.Empty[V]()
+	}
+	v, ok := value.(V)
+	if !ok {
+		panic(fmt.Sprintf("bug: driver option %q has type %T, not %T", name, value, v))
+	}
+	return v
+}
+
+// Matches valid URI schemes (RFC 3986, section 3.1).
+var schemeRegex = regexp.MustCompile(`^[a-z][a-z0-9+.-]*$`)
+
+// A registry of drivers which build stores of type S.
+type DriverRegistry[S any] struct {
+	lock    sync.RWMutex
+	drivers map[string]Driver[S]
+}
+
+func NewDriverRegistry[S any]() *DriverRegistry[S] {
+	return &DriverRegistry[S]{
+		drivers: map[string]Driver[S]{},
+	}
+}
+
+// The registry of key-value store drivers. Drivers register themselves here
+// when their package is imported.
+var KeyValueStoreDrivers = NewDriverRegistry[KeyValueStore]()
+
+var valueStoreDrivers sync.Map // reflect.Type => *DriverRegistry[ValueStoreT[T]]
+
+// Returns the registry of value store drivers for values of type T. Value
+// store drivers depend on the type of the stored value, so each type has its
+// own registry, which is created the first time it is requested.
+func ValueStoreDrivers[T any]() *DriverRegistry[ValueStoreT[T]] {
+	registry, _ := valueStoreDrivers.LoadOrStore(reflect.TypeFor[T](), NewDriverRegistry[ValueStoreT[T]]())
+	return registry.(*DriverRegistry[ValueStoreT[T]])
+}
+
+// Reports whether name can be used as the name of a driver, which must be a
+// valid URI scheme in lowercase.
+func IsValidDriverName(name string) bool {
+	return schemeRegex.MatchString(name)
+}
+
+// Registers a driver. Panics if the driver is invalid, or a driver with the
+// same name has already been registered.
+func (r *DriverRegistry[S]) Register(driver Driver[S]) {
+	if !IsValidDriverName(driver.Name) {
+		panic(fmt.Sprintf("bug: invalid driver name %q", driver.Name))
+	}
+	if driver.Build == nil {
+		panic(fmt.Sprintf("bug: driver %q has no build function", driver.Name))
+	}
+	for i, opt := range driver.Options {
+		if slices.ContainsFunc(driver.Options[:i], func(o DriverOption) bool { return o.Name == opt.Name }) {
+			panic(fmt.Sprintf("bug: driver %q has duplicate option %q", driver.Name, opt.Name))
+		}
+		if opt.Required && opt.Default != "" {
+			panic(fmt.Sprintf("bug: driver %q option %q is required but has a default value", driver.Name, opt.Name))
+		}
+		if opt.Default != "" {
+			if _, err := opt.Type.parse(opt.Default); err != nil {
+				panic(fmt.Sprintf("bug: driver %q option %q has an invalid default value: %v", driver.Name, opt.Name, err))
+			}
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.drivers[driver.Name]; ok {
+		panic(fmt.Sprintf("bug: driver %q is already registered", driver.Name))
+	}
+	r.drivers[driver.Name] = driver
+}
+
+func (r *DriverRegistry[S]) Unregister(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.drivers, name)
+}
+
+func (r *DriverRegistry[S]) Lookup(name string) (Driver[S], bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	driver, ok := r.drivers[name]
+	return driver, ok
+}
+
+// Returns all registered drivers, sorted by name.
+func (r *DriverRegistry[S]) Drivers() []Driver[S] {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	drivers := lo.Values(r.drivers)
+	slices.SortFunc(drivers, func(a, b Driver[S]) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return drivers
+}
+
+// Builds a store from the given URI using the driver matching its scheme.
+// The query parameters of the URI are validated against the driver's options
+// before the store is built. All errors caused by an invalid URI have the
+// InvalidArgument status code.
+//
+// If the returned store implements [io.Closer], it should be closed once it
+// is no longer needed.
+func (r *DriverRegistry[S]) Open(ctx context.Context, uri string) (S, error) {
+	var zero S
+	u, err := url.Parse(uri)
+	if err != nil {
+		return zero, status.Errorf(codes.InvalidArgument, "invalid store uri: %v", err)
+	}
+	if u.Scheme == "" {
+		return zero, status.Errorf(codes.InvalidArgument, "invalid store uri %q: missing driver name (expected <driver>://...)", uri)
+	}
+	if u.Opaque != "" {
+		return zero, status.Errorf(codes.InvalidArgument, "invalid store uri %q: expected %s://...", uri, u.Scheme)
+	}
+	driver, ok := r.Lookup(u.Scheme)
+	if !ok {
+		names := lo.Map(r.Drivers(), func(d Driver[S], _ int) string { return d.Name })
+		return zero, status.Errorf(codes.InvalidArgument, "unknown storage driver %q (available drivers: %s)", u.Scheme, strings.Join(names, ", "))
+	}
+	conf, err := driver.configure(u)
+	if err != nil {
+		return zero, err
+	}
+	return driver.Build(ctx, conf)
+}
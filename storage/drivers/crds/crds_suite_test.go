@@ -0,0 +1,368 @@
+package crds_test
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/drivers/crds"
+	conformance_storage "github.com/kralicky/protoconfig/test/conformance/storage"
+	"github.com/kralicky/protoconfig/test/ext"
+	"github.com/kralicky/protoconfig/util/future"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/samber/lo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestCrds(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CRDs Suite")
+}
+
+// Stores the configuration in a ConfigMap, which is sufficient to exercise
+// the value store without installing any custom resource definitions.
+type configMapMethods struct{}
+
+func (configMapMethods) ControllerReference() (client.Object, bool) {
+	return nil, false
+}
+
+func (configMapMethods) FillObjectFromConfig(obj *corev1.ConfigMap, conf *ext.SampleConfiguration) {
+	data, err := proto.Marshal(conf)
+	Expect(err).NotTo(HaveOccurred())
+	obj.BinaryData = map[string][]byte{"config": data}
+}
+
+func (configMapMethods) FillConfigFromObject(obj *corev1.ConfigMap, conf *ext.SampleConfiguration) {
+	Expect(proto.Unmarshal(obj.BinaryData["config"], conf)).To(Succeed())
+}
+
+// Assigns resource versions from a single counter shared by all objects, as
+// the api server does. The fake client otherwise numbers the resource
+// versions of each object separately, starting at 1 when it is created.
+type monotonicTracker struct {
+	k8stesting.ObjectTracker
+	resourceVersion atomic.Int64
+}
+
+func (t *monotonicTracker) setResourceVersion(obj runtime.Object) error {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	accessor.SetResourceVersion(strconv.FormatInt(t.resourceVersion.Add(1), 10))
+	return nil
+}
+
+func (t *monotonicTracker) Create(gvr schema.GroupVersionResource, obj runtime.Object, ns string) error {
+	if err := t.setResourceVersion(obj); err != nil {
+		return err
+	}
+	return t.ObjectTracker.Create(gvr, obj, ns)
+}
+
+func (t *monotonicTracker) Update(gvr schema.GroupVersionResource, obj runtime.Object, ns string) error {
+	if err := t.setResourceVersion(obj); err != nil {
+		return err
+	}
+	return t.ObjectTracker.Update(gvr, obj, ns)
+}
+
+// Returns a fake client whose watches begin with an Added event for each
+// existing object, as the api server does when no resource version is given.
+// Unlike the fake client, watches only send events for objects matching
+// their field and label selectors, and resource versions increase across
+// all objects.
+func newFakeClient() client.WithWatch {
+	scheme := runtime.NewScheme()
+	lo.Must0(corev1.AddToScheme(scheme))
+	tracker := &monotonicTracker{
+		ObjectTracker: k8stesting.NewObjectTracker(scheme, serializer.NewCodecFactory(scheme).UniversalDecoder()),
+	}
+	return fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjectTracker(tracker).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Watch: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) (watch.Interface, error) {
+				w, err := c.Watch(ctx, list, opts...)
+				if err != nil {
+					return nil, err
+				}
+				listOpts := client.ListOptions{}
+				listOpts.ApplyOptions(opts)
+				matches := func(ev watch.Event) bool {
+					obj, ok := ev.Object.(client.Object)
+					if !ok || (ev.Type != watch.Added && ev.Type != watch.Modified && ev.Type != watch.Deleted) {
+						return true
+					}
+					if listOpts.FieldSelector != nil && !listOpts.FieldSelector.Matches(fields.Set{
+						"metadata.name":      obj.GetName(),
+						"metadata.namespace": obj.GetNamespace(),
+					}) {
+						return false
+					}
+					return listOpts.LabelSelector == nil || listOpts.LabelSelector.Matches(labels.Set(obj.GetLabels()))
+				}
+				var existing corev1.ConfigMapList
+				if err := c.List(ctx, &existing, client.InNamespace(listOpts.Namespace)); err != nil {
+					w.Stop()
+					return nil, err
+				}
+				events := make(chan watch.Event, len(existing.Items))
+				for i := range existing.Items {
+					if ev := (watch.Event{Type: watch.Added, Object: &existing.Items[i]}); matches(ev) {
+						events <- ev
+					}
+				}
+				proxy := watch.NewProxyWatcher(events)
+				go func() {
+					defer w.Stop()
+					for {
+						select {
+						case <-proxy.StopChan():
+							return
+						case ev, ok := <-w.ResultChan():
+							if !ok {
+								proxy.Stop()
+								return
+							}
+							if !matches(ev) {
+								continue
+							}
+							select {
+							case events <- ev:
+							case <-proxy.StopChan():
+								return
+							}
+						}
+					}
+				}()
+				return proxy, nil
+			},
+		}).
+		Build()
+}
+
+var _ = Describe("CRD Value Store", Label("integration"), func() {
+	k8sClient := newFakeClient()
+	conformance_storage.ValueStoreTestSuite(func() storage.ValueStoreT[*ext.SampleConfiguration] {
+		return crds.NewCRDValueStore[*corev1.ConfigMap, *ext.SampleConfiguration](
+			client.ObjectKey{Namespace: uuid.NewString(), Name: "config"},
+			configMapMethods{},
+			crds.WithClient(k8sClient),
+		)
+	}, conformance_storage.NewSampleConfiguration, conformance_storage.ProtoEqual, conformance_storage.WithoutDeletedHistory())()
+})
+
+var _ = Describe("CRD Value Store with ConfigMap history", Label("integration"), func() {
+	k8sClient := newFakeClient()
+	conformance_storage.ValueStoreTestSuite(func() storage.ValueStoreT[*ext.SampleConfiguration] {
+		return crds.NewCRDValueStore[*corev1.ConfigMap, *ext.SampleConfiguration](
+			client.ObjectKey{Namespace: uuid.NewString(), Name: "config"},
+			configMapMethods{},
+			crds.WithClient(k8sClient),
+			crds.WithHistoryStorage(crds.HistoryInConfigMaps),
+		)
+	}, conformance_storage.NewSampleConfiguration, conformance_storage.ProtoEqual, conformance_storage.WithoutDeletedHistory())()
+})
+
+// Returns stores sharing a single namespace, so that stores are only
+// isolated by their labels.
+type kvTestBroker struct {
+	client client.WithWatch
+}
+
+func (b kvTestBroker) KeyValueStore(namespace string) storage.KeyValueStoreT[*ext.SampleConfiguration] {
+	return crds.NewCRDKeyValueStore[*corev1.ConfigMap, *ext.SampleConfiguration]("default", namespace, configMapMethods{}, crds.WithClient(b.client))
+}
+
+var _ = Describe("CRD KV Store", Ordered, Label("integration"), conformance_storage.KeyValueStoreTestSuite(future.Instant(kvTestBroker{client: newFakeClient()}), conformance_storage.NewSampleConfiguration, conformance_storage.ProtoEqual))
+
+var _ = Describe("CRD History", Label("unit"), func() {
+	var k8sClient client.WithWatch
+	var ref client.ObjectKey
+	BeforeEach(func() {
+		k8sClient = newFakeClient()
+		ref = client.ObjectKey{Namespace: uuid.NewString(), Name: "config"}
+	})
+	newStore := func(opts ...crds.CRDValueStoreOption) storage.ValueStoreT[*ext.SampleConfiguration] {
+		return crds.NewCRDValueStore[*corev1.ConfigMap, *ext.SampleConfiguration](
+			ref, configMapMethods{}, append([]crds.CRDValueStoreOption{crds.WithClient(k8sClient)}, opts...)...)
+	}
+	// returns the ConfigMaps holding history entries
+	listEntries := func(ctx context.Context) []corev1.ConfigMap {
+		var list corev1.ConfigMapList
+		Expect(k8sClient.List(ctx, &list, client.InNamespace(ref.Namespace), client.HasLabels{crds.HistoryObjectLabel})).To(Succeed())
+		return list.Items
+	}
+	revisions := func(history []storage.KeyRevision[*ext.SampleConfiguration]) []int64 {
+		return lo.Map(history, func(kr storage.KeyRevision[*ext.SampleConfiguration], _ int) int64 {
+			return kr.Revision()
+		})
+	}
+
+	It("should store history entries in ConfigMaps owned by the object", func(ctx SpecContext) {
+		store := newStore(crds.WithHistoryStorage(crds.HistoryInConfigMaps))
+		for i := 1; i <= 3; i++ {
+			Expect(store.Put(ctx, conformance_storage.NewSampleConfiguration(int64(i)))).To(Succeed())
+		}
+
+		var obj corev1.ConfigMap
+		Expect(k8sClient.Get(ctx, ref, &obj)).To(Succeed())
+		Expect(obj.Annotations).NotTo(HaveKey(crds.HistoryAnnotation))
+		entries := listEntries(ctx)
+		Expect(entries).To(HaveLen(2))
+		for _, entry := range entries {
+			Expect(entry.OwnerReferences).To(ConsistOf(And(
+				HaveField("Kind", "ConfigMap"),
+				HaveField("Name", ref.Name),
+			)))
+		}
+
+		history, err := store.History(ctx, storage.IncludeValues(true))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(history).To(HaveLen(3))
+		for i, kr := range history {
+			Expect(kr.Value()).To(conformance_storage.ProtoEqual(conformance_storage.NewSampleConfiguration(int64(i + 1))))
+			Expect(kr.Version()).To(BeEquivalentTo(i + 1))
+		}
+
+		By("deleting the entries along with the object")
+		Expect(store.Delete(ctx)).To(Succeed())
+		Expect(listEntries(ctx)).To(BeEmpty())
+	})
+
+	It("should retain the configured number of entries", func(ctx SpecContext) {
+		for _, hs := range []crds.HistoryStorage{crds.HistoryInAnnotation, crds.HistoryInConfigMaps} {
+			ref.Namespace = uuid.NewString()
+			store := newStore(crds.WithHistoryStorage(hs), crds.WithHistoryLimit(2))
+			var revs []int64
+			for i := 1; i <= 5; i++ {
+				var rev int64
+				Expect(store.Put(ctx, conformance_storage.NewSampleConfiguration(int64(i)), storage.WithRevisionOut(&rev))).To(Succeed())
+				revs = append(revs, rev)
+			}
+
+			history, err := store.History(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(revisions(history)).To(Equal(revs[2:]))
+			Expect(history[0].Version()).To(BeEquivalentTo(3))
+			_, err = store.History(ctx, storage.WithRevision(revs[1]))
+			Expect(storage.IsCompacted(err)).To(BeTrue())
+		}
+	})
+
+	It("should migrate history from the annotation", func(ctx SpecContext) {
+		var revs []int64
+		annotationStore := newStore()
+		for i := 1; i <= 3; i++ {
+			var rev int64
+			Expect(annotationStore.Put(ctx, conformance_storage.NewSampleConfiguration(int64(i)), storage.WithRevisionOut(&rev))).To(Succeed())
+			revs = append(revs, rev)
+		}
+
+		store := newStore(crds.WithHistoryStorage(crds.HistoryInConfigMaps))
+		history, err := store.History(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(revisions(history)).To(Equal(revs))
+
+		var rev int64
+		Expect(store.Put(ctx, conformance_storage.NewSampleConfiguration(4), storage.WithRevisionOut(&rev))).To(Succeed())
+		revs = append(revs, rev)
+		var obj corev1.ConfigMap
+		Expect(k8sClient.Get(ctx, ref, &obj)).To(Succeed())
+		Expect(obj.Annotations).NotTo(HaveKey(crds.HistoryAnnotation))
+		Expect(listEntries(ctx)).To(HaveLen(3))
+
+		history, err = store.History(ctx, storage.IncludeValues(true))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(revisions(history)).To(Equal(revs))
+		for i, kr := range history {
+			Expect(kr.Value()).To(conformance_storage.ProtoEqual(conformance_storage.NewSampleConfiguration(int64(i + 1))))
+			Expect(kr.Version()).To(BeEquivalentTo(i + 1))
+			Expect(kr.CreateRevision()).To(Equal(revs[0]))
+		}
+		value, err := store.Get(ctx, storage.WithRevision(revs[1]))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(conformance_storage.ProtoEqual(conformance_storage.NewSampleConfiguration(2)))
+	})
+})
+
+var _ = Describe("CRD KV Store objects", Label("unit"), func() {
+	It("should store each key in an object labeled with its directories", func(ctx SpecContext) {
+		k8sClient := newFakeClient()
+		store := kvTestBroker{client: k8sClient}.KeyValueStore("store")
+		for i, key := range []string{"plain", "a/b/c", "a/d", "ab"} {
+			Expect(store.Put(ctx, key, conformance_storage.NewSampleConfiguration(int64(i)))).To(Succeed())
+		}
+
+		var obj corev1.ConfigMap
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "store.plain"}, &obj)).To(Succeed())
+		Expect(obj.Annotations).To(HaveKeyWithValue(crds.KeyAnnotation, "plain"))
+		Expect(obj.Labels).To(HaveKeyWithValue(crds.KeyValueStoreLabel, "store"))
+
+		keys, err := store.ListKeys(ctx, "a/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(Equal([]string{"a/b/c", "a/d"}))
+		keys, err = store.ListKeys(ctx, "a/b")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(Equal([]string{"a/b/c"}))
+		keys, err = store.ListKeys(ctx, "a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(Equal([]string{"a/b/c", "a/d", "ab"}))
+
+		By("keeping deleted keys as tombstones")
+		Expect(store.Delete(ctx, "plain")).To(Succeed())
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "store.plain"}, &obj)).To(Succeed())
+		Expect(obj.Labels).To(HaveKey(crds.TombstoneLabel))
+		keys, err = store.ListKeys(ctx, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(Equal([]string{"a/b/c", "a/d", "ab"}))
+	})
+
+	It("should reject invalid store names", func() {
+		Expect(func() { kvTestBroker{client: newFakeClient()}.KeyValueStore("a/b") }).To(Panic())
+		Expect(func() { kvTestBroker{client: newFakeClient()}.KeyValueStore("") }).To(Panic())
+	})
+})
+
+var _ = Describe("CRD Driver", Label("unit"), func() {
+	It("should open value stores for registered types", func(ctx SpecContext) {
+		crds.Register[*corev1.ConfigMap, *ext.SampleConfiguration](configMapMethods{}, crds.WithClient(newFakeClient()))
+		DeferCleanup(func() {
+			storage.ValueStoreDrivers[*ext.SampleConfiguration]().Unregister("crd")
+		})
+
+		store, err := storage.ValueStoreDrivers[*ext.SampleConfiguration]().Open(ctx, "crd://"+uuid.NewString()+"/config")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.Put(ctx, conformance_storage.NewSampleConfiguration(1))).To(Succeed())
+
+		_, err = storage.ValueStoreDrivers[*ext.SampleConfiguration]().Open(ctx, "crd://namespace")
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+	})
+
+	It("should not register a key-value store driver", func(ctx SpecContext) {
+		_, ok := storage.KeyValueStoreDrivers.Lookup("crd")
+		Expect(ok).To(BeFalse())
+		_, err := storage.KeyValueStoreDrivers.Open(ctx, "crd://namespace/name")
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+	})
+})
@@ -0,0 +1,46 @@
+package crds
+
+import (
+	"context"
+	"strings"
+
+	"github.com/kralicky/protoconfig/server"
+	"github.com/kralicky/protoconfig/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Returns a driver which builds value stores for objects of type O, addressed
+// by URIs of the form crd://namespace/name. Use [Register] to register it for
+// the config type.
+func NewDriver[O client.Object, T server.ConfigType[T]](
+	methods ValueStoreMethods[O, T],
+	opts ...CRDValueStoreOption,
+) storage.Driver[storage.ValueStoreT[T]] {
+	return storage.Driver[storage.ValueStoreT[T]]{
+		Name:        "crd",
+		Description: "Stores the value in a single Kubernetes object, e.g. crd://namespace/name.",
+		Build: func(_ context.Context, conf storage.DriverConfig) (storage.ValueStoreT[T], error) {
+			namespace := conf.URI.Host
+			name := strings.TrimPrefix(conf.URI.Path, "/")
+			if namespace == "" || name == "" || strings.Contains(name, "/") {
+				return nil, status.Errorf(codes.InvalidArgument, "crd: expected crd://namespace/name, got %q", conf.URI.Redacted())
+			}
+			return NewCRDValueStore(client.ObjectKey{Namespace: namespace, Name: name}, methods, opts...), nil
+		},
+	}
+}
+
+// Registers the driver returned by [NewDriver] with the value store registry
+// for T, so that crd:// URIs can be opened with:
+//
+//	storage.ValueStoreDrivers[T]().Open(ctx, "crd://namespace/name")
+//
+// Panics if a crd driver is already registered for T.
+func Register[O client.Object, T server.ConfigType[T]](
+	methods ValueStoreMethods[O, T],
+	opts ...CRDValueStoreOption,
+) {
+	storage.ValueStoreDrivers[T]().Register(NewDriver(methods, opts...))
+}
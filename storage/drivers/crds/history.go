@@ -0,0 +1,315 @@
+package crds
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/kralicky/protoconfig/server"
+	"google.golang.org/protobuf/proto"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// Where the history of an object is stored.
+type HistoryStorage int
+
+const (
+	// The history is stored in the HistoryAnnotation of the object. It is
+	// updated atomically with the object, but is limited by the maximum size
+	// of annotations, so entries may be dropped for large objects.
+	HistoryInAnnotation HistoryStorage = iota
+	// Each history entry is stored in a separate ConfigMap in the namespace of
+	// the object, owned by the object so that the api server deletes the
+	// entries along with it. Entries are labeled with HistoryObjectLabel.
+	// The client must be allowed to manage ConfigMaps in the namespace.
+	//
+	// History previously stored in the annotation of the object is moved to
+	// ConfigMaps the next time the object is updated.
+	HistoryInConfigMaps
+)
+
+const (
+	// Label of the ConfigMaps storing history entries, identifying the object
+	// they belong to.
+	HistoryObjectLabel = "protoconfig-history-object"
+	// Annotation holding the creation revision and version of objects whose
+	// history is stored in ConfigMaps.
+	HistoryMetadataAnnotation = "protoconfig-history-metadata"
+
+	historyEntryKey         = "entry"
+	historyEntryMetadataKey = "metadata"
+	defaultHistoryLimit     = 64
+)
+
+// The metadata of the current value of an object, or of a history entry.
+type historyMetadata struct {
+	CreateRevision int64 `json:"createRevision"`
+	Version        int64 `json:"version,omitempty"`
+	// Set for the deletions of keys of a [CRDKeyValueStore].
+	Tombstone bool `json:"tombstone,omitempty"`
+}
+
+// Sets the metadata annotation of obj.
+func setHistoryMetadata(obj client.Object, metadata historyMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[HistoryMetadataAnnotation] = string(data)
+	obj.SetAnnotations(annotations)
+	return nil
+}
+
+// Returns an identifier for the object, used to name and label its history
+// entries. Object names can be longer than label values, so a hash is used.
+func (s *CRDValueStore[O, T]) historyID() string {
+	sum := sha256.Sum256([]byte(s.gvk.GroupKind().String() + "/" + s.objectRef.Name))
+	return hex.EncodeToString(sum[:10])
+}
+
+func (s *CRDValueStore[O, T]) historyEntryName(revision int64) string {
+	return fmt.Sprintf("protoconfig-history-%s-%d", s.historyID(), revision)
+}
+
+// Returns the history entries stored in ConfigMaps, sorted by revision.
+func (s *CRDValueStore[O, T]) listHistoryEntries(ctx context.Context) ([]historyEntry[T], error) {
+	var list corev1.ConfigMapList
+	if err := s.client.List(ctx, &list,
+		client.InNamespace(s.objectRef.Namespace),
+		client.MatchingLabels{HistoryObjectLabel: s.historyID()},
+	); err != nil {
+		return nil, toGrpcError(err)
+	}
+	entries := make([]historyEntry[T], 0, len(list.Items))
+	for _, cm := range list.Items {
+		wire, err := snappy.Decode(nil, cm.BinaryData[historyEntryKey])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode history entry %s: %w", cm.Name, err)
+		}
+		conf := s.newEmptyConfig()
+		if err := proto.Unmarshal(wire, conf); err != nil {
+			return nil, fmt.Errorf("failed to decode history entry %s: %w", cm.Name, err)
+		}
+		entry := historyEntry[T]{Config: conf}
+		if str, ok := cm.Data[historyEntryMetadataKey]; ok {
+			var metadata historyMetadata
+			if err := json.Unmarshal([]byte(str), &metadata); err != nil {
+				return nil, fmt.Errorf("failed to decode history entry %s: %w", cm.Name, err)
+			}
+			entry.CreateRevision = metadata.CreateRevision
+			entry.Version = metadata.Version
+			entry.Tombstone = metadata.Tombstone
+		}
+		entries = append(entries, entry)
+	}
+	sortHistoryEntries(entries)
+	return entries, nil
+}
+
+// Stores the entry, whose config must have its revision set, as a history
+// entry of owner. Entries are immutable, so an existing entry for the same
+// revision is kept.
+func (s *CRDValueStore[O, T]) createHistoryEntry(ctx context.Context, owner O, entry historyEntry[T]) error {
+	wire, err := proto.Marshal(entry.Config)
+	if err != nil {
+		return err
+	}
+	metadata, err := json.Marshal(historyMetadata{
+		CreateRevision: entry.CreateRevision,
+		Version:        entry.Version,
+		Tombstone:      entry.Tombstone,
+	})
+	if err != nil {
+		return err
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.historyEntryName(entry.Config.GetRevision().GetRevision()),
+			Namespace: s.objectRef.Namespace,
+			Labels: map[string]string{
+				HistoryObjectLabel: s.historyID(),
+			},
+		},
+		Data: map[string]string{
+			historyEntryMetadataKey: string(metadata),
+		},
+		BinaryData: map[string][]byte{
+			historyEntryKey: snappy.Encode(nil, wire),
+		},
+	}
+	if err := controllerutil.SetOwnerReference(owner, cm, s.client.Scheme()); err != nil {
+		return err
+	}
+	err = s.client.Create(ctx, cm, client.FieldOwner(FieldManagerName))
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return toGrpcError(err)
+	}
+	return nil
+}
+
+// Deletes the oldest history entries exceeding the history limit.
+func (s *CRDValueStore[O, T]) pruneHistoryEntries(ctx context.Context) error {
+	entries, err := s.listHistoryEntries(ctx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries[:max(0, len(entries)-s.historyLimit)] {
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.historyEntryName(entry.Config.GetRevision().GetRevision()),
+				Namespace: s.objectRef.Namespace,
+			},
+		}
+		if err := s.client.Delete(ctx, cm); err != nil && !k8serrors.IsNotFound(err) {
+			return toGrpcError(err)
+		}
+	}
+	return nil
+}
+
+// Deletes all history entries of the object.
+func (s *CRDValueStore[O, T]) deleteHistoryEntries(ctx context.Context) error {
+	err := s.client.DeleteAllOf(ctx, &corev1.ConfigMap{},
+		client.InNamespace(s.objectRef.Namespace),
+		client.MatchingLabels{HistoryObjectLabel: s.historyID()},
+	)
+	return toGrpcError(err)
+}
+
+// Stores the current value of obj as a history entry before it is updated,
+// and updates the annotations of obj accordingly. History found in the
+// annotation of obj is moved to ConfigMaps, and the annotation is removed.
+//
+// Entries are written before the object is updated, so an entry for the
+// current revision of the object can be left behind if the update fails; it
+// is ignored when reading, and reused by the next update.
+func (s *CRDValueStore[O, T]) appendSpecToHistoryConfigMaps(ctx context.Context, obj O) error {
+	revisionNumber, err := strconv.ParseInt(obj.GetResourceVersion(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid resource version %q: %w", obj.GetResourceVersion(), err)
+	}
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	createRevision, version := objectMetadata(obj)
+
+	if str := annotations[HistoryAnnotation]; str != "" {
+		var legacy historyFormat[T]
+		if err := decodeHistory(str, &legacy); err != nil {
+			return fmt.Errorf("failed to migrate history annotation: %w", err)
+		}
+		for i, entry := range legacy.Entries {
+			entry.CreateRevision = legacy.CreateRevision
+			if legacy.FirstVersion > 0 {
+				entry.Version = legacy.FirstVersion + int64(i)
+			}
+			if err := s.createHistoryEntry(ctx, obj, entry); err != nil {
+				return err
+			}
+		}
+	}
+	delete(annotations, HistoryAnnotation)
+
+	conf := s.newEmptyConfig()
+	s.methods.FillConfigFromObject(obj, conf)
+	server.SetRevision(conf, revisionNumber, lastModifiedTime(obj))
+	if err := s.createHistoryEntry(ctx, obj, historyEntry[T]{
+		Config:         conf,
+		CreateRevision: createRevision,
+		Version:        version,
+	}); err != nil {
+		return err
+	}
+	if err := s.pruneHistoryEntries(ctx); err != nil {
+		return err
+	}
+
+	metadata := historyMetadata{CreateRevision: createRevision}
+	if version > 0 {
+		metadata.Version = version + 1
+	}
+	annotations[LastModifiedAnnotation] = time.Now().Format(time.RFC3339Nano)
+	obj.SetAnnotations(annotations)
+	return setHistoryMetadata(obj, metadata)
+}
+
+// Stores the deletion recorded by the tombstone obj as a history entry before
+// the key is recreated, and removes the metadata of the deleted value from
+// obj.
+func (s *CRDValueStore[O, T]) appendTombstoneToHistory(ctx context.Context, obj O) error {
+	revisionNumber, err := strconv.ParseInt(obj.GetResourceVersion(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid resource version %q: %w", obj.GetResourceVersion(), err)
+	}
+	createRevision, _ := objectMetadata(obj)
+	conf := s.newEmptyConfig()
+	server.SetRevision(conf, revisionNumber, lastModifiedTime(obj))
+	if err := s.createHistoryEntry(ctx, obj, historyEntry[T]{
+		Config:         conf,
+		CreateRevision: createRevision,
+		Tombstone:      true,
+	}); err != nil {
+		return err
+	}
+	if err := s.pruneHistoryEntries(ctx); err != nil {
+		return err
+	}
+	// without metadata, the recreated value is reported as created at the
+	// revision of the update
+	annotations := obj.GetAnnotations()
+	delete(annotations, HistoryMetadataAnnotation)
+	obj.SetAnnotations(annotations)
+	return nil
+}
+
+// Adds the history entries stored in ConfigMaps to hist, which holds the
+// history read from the annotation of obj, if any. Entries for the current or
+// later revisions of obj are left over from failed updates, and are ignored.
+func (s *CRDValueStore[O, T]) mergeHistoryEntries(ctx context.Context, obj O, hist *historyFormat[T]) error {
+	entries, err := s.listHistoryEntries(ctx)
+	if err != nil {
+		return err
+	}
+	currentRevision, _ := strconv.ParseInt(obj.GetResourceVersion(), 10, 64)
+	entries = append(entries, hist.Entries...)
+	sortHistoryEntries(entries)
+	entries = slices.CompactFunc(entries, func(a, b historyEntry[T]) bool {
+		return a.Config.GetRevision().GetRevision() == b.Config.GetRevision().GetRevision()
+	})
+	entries = slices.DeleteFunc(entries, func(entry historyEntry[T]) bool {
+		return entry.Config.GetRevision().GetRevision() >= currentRevision
+	})
+	hist.Entries = entries
+
+	// entries are only ever dropped from the start of the history, so their
+	// versions are consecutive up to the version of the current value
+	createRevision, version := objectMetadata(obj)
+	hist.CreateRevision = createRevision
+	hist.FirstVersion = 0
+	if version > int64(len(entries)) {
+		hist.FirstVersion = version - int64(len(entries))
+	}
+	return nil
+}
+
+func sortHistoryEntries[T server.ConfigType[T]](entries []historyEntry[T]) {
+	slices.SortStableFunc(entries, func(a, b historyEntry[T]) int {
+		return cmp.Compare(a.Config.GetRevision().GetRevision(), b.Config.GetRevision().GetRevision())
+	})
+}
@@ -0,0 +1,811 @@
+package crds
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kralicky/protoconfig/server"
+	"github.com/kralicky/protoconfig/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// Label of the objects of a key-value store, identifying the store they
+	// belong to.
+	KeyValueStoreLabel = "protoconfig-kv-store"
+	// Label of the objects of deleted keys.
+	TombstoneLabel = "protoconfig-kv-deleted"
+	// Annotation holding the key stored in an object.
+	KeyAnnotation = "protoconfig-kv-key"
+
+	keyHashLabel   = "protoconfig-kv-key-hash"
+	dirLabelPrefix = "protoconfig-kv-dir-"
+)
+
+// A key-value store which stores each key in a separate object of type O, in
+// the same way as a [CRDValueStore]. Objects are named after the store and
+// the key, and labeled with KeyValueStoreLabel and with each directory (the
+// prefixes of the key ending with "/") the key is in, so that keys can be
+// listed and watched by prefix using label selectors.
+//
+// The history of each key is stored in ConfigMaps owned by its object, see
+// [HistoryInConfigMaps]. Deleted keys are kept as objects labeled with
+// TombstoneLabel, retaining their history until the key is recreated.
+// Revisions are the resource versions of the objects.
+type CRDKeyValueStore[O client.Object, T server.ConfigType[T]] struct {
+	base *CRDValueStore[O, T]
+	name string
+}
+
+// Returns a key-value store for objects of type O in the namespace. The name
+// must be a valid DNS label, and identifies the objects of the store.
+//
+// The history is always stored in ConfigMaps, so [WithHistoryStorage] has no
+// effect.
+func NewCRDKeyValueStore[O client.Object, T server.ConfigType[T]](
+	namespace string,
+	name string,
+	methods ValueStoreMethods[O, T],
+	opts ...CRDValueStoreOption,
+) storage.KeyValueStoreT[T] {
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		panic(fmt.Sprintf("bug: invalid store name %q: %s", name, strings.Join(errs, ", ")))
+	}
+	options := CRDValueStoreOptions{
+		historyLimit: defaultHistoryLimit,
+	}
+	options.apply(opts...)
+	options.historyStorage = HistoryInConfigMaps
+
+	return &CRDKeyValueStore[O, T]{
+		base: newCRDValueStore(client.ObjectKey{Namespace: namespace}, methods, options),
+		name: name,
+	}
+}
+
+// Returns a value store for the object of the key.
+func (s *CRDKeyValueStore[O, T]) valueStore(key string) *CRDValueStore[O, T] {
+	vs := *s.base
+	vs.objectRef.Name = s.objectName(key)
+	return &vs
+}
+
+// Returns the name of the object storing the key. Keys which are valid DNS
+// labels are used as is, and other keys are hashed. Hashed names contain a
+// "." after the name of the store, which keys used as is cannot, so the names
+// never collide.
+func (s *CRDKeyValueStore[O, T]) objectName(key string) string {
+	if len(validation.IsDNS1123Label(key)) == 0 {
+		return s.name + "." + key
+	}
+	return s.name + "." + hashKey(key) + ".k"
+}
+
+// Sets the labels and annotations identifying the key stored in obj.
+func (s *CRDKeyValueStore[O, T]) setKeyMetadata(obj O, key string) {
+	objLabels := obj.GetLabels()
+	if objLabels == nil {
+		objLabels = map[string]string{}
+	}
+	objLabels[KeyValueStoreLabel] = s.name
+	objLabels[keyHashLabel] = hashKey(key)
+	for i := range key {
+		if key[i] == '/' {
+			objLabels[dirLabel(key[:i+1])] = "true"
+		}
+	}
+	obj.SetLabels(objLabels)
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[KeyAnnotation] = key
+	annotations[LastModifiedAnnotation] = time.Now().Format(time.RFC3339Nano)
+	obj.SetAnnotations(annotations)
+}
+
+// Returns a selector for the objects of all keys starting with prefix. Keys
+// are only labeled with their directories, so the objects it selects must
+// still be filtered by key.
+func (s *CRDKeyValueStore[O, T]) prefixSelector(prefix string) labels.Selector {
+	set := labels.Set{KeyValueStoreLabel: s.name}
+	if i := strings.LastIndexByte(prefix, '/'); i >= 0 {
+		set[dirLabel(prefix[:i+1])] = "true"
+	}
+	return labels.SelectorFromSet(set)
+}
+
+// Returns the objects of the keys starting with prefix. The tombstones of
+// deleted keys are only included if includeDeleted is set.
+func (s *CRDKeyValueStore[O, T]) listObjects(ctx context.Context, prefix string, includeDeleted bool) ([]O, error) {
+	selector := s.prefixSelector(prefix)
+	if !includeDeleted {
+		notDeleted, err := labels.NewRequirement(TombstoneLabel, selection.DoesNotExist, nil)
+		if err != nil {
+			return nil, err
+		}
+		selector = selector.Add(*notDeleted)
+	}
+	list := s.base.newEmptyObjectList()
+	if err := s.base.client.List(ctx, list,
+		client.InNamespace(s.base.objectRef.Namespace),
+		client.MatchingLabelsSelector{Selector: selector},
+	); err != nil {
+		return nil, toGrpcError(err)
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]O, 0, len(items))
+	for _, item := range items {
+		obj := item.(O)
+		if strings.HasPrefix(obj.GetAnnotations()[KeyAnnotation], prefix) {
+			objs = append(objs, obj)
+		}
+	}
+	return objs, nil
+}
+
+// Returns the current value of the key stored in obj, or a tombstone if the
+// key is deleted.
+func (s *CRDKeyValueStore[O, T]) keyRevision(obj O) *storage.KeyRevisionImpl[T] {
+	kr := &storage.KeyRevisionImpl[T]{
+		K:         obj.GetAnnotations()[KeyAnnotation],
+		Rev:       objectRevision(obj),
+		Time:      lastModifiedTime(obj),
+		Tombstone: isTombstone(obj),
+	}
+	kr.CreateRev, kr.Ver = objectMetadata(obj)
+	if !kr.Tombstone {
+		conf := s.base.newEmptyConfig()
+		s.base.methods.FillConfigFromObject(obj, conf)
+		server.UnsetRevision(conf)
+		kr.V = conf
+	}
+	return kr
+}
+
+// Returns all retained revisions of the key stored in obj, ending with its
+// current value or tombstone.
+func (s *CRDKeyValueStore[O, T]) readHistory(ctx context.Context, vs *CRDValueStore[O, T], obj O) ([]*storage.KeyRevisionImpl[T], error) {
+	entries, err := vs.listHistoryEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	current := s.keyRevision(obj)
+	revs := make([]*storage.KeyRevisionImpl[T], 0, len(entries)+1)
+	for _, entry := range entries {
+		revision := entry.Config.GetRevision()
+		if revision.GetRevision() >= current.Rev {
+			// left over from a failed update
+			continue
+		}
+		kr := &storage.KeyRevisionImpl[T]{
+			K:         current.K,
+			Rev:       revision.GetRevision(),
+			Time:      revision.GetTimestamp().AsTime(),
+			CreateRev: entry.CreateRevision,
+			Ver:       entry.Version,
+			Tombstone: entry.Tombstone,
+		}
+		if !entry.Tombstone {
+			server.UnsetRevision(entry.Config)
+			kr.V = entry.Config
+		}
+		revs = append(revs, kr)
+	}
+	return append(revs, current), nil
+}
+
+// Put implements storage.KeyValueStoreT.
+func (s *CRDKeyValueStore[O, T]) Put(ctx context.Context, key string, value T, opts ...storage.PutOpt) error {
+	putOptions := storage.PutOptions{}
+	putOptions.Apply(opts...)
+
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if putOptions.TTL != nil {
+		return status.Errorf(codes.Unimplemented, "ttls are not supported by this store")
+	}
+	if reflect.ValueOf(value).IsNil() {
+		value = s.base.newEmptyConfig()
+	}
+
+	vs := s.valueStore(key)
+	obj := vs.newEmptyObject()
+	err := vs.client.Get(ctx, vs.objectRef, obj)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return toGrpcError(err)
+	}
+	exists := err == nil
+
+	switch {
+	case exists && !isTombstone(obj):
+		if putOptions.Revision != nil && *putOptions.Revision != objectRevision(obj) {
+			if *putOptions.Revision == 0 {
+				return fmt.Errorf("%w: expected key not to exist (requested revision 0)", storage.ErrConflict)
+			}
+			return fmt.Errorf("%w: revision mismatch", storage.ErrConflict)
+		}
+		if err := vs.appendSpecToHistory(ctx, obj); err != nil {
+			return err
+		}
+	case exists:
+		if putOptions.Revision != nil && *putOptions.Revision != 0 {
+			return fmt.Errorf("%w: revision mismatch", storage.ErrConflict)
+		}
+		if err := vs.appendTombstoneToHistory(ctx, obj); err != nil {
+			return err
+		}
+		objLabels := obj.GetLabels()
+		delete(objLabels, TombstoneLabel)
+		obj.SetLabels(objLabels)
+	default:
+		if putOptions.Revision != nil && *putOptions.Revision != 0 {
+			return fmt.Errorf("%w: revision mismatch", storage.ErrConflict)
+		}
+		// entries of an object deleted outside of the store may not have been
+		// garbage collected yet
+		if err := vs.deleteHistoryEntries(ctx); err != nil {
+			return err
+		}
+	}
+
+	s.setKeyMetadata(obj, key)
+	if ref, ok := vs.methods.ControllerReference(); ok {
+		controllerutil.SetControllerReference(ref, obj, vs.client.Scheme())
+	}
+	vs.methods.FillObjectFromConfig(obj, value)
+	obj.GetObjectKind().SetGroupVersionKind(vs.gvk)
+
+	if exists {
+		err = vs.client.Update(ctx, obj, client.FieldOwner(FieldManagerName))
+	} else {
+		err = vs.client.Create(ctx, obj, client.FieldOwner(FieldManagerName))
+	}
+	if err != nil {
+		return writeError(err)
+	}
+	if putOptions.RevisionOut != nil {
+		*putOptions.RevisionOut = objectRevision(obj)
+	}
+	return nil
+}
+
+// Get implements storage.KeyValueStoreT.
+func (s *CRDKeyValueStore[O, T]) Get(ctx context.Context, key string, opts ...storage.GetOpt) (T, error) {
+	getOptions := storage.GetOptions{}
+	getOptions.Apply(opts...)
+
+	var zero T
+	if err := validateKey(key); err != nil {
+		return zero, err
+	}
+
+	vs := s.valueStore(key)
+	obj := vs.newEmptyObject()
+	if err := vs.client.Get(ctx, vs.objectRef, obj); err != nil {
+		return zero, toGrpcError(err)
+	}
+
+	latestRevision := objectRevision(obj)
+	if getOptions.Revision == nil || *getOptions.Revision == latestRevision {
+		if isTombstone(obj) {
+			return zero, storage.ErrNotFound
+		}
+		conf := vs.newEmptyConfig()
+		vs.methods.FillConfigFromObject(obj, conf)
+		server.UnsetRevision(conf)
+		if getOptions.RevisionOut != nil {
+			*getOptions.RevisionOut = latestRevision
+		}
+		return conf, nil
+	}
+
+	revs, err := s.readHistory(ctx, vs, obj)
+	if err != nil {
+		return zero, err
+	}
+	for _, kr := range revs {
+		if kr.Rev != *getOptions.Revision {
+			continue
+		}
+		if kr.Tombstone {
+			return zero, storage.ErrNotFound
+		}
+		if getOptions.RevisionOut != nil {
+			*getOptions.RevisionOut = kr.Rev
+		}
+		return kr.V, nil
+	}
+	if *getOptions.Revision > latestRevision {
+		return zero, status.Errorf(codes.OutOfRange, "revision %d is a future revision", *getOptions.Revision)
+	}
+	return zero, status.Errorf(codes.NotFound, "revision %d not found", *getOptions.Revision)
+}
+
+// Delete implements storage.KeyValueStoreT.
+//
+// Keys are deleted one at a time when deleting a prefix, so a failed delete
+// can leave some of the keys deleted.
+func (s *CRDKeyValueStore[O, T]) Delete(ctx context.Context, key string, opts ...storage.DeleteOpt) error {
+	deleteOptions := storage.DeleteOptions{}
+	deleteOptions.Apply(opts...)
+
+	if deleteOptions.Prefix {
+		if deleteOptions.Revision != nil {
+			return status.Errorf(codes.InvalidArgument, "revision cannot be used when deleting a prefix")
+		}
+		objs, err := s.listObjects(ctx, key, false)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objs {
+			err := s.delete(ctx, obj.GetAnnotations()[KeyAnnotation], nil)
+			if err != nil && !storage.IsNotFound(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	return s.delete(ctx, key, deleteOptions.Revision)
+}
+
+// Replaces the object of the key with a tombstone.
+func (s *CRDKeyValueStore[O, T]) delete(ctx context.Context, key string, revision *int64) error {
+	vs := s.valueStore(key)
+	obj := vs.newEmptyObject()
+	if err := vs.client.Get(ctx, vs.objectRef, obj); err != nil {
+		return toGrpcError(err)
+	}
+	if isTombstone(obj) {
+		return storage.ErrNotFound
+	}
+	if revision != nil && *revision != objectRevision(obj) {
+		return fmt.Errorf("%w: revision mismatch", storage.ErrConflict)
+	}
+
+	createRevision, _ := objectMetadata(obj)
+	if err := vs.appendSpecToHistory(ctx, obj); err != nil {
+		return err
+	}
+	if err := setHistoryMetadata(obj, historyMetadata{
+		CreateRevision: createRevision,
+		Tombstone:      true,
+	}); err != nil {
+		return err
+	}
+	objLabels := obj.GetLabels()
+	if objLabels == nil {
+		objLabels = map[string]string{}
+	}
+	objLabels[TombstoneLabel] = "true"
+	obj.SetLabels(objLabels)
+
+	obj.GetObjectKind().SetGroupVersionKind(vs.gvk)
+	if err := vs.client.Update(ctx, obj, client.FieldOwner(FieldManagerName)); err != nil {
+		return writeError(err)
+	}
+	return nil
+}
+
+// ListKeys implements storage.KeyValueStoreT.
+func (s *CRDKeyValueStore[O, T]) ListKeys(ctx context.Context, prefix string, opts ...storage.ListOpt) ([]string, error) {
+	listOptions := storage.ListKeysOptions{}
+	listOptions.Apply(opts...)
+
+	objs, err := s.listObjects(ctx, prefix, listOptions.IncludeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		keys = append(keys, obj.GetAnnotations()[KeyAnnotation])
+	}
+	slices.Sort(keys)
+	if listOptions.Limit != nil && int64(len(keys)) > *listOptions.Limit {
+		keys = keys[:*listOptions.Limit]
+	}
+	return keys, nil
+}
+
+// History implements storage.KeyValueStoreT.
+func (s *CRDKeyValueStore[O, T]) History(ctx context.Context, key string, opts ...storage.HistoryOpt) ([]storage.KeyRevision[T], error) {
+	historyOptions := storage.HistoryOptions{}
+	historyOptions.Apply(opts...)
+
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+
+	vs := s.valueStore(key)
+	obj := vs.newEmptyObject()
+	if err := vs.client.Get(ctx, vs.objectRef, obj); err != nil {
+		return nil, toGrpcError(err)
+	}
+	revs, err := s.readHistory(ctx, vs, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	last := len(revs) - 1
+	if historyOptions.Revision != nil {
+		for last >= 0 && revs[last].Rev > *historyOptions.Revision {
+			last--
+		}
+		// older revisions were discarded, unless the oldest entry is the
+		// creation of the key
+		if last < 0 && revs[0].CreateRev != revs[0].Rev {
+			return nil, storage.ErrCompacted
+		}
+	}
+	if last < 0 || (revs[last].Tombstone && !historyOptions.IncludeDeleted) {
+		return nil, storage.ErrNotFound
+	}
+	first := last
+	if historyOptions.IncludeDeleted {
+		first = 0
+	}
+	for first > 0 && !revs[first-1].Tombstone {
+		first--
+	}
+
+	var zero T
+	entries := make([]storage.KeyRevision[T], 0, last-first+1)
+	for _, kr := range revs[first : last+1] {
+		if !historyOptions.IncludeValues {
+			kr.V = zero
+		}
+		entries = append(entries, kr)
+	}
+	return entries, nil
+}
+
+// Watch implements storage.KeyValueStoreT.
+//
+// Each watch runs an informer for the objects of the watched keys, holding
+// them in memory until the watch ends. Changes made while the informer is
+// disconnected from the api server may be coalesced into a single event.
+// Bookmarks are not sent.
+func (s *CRDKeyValueStore[O, T]) Watch(ctx context.Context, key string, opts ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error) {
+	watchOptions := storage.WatchOptions{}
+	watchOptions.Apply(opts...)
+
+	informerCtx, cancel := context.WithCancel(ctx)
+	w := &crdKeyValueWatch[O, T]{
+		store:   s,
+		ctx:     informerCtx,
+		options: watchOptions,
+	}
+	var selector labels.Selector
+	if watchOptions.Prefix {
+		selector = s.prefixSelector(key)
+		w.matchesKey = func(k string) bool {
+			return strings.HasPrefix(k, key)
+		}
+	} else {
+		if err := validateKey(key); err != nil {
+			cancel()
+			return nil, err
+		}
+		selector = labels.SelectorFromSet(labels.Set{
+			KeyValueStoreLabel: s.name,
+			keyHashLabel:       hashKey(key),
+		})
+		w.matchesKey = func(k string) bool {
+			return k == key
+		}
+	}
+
+	listOptions := func(options metav1.ListOptions) *client.ListOptions {
+		return &client.ListOptions{
+			Namespace:     s.base.objectRef.Namespace,
+			LabelSelector: selector,
+			Raw:           &options,
+		}
+	}
+	// the watch is only returned once the informer is watching, so that no
+	// changes made after it is returned are missed
+	var watching atomic.Bool
+	informer := cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			list := s.base.newEmptyObjectList()
+			if err := s.base.client.List(informerCtx, list, listOptions(options)); err != nil {
+				return nil, err
+			}
+			return list, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			watcher, err := s.base.client.Watch(informerCtx, s.base.newEmptyObjectList(), listOptions(options))
+			if err != nil {
+				return nil, err
+			}
+			watching.Store(true)
+			return watcher, nil
+		},
+	}, s.base.newEmptyObject(), 0, cache.Indexers{})
+
+	// errors before the informer has synced fail the watch; the informer
+	// recovers from later errors by itself
+	errC := make(chan error, 1)
+	if err := informer.SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
+		select {
+		case errC <- err:
+		default:
+		}
+	}); err != nil {
+		cancel()
+		return nil, err
+	}
+	registration, err := informer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc:    w.onAdd,
+		UpdateFunc: w.onUpdate,
+		DeleteFunc: w.onDelete,
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go informer.Run(informerCtx.Done())
+
+	synced := make(chan struct{})
+	go func() {
+		if cache.WaitForCacheSync(informerCtx.Done(), registration.HasSynced, watching.Load) {
+			close(synced)
+		}
+	}()
+	select {
+	case <-synced:
+	case err := <-errC:
+		cancel()
+		return nil, watchError(err)
+	case <-ctx.Done():
+		cancel()
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		cancel()
+		return nil, w.err
+	}
+	slices.SortStableFunc(w.replayed, func(a, b storage.WatchEvent[storage.KeyRevision[T]]) int {
+		return cmp.Compare(a.Revision, b.Revision)
+	})
+	queue, eventC := storage.NewWatchQueue(ctx, watchOptions.OverflowPolicy, append(w.replayed, w.pending...)...)
+	if w.compacted {
+		queue.Terminate(storage.ErrCompacted)
+	}
+	w.queue = queue
+	w.replayed, w.pending = nil, nil
+	go func() {
+		<-queue.Done()
+		cancel()
+	}()
+	return eventC, nil
+}
+
+// Converts the events of the informer of a watch into watch events.
+type crdKeyValueWatch[O client.Object, T server.ConfigType[T]] struct {
+	store      *CRDKeyValueStore[O, T]
+	ctx        context.Context
+	options    storage.WatchOptions
+	matchesKey func(string) bool
+
+	mu sync.Mutex
+	// nil until the informer has synced; until then, events are buffered
+	queue *storage.WatchQueue[T]
+	// events replayed from the history of the initial objects
+	replayed []storage.WatchEvent[storage.KeyRevision[T]]
+	// events received after the initial objects
+	pending   []storage.WatchEvent[storage.KeyRevision[T]]
+	compacted bool
+	err       error
+}
+
+func (w *crdKeyValueWatch[O, T]) send(ev storage.WatchEvent[storage.KeyRevision[T]]) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.queue == nil {
+		w.pending = append(w.pending, ev)
+		return
+	}
+	w.queue.Send(ev)
+}
+
+// Returns the object of an informer event if it stores a watched key.
+func (w *crdKeyValueWatch[O, T]) watchedObject(obj any) (O, bool) {
+	if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = unknown.Obj
+	}
+	o, ok := obj.(O)
+	if !ok {
+		return o, false
+	}
+	key, ok := o.GetAnnotations()[KeyAnnotation]
+	return o, ok && w.matchesKey(key)
+}
+
+func (w *crdKeyValueWatch[O, T]) onAdd(obj any, isInInitialList bool) {
+	o, ok := w.watchedObject(obj)
+	if !ok {
+		return
+	}
+	if isInInitialList {
+		if w.options.Revision != nil {
+			w.replay(o)
+		}
+		return
+	}
+	if isTombstone(o) {
+		return
+	}
+	current := w.store.keyRevision(o)
+	w.send(storage.WatchEvent[storage.KeyRevision[T]]{
+		EventType: storage.WatchEventPut,
+		Current:   current,
+		Revision:  current.Rev,
+	})
+}
+
+func (w *crdKeyValueWatch[O, T]) onUpdate(oldObj, newObj any) {
+	old, ok := w.watchedObject(oldObj)
+	if !ok {
+		return
+	}
+	o, ok := w.watchedObject(newObj)
+	if !ok || old.GetResourceVersion() == o.GetResourceVersion() {
+		return
+	}
+	previous := w.store.keyRevision(old)
+	current := w.store.keyRevision(o)
+	switch {
+	case previous.Tombstone && current.Tombstone:
+	case current.Tombstone:
+		w.send(storage.WatchEvent[storage.KeyRevision[T]]{
+			EventType: storage.WatchEventDelete,
+			Previous:  previous,
+			Revision:  current.Rev,
+		})
+	case previous.Tombstone:
+		w.send(storage.WatchEvent[storage.KeyRevision[T]]{
+			EventType: storage.WatchEventPut,
+			Current:   current,
+			Revision:  current.Rev,
+		})
+	default:
+		w.send(storage.WatchEvent[storage.KeyRevision[T]]{
+			EventType: storage.WatchEventPut,
+			Current:   current,
+			Previous:  previous,
+			Revision:  current.Rev,
+		})
+	}
+}
+
+// Objects are only removed when they are deleted outside of the store, e.g.
+// along with their namespace; the revision of the deletion is not known.
+func (w *crdKeyValueWatch[O, T]) onDelete(obj any) {
+	o, ok := w.watchedObject(obj)
+	if !ok || isTombstone(o) {
+		return
+	}
+	w.send(storage.WatchEvent[storage.KeyRevision[T]]{
+		EventType: storage.WatchEventDelete,
+		Previous:  w.store.keyRevision(o),
+	})
+}
+
+// Replays the events of the initial object o starting at the requested
+// revision. Revision 0 starts at the creation of the current value.
+func (w *crdKeyValueWatch[O, T]) replay(o O) {
+	vs := w.store.valueStore(o.GetAnnotations()[KeyAnnotation])
+	revs, err := w.store.readHistory(w.ctx, vs, o)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		w.err = err
+		return
+	}
+	start := *w.options.Revision
+	if start == 0 {
+		current := revs[len(revs)-1]
+		if current.Tombstone {
+			return
+		}
+		start = current.CreateRev
+	}
+	if start > 0 && revs[0].Rev > start && revs[0].CreateRev != revs[0].Rev {
+		w.compacted = true
+	}
+	for i, kr := range revs {
+		if kr.Rev < start {
+			continue
+		}
+		var previous storage.KeyRevision[T]
+		if i > 0 && !revs[i-1].Tombstone {
+			previous = vs.cloneKeyRevision(revs[i-1])
+		}
+		if kr.Tombstone {
+			w.replayed = append(w.replayed, storage.WatchEvent[storage.KeyRevision[T]]{
+				EventType: storage.WatchEventDelete,
+				Previous:  previous,
+				Revision:  kr.Rev,
+			})
+			continue
+		}
+		w.replayed = append(w.replayed, storage.WatchEvent[storage.KeyRevision[T]]{
+			EventType: storage.WatchEventPut,
+			Current:   vs.cloneKeyRevision(kr),
+			Previous:  previous,
+			Revision:  kr.Rev,
+		})
+	}
+}
+
+func isTombstone(obj client.Object) bool {
+	_, ok := obj.GetLabels()[TombstoneLabel]
+	return ok
+}
+
+func objectRevision(obj client.Object) int64 {
+	revision, _ := strconv.ParseInt(obj.GetResourceVersion(), 10, 64)
+	return revision
+}
+
+// Returns a hash of the key which can be used in label keys and values.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+func dirLabel(dir string) string {
+	return dirLabelPrefix + hashKey(dir)
+}
+
+func validateKey(key string) error {
+	if key == "" {
+		return status.Errorf(codes.InvalidArgument, "key cannot be empty")
+	}
+	return nil
+}
+
+// Converts an error from a write to an object into a grpc error. Writes
+// racing with another write to the same key are reported as conflicts.
+func writeError(err error) error {
+	if k8serrors.IsConflict(err) || k8serrors.IsAlreadyExists(err) {
+		return fmt.Errorf("%w: %s", storage.ErrConflict, err.Error())
+	}
+	return toGrpcError(err)
+}
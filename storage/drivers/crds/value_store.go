@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"slices"
 	"strconv"
 	"time"
 
@@ -13,16 +14,18 @@ import (
 	"github.com/kralicky/protoconfig/server"
 	"github.com/kralicky/protoconfig/storage"
 	"github.com/kralicky/protoconfig/util"
-	"github.com/kralicky/protoconfig/util/k8sutil"
 	"github.com/samber/lo"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
+	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/watch"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
@@ -47,7 +50,9 @@ type CRDValueStore[O client.Object, T server.ConfigType[T]] struct {
 }
 
 type CRDValueStoreOptions struct {
-	client client.WithWatch
+	client         client.WithWatch
+	historyStorage HistoryStorage
+	historyLimit   int
 }
 
 type CRDValueStoreOption func(*CRDValueStoreOptions)
@@ -64,17 +69,58 @@ func WithClient(client client.WithWatch) CRDValueStoreOption {
 	}
 }
 
+// Sets where the history of the object is stored. Defaults to
+// [HistoryInAnnotation].
+func WithHistoryStorage(storage HistoryStorage) CRDValueStoreOption {
+	return func(o *CRDValueStoreOptions) {
+		o.historyStorage = storage
+	}
+}
+
+// Sets the maximum number of previous revisions retained in the history of
+// the object. Older revisions are discarded when the object is updated.
+// Defaults to 64.
+func WithHistoryLimit(limit int) CRDValueStoreOption {
+	if limit <= 0 {
+		panic(fmt.Sprintf("bug: invalid history limit %d", limit))
+	}
+	return func(o *CRDValueStoreOptions) {
+		o.historyLimit = limit
+	}
+}
+
+// Returns a client for the cluster configured in the environment (in-cluster
+// config or kubeconfig), using the default client-go scheme. Stores for custom
+// object types should be given a client with a matching scheme using
+// [WithClient] instead.
+func newDefaultClient() (client.WithWatch, error) {
+	restConfig, err := config.GetConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubernetes client config: %w", err)
+	}
+	return client.NewWithWatch(restConfig, client.Options{})
+}
+
 func NewCRDValueStore[O client.Object, T server.ConfigType[T]](
 	objectRef client.ObjectKey,
 	methods ValueStoreMethods[O, T],
 	opts ...CRDValueStoreOption,
 ) storage.ValueStoreT[T] {
-	options := CRDValueStoreOptions{}
+	options := CRDValueStoreOptions{
+		historyLimit: defaultHistoryLimit,
+	}
 	options.apply(opts...)
+	return newCRDValueStore(objectRef, methods, options)
+}
 
+func newCRDValueStore[O client.Object, T server.ConfigType[T]](
+	objectRef client.ObjectKey,
+	methods ValueStoreMethods[O, T],
+	options CRDValueStoreOptions,
+) *CRDValueStore[O, T] {
 	if options.client == nil {
 		var err error
-		options.client, err = k8sutil.NewK8sClient(k8sutil.ClientOptions{})
+		options.client, err = newDefaultClient()
 		if err != nil {
 			panic(err)
 		}
@@ -98,6 +144,11 @@ func NewCRDValueStore[O client.Object, T server.ConfigType[T]](
 	if !ok {
 		panic(fmt.Sprintf("bug: no list type for %T available in scheme", obj))
 	}
+	if options.historyStorage == HistoryInConfigMaps {
+		if _, _, err := options.client.Scheme().ObjectKinds(&corev1.ConfigMap{}); err != nil {
+			panic(fmt.Sprintf("bug: ConfigMaps must be available in the client scheme to store history in them: %v", err))
+		}
+	}
 
 	return &CRDValueStore[O, T]{
 		objectRef:            objectRef,
@@ -137,6 +188,9 @@ func (s *CRDValueStore[O, T]) Put(ctx context.Context, value T, opts ...storage.
 
 	putOptions := storage.PutOptions{}
 	putOptions.Apply(opts...)
+	if putOptions.TTL != nil {
+		return status.Errorf(codes.Unimplemented, "ttls are not supported by this store")
+	}
 
 	obj := s.newEmptyObject()
 	err := s.client.Get(ctx, s.objectRef, obj)
@@ -150,7 +204,15 @@ func (s *CRDValueStore[O, T]) Put(ctx context.Context, value T, opts ...storage.
 	}
 
 	if exists {
-		s.appendSpecToHistory(obj)
+		if err := s.appendSpecToHistory(ctx, obj); err != nil {
+			return err
+		}
+	} else if s.historyStorage == HistoryInConfigMaps {
+		// entries of a previous object with the same name may not have been
+		// garbage collected yet
+		if err := s.deleteHistoryEntries(ctx); err != nil {
+			return err
+		}
 	}
 
 	if ref, ok := s.methods.ControllerReference(); ok {
@@ -202,10 +264,10 @@ func (s *CRDValueStore[O, T]) Get(ctx context.Context, opts ...storage.GetOpt) (
 	var confRevision int64
 	if getOpts.Revision != nil && *getOpts.Revision != latestRevision {
 		var history historyFormat[T]
-		if str, ok := obj.GetAnnotations()[HistoryAnnotation]; ok {
-			// not using readHistory here because the previous check for the
-			// latest revision is quicker, and we aren't returning the history
-			decodeHistory(str, &history)
+		// not using readHistory here because the previous check for the
+		// latest revision is quicker, and we aren't returning the history
+		if err := s.readPastHistory(ctx, obj, &history); err != nil {
+			return zero, err
 		}
 		found := false
 		for _, entry := range history.Entries {
@@ -250,6 +312,9 @@ func (s *CRDValueStore[O, T]) Watch(ctx context.Context, opts ...storage.WatchOp
 		Namespace:     s.objectRef.Namespace,
 		FieldSelector: fields.OneTermEqualSelector("metadata.name", s.objectRef.Name),
 	}
+	if watchOpts.Bookmarks {
+		listOpts.Raw = &metav1.ListOptions{AllowWatchBookmarks: true}
+	}
 	var latestVersion string
 	{
 		obj := s.newEmptyObject()
@@ -261,12 +326,30 @@ func (s *CRDValueStore[O, T]) Watch(ctx context.Context, opts ...storage.WatchOp
 		return nil, toGrpcError(err)
 	}
 
-	eventC := make(chan storage.WatchEvent[storage.KeyRevision[T]], 64)
+	queue, eventC := storage.NewWatchQueue[T](ctx, watchOpts.OverflowPolicy)
 	go func() {
-		defer func() {
-			watcher.Stop()
-			close(eventC)
-		}()
+		defer watcher.Stop()
+
+		// handles bookmark and error events, and reports whether the watch
+		// should continue
+		handleControlEvent := func(res watch.Event) bool {
+			switch res.Type {
+			case watch.Bookmark:
+				if watchOpts.Bookmarks {
+					if obj, ok := res.Object.(client.Object); ok {
+						revision, _ := strconv.ParseInt(obj.GetResourceVersion(), 10, 64)
+						queue.Send(storage.WatchEvent[storage.KeyRevision[T]]{
+							EventType: storage.WatchEventBookmark,
+							Revision:  revision,
+						})
+					}
+				}
+			case watch.Error:
+				queue.Terminate(watchError(k8serrors.FromObject(res.Object)))
+				return false
+			}
+			return true
+		}
 
 		rc := watcher.ResultChan()
 		var previous *storage.KeyRevisionImpl[T]
@@ -274,8 +357,11 @@ func (s *CRDValueStore[O, T]) Watch(ctx context.Context, opts ...storage.WatchOp
 		select {
 		case <-ctx.Done():
 			return
+		case <-queue.Done():
+			return
 		case res, ok := <-rc:
 			if !ok {
+				queue.Terminate(status.Errorf(codes.Unavailable, "watch closed unexpectedly"))
 				return
 			}
 			var eventType storage.WatchEventType
@@ -285,6 +371,9 @@ func (s *CRDValueStore[O, T]) Watch(ctx context.Context, opts ...storage.WatchOp
 			case watch.Deleted:
 				eventType = storage.WatchEventDelete
 			default:
+				if !handleControlEvent(res) {
+					return
+				}
 				break INITIAL
 			}
 			obj := res.Object.DeepCopyObject().(O)
@@ -292,24 +381,20 @@ func (s *CRDValueStore[O, T]) Watch(ctx context.Context, opts ...storage.WatchOp
 
 			if watchOpts.Revision != nil {
 				var history historyFormat[T]
-				s.readHistory(obj, &history)
-				for _, entry := range history.Entries {
-					rev := entry.Config.GetRevision()
-					if rev.GetRevision() == currentRevision {
+				s.readHistory(ctx, obj, &history)
+				for i := range history.Entries {
+					if history.Entries[i].Config.GetRevision().GetRevision() == currentRevision {
 						break
 					}
-					server.UnsetRevision(entry.Config)
-					kr := &storage.KeyRevisionImpl[T]{
-						V:    entry.Config,
-						Rev:  rev.GetRevision(),
-						Time: rev.GetTimestamp().AsTime(),
-					}
-					if rev.Revision != nil && *rev.Revision >= *watchOpts.Revision && *rev.Revision < currentRevision {
-						eventC <- storage.WatchEvent[storage.KeyRevision[T]]{
+					kr := history.keyRevision(i, true)
+					// revision 0 indicates that the first event should be the current value
+					if *watchOpts.Revision > 0 && kr.Rev >= *watchOpts.Revision && kr.Rev < currentRevision {
+						queue.Send(storage.WatchEvent[storage.KeyRevision[T]]{
 							EventType: eventType,
 							Current:   s.cloneKeyRevision(kr),
 							Previous:  s.cloneKeyRevision(previous),
-						}
+							Revision:  kr.Rev,
+						})
 					}
 					previous = kr
 				}
@@ -322,17 +407,19 @@ func (s *CRDValueStore[O, T]) Watch(ctx context.Context, opts ...storage.WatchOp
 				V:   conf,
 				Rev: currentRevision,
 			}
+			current.CreateRev, current.Ver = objectMetadata(obj)
 			currentEvent := storage.WatchEvent[storage.KeyRevision[T]]{
 				EventType: eventType,
 				Current:   s.cloneKeyRevision(current),
 				Previous:  s.cloneKeyRevision(previous),
+				Revision:  currentRevision,
 			}
 			// we only want to send the current revision in the following cases:
 			// 1. The revision option is set
 			// 2. The revision option is not set, but the object was created after
 			//    the watch started
 			if watchOpts.Revision != nil || obj.GetResourceVersion() != latestVersion {
-				eventC <- currentEvent
+				queue.Send(currentEvent)
 			}
 			previous = current
 		}
@@ -340,10 +427,21 @@ func (s *CRDValueStore[O, T]) Watch(ctx context.Context, opts ...storage.WatchOp
 			select {
 			case <-ctx.Done():
 				return
+			case <-queue.Done():
+				return
 			case res, ok := <-rc:
 				if !ok {
+					if ctx.Err() == nil {
+						queue.Terminate(status.Errorf(codes.Unavailable, "watch closed unexpectedly"))
+					}
 					return
 				}
+				if res.Type != watch.Added && res.Type != watch.Modified && res.Type != watch.Deleted {
+					if !handleControlEvent(res) {
+						return
+					}
+					continue
+				}
 				var ev storage.WatchEvent[storage.KeyRevision[T]]
 				obj := res.Object.DeepCopyObject().(O)
 				conf := s.newEmptyConfig()
@@ -354,10 +452,12 @@ func (s *CRDValueStore[O, T]) Watch(ctx context.Context, opts ...storage.WatchOp
 				switch res.Type {
 				case watch.Added, watch.Modified:
 					ev.EventType = storage.WatchEventPut
+					ev.Revision = revisionNumber
 					current := &storage.KeyRevisionImpl[T]{
 						Rev: revisionNumber,
 						V:   conf,
 					}
+					current.CreateRev, current.Ver = objectMetadata(obj)
 					ev.Current = s.cloneKeyRevision(current)
 					if previous != nil {
 						ev.Previous = s.cloneKeyRevision(previous)
@@ -371,15 +471,22 @@ func (s *CRDValueStore[O, T]) Watch(ctx context.Context, opts ...storage.WatchOp
 					} else {
 						previousRevision = previous.Revision()
 					}
-					ev.Previous = &storage.KeyRevisionImpl[T]{
+					prev := &storage.KeyRevisionImpl[T]{
 						Rev: previousRevision,
 						V:   util.ProtoClone(conf),
 					}
+					prev.CreateRev, prev.Ver = objectMetadata(obj)
+					ev.Previous = prev
+					// some implementations report the last revision of the object
+					// instead of the revision of the delete itself
+					if revisionNumber > previousRevision {
+						ev.Revision = revisionNumber
+					}
 					previous = nil
 				default:
 					continue
 				}
-				eventC <- ev
+				queue.Send(ev)
 			}
 		}
 	}()
@@ -387,6 +494,16 @@ func (s *CRDValueStore[O, T]) Watch(ctx context.Context, opts ...storage.WatchOp
 	return eventC, nil
 }
 
+// Converts an error received from a watch into a grpc error. The api server
+// reports that the requested resource version is too old with a 410 Gone
+// status, which is equivalent to a compacted revision.
+func watchError(err error) error {
+	if k8serrors.IsGone(err) || k8serrors.IsResourceExpired(err) {
+		return fmt.Errorf("%w: %s", storage.ErrCompacted, err.Error())
+	}
+	return toGrpcError(err)
+}
+
 func (s *CRDValueStore[O, T]) cloneKeyRevision(kr *storage.KeyRevisionImpl[T]) storage.KeyRevision[T] {
 	if kr == nil {
 		// it is important that the return value is the interface type, otherwise
@@ -394,9 +511,11 @@ func (s *CRDValueStore[O, T]) cloneKeyRevision(kr *storage.KeyRevisionImpl[T]) s
 		return nil
 	}
 	rev := &storage.KeyRevisionImpl[T]{
-		K:    kr.K,
-		Rev:  kr.Rev,
-		Time: kr.Time,
+		K:         kr.K,
+		Rev:       kr.Rev,
+		Time:      kr.Time,
+		CreateRev: kr.CreateRev,
+		Ver:       kr.Ver,
 	}
 	if kr.V.ProtoReflect().IsValid() {
 		rev.V = util.ProtoClone(kr.V)
@@ -443,6 +562,11 @@ func (s *CRDValueStore[O, T]) Delete(ctx context.Context, opts ...storage.Delete
 	if err != nil {
 		return toGrpcError(err)
 	}
+	if s.historyStorage == HistoryInConfigMaps {
+		// the entries are owned by the object and will be garbage collected;
+		// deleting them here is only an optimization, so errors are ignored
+		s.deleteHistoryEntries(ctx)
+	}
 	return nil
 }
 
@@ -455,24 +579,32 @@ func (s *CRDValueStore[O, T]) History(ctx context.Context, opts ...storage.Histo
 	err := s.client.Get(ctx, s.objectRef, obj)
 	if err != nil {
 		if k8serrors.IsNotFound(err) && historyOpts.Revision != nil {
-			return nil, status.Errorf(codes.Unimplemented, "this storage backend does not support tracking history for deleted objects")
+			// the history is stored in the object, and was deleted with it
+			return nil, storage.ErrCompacted
 		}
 		return nil, toGrpcError(err)
 	}
 
-	s.readHistory(obj, &history)
+	if err := s.readHistory(ctx, obj, &history); err != nil {
+		return nil, err
+	}
 
-	entries := make([]storage.KeyRevision[T], 0, len(history.Entries))
-	for _, entry := range history.Entries {
-		revision := entry.Config.GetRevision()
-		server.UnsetRevision(entry.Config)
-		rev := &storage.KeyRevisionImpl[T]{
-			Rev:  revision.GetRevision(),
-			Time: revision.GetTimestamp().AsTime(),
-		}
-		if historyOpts.IncludeValues {
-			rev.V = entry.Config
+	if historyOpts.Revision != nil && !slices.ContainsFunc(history.Entries, func(entry historyEntry[T]) bool {
+		return entry.Config.GetRevision().GetRevision() == *historyOpts.Revision
+	}) {
+		// Revisions older than the oldest entry were either truncated from the
+		// history, or belong to a previous incarnation of the object.
+		if len(history.Entries) > 0 && *historyOpts.Revision < history.Entries[0].Config.GetRevision().GetRevision() {
+			return nil, storage.ErrCompacted
 		}
+		return nil, storage.ErrNotFound
+	}
+
+	// deleted objects are not retained, so the history never includes
+	// tombstones
+	entries := make([]storage.KeyRevision[T], 0, len(history.Entries))
+	for i := range history.Entries {
+		rev := history.keyRevision(i, historyOpts.IncludeValues)
 		entries = append(entries, rev)
 		if historyOpts.Revision != nil && rev.Rev == *historyOpts.Revision {
 			break
@@ -483,12 +615,82 @@ func (s *CRDValueStore[O, T]) History(ctx context.Context, opts ...storage.Histo
 
 type historyFormat[T server.ConfigType[T]] struct {
 	Entries []historyEntry[T] `json:"entries"`
+	// The revision at which the object was created.
+	CreateRevision int64 `json:"createRevision,omitempty"`
+	// The version of the first entry. The versions of the following entries
+	// are consecutive.
+	FirstVersion int64 `json:"firstVersion,omitempty"`
+}
+
+// Returns entry i as a key revision, unsetting the revision of its config.
+// The creation revision and version are 0 for histories written before they
+// were recorded.
+func (h *historyFormat[T]) keyRevision(i int, includeValue bool) *storage.KeyRevisionImpl[T] {
+	conf := h.Entries[i].Config
+	kr := &storage.KeyRevisionImpl[T]{
+		Rev:       conf.GetRevision().GetRevision(),
+		Time:      conf.GetRevision().GetTimestamp().AsTime(),
+		CreateRev: h.CreateRevision,
+	}
+	if h.FirstVersion > 0 {
+		kr.Ver = h.FirstVersion + int64(i)
+	}
+	server.UnsetRevision(conf)
+	if includeValue {
+		kr.V = conf
+	}
+	return kr
+}
+
+// Drops the first n entries.
+func (h *historyFormat[T]) truncate(n int) {
+	h.Entries = h.Entries[n:]
+	if h.FirstVersion > 0 {
+		h.FirstVersion += int64(n)
+	}
+}
+
+// Returns the creation revision and version of the current value of the
+// object from its history metadata or annotation, without decoding the
+// entries. Both are 0 if they were not recorded.
+func objectMetadata(obj client.Object) (createRevision, version int64) {
+	if str, ok := obj.GetAnnotations()[HistoryMetadataAnnotation]; ok {
+		var metadata historyMetadata
+		if json.Unmarshal([]byte(str), &metadata) != nil {
+			return 0, 0
+		}
+		return metadata.CreateRevision, metadata.Version
+	}
+	str, ok := obj.GetAnnotations()[HistoryAnnotation]
+	if !ok {
+		// the object has not been updated since it was created
+		revision, _ := strconv.ParseInt(obj.GetResourceVersion(), 10, 64)
+		return revision, 1
+	}
+	var history struct {
+		Entries        []json.RawMessage `json:"entries"`
+		CreateRevision int64             `json:"createRevision"`
+		FirstVersion   int64             `json:"firstVersion"`
+	}
+	if len(str) == 0 || str[0] != '{' || json.Unmarshal([]byte(str), &history) != nil {
+		return 0, 0
+	}
+	if history.FirstVersion == 0 {
+		return history.CreateRevision, 0
+	}
+	return history.CreateRevision, history.FirstVersion + int64(len(history.Entries))
 }
 
 type historyEntry[T server.ConfigType[T]] struct {
 	Wire   []byte `json:"wire,omitempty"`
 	Wirev2 []byte `json:"wirev2"`
 	Config T      `json:"-"`
+
+	// Only recorded for entries stored in ConfigMaps. The creation revision
+	// and version are 0 for entries written before they were recorded.
+	CreateRevision int64 `json:"-"`
+	Version        int64 `json:"-"`
+	Tombstone      bool  `json:"-"`
 }
 
 func (e *historyEntry[T]) MarshalJSON() ([]byte, error) {
@@ -528,7 +730,10 @@ func (e *historyEntry[T]) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-func (s *CRDValueStore[O, T]) appendSpecToHistory(obj O) error {
+func (s *CRDValueStore[O, T]) appendSpecToHistory(ctx context.Context, obj O) error {
+	if s.historyStorage == HistoryInConfigMaps {
+		return s.appendSpecToHistoryConfigMaps(ctx, obj)
+	}
 	conf := s.newEmptyConfig()
 	s.methods.FillConfigFromObject(obj, conf)
 
@@ -537,28 +742,24 @@ func (s *CRDValueStore[O, T]) appendSpecToHistory(obj O) error {
 	if annotations == nil {
 		annotations = map[string]string{}
 	}
+	revisionNumber, revisionErr := strconv.ParseInt(obj.GetResourceVersion(), 10, 64)
 	if str, ok := annotations[HistoryAnnotation]; ok {
 		decodeHistory(str, &history)
 	} else {
+		// this is the first update since the object was created
 		history.Entries = []historyEntry[T]{}
+		history.CreateRevision = revisionNumber
+		history.FirstVersion = 1
 	}
-	var lastModifiedTime time.Time
-
-	if lastModified, ok := annotations[LastModifiedAnnotation]; ok {
-		lastModifiedTime, _ = time.Parse(time.RFC3339Nano, lastModified)
-	} else {
-		lastModifiedTime = obj.GetCreationTimestamp().Time
+	if revisionErr == nil {
+		server.SetRevision(conf, revisionNumber, lastModifiedTime(obj))
 	}
 	annotations[LastModifiedAnnotation] = time.Now().Format(time.RFC3339Nano)
-	if revisionNumber, err := strconv.ParseInt(obj.GetResourceVersion(), 10, 64); err == nil {
-		server.SetRevision(conf, revisionNumber, lastModifiedTime)
-	}
 	history.Entries = append(history.Entries, historyEntry[T]{
 		Config: conf,
 	})
-	// keep only the newest 64 entries
-	if len(history.Entries) > 64 {
-		history.Entries = history.Entries[len(history.Entries)-64:]
+	if len(history.Entries) > s.historyLimit {
+		history.truncate(len(history.Entries) - s.historyLimit)
 	}
 
 	numEntries := len(history.Entries)
@@ -576,25 +777,17 @@ func (s *CRDValueStore[O, T]) appendSpecToHistory(obj O) error {
 	return nil
 }
 
-func (s *CRDValueStore[O, T]) readHistory(obj O, hist *historyFormat[T]) error {
-	annotations := obj.GetAnnotations()
-	if str, ok := annotations[HistoryAnnotation]; ok {
-		decodeHistory(str, hist)
-	} else {
-		hist.Entries = []historyEntry[T]{}
+// Reads the history of obj, including its current value as the last entry.
+func (s *CRDValueStore[O, T]) readHistory(ctx context.Context, obj O, hist *historyFormat[T]) error {
+	if err := s.readPastHistory(ctx, obj, hist); err != nil {
+		return err
 	}
 	conf := s.newEmptyConfig()
 	s.methods.FillConfigFromObject(obj, conf)
 
 	// fill in the revision of the current object
 	revisionNumber, _ := strconv.ParseInt(obj.GetResourceVersion(), 10, 64)
-	var lastModifiedTime time.Time
-	if lastModified, ok := annotations[LastModifiedAnnotation]; ok {
-		lastModifiedTime, _ = time.Parse(time.RFC3339Nano, lastModified)
-	} else {
-		lastModifiedTime = obj.GetCreationTimestamp().Time
-	}
-	server.SetRevision(conf, revisionNumber, lastModifiedTime)
+	server.SetRevision(conf, revisionNumber, lastModifiedTime(obj))
 
 	hist.Entries = append(hist.Entries, historyEntry[T]{
 		Config: conf,
@@ -602,7 +795,33 @@ func (s *CRDValueStore[O, T]) readHistory(obj O, hist *historyFormat[T]) error {
 	return nil
 }
 
+// Reads the history of obj, excluding its current value.
+func (s *CRDValueStore[O, T]) readPastHistory(ctx context.Context, obj O, hist *historyFormat[T]) error {
+	if str, ok := obj.GetAnnotations()[HistoryAnnotation]; ok {
+		decodeHistory(str, hist)
+	} else {
+		hist.Entries = []historyEntry[T]{}
+		hist.CreateRevision, hist.FirstVersion = objectMetadata(obj)
+	}
+	if s.historyStorage == HistoryInConfigMaps {
+		return s.mergeHistoryEntries(ctx, obj, hist)
+	}
+	return nil
+}
+
+// Returns the time at which the current value of obj was written.
+func lastModifiedTime(obj client.Object) time.Time {
+	if lastModified, ok := obj.GetAnnotations()[LastModifiedAnnotation]; ok {
+		t, _ := time.Parse(time.RFC3339Nano, lastModified)
+		return t
+	}
+	return obj.GetCreationTimestamp().Time
+}
+
 func decodeHistory[T server.ConfigType[T]](str string, hist *historyFormat[T]) error {
+	if str == "" {
+		return nil
+	}
 	if str[0] != '{' {
 		// v1
 		b64, err := base64.StdEncoding.DecodeString(str)
@@ -647,7 +866,7 @@ func encodeHistory[T server.ConfigType[T]](history *historyFormat[T]) (string, i
 	for i := len(history.Entries) - 1; i >= 0; i-- {
 		size += base64.StdEncoding.EncodedLen(snappy.MaxEncodedLen(len(`{"wire":""},`) + len(history.Entries[i].Wire)))
 		if size > maxAnnotationSize {
-			history.Entries = history.Entries[i+1:]
+			history.truncate(i + 1)
 			break
 		}
 	}
@@ -0,0 +1,140 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kralicky/protoconfig/storage"
+)
+
+type keyValueStoreBroker struct {
+	client *clientv3.Client
+	prefix string
+}
+
+// Returns a broker which stores the keys of each namespace under
+// prefix/namespace, using stores created with [NewKeyValueStore].
+//
+// The broker implements [storage.NamespaceManager]. Namespaces must be
+// non-empty and must not contain "/", so that the keys of one namespace can
+// never fall under the prefix of another.
+func NewKeyValueStoreBroker(client *clientv3.Client, prefix string) storage.KeyValueStoreBroker {
+	return &keyValueStoreBroker{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+// KeyValueStore implements storage.KeyValueStoreBroker.
+func (b *keyValueStoreBroker) KeyValueStore(namespace string) storage.KeyValueStore {
+	if err := validateNamespace(namespace); err != nil {
+		panic(fmt.Sprintf("bug: %v", err))
+	}
+	return NewKeyValueStore(b.client, path.Join(b.prefix, namespace))
+}
+
+// ListNamespaces implements storage.NamespaceManager.
+//
+// etcd cannot group keys by namespace, so each namespace is found by reading
+// the first key after the previous namespace's keys.
+func (b *keyValueStoreBroker) ListNamespaces(ctx context.Context) ([]string, error) {
+	root := b.rootPrefix()
+	end := clientv3.GetPrefixRangeEnd(root)
+	start := root
+	if start == "" {
+		start = "\x00"
+	}
+	var namespaces []string
+	for {
+		resp, err := b.client.Get(ctx, start,
+			clientv3.WithRange(end),
+			clientv3.WithLimit(1),
+			clientv3.WithKeysOnly(),
+		)
+		if err != nil {
+			return nil, etcdGrpcError(err)
+		}
+		if len(resp.Kvs) == 0 {
+			return namespaces, nil
+		}
+		key := string(resp.Kvs[0].Key)
+		namespace, _, ok := strings.Cut(strings.TrimPrefix(key, root), "/")
+		if !ok || namespace == "" {
+			// not written by a store of this broker
+			start = key + "\x00"
+			continue
+		}
+		namespaces = append(namespaces, namespace)
+		// '0' sorts directly after '/', so this skips the remaining keys of
+		// the namespace
+		start = root + namespace + "0"
+	}
+}
+
+// DeleteNamespace implements storage.NamespaceManager.
+//
+// All keys are deleted at a single revision.
+func (b *keyValueStoreBroker) DeleteNamespace(ctx context.Context, namespace string) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	if _, err := b.client.Delete(ctx, b.namespacePrefix(namespace), clientv3.WithPrefix()); err != nil {
+		return etcdGrpcError(err)
+	}
+	return nil
+}
+
+// NamespaceStats implements storage.NamespaceManager.
+func (b *keyValueStoreBroker) NamespaceStats(ctx context.Context, namespace string) (storage.NamespaceStats, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return storage.NamespaceStats{}, err
+	}
+	prefix := b.namespacePrefix(namespace)
+	// both reads are made in a transaction so that they are consistent
+	resp, err := b.client.Txn(ctx).Then(
+		clientv3.OpGet(prefix, clientv3.WithPrefix(), clientv3.WithCountOnly()),
+		clientv3.OpGet(prefix, append(clientv3.WithLastRev(), clientv3.WithKeysOnly())...),
+	).Commit()
+	if err != nil {
+		return storage.NamespaceStats{}, etcdGrpcError(err)
+	}
+	stats := storage.NamespaceStats{
+		Keys: resp.Responses[0].GetResponseRange().Count,
+	}
+	if kvs := resp.Responses[1].GetResponseRange().Kvs; len(kvs) > 0 {
+		stats.Revision = kvs[0].ModRevision
+	}
+	return stats, nil
+}
+
+// Returns the prefix of the keys of all namespaces, which is empty or ends
+// with "/".
+func (b *keyValueStoreBroker) rootPrefix() string {
+	root := path.Join(b.prefix)
+	if root != "" && !strings.HasSuffix(root, "/") {
+		root += "/"
+	}
+	return root
+}
+
+// Returns the prefix of the keys of the namespace, including the trailing
+// "/" so that it does not match other namespaces.
+func (b *keyValueStoreBroker) namespacePrefix(namespace string) string {
+	return path.Join(b.prefix, namespace) + "/"
+}
+
+func validateNamespace(namespace string) error {
+	if namespace == "" {
+		return status.Errorf(codes.InvalidArgument, "namespace cannot be empty")
+	}
+	if strings.Contains(namespace, "/") {
+		return status.Errorf(codes.InvalidArgument, "namespace cannot contain '/': %q", namespace)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package etcd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"strings"
+
+	"github.com/kralicky/protoconfig/storage"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	storage.KeyValueStoreDrivers.Register(storage.Driver[storage.KeyValueStore]{
+		Name: "etcd",
+		Description: "Stores keys in etcd under the prefix given by the path of the URI, e.g. etcd://host:2379/prefix. " +
+			"Multiple endpoints can be separated by commas. Credentials can be given in the user info of the URI.",
+		Options: []storage.DriverOption{
+			{
+				Name:        "tls",
+				Type:        storage.DriverOptionBool,
+				Description: "connect using tls; implied if any of the other tls options are set",
+			},
+			{
+				Name:        "ca",
+				Type:        storage.DriverOptionString,
+				Description: "path to a ca certificate used to verify the server; defaults to the system roots",
+			},
+			{
+				Name:        "cert",
+				Type:        storage.DriverOptionString,
+				Description: "path to a client certificate",
+			},
+			{
+				Name:        "key",
+				Type:        storage.DriverOptionString,
+				Description: "path to the private key of the client certificate",
+			},
+			{
+				Name:        "dial-timeout",
+				Type:        storage.DriverOptionDuration,
+				Description: "timeout for establishing a connection",
+				Default:     "5s",
+			},
+		},
+		Build: func(_ context.Context, conf storage.DriverConfig) (storage.KeyValueStore, error) {
+			if conf.URI.Host == "" {
+				return nil, status.Errorf(codes.InvalidArgument, "etcd: missing endpoint (expected etcd://host:port/prefix)")
+			}
+			config := clientv3.Config{
+				Endpoints:   strings.Split(conf.URI.Host, ","),
+				DialTimeout: conf.Duration("dial-timeout"),
+			}
+			if user := conf.URI.User; user != nil {
+				config.Username = user.Username()
+				config.Password, _ = user.Password()
+			}
+			tlsConfig, err := tlsConfigFromDriverConfig(conf)
+			if err != nil {
+				return nil, err
+			}
+			config.TLS = tlsConfig
+
+			client, err := clientv3.New(config)
+			if err != nil {
+				return nil, status.Errorf(codes.Unavailable, "etcd: failed to create client: %v", err)
+			}
+			return &genericKeyValueStore{
+				client:     client,
+				prefix:     conf.URI.Path,
+				ownsClient: true,
+			}, nil
+		},
+	})
+}
+
+// Returns nil if tls is not enabled.
+func tlsConfigFromDriverConfig(conf storage.DriverConfig) (*tls.Config, error) {
+	ca, cert, key := conf.String("ca"), conf.String("cert"), conf.String("key")
+	if !conf.Bool("tls") && ca == "" && cert == "" && key == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if ca != "" {
+		data, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "etcd: failed to read ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, status.Errorf(codes.InvalidArgument, "etcd: no certificates found in ca %q", ca)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (cert == "") != (key == "") {
+		return nil, status.Errorf(codes.InvalidArgument, "etcd: cert and key must be set together")
+	}
+	if cert != "" {
+		keyPair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "etcd: failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{keyPair}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,76 @@
+package etcd_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/drivers/etcd"
+	conformance_storage "github.com/kralicky/protoconfig/test/conformance/storage"
+	"github.com/kralicky/protoconfig/util/future"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func TestEtcd(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Etcd Suite")
+}
+
+var etcdClient = future.New[*clientv3.Client]()
+
+var _ = BeforeSuite(func() {
+	cfg := embed.NewConfig()
+	cfg.Dir = GinkgoT().TempDir()
+	cfg.LogLevel = "error"
+	clientURL := url.URL{Scheme: "http", Host: "127.0.0.1:0"}
+	peerURL := url.URL{Scheme: "http", Host: "127.0.0.1:0"}
+	cfg.ListenClientUrls = []url.URL{clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{clientURL}
+	cfg.ListenPeerUrls = []url.URL{peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	server, err := embed.StartEtcd(cfg)
+	Expect(err).NotTo(HaveOccurred())
+	DeferCleanup(server.Close)
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		server.Server.Stop()
+		Fail("timed out waiting for embedded etcd server to start")
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{server.Clients[0].Addr().String()},
+		DialTimeout: 5 * time.Second,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	DeferCleanup(client.Close)
+	etcdClient.Set(client)
+})
+
+func newLockManager() future.Future[storage.LockManager] {
+	f := future.New[storage.LockManager]()
+	future.Wait1(etcdClient, func(client *clientv3.Client) {
+		f.Set(etcd.NewLockManager(client, "/test/locks", etcd.WithLeaseTTL(5*time.Second)))
+	})
+	return f
+}
+
+var _ = Describe("Etcd Lock Manager", Ordered, Label("integration"), conformance_storage.LockManagerTestSuite(newLockManager()))
+
+func newTestBroker(prefix string) future.Future[storage.KeyValueStoreBroker] {
+	f := future.New[storage.KeyValueStoreBroker]()
+	future.Wait1(etcdClient, func(client *clientv3.Client) {
+		f.Set(etcd.NewKeyValueStoreBroker(client, prefix))
+	})
+	return f
+}
+
+var _ = Describe("Etcd KV Store", Ordered, Label("integration"), conformance_storage.KeyValueStoreTestSuite(newTestBroker("/test/kv"), conformance_storage.NewBytes, Equal, conformance_storage.WithoutDeletedKeyListing()))
+
+var _ = Describe("Etcd KV Store Broker", Ordered, Label("integration"), conformance_storage.KeyValueStoreBrokerTestSuite(newTestBroker("/test/brokers"), conformance_storage.NewBytes, Equal))
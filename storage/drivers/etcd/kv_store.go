@@ -3,23 +3,56 @@ package etcd
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"math"
 	"path"
 	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"go.etcd.io/etcd/api/v3/mvccpb"
 	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	"github.com/kralicky/protoconfig/storage"
 )
 
+// Metadata used to give history watches which rely on progress notifications
+// their own watch stream, identified by historyStreamID.
+const historyStreamMetadataKey = "protoconfig-history-stream"
+
+var historyStreamID atomic.Int64
+
 type genericKeyValueStore struct {
 	client *clientv3.Client
 	prefix string
+	// If set, the client was created for this store and is closed along
+	// with it.
+	ownsClient bool
+}
+
+// Returns a new key-value store which stores all keys under the given prefix.
+func NewKeyValueStore(client *clientv3.Client, prefix string) storage.KeyValueStore {
+	return &genericKeyValueStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+// Close closes the client if it was created by the store driver. Stores
+// created using [NewKeyValueStore] do not own their client, and closing them
+// has no effect.
+func (s *genericKeyValueStore) Close() error {
+	if !s.ownsClient {
+		return nil
+	}
+	return s.client.Close()
 }
 
 func etcdGrpcError(err error) error {
@@ -27,6 +60,9 @@ func etcdGrpcError(err error) error {
 	if !ok {
 		return err
 	}
+	if e == rpctypes.ErrCompacted {
+		return storage.ErrCompacted
+	}
 	return status.Error(e.Code(), e.Error())
 }
 
@@ -48,6 +84,9 @@ func (s *genericKeyValueStore) Put(ctx context.Context, key string, value []byte
 			comparisons = []clientv3.Cmp{clientv3.Compare(clientv3.Version(qualifiedKey), "=", 0)}
 		}
 	}
+	if options.TTL != nil {
+		return s.putWithTTL(ctx, qualifiedKey, encodedValue, comparisons, *options.TTL, options.RevisionOut)
+	}
 	// This nested transaction applies the WithIgnoreLease option only if the key already has a lease.
 	resp, err := s.client.Txn(ctx).
 		If(clientv3.Compare(clientv3.LeaseValue(qualifiedKey), "!=", clientv3.NoLease)).
@@ -81,6 +120,115 @@ func (s *genericKeyValueStore) Put(ctx context.Context, key string, value []byte
 	return nil
 }
 
+// Puts the key with a new lease. Any previous lease attached to the key is
+// left to expire on its own, since it may be shared with other keys.
+func (s *genericKeyValueStore) putWithTTL(
+	ctx context.Context,
+	qualifiedKey, encodedValue string,
+	comparisons []clientv3.Cmp,
+	ttl time.Duration,
+	revisionOut *int64,
+) error {
+	if ttl <= 0 {
+		return status.Errorf(codes.InvalidArgument, "ttl must be positive")
+	}
+	lease, err := s.client.Grant(ctx, int64(math.Ceil(ttl.Seconds())))
+	if err != nil {
+		return etcdGrpcError(err)
+	}
+	resp, err := s.client.Txn(ctx).
+		If(comparisons...).
+		Then(clientv3.OpPut(qualifiedKey, encodedValue, clientv3.WithLease(lease.ID))).
+		Commit()
+	if err != nil || !resp.Succeeded {
+		s.client.Revoke(context.WithoutCancel(ctx), lease.ID)
+		if err != nil {
+			return etcdGrpcError(err)
+		}
+		return fmt.Errorf("%w: revision mismatch", storage.ErrConflict)
+	}
+	if revisionOut != nil {
+		*revisionOut = resp.Header.Revision
+	}
+	return nil
+}
+
+// KeepAlive implements storage.KeepAliver.
+func (s *genericKeyValueStore) KeepAlive(ctx context.Context, key string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	resp, err := s.client.Get(ctx, path.Join(s.prefix, key), clientv3.WithKeysOnly())
+	if err != nil {
+		return etcdGrpcError(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return storage.ErrNotFound
+	}
+	if resp.Kvs[0].Lease == 0 {
+		return storage.ErrNoTTL
+	}
+	if _, err := s.client.KeepAliveOnce(ctx, clientv3.LeaseID(resp.Kvs[0].Lease)); err != nil {
+		if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			return storage.ErrNotFound
+		}
+		return etcdGrpcError(err)
+	}
+	return nil
+}
+
+// Txn implements storage.Txner.
+func (s *genericKeyValueStore) Txn(ctx context.Context, req storage.TxnRequest[[]byte]) (*storage.TxnResponse, error) {
+	comparisons := make([]clientv3.Cmp, 0, len(req.Compare))
+	for _, cmp := range req.Compare {
+		if err := validateKey(cmp.Key); err != nil {
+			return nil, err
+		}
+		qualifiedKey := path.Join(s.prefix, cmp.Key)
+		if cmp.Revision > 0 {
+			comparisons = append(comparisons, clientv3.Compare(clientv3.ModRevision(qualifiedKey), "=", cmp.Revision))
+		} else {
+			comparisons = append(comparisons, clientv3.Compare(clientv3.Version(qualifiedKey), "=", 0))
+		}
+	}
+	ops := make([]clientv3.Op, 0, len(req.Ops))
+	seen := make(map[string]struct{}, len(req.Ops))
+	for _, op := range req.Ops {
+		if err := validateKey(op.Key); err != nil {
+			return nil, err
+		}
+		if _, ok := seen[op.Key]; ok {
+			return nil, status.Errorf(codes.InvalidArgument, "duplicate key in transaction: %q", op.Key)
+		}
+		seen[op.Key] = struct{}{}
+		qualifiedKey := path.Join(s.prefix, op.Key)
+		switch op.Type {
+		case storage.TxnOpPut:
+			// As in Put, keep the lease attached to the key, if any.
+			encodedValue := base64.StdEncoding.EncodeToString(op.Value)
+			ops = append(ops, clientv3.OpTxn(
+				/*   if */ []clientv3.Cmp{clientv3.Compare(clientv3.LeaseValue(qualifiedKey), "!=", clientv3.NoLease)},
+				/* then */ []clientv3.Op{clientv3.OpPut(qualifiedKey, encodedValue, clientv3.WithIgnoreLease())},
+				/* else */ []clientv3.Op{clientv3.OpPut(qualifiedKey, encodedValue)},
+			))
+		case storage.TxnOpDelete:
+			ops = append(ops, clientv3.OpDelete(qualifiedKey))
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unknown transaction operation type: %v", op.Type)
+		}
+	}
+	resp, err := s.client.Txn(ctx).If(comparisons...).Then(ops...).Commit()
+	if err != nil {
+		return nil, etcdGrpcError(err)
+	}
+	if !resp.Succeeded {
+		return nil, fmt.Errorf("%w: revision mismatch", storage.ErrConflict)
+	}
+	return &storage.TxnResponse{
+		Revision: resp.Header.Revision,
+	}, nil
+}
+
 func (s *genericKeyValueStore) Get(ctx context.Context, key string, opts ...storage.GetOpt) ([]byte, error) {
 	options := storage.GetOptions{}
 	options.Apply(opts...)
@@ -111,6 +259,7 @@ func (s *genericKeyValueStore) Watch(ctx context.Context, key string, opts ...st
 
 	qualifiedKey := path.Join(s.prefix, key)
 	if options.Prefix {
+		qualifiedKey = s.qualifiedPrefix(key)
 		// in prefix mode, key can be "" to watch the entire prefix
 		if err := validateKey(qualifiedKey); err != nil {
 			return nil, err
@@ -139,28 +288,54 @@ func (s *genericKeyValueStore) Watch(ctx context.Context, key string, opts ...st
 	if options.Prefix {
 		clientOptions = append(clientOptions, clientv3.WithPrefix())
 	}
+	if options.Bookmarks {
+		clientOptions = append(clientOptions, clientv3.WithProgressNotify())
+	}
 
-	eventC := make(chan storage.WatchEvent[storage.KeyRevision[[]byte]], 64)
+	queue, eventC := storage.NewWatchQueue[[]byte](ctx, options.OverflowPolicy)
 
-	wc := s.client.Watch(ctx, qualifiedKey, clientOptions...)
+	// the etcd watch is canceled once the queue stops, e.g. when the watch
+	// overflows, while the queue keeps the caller's context so that it can
+	// deliver the final error event
+	watchCtx, cancelWatch := context.WithCancel(ctx)
+	wc := s.client.Watch(watchCtx, qualifiedKey, clientOptions...)
 	go func() {
-		defer close(eventC)
+		defer cancelWatch()
 		for {
 			select {
 			case <-ctx.Done():
 				return
+			case <-queue.Done():
+				return
 			case event, ok := <-wc:
+				if ctx.Err() != nil {
+					return
+				}
 				if !ok {
+					queue.Terminate(status.Errorf(codes.Unavailable, "watch closed unexpectedly"))
+					return
+				}
+				if event.CompactRevision != 0 {
+					queue.Terminate(fmt.Errorf("%w: oldest available revision is %d", storage.ErrCompacted, event.CompactRevision))
 					return
 				}
 				if err := event.Err(); err != nil {
+					queue.Terminate(etcdGrpcError(err))
 					return
 				}
 				if event.IsProgressNotify() {
+					if options.Bookmarks {
+						queue.Send(storage.WatchEvent[storage.KeyRevision[[]byte]]{
+							EventType: storage.WatchEventBookmark,
+							Revision:  event.Header.Revision,
+						})
+					}
 					continue
 				}
 				for _, ev := range event.Events {
-					wevent := storage.WatchEvent[storage.KeyRevision[[]byte]]{}
+					wevent := storage.WatchEvent[storage.KeyRevision[[]byte]]{
+						Revision: ev.Kv.ModRevision,
+					}
 					switch ev.Type {
 					case clientv3.EventTypePut:
 						wevent.Current = s.newKeyRevision(ev.Kv)
@@ -174,7 +349,7 @@ func (s *genericKeyValueStore) Watch(ctx context.Context, key string, opts ...st
 						wevent.EventType = storage.WatchEventDelete
 						wevent.Previous = s.newKeyRevision(ev.PrevKv)
 					}
-					eventC <- wevent
+					queue.Send(wevent)
 				}
 			}
 		}
@@ -182,10 +357,24 @@ func (s *genericKeyValueStore) Watch(ctx context.Context, key string, opts ...st
 	return eventC, nil
 }
 
+// Returns the etcd key prefix matching all keys of the store which start with
+// prefix. path.Join drops trailing slashes, which would widen the prefix to
+// sibling keys (or, for an empty prefix, to sibling stores).
+func (s *genericKeyValueStore) qualifiedPrefix(prefix string) string {
+	qualified := path.Join(s.prefix, prefix)
+	if qualified != "" && !strings.HasSuffix(qualified, "/") &&
+		(prefix == "" || strings.HasSuffix(prefix, "/")) {
+		qualified += "/"
+	}
+	return qualified
+}
+
 func (s *genericKeyValueStore) newKeyRevision(kv *mvccpb.KeyValue) storage.KeyRevision[[]byte] {
 	kr := &storage.KeyRevisionImpl[[]byte]{
-		K:   strings.TrimPrefix(strings.TrimPrefix(string(kv.Key), s.prefix), "/"),
-		Rev: kv.ModRevision,
+		K:         strings.TrimPrefix(strings.TrimPrefix(string(kv.Key), s.prefix), "/"),
+		Rev:       kv.ModRevision,
+		CreateRev: kv.CreateRevision,
+		Ver:       kv.Version,
 	}
 	var err error
 	kr.V, err = base64.StdEncoding.DecodeString(string(kv.Value))
@@ -201,6 +390,16 @@ func (s *genericKeyValueStore) Delete(ctx context.Context, key string, opts ...s
 	options := storage.DeleteOptions{}
 	options.Apply(opts...)
 
+	if options.Prefix {
+		if options.Revision != nil {
+			return status.Errorf(codes.InvalidArgument, "revision cannot be used when deleting a prefix")
+		}
+		if _, err := s.client.Delete(ctx, s.qualifiedPrefix(key), clientv3.WithPrefix()); err != nil {
+			return etcdGrpcError(err)
+		}
+		return nil
+	}
+
 	if err := validateKey(key); err != nil {
 		return err
 	}
@@ -233,6 +432,9 @@ func (s *genericKeyValueStore) Delete(ctx context.Context, key string, opts ...s
 func (s *genericKeyValueStore) ListKeys(ctx context.Context, prefix string, opts ...storage.ListOpt) ([]string, error) {
 	options := storage.ListKeysOptions{}
 	options.Apply(opts...)
+	if options.IncludeDeleted {
+		return nil, status.Errorf(codes.Unimplemented, "listing deleted keys is not supported")
+	}
 
 	clientOptions := []clientv3.OpOption{
 		clientv3.WithPrefix(),
@@ -241,7 +443,7 @@ func (s *genericKeyValueStore) ListKeys(ctx context.Context, prefix string, opts
 	if options.Limit != nil {
 		clientOptions = append(clientOptions, clientv3.WithLimit(*options.Limit))
 	}
-	resp, err := s.client.Get(ctx, path.Join(s.prefix, prefix), clientOptions...)
+	resp, err := s.client.Get(ctx, s.qualifiedPrefix(prefix), clientOptions...)
 	if err != nil {
 		return nil, etcdGrpcError(err)
 	}
@@ -252,6 +454,84 @@ func (s *genericKeyValueStore) ListKeys(ctx context.Context, prefix string, opts
 	return keys, nil
 }
 
+// List implements storage.BatchReader.
+func (s *genericKeyValueStore) List(ctx context.Context, prefix string, opts ...storage.ListOpt) ([]storage.KeyRevision[[]byte], error) {
+	options := storage.ListKeysOptions{}
+	options.Apply(opts...)
+
+	qualifiedPrefix := s.qualifiedPrefix(prefix)
+	start := qualifiedPrefix
+	if options.StartAfter != nil {
+		if after := path.Join(s.prefix, *options.StartAfter) + "\x00"; after > start {
+			start = after
+		}
+	}
+	clientOptions := []clientv3.OpOption{
+		clientv3.WithRange(clientv3.GetPrefixRangeEnd(qualifiedPrefix)),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+	}
+	if options.Limit != nil {
+		clientOptions = append(clientOptions, clientv3.WithLimit(*options.Limit))
+	}
+	resp, err := s.client.Get(ctx, start, clientOptions...)
+	if err != nil {
+		return nil, etcdGrpcError(err)
+	}
+	results := make([]storage.KeyRevision[[]byte], len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		results[i] = s.newKeyRevision(kv)
+	}
+	if options.ContinueOut != nil {
+		*options.ContinueOut = ""
+		if resp.More && len(results) > 0 {
+			*options.ContinueOut = results[len(results)-1].Key()
+		}
+	}
+	return results, nil
+}
+
+// The default limit on the number of operations in a single etcd transaction.
+const maxTxnOps = 128
+
+// GetMany implements storage.BatchReader.
+//
+// Keys are read in batches; all batches after the first are read at the
+// revision of the first batch so that the results are consistent.
+func (s *genericKeyValueStore) GetMany(ctx context.Context, keys []string) ([]storage.KeyRevision[[]byte], error) {
+	for _, key := range keys {
+		if err := validateKey(key); err != nil {
+			return nil, err
+		}
+	}
+	results := make([]storage.KeyRevision[[]byte], 0, len(keys))
+	var revision int64
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), maxTxnOps)]
+		keys = keys[len(batch):]
+		ops := make([]clientv3.Op, len(batch))
+		for i, key := range batch {
+			var clientOptions []clientv3.OpOption
+			if revision != 0 {
+				clientOptions = append(clientOptions, clientv3.WithRev(revision))
+			}
+			ops[i] = clientv3.OpGet(path.Join(s.prefix, key), clientOptions...)
+		}
+		resp, err := s.client.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return nil, etcdGrpcError(err)
+		}
+		if revision == 0 {
+			revision = resp.Header.Revision
+		}
+		for _, r := range resp.Responses {
+			for _, kv := range r.GetResponseRange().Kvs {
+				results = append(results, s.newKeyRevision(kv))
+			}
+		}
+	}
+	return results, nil
+}
+
 func (s *genericKeyValueStore) History(ctx context.Context, key string, opts ...storage.HistoryOpt) ([]storage.KeyRevision[[]byte], error) {
 	options := storage.HistoryOptions{}
 	options.Apply(opts...)
@@ -259,6 +539,9 @@ func (s *genericKeyValueStore) History(ctx context.Context, key string, opts ...
 	if err := validateKey(key); err != nil {
 		return nil, err
 	}
+	if options.IncludeDeleted {
+		return s.historyIncludingDeleted(ctx, key, options)
+	}
 	clientOptions := []clientv3.OpOption{clientv3.WithLimit(1)}
 	if !options.IncludeValues {
 		clientOptions = append(clientOptions, clientv3.WithKeysOnly())
@@ -303,8 +586,10 @@ WATCH:
 			for _, ev := range resp.Events {
 				if ev.Type == clientv3.EventTypePut {
 					entry := &storage.KeyRevisionImpl[[]byte]{
-						K:   key,
-						Rev: ev.Kv.ModRevision,
+						K:         key,
+						Rev:       ev.Kv.ModRevision,
+						CreateRev: ev.Kv.CreateRevision,
+						Ver:       ev.Kv.Version,
 					}
 					if options.IncludeValues {
 						value, err := base64.StdEncoding.DecodeString(string(ev.Kv.Value))
@@ -324,6 +609,138 @@ WATCH:
 	return revs, nil
 }
 
+// Returns all retained revisions of the key up to the requested revision,
+// including tombstones. They are read by watching the key from the oldest
+// retained revision.
+//
+// The watch stops at the last revision of the key up to the requested
+// revision, or at the first revision after it, which are found using Get. If
+// the key does not exist at either revision, the revision of its tombstone is
+// not known in advance; the watch is then started on a separate stream, and
+// ends once a progress notification reports that it has caught up. If such a
+// key has no retained revisions at all, the watch has nothing to catch up
+// with, and ends at the next periodic progress notification of the server.
+func (s *genericKeyValueStore) historyIncludingDeleted(ctx context.Context, key string, options storage.HistoryOptions) ([]storage.KeyRevision[[]byte], error) {
+	qualifiedKey := path.Join(s.prefix, key)
+	current, err := s.client.Get(ctx, qualifiedKey, clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, etcdGrpcError(err)
+	}
+	endRev := current.Header.Revision
+	atEnd := current
+	if options.Revision != nil && *options.Revision < endRev {
+		endRev = *options.Revision
+		atEnd, err = s.client.Get(ctx, qualifiedKey, clientv3.WithKeysOnly(), clientv3.WithRev(endRev))
+		if err != nil {
+			return nil, etcdGrpcError(err)
+		}
+	}
+	// the watch stops at the first event at or after stopRev
+	var stopRev int64
+	switch {
+	case len(atEnd.Kvs) > 0:
+		stopRev = atEnd.Kvs[0].ModRevision
+	case len(current.Kvs) > 0:
+		// the key was re-created after endRev
+		stopRev = current.Kvs[0].CreateRevision
+	}
+
+	clientOptions := []clientv3.OpOption{clientv3.WithPrevKV()}
+	if !options.IncludeValues {
+		clientOptions = append(clientOptions, clientv3.WithKeysOnly())
+	}
+	if stopRev == 0 {
+		// progress notifications are sent to every watch on a stream, so the
+		// stream must not be shared with other watches
+		ctx = metadata.AppendToOutgoingContext(ctx, historyStreamMetadataKey,
+			strconv.FormatInt(historyStreamID.Add(1), 10))
+		clientOptions = append(clientOptions, clientv3.WithCreatedNotify(), clientv3.WithProgressNotify())
+	}
+
+	var revs []storage.KeyRevision[[]byte]
+	// Watches from startRev until endRev, and returns the compacted revision
+	// if startRev has been compacted.
+	watchUntilEnd := func(startRev int64) (int64, error) {
+		watchCtx, ca := context.WithCancel(ctx)
+		defer ca()
+		wc := s.client.Watch(watchCtx, qualifiedKey, append(clientOptions, clientv3.WithRev(startRev))...)
+		for {
+			var resp clientv3.WatchResponse
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case r, ok := <-wc:
+				if !ok {
+					return 0, status.Errorf(codes.Unavailable, "watch closed unexpectedly")
+				}
+				resp = r
+			}
+			if resp.CompactRevision != 0 {
+				return resp.CompactRevision, nil
+			}
+			if err := resp.Err(); err != nil {
+				return 0, etcdGrpcError(err)
+			}
+			if resp.IsProgressNotify() && resp.Header.Revision >= endRev {
+				return 0, nil
+			}
+			for _, ev := range resp.Events {
+				if ev.Kv.ModRevision > endRev {
+					return 0, nil
+				}
+				entry := &storage.KeyRevisionImpl[[]byte]{
+					K:         key,
+					Rev:       ev.Kv.ModRevision,
+					CreateRev: ev.Kv.CreateRevision,
+					Ver:       ev.Kv.Version,
+				}
+				if ev.Type == clientv3.EventTypeDelete {
+					entry.Tombstone = true
+					if ev.PrevKv != nil {
+						entry.CreateRev = ev.PrevKv.CreateRevision
+					}
+				} else if options.IncludeValues {
+					value, err := base64.StdEncoding.DecodeString(string(ev.Kv.Value))
+					if err != nil {
+						return 0, err
+					}
+					entry.V = value
+				}
+				revs = append(revs, entry)
+				if entry.Rev == endRev || entry.Rev == stopRev {
+					return 0, nil
+				}
+			}
+			if stopRev == 0 {
+				// Progress is only reported once the watch has caught up, and
+				// the watch catches up after sending a response, so one request
+				// is made after each response rather than periodically.
+				if err := s.client.RequestProgress(watchCtx); err != nil {
+					return 0, etcdGrpcError(err)
+				}
+			}
+		}
+	}
+	startRev := int64(1)
+	for {
+		compactRev, err := watchUntilEnd(startRev)
+		if err != nil {
+			return nil, err
+		}
+		if compactRev == 0 {
+			break
+		}
+		if compactRev > endRev {
+			return nil, fmt.Errorf("%w: oldest available revision is %d", storage.ErrCompacted, compactRev)
+		}
+		startRev = compactRev
+	}
+	if len(revs) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	return revs, nil
+}
+
 func validateKey(key string) error {
 	// etcd will check keys, but we need to check if the key is empty ourselves
 	// since we always prepend a prefix to the key
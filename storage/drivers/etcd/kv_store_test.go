@@ -0,0 +1,98 @@
+package etcd_test
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/drivers/etcd"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Etcd KV Store Compaction", Label("integration"), func() {
+	It("should return a compacted error for revisions discarded by etcd", func(ctx SpecContext) {
+		client := etcdClient.Get()
+		store := etcd.NewKeyValueStore(client, "/test/compaction/"+uuid.NewString())
+
+		var rev1, rev2 int64
+		Expect(store.Put(ctx, "key", []byte("1"), storage.WithRevisionOut(&rev1))).To(Succeed())
+		Expect(store.Put(ctx, "key", []byte("2"), storage.WithRevisionOut(&rev2))).To(Succeed())
+		_, err := client.Compact(ctx, rev2)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = store.Get(ctx, "key", storage.WithRevision(rev1))
+		Expect(storage.IsCompacted(err)).To(BeTrue(), "expected compacted error, got %v", err)
+
+		value, err := store.Get(ctx, "key", storage.WithRevision(rev2))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal([]byte("2")))
+	})
+})
+
+var _ = Describe("Etcd KV Store Watch", Label("integration"), func() {
+	It("should send a compacted error event when watching from a compacted revision", func(ctx SpecContext) {
+		client := etcdClient.Get()
+		store := etcd.NewKeyValueStore(client, "/test/watch/"+uuid.NewString())
+
+		var rev1, rev2 int64
+		Expect(store.Put(ctx, "key", []byte("1"), storage.WithRevisionOut(&rev1))).To(Succeed())
+		Expect(store.Put(ctx, "key", []byte("2"), storage.WithRevisionOut(&rev2))).To(Succeed())
+		_, err := client.Compact(ctx, rev2)
+		Expect(err).NotTo(HaveOccurred())
+
+		wc, err := store.Watch(ctx, "key", storage.WithRevision(rev1))
+		Expect(err).NotTo(HaveOccurred())
+
+		var event storage.WatchEvent[storage.KeyRevision[[]byte]]
+		Eventually(wc).Should(Receive(&event))
+		Expect(event.EventType).To(Equal(storage.WatchEventError))
+		Expect(storage.IsCompacted(event.Err)).To(BeTrue(), "expected compacted error, got %v", event.Err)
+		Eventually(wc).Should(BeClosed())
+	})
+
+	It("should send bookmark events when requested", func(ctx SpecContext) {
+		client := etcdClient.Get()
+		store := etcd.NewKeyValueStore(client, "/test/watch/"+uuid.NewString())
+
+		var rev int64
+		Expect(store.Put(ctx, "key", []byte("1"), storage.WithRevisionOut(&rev))).To(Succeed())
+
+		wc, err := store.Watch(ctx, "key", storage.WithBookmarks())
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(func() storage.WatchEventType {
+			Expect(client.RequestProgress(ctx)).To(Succeed())
+			select {
+			case event := <-wc:
+				if event.EventType == storage.WatchEventBookmark {
+					Expect(event.Revision).To(BeNumerically(">=", rev))
+				}
+				return event.EventType
+			case <-time.After(100 * time.Millisecond):
+				return ""
+			}
+		}).Should(Equal(storage.WatchEventBookmark))
+	})
+})
+
+var _ = Describe("Etcd KV Store History", Label("integration"), func() {
+	It("should not send progress notifications to other watches when reading deleted history", func(ctx SpecContext) {
+		client := etcdClient.Get()
+		store := etcd.NewKeyValueStore(client, "/test/history/"+uuid.NewString())
+
+		Expect(store.Put(ctx, "key", []byte("1"))).To(Succeed())
+		Expect(store.Delete(ctx, "key")).To(Succeed())
+
+		wc, err := store.Watch(ctx, "other", storage.WithBookmarks())
+		Expect(err).NotTo(HaveOccurred())
+
+		for range 5 {
+			revs, err := store.History(ctx, "key", storage.IncludeDeleted(true))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(revs).To(HaveLen(2))
+			Expect(revs[1].IsTombstone()).To(BeTrue())
+		}
+		Consistently(wc, 500*time.Millisecond).ShouldNot(Receive())
+	})
+})
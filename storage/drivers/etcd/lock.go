@@ -0,0 +1,189 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+
+	"github.com/kralicky/protoconfig/storage"
+)
+
+const defaultLockLeaseTTL = 60 * time.Second
+
+type LockManagerOptions struct {
+	leaseTTL time.Duration
+}
+
+type LockManagerOption func(*LockManagerOptions)
+
+func (o *LockManagerOptions) apply(opts ...LockManagerOption) {
+	for _, op := range opts {
+		op(o)
+	}
+}
+
+// Sets the TTL of the lease backing each held lock. If the process holding
+// a lock stops renewing its lease (e.g. because it crashed, or lost its
+// connection to etcd), the lock will be released after this duration.
+// The TTL is rounded down to the nearest second, with a minimum of 1 second.
+func WithLeaseTTL(ttl time.Duration) LockManagerOption {
+	return func(o *LockManagerOptions) {
+		o.leaseTTL = ttl
+	}
+}
+
+type etcdLockManager struct {
+	LockManagerOptions
+	client *clientv3.Client
+	prefix string
+}
+
+// Returns a new lock manager which stores lock keys under the given prefix.
+// Lock managers in different processes using the same prefix will exclude
+// each other. The prefix should not overlap with any key-value store prefix.
+func NewLockManager(client *clientv3.Client, prefix string, opts ...LockManagerOption) storage.LockManager {
+	options := LockManagerOptions{
+		leaseTTL: defaultLockLeaseTTL,
+	}
+	options.apply(opts...)
+
+	return &etcdLockManager{
+		LockManagerOptions: options,
+		client:             client,
+		prefix:             prefix,
+	}
+}
+
+// Locker implements storage.LockManager.
+func (m *etcdLockManager) Locker(key string) storage.Lock {
+	return &etcdLock{
+		client: m.client,
+		key:    path.Join(m.prefix, key),
+		ttl:    max(int(m.leaseTTL.Seconds()), 1),
+	}
+}
+
+type etcdLock struct {
+	client *clientv3.Client
+	key    string
+	ttl    int
+
+	mu   sync.Mutex
+	held *heldLock
+}
+
+// Each successful acquisition uses its own session, so that two Locks for the
+// same key never share a lease (etcd mutexes are reentrant per lease).
+type heldLock struct {
+	session *concurrency.Session
+	mutex   *concurrency.Mutex
+	expired chan struct{}
+	once    sync.Once
+}
+
+func (h *heldLock) expire() {
+	h.once.Do(func() {
+		close(h.expired)
+	})
+}
+
+// Lock implements storage.Lock.
+func (l *etcdLock) Lock(ctx context.Context) (chan struct{}, error) {
+	session, err := l.newSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mutex := concurrency.NewMutex(session, l.key)
+	if err := mutex.Lock(ctx); err != nil {
+		session.Close()
+		return nil, etcdGrpcError(err)
+	}
+	return l.acquired(session, mutex), nil
+}
+
+// TryLock implements storage.Lock.
+func (l *etcdLock) TryLock(ctx context.Context) (bool, chan struct{}, error) {
+	session, err := l.newSession(ctx)
+	if err != nil {
+		return false, nil, err
+	}
+	mutex := concurrency.NewMutex(session, l.key)
+	if err := mutex.TryLock(ctx); err != nil {
+		session.Close()
+		if errors.Is(err, concurrency.ErrLocked) {
+			return false, nil, nil
+		}
+		return false, nil, etcdGrpcError(err)
+	}
+	return true, l.acquired(session, mutex), nil
+}
+
+func (l *etcdLock) newSession(ctx context.Context) (*concurrency.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// The session's lease must outlive ctx, which only bounds the acquisition.
+	session, err := concurrency.NewSession(l.client, concurrency.WithTTL(l.ttl))
+	if err != nil {
+		return nil, etcdGrpcError(err)
+	}
+	return session, nil
+}
+
+func (l *etcdLock) acquired(session *concurrency.Session, mutex *concurrency.Mutex) chan struct{} {
+	held := &heldLock{
+		session: session,
+		mutex:   mutex,
+		expired: make(chan struct{}),
+	}
+	l.mu.Lock()
+	l.held = held
+	l.mu.Unlock()
+
+	go func() {
+		select {
+		case <-session.Done():
+			// the lease could not be kept alive, and has expired or will
+			// expire on the server
+			held.expire()
+		case <-held.expired:
+		}
+	}()
+	return held.expired
+}
+
+// Unlock implements storage.Lock.
+func (l *etcdLock) Unlock() error {
+	l.mu.Lock()
+	held := l.held
+	l.held = nil
+	l.mu.Unlock()
+	if held == nil {
+		return storage.ErrLockNotHeld
+	}
+	held.expire()
+
+	go func() {
+		defer held.session.Close()
+		for {
+			ctx, ca := context.WithTimeout(l.client.Ctx(), time.Duration(l.ttl)*time.Second)
+			err := held.mutex.Unlock(ctx)
+			ca()
+			if err == nil {
+				return
+			}
+			select {
+			case <-held.session.Done():
+				// the lease has expired, which releases the lock
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,42 @@
+package etcd_test
+
+import (
+	"path"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kralicky/protoconfig/storage/drivers/etcd"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var _ = Describe("Etcd Lock", Label("integration"), func() {
+	When("the lease backing a held lock is revoked", func() {
+		It("should signal that the lock has expired and allow others to acquire it", func(ctx SpecContext) {
+			client := etcdClient.Get()
+			lm := etcd.NewLockManager(client, "/test/expiry", etcd.WithLeaseTTL(5*time.Second))
+			key := uuid.NewString()
+
+			lock1 := lm.Locker(key)
+			expired, err := lock1.Lock(ctx)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("revoking the lease backing the lock, as if the holder had stopped renewing it")
+			// other suites share the etcd server, so only the lease owned by
+			// this lock can be revoked
+			resp, err := client.Get(ctx, path.Join("/test/expiry", key)+"/", clientv3.WithPrefix())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Kvs).To(HaveLen(1))
+			_, err = client.Revoke(ctx, clientv3.LeaseID(resp.Kvs[0].Lease))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(expired).WithTimeout(10 * time.Second).Should(BeClosed())
+
+			lock2 := lm.Locker(key)
+			acquired, _, err := lock2.TryLock(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(acquired).To(BeTrue())
+			Expect(lock2.Unlock()).To(Succeed())
+		})
+	})
+})
@@ -0,0 +1,53 @@
+package file
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/kralicky/protoconfig/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	storage.KeyValueStoreDrivers.Register(storage.Driver[storage.KeyValueStore]{
+		Name:        "file",
+		Description: "Stores keys in a write-ahead log in the directory given by the path of the URI, e.g. file:///var/lib/cfg. The directory is created if it does not exist.",
+		Options: []storage.DriverOption{
+			{
+				Name:        "history-limit",
+				Type:        storage.DriverOptionInt,
+				Description: "maximum number of revisions to retain for each key when the log is compacted",
+				Default:     strconv.Itoa(defaultHistoryLimit),
+			},
+			{
+				Name:        "compaction-interval",
+				Type:        storage.DriverOptionDuration,
+				Description: "interval at which the log is compacted, or 0 to disable background compaction",
+				Default:     defaultCompactionInterval.String(),
+			},
+		},
+		Build: func(_ context.Context, conf storage.DriverConfig) (storage.KeyValueStore, error) {
+			if conf.URI.Host != "" && conf.URI.Host != "localhost" {
+				return nil, status.Errorf(codes.InvalidArgument, "file: remote hosts are not supported (got %q)", conf.URI.Host)
+			}
+			if conf.URI.Path == "" {
+				return nil, status.Errorf(codes.InvalidArgument, "file: missing directory (expected file:///path/to/dir)")
+			}
+			if conf.Int("history-limit") <= 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "file: history-limit must be positive")
+			}
+			if conf.Duration("compaction-interval") < 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "file: compaction-interval must not be negative")
+			}
+			store, err := NewFileKeyValueStore(conf.URI.Path,
+				WithHistoryLimit(conf.Int("history-limit")),
+				WithCompactionInterval(conf.Duration("compaction-interval")),
+			)
+			if err != nil {
+				return nil, err
+			}
+			return store, nil
+		},
+	})
+}
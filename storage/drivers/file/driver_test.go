@@ -0,0 +1,38 @@
+package file_test
+
+import (
+	"io"
+	"net/url"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/test/testutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+)
+
+var _ = Describe("File Driver", Label("unit"), func() {
+	It("should open stores from file uris", func(ctx SpecContext) {
+		uri := url.URL{Scheme: "file", Path: GinkgoT().TempDir(), RawQuery: "history-limit=2&compaction-interval=0s"}
+		store, err := storage.KeyValueStoreDrivers.Open(ctx, uri.String())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.Put(ctx, "key", []byte("value"))).To(Succeed())
+		Expect(store.(io.Closer).Close()).To(Succeed())
+
+		store, err = storage.KeyValueStoreDrivers.Open(ctx, uri.String())
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(store.(io.Closer).Close)
+		value, err := store.Get(ctx, "key")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal([]byte("value")))
+	})
+	DescribeTable("rejecting invalid uris",
+		func(ctx SpecContext, uri string) {
+			_, err := storage.KeyValueStoreDrivers.Open(ctx, uri)
+			Expect(err).To(testutil.MatchStatusCode(codes.InvalidArgument))
+		},
+		Entry("missing path", "file://"),
+		Entry("remote host", "file://example.com/data"),
+		Entry("non-positive history limit", "file:///tmp/x?history-limit=0"),
+	)
+})
@@ -0,0 +1,37 @@
+package file_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/drivers/file"
+	conformance_storage "github.com/kralicky/protoconfig/test/conformance/storage"
+	"github.com/kralicky/protoconfig/util/future"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestFile(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "File Suite")
+}
+
+type testBroker struct {
+	dir string
+}
+
+func (t testBroker) KeyValueStore(namespace string) storage.KeyValueStore {
+	store, err := file.NewFileKeyValueStore(filepath.Join(t.dir, namespace))
+	Expect(err).NotTo(HaveOccurred())
+	DeferCleanup(store.Close)
+	return store
+}
+
+var broker = future.New[testBroker]()
+
+var _ = BeforeSuite(func() {
+	broker.Set(testBroker{dir: GinkgoT().TempDir()})
+})
+
+var _ = Describe("File KV Store", Ordered, Label("integration"), conformance_storage.KeyValueStoreTestSuite(broker, conformance_storage.NewBytes, Equal))
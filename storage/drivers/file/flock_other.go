@@ -0,0 +1,10 @@
+//go:build !unix
+
+package file
+
+import "os"
+
+// File locking is not supported on this platform. Callers must ensure that
+// only one process opens a given directory at a time.
+func lockFile(*os.File) error   { return nil }
+func unlockFile(*os.File) error { return nil }
@@ -0,0 +1,831 @@
+package file
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kralicky/protoconfig/storage"
+	art "github.com/plar/go-adaptive-radix-tree"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	logFileName  = "wal.log"
+	lockFileName = "LOCK"
+
+	defaultHistoryLimit       = 64
+	defaultCompactionInterval = 5 * time.Minute
+)
+
+type FileKeyValueStoreOptions struct {
+	historyLimit       int
+	compactionInterval time.Duration
+	logger             *slog.Logger
+}
+
+type FileKeyValueStoreOption func(*FileKeyValueStoreOptions)
+
+func (o *FileKeyValueStoreOptions) apply(opts ...FileKeyValueStoreOption) {
+	for _, op := range opts {
+		op(o)
+	}
+}
+
+// Sets the maximum number of revisions (including deletes) retained for each
+// key when the log is compacted. Defaults to 64.
+func WithHistoryLimit(limit int) FileKeyValueStoreOption {
+	return func(o *FileKeyValueStoreOptions) {
+		o.historyLimit = limit
+	}
+}
+
+// Sets the interval at which the log is compacted in the background. If the
+// interval is 0, the log is only compacted when Compact is called.
+// Defaults to 5 minutes.
+func WithCompactionInterval(interval time.Duration) FileKeyValueStoreOption {
+	return func(o *FileKeyValueStoreOptions) {
+		o.compactionInterval = interval
+	}
+}
+
+// Sets the logger used to report errors of background compactions. Defaults
+// to slog.Default().
+func WithLogger(logger *slog.Logger) FileKeyValueStoreOption {
+	return func(o *FileKeyValueStoreOptions) {
+		o.logger = logger
+	}
+}
+
+type entry struct {
+	revision       int64
+	createRevision int64
+	timestamp      time.Time
+	value          []byte
+	deleted        bool
+}
+
+// Returns the entry as a key revision of the given key. Versions are not
+// recorded in the log, so they are not reported.
+func (e *entry) keyRevision(key string, includeValue bool) *storage.KeyRevisionImpl[[]byte] {
+	kr := &storage.KeyRevisionImpl[[]byte]{
+		K:         key,
+		Rev:       e.revision,
+		Time:      e.timestamp,
+		CreateRev: e.createRevision,
+		Tombstone: e.deleted,
+	}
+	if includeValue && !e.deleted {
+		kr.V = bytes.Clone(e.value)
+	}
+	return kr
+}
+
+// Revisions of a single key, in ascending order.
+type keyEntries struct {
+	entries []entry
+	// The newest revision of this key discarded by compaction, if any.
+	compacted int64
+}
+
+func (k *keyEntries) latest() *entry {
+	if len(k.entries) == 0 {
+		return nil
+	}
+	return &k.entries[len(k.entries)-1]
+}
+
+// Returns the index of the newest entry with a revision <= rev, or -1.
+func (k *keyEntries) indexAt(rev int64) int {
+	i, found := slices.BinarySearchFunc(k.entries, rev, func(e entry, rev int64) int {
+		return cmp.Compare(e.revision, rev)
+	})
+	if found {
+		return i
+	}
+	return i - 1
+}
+
+// A durable key-value store backed by an append-only log on the local
+// filesystem. Every write is fsynced before it is acknowledged. The full
+// contents of the log are indexed in memory; the log is periodically
+// compacted to discard revisions exceeding the configured history limit.
+//
+// Revisions are global to the store, and increase by one for every Put or
+// Delete, similar to etcd.
+type FileKeyValueStore struct {
+	FileKeyValueStoreOptions
+	dir string
+
+	mu       sync.RWMutex
+	log      *os.File
+	lockFile *os.File
+	size     int64
+	buf      []byte
+	revision int64
+	// The newest revision of any key discarded by compaction. Revisions of
+	// keys which were discarded entirely are only tracked here.
+	compactedRevision int64
+	keys              art.Tree
+	// number of records appended since the last compaction
+	dirty   int
+	watches map[*fileWatch]struct{}
+	closed  bool
+
+	stopCompaction context.CancelFunc
+	compactionDone chan struct{}
+}
+
+var _ storage.KeyValueStoreT[[]byte] = (*FileKeyValueStore)(nil)
+
+// Opens (or creates) a store in the given directory. Only one store can have
+// the directory open at a time. If the log contains a partially written
+// record (for example, after a crash), it is truncated to the last complete
+// record.
+func NewFileKeyValueStore(dir string, opts ...FileKeyValueStoreOption) (*FileKeyValueStore, error) {
+	options := FileKeyValueStoreOptions{
+		historyLimit:       defaultHistoryLimit,
+		compactionInterval: defaultCompactionInterval,
+		logger:             slog.Default(),
+	}
+	options.apply(opts...)
+	if options.historyLimit < 1 {
+		return nil, fmt.Errorf("history limit must be at least 1")
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	lf, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(lf); err != nil {
+		lf.Close()
+		return nil, err
+	}
+
+	s := &FileKeyValueStore{
+		FileKeyValueStoreOptions: options,
+		dir:                      dir,
+		lockFile:                 lf,
+		keys:                     art.New(),
+		watches:                  map[*fileWatch]struct{}{},
+	}
+	if err := s.open(); err != nil {
+		unlockFile(lf)
+		lf.Close()
+		return nil, err
+	}
+
+	ctx, ca := context.WithCancel(context.Background())
+	s.stopCompaction = ca
+	s.compactionDone = make(chan struct{})
+	go s.runCompaction(ctx)
+	return s, nil
+}
+
+func (s *FileKeyValueStore) open() error {
+	// clean up after a compaction that did not complete
+	os.Remove(filepath.Join(s.dir, logFileName+".tmp"))
+
+	f, err := os.OpenFile(filepath.Join(s.dir, logFileName), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	offset, err := readLog(f, s.applyRecordLocked)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to read log: %w", err)
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return err
+	}
+	if s.compactedRevision > 0 {
+		// Which revisions of each key were discarded is not recorded in the
+		// log; assume any revision older than the oldest retained one was.
+		s.keys.ForEach(func(node art.Node) bool {
+			ke := node.Value().(*keyEntries)
+			ke.compacted = min(s.compactedRevision, ke.entries[0].revision-1)
+			return true
+		}, art.TraverseLeaf)
+	}
+	if _, err := f.Seek(offset, 0); err != nil {
+		f.Close()
+		return err
+	}
+	s.log = f
+	s.size = offset
+	return nil
+}
+
+func (s *FileKeyValueStore) applyRecordLocked(rec *record) {
+	s.revision = max(s.revision, rec.revision)
+	if rec.typ == recordRevision {
+		s.compactedRevision = max(s.compactedRevision, rec.createRevision)
+		return
+	}
+	s.dirty++
+	var ke *keyEntries
+	if v, ok := s.keys.Search(art.Key(rec.key)); ok {
+		ke = v.(*keyEntries)
+	} else {
+		ke = &keyEntries{}
+		s.keys.Insert(art.Key(rec.key), ke)
+	}
+	ke.entries = append(ke.entries, entry{
+		revision:       rec.revision,
+		createRevision: rec.createRevision,
+		timestamp:      time.Unix(0, rec.timestamp),
+		value:          rec.value,
+		deleted:        rec.typ == recordDelete,
+	})
+}
+
+// Appends the records to the log in a single write and syncs it to disk.
+func (s *FileKeyValueStore) appendLocked(recs ...*record) error {
+	if s.closed {
+		return status.Errorf(codes.Unavailable, "store is closed")
+	}
+	s.buf = s.buf[:0]
+	for _, rec := range recs {
+		s.buf = rec.encode(s.buf)
+	}
+	if _, err := s.log.Write(s.buf); err != nil {
+		// undo the partial write, if any
+		s.log.Truncate(s.size)
+		s.log.Seek(s.size, 0)
+		return status.Errorf(codes.Internal, "failed to write log: %v", err)
+	}
+	if err := s.log.Sync(); err != nil {
+		s.log.Truncate(s.size)
+		s.log.Seek(s.size, 0)
+		return status.Errorf(codes.Internal, "failed to sync log: %v", err)
+	}
+	s.size += int64(len(s.buf))
+	return nil
+}
+
+func (s *FileKeyValueStore) lookupLocked(key string) *keyEntries {
+	if v, ok := s.keys.Search(art.Key(key)); ok {
+		return v.(*keyEntries)
+	}
+	return nil
+}
+
+// Put implements storage.KeyValueStoreT.
+func (s *FileKeyValueStore) Put(_ context.Context, key string, value []byte, opts ...storage.PutOpt) error {
+	options := storage.PutOptions{}
+	options.Apply(opts...)
+
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if options.TTL != nil {
+		return status.Errorf(codes.Unimplemented, "ttls are not supported by this store")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var prev *entry
+	ke := s.lookupLocked(key)
+	if ke != nil {
+		if latest := ke.latest(); !latest.deleted {
+			prev = latest
+		}
+	}
+	if options.Revision != nil {
+		if *options.Revision == 0 {
+			if prev != nil {
+				return fmt.Errorf("%w: expected key not to exist (requested revision 0)", storage.ErrConflict)
+			}
+		} else if prev == nil || prev.revision != *options.Revision {
+			return fmt.Errorf("%w: revision mismatch", storage.ErrConflict)
+		}
+	}
+
+	rec := &record{
+		typ:       recordPut,
+		revision:  s.revision + 1,
+		timestamp: time.Now().UnixNano(),
+		key:       key,
+		value:     bytes.Clone(value),
+	}
+	if prev != nil {
+		rec.createRevision = prev.createRevision
+	} else {
+		rec.createRevision = rec.revision
+	}
+	if err := s.appendLocked(rec); err != nil {
+		return err
+	}
+	s.applyRecordLocked(rec)
+	if ke == nil {
+		ke = s.lookupLocked(key)
+	}
+	s.notifyLocked(key, ke, len(ke.entries)-1)
+
+	if options.RevisionOut != nil {
+		*options.RevisionOut = rec.revision
+	}
+	return nil
+}
+
+// Get implements storage.KeyValueStoreT.
+func (s *FileKeyValueStore) Get(_ context.Context, key string, opts ...storage.GetOpt) ([]byte, error) {
+	options := storage.GetOptions{}
+	options.Apply(opts...)
+
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if options.Revision != nil && *options.Revision > s.revision {
+		return nil, status.Errorf(codes.OutOfRange, "revision %d is a future revision", *options.Revision)
+	}
+	ke := s.lookupLocked(key)
+	if ke == nil {
+		if options.Revision != nil && *options.Revision <= s.compactedRevision {
+			return nil, storage.ErrCompacted
+		}
+		return nil, storage.ErrNotFound
+	}
+	var found *entry
+	if options.Revision != nil {
+		i := ke.indexAt(*options.Revision)
+		if i < 0 && *options.Revision <= ke.compacted {
+			return nil, storage.ErrCompacted
+		}
+		if i >= 0 {
+			found = &ke.entries[i]
+		}
+	} else {
+		found = ke.latest()
+	}
+	if found == nil || found.deleted {
+		return nil, storage.ErrNotFound
+	}
+	if options.RevisionOut != nil {
+		*options.RevisionOut = found.revision
+	}
+	return bytes.Clone(found.value), nil
+}
+
+// Delete implements storage.KeyValueStoreT.
+func (s *FileKeyValueStore) Delete(_ context.Context, key string, opts ...storage.DeleteOpt) error {
+	options := storage.DeleteOptions{}
+	options.Apply(opts...)
+
+	if options.Prefix {
+		if options.Revision != nil {
+			return status.Errorf(codes.InvalidArgument, "revision cannot be used when deleting a prefix")
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.deletePrefixLocked(key)
+	}
+
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ke := s.lookupLocked(key)
+	if ke == nil || ke.latest().deleted {
+		return storage.ErrNotFound
+	}
+	prev := ke.latest()
+	if options.Revision != nil && *options.Revision != prev.revision {
+		return fmt.Errorf("%w: revision mismatch", storage.ErrConflict)
+	}
+	rec := &record{
+		typ:            recordDelete,
+		revision:       s.revision + 1,
+		createRevision: prev.createRevision,
+		timestamp:      time.Now().UnixNano(),
+		key:            key,
+	}
+	if err := s.appendLocked(rec); err != nil {
+		return err
+	}
+	s.applyRecordLocked(rec)
+	s.notifyLocked(key, ke, len(ke.entries)-1)
+	return nil
+}
+
+// Deletes all keys starting with prefix at a single revision. The records are
+// written together, but a crash while writing them can leave some of the keys
+// deleted.
+func (s *FileKeyValueStore) deletePrefixLocked(prefix string) error {
+	var (
+		recs    []*record
+		entries []*keyEntries
+	)
+	now := time.Now().UnixNano()
+	s.keys.ForEachPrefix(art.Key(prefix), func(node art.Node) bool {
+		if node.Kind() != art.Leaf {
+			return true
+		}
+		ke := node.Value().(*keyEntries)
+		if ke.latest().deleted {
+			return true
+		}
+		recs = append(recs, &record{
+			typ:            recordDelete,
+			revision:       s.revision + 1,
+			createRevision: ke.latest().createRevision,
+			timestamp:      now,
+			key:            string(node.Key()),
+		})
+		entries = append(entries, ke)
+		return true
+	})
+	if len(recs) == 0 {
+		return nil
+	}
+	if err := s.appendLocked(recs...); err != nil {
+		return err
+	}
+	for i, rec := range recs {
+		s.applyRecordLocked(rec)
+		s.notifyLocked(rec.key, entries[i], len(entries[i].entries)-1)
+	}
+	return nil
+}
+
+// ListKeys implements storage.KeyValueStoreT.
+func (s *FileKeyValueStore) ListKeys(_ context.Context, prefix string, opts ...storage.ListOpt) ([]string, error) {
+	options := storage.ListKeysOptions{}
+	options.Apply(opts...)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []string{}
+	s.keys.ForEachPrefix(art.Key(prefix), func(node art.Node) bool {
+		if node.Kind() != art.Leaf {
+			return true
+		}
+		if node.Value().(*keyEntries).latest().deleted && !options.IncludeDeleted {
+			return true
+		}
+		keys = append(keys, string(node.Key()))
+		return options.Limit == nil || int64(len(keys)) < *options.Limit
+	})
+	return keys, nil
+}
+
+// History implements storage.KeyValueStoreT.
+func (s *FileKeyValueStore) History(_ context.Context, key string, opts ...storage.HistoryOpt) ([]storage.KeyRevision[[]byte], error) {
+	options := storage.HistoryOptions{}
+	options.Apply(opts...)
+
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ke := s.lookupLocked(key)
+	if ke == nil {
+		if options.Revision != nil && *options.Revision <= s.compactedRevision {
+			return nil, storage.ErrCompacted
+		}
+		return nil, storage.ErrNotFound
+	}
+	last := len(ke.entries) - 1
+	if options.Revision != nil {
+		last = ke.indexAt(*options.Revision)
+		if last < 0 && *options.Revision <= ke.compacted {
+			return nil, storage.ErrCompacted
+		}
+	}
+	if last < 0 || (ke.entries[last].deleted && !options.IncludeDeleted) {
+		return nil, storage.ErrNotFound
+	}
+	first := last
+	if options.IncludeDeleted {
+		first = 0
+	}
+	for first > 0 && !ke.entries[first-1].deleted {
+		first--
+	}
+	revs := make([]storage.KeyRevision[[]byte], 0, last-first+1)
+	for i := range ke.entries[first : last+1] {
+		revs = append(revs, ke.entries[first+i].keyRevision(key, options.IncludeValues))
+	}
+	return revs, nil
+}
+
+// Watch implements storage.KeyValueStoreT.
+func (s *FileKeyValueStore) Watch(ctx context.Context, key string, opts ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[[]byte]], error) {
+	options := storage.WatchOptions{}
+	options.Apply(opts...)
+
+	if !options.Prefix {
+		if err := validateKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	w := &fileWatch{}
+	if options.Prefix {
+		w.matchesKey = func(k string) bool {
+			return strings.HasPrefix(k, key)
+		}
+	} else {
+		w.matchesKey = func(k string) bool {
+			return k == key
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, status.Errorf(codes.Unavailable, "store is closed")
+	}
+
+	var replay []storage.WatchEvent[storage.KeyRevision[[]byte]]
+	var compacted bool
+	if options.Revision != nil {
+		start := *options.Revision
+		matching := map[string]*keyEntries{}
+		if options.Prefix {
+			s.keys.ForEachPrefix(art.Key(key), func(node art.Node) bool {
+				if node.Kind() == art.Leaf {
+					matching[string(node.Key())] = node.Value().(*keyEntries)
+				}
+				return true
+			})
+		} else if ke := s.lookupLocked(key); ke != nil {
+			matching[key] = ke
+		}
+		// Replaying only the retained revisions would silently skip events.
+		// Keys which were discarded entirely are not known, so prefix watches
+		// are checked against the newest revision discarded from any key.
+		compacted = start > 0 && start <= s.compactedRevision
+		if ke := matching[key]; !options.Prefix && ke != nil {
+			compacted = start > 0 && start <= ke.compacted
+		}
+		if !compacted {
+			if start == 0 {
+				// start at the oldest creation revision among existing keys
+				start = s.revision + 1
+				for _, ke := range matching {
+					if latest := ke.latest(); !latest.deleted {
+						start = min(start, latest.createRevision)
+					}
+				}
+			}
+			type replayed struct {
+				key string
+				ke  *keyEntries
+				idx int
+			}
+			var events []replayed
+			for k, ke := range matching {
+				for i := max(ke.indexAt(start-1)+1, 0); i < len(ke.entries); i++ {
+					events = append(events, replayed{k, ke, i})
+				}
+			}
+			slices.SortFunc(events, func(a, b replayed) int {
+				return cmp.Compare(a.ke.entries[a.idx].revision, b.ke.entries[b.idx].revision)
+			})
+			for _, ev := range events {
+				replay = append(replay, newWatchEvent(ev.key, ev.ke, ev.idx))
+			}
+		}
+	}
+
+	var eventC <-chan storage.WatchEvent[storage.KeyRevision[[]byte]]
+	w.queue, eventC = storage.NewWatchQueue(ctx, options.OverflowPolicy, replay...)
+	if compacted {
+		w.queue.Terminate(storage.ErrCompacted)
+	}
+	s.watches[w] = struct{}{}
+	go func() {
+		<-w.queue.Done()
+		s.mu.Lock()
+		delete(s.watches, w)
+		s.mu.Unlock()
+	}()
+	return eventC, nil
+}
+
+// Must be called with the write lock held, after the entry at index idx
+// has been applied.
+func (s *FileKeyValueStore) notifyLocked(key string, ke *keyEntries, idx int) {
+	for w := range s.watches {
+		if w.matchesKey(key) {
+			w.queue.Send(newWatchEvent(key, ke, idx))
+		}
+	}
+}
+
+func newWatchEvent(key string, ke *keyEntries, idx int) storage.WatchEvent[storage.KeyRevision[[]byte]] {
+	e := ke.entries[idx]
+	var prev storage.KeyRevision[[]byte]
+	if idx > 0 && !ke.entries[idx-1].deleted {
+		prev = ke.entries[idx-1].keyRevision(key, true)
+	}
+	if e.deleted {
+		return storage.WatchEvent[storage.KeyRevision[[]byte]]{
+			EventType: storage.WatchEventDelete,
+			Previous:  prev,
+			Revision:  e.revision,
+		}
+	}
+	return storage.WatchEvent[storage.KeyRevision[[]byte]]{
+		EventType: storage.WatchEventPut,
+		Current:   e.keyRevision(key, true),
+		Previous:  prev,
+		Revision:  e.revision,
+	}
+}
+
+// Compacts the log, discarding all but the newest revisions of each key
+// according to the configured history limit. Keys that have been deleted are
+// discarded entirely once no revisions other than the delete remain.
+func (s *FileKeyValueStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compactLocked()
+}
+
+func (s *FileKeyValueStore) compactLocked() error {
+	if s.closed {
+		return status.Errorf(codes.Unavailable, "store is closed")
+	}
+	var (
+		retained []*record
+		empty    [][]byte
+	)
+	s.keys.ForEach(func(node art.Node) bool {
+		ke := node.Value().(*keyEntries)
+		entries := ke.entries[max(len(ke.entries)-s.historyLimit, 0):]
+		// leading deletes are meaningless without the preceding revisions
+		for len(entries) > 0 && entries[0].deleted {
+			entries = entries[1:]
+		}
+		if discarded := len(ke.entries) - len(entries); discarded > 0 {
+			ke.compacted = ke.entries[discarded-1].revision
+			s.compactedRevision = max(s.compactedRevision, ke.compacted)
+		}
+		ke.entries = slices.Clip(entries)
+		if len(entries) == 0 {
+			empty = append(empty, node.Key())
+			return true
+		}
+		for _, e := range entries {
+			rec := &record{
+				typ:            recordPut,
+				revision:       e.revision,
+				createRevision: e.createRevision,
+				timestamp:      e.timestamp.UnixNano(),
+				key:            string(node.Key()),
+				value:          e.value,
+			}
+			if e.deleted {
+				rec.typ = recordDelete
+			}
+			retained = append(retained, rec)
+		}
+		return true
+	}, art.TraverseLeaf)
+	for _, key := range empty {
+		s.keys.Delete(key)
+	}
+	slices.SortFunc(retained, func(a, b *record) int {
+		return cmp.Compare(a.revision, b.revision)
+	})
+
+	tmpPath := filepath.Join(s.dir, logFileName+".tmp")
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	var size int64
+	var buf []byte
+	write := func(rec *record) error {
+		buf = rec.encode(buf[:0])
+		n, err := tmp.Write(buf)
+		size += int64(n)
+		return err
+	}
+	err = write(&record{typ: recordRevision, revision: s.revision, createRevision: s.compactedRevision})
+	for i := 0; err == nil && i < len(retained); i++ {
+		err = write(retained[i])
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(s.dir, logFileName))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to compact log: %w", err)
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	// the old file handle now refers to the unlinked log
+	s.log.Close()
+	s.log, err = os.OpenFile(filepath.Join(s.dir, logFileName), os.O_RDWR, 0o600)
+	if err != nil {
+		// the store can't accept writes without a log
+		s.closed = true
+		return fmt.Errorf("failed to reopen log after compaction: %w", err)
+	}
+	if _, err := s.log.Seek(size, 0); err != nil {
+		return err
+	}
+	s.size = size
+	s.dirty = 0
+	return nil
+}
+
+func (s *FileKeyValueStore) runCompaction(ctx context.Context) {
+	defer close(s.compactionDone)
+	if s.compactionInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.compactionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.dirty > 0 {
+				if err := s.compactLocked(); err != nil {
+					s.logger.With("error", err).Warn("background compaction failed", "dir", s.dir)
+					if s.closed {
+						// the log could not be reopened
+						s.terminateWatchesLocked(status.Errorf(codes.Unavailable, "store is closed: %v", err))
+					}
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Stops background compaction and closes the log. Active watches are
+// terminated with an Unavailable error.
+func (s *FileKeyValueStore) Close() error {
+	s.stopCompaction()
+	<-s.compactionDone
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.terminateWatchesLocked(status.Errorf(codes.Unavailable, "store is closed"))
+	err := s.log.Close()
+	unlockFile(s.lockFile)
+	s.lockFile.Close()
+	return err
+}
+
+func (s *FileKeyValueStore) terminateWatchesLocked(err error) {
+	for w := range s.watches {
+		w.queue.Terminate(err)
+	}
+}
+
+type fileWatch struct {
+	matchesKey func(string) bool
+	queue      *storage.WatchQueue[[]byte]
+}
+
+func validateKey(key string) error {
+	if key == "" {
+		return status.Errorf(codes.InvalidArgument, "key cannot be empty")
+	}
+	return nil
+}
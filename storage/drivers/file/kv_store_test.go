@@ -0,0 +1,249 @@
+package file_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/drivers/file"
+	"github.com/kralicky/protoconfig/test/testutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+)
+
+var _ = Describe("FileKeyValueStore", Label("unit"), func() {
+	var (
+		dir string
+		ctx context.Context
+	)
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		ctx = context.Background()
+	})
+	open := func(opts ...file.FileKeyValueStoreOption) *file.FileKeyValueStore {
+		store, err := file.NewFileKeyValueStore(dir, append([]file.FileKeyValueStoreOption{file.WithCompactionInterval(0)}, opts...)...)
+		Expect(err).NotTo(HaveOccurred())
+		return store
+	}
+
+	When("the store is reopened", func() {
+		It("should restore all keys, history, and revisions", func() {
+			store := open()
+			var rev1, rev2 int64
+			Expect(store.Put(ctx, "a", []byte("1"), storage.WithRevisionOut(&rev1))).To(Succeed())
+			Expect(store.Put(ctx, "a", []byte("2"), storage.WithRevisionOut(&rev2))).To(Succeed())
+			Expect(store.Put(ctx, "b", []byte("3"))).To(Succeed())
+			Expect(store.Delete(ctx, "b")).To(Succeed())
+			Expect(store.Close()).To(Succeed())
+
+			store = open()
+			defer store.Close()
+			value, err := store.Get(ctx, "a")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal([]byte("2")))
+			value, err = store.Get(ctx, "a", storage.WithRevision(rev1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal([]byte("1")))
+
+			_, err = store.Get(ctx, "b")
+			Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+
+			hist, err := store.History(ctx, "a", storage.IncludeValues(true))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hist).To(HaveLen(2))
+			Expect(hist[0].Revision()).To(Equal(rev1))
+			Expect(hist[1].Revision()).To(Equal(rev2))
+
+			By("continuing to increase revisions after the last write")
+			var rev3 int64
+			Expect(store.Put(ctx, "a", []byte("4"), storage.WithRevisionOut(&rev3))).To(Succeed())
+			Expect(rev3).To(Equal(rev2 + 3))
+		})
+
+		It("should not allow the same directory to be opened twice", func() {
+			store := open()
+			defer store.Close()
+			_, err := file.NewFileKeyValueStore(dir)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	When("the store is closed", func() {
+		It("should terminate active watches with an error event", func() {
+			store := open()
+			wc, err := store.Watch(ctx, "a")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.Close()).To(Succeed())
+
+			var event storage.WatchEvent[storage.KeyRevision[[]byte]]
+			Eventually(wc).Should(Receive(&event))
+			Expect(event.EventType).To(Equal(storage.WatchEventError))
+			Expect(event.Err).To(testutil.MatchStatusCode(codes.Unavailable))
+			Eventually(wc).Should(BeClosed())
+		})
+	})
+
+	When("the log ends with a partially written record", func() {
+		It("should discard the incomplete record", func() {
+			store := open()
+			Expect(store.Put(ctx, "a", []byte("1"))).To(Succeed())
+			Expect(store.Put(ctx, "a", []byte("2"))).To(Succeed())
+			Expect(store.Close()).To(Succeed())
+
+			logPath := filepath.Join(dir, "wal.log")
+			info, err := os.Stat(logPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.Truncate(logPath, info.Size()-3)).To(Succeed())
+
+			store = open()
+			defer store.Close()
+			value, err := store.Get(ctx, "a")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal([]byte("1")))
+
+			By("appending new records after the truncated record")
+			Expect(store.Put(ctx, "a", []byte("3"))).To(Succeed())
+			Expect(store.Close()).To(Succeed())
+			store = open()
+			value, err = store.Get(ctx, "a")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal([]byte("3")))
+		})
+	})
+
+	When("the final record in the log is corrupt", func() {
+		It("should discard the corrupt record", func() {
+			store := open()
+			Expect(store.Put(ctx, "a", []byte("1"))).To(Succeed())
+			Expect(store.Put(ctx, "a", []byte("2"))).To(Succeed())
+			Expect(store.Close()).To(Succeed())
+
+			logPath := filepath.Join(dir, "wal.log")
+			data, err := os.ReadFile(logPath)
+			Expect(err).NotTo(HaveOccurred())
+			data[len(data)-1] ^= 0xff
+			Expect(os.WriteFile(logPath, data, 0o600)).To(Succeed())
+
+			store = open()
+			defer store.Close()
+			value, err := store.Get(ctx, "a")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal([]byte("1")))
+		})
+	})
+
+	When("a record before the end of the log is corrupt", func() {
+		It("should fail to open the store with a DataLoss error", func() {
+			store := open()
+			Expect(store.Put(ctx, "a", []byte("1"))).To(Succeed())
+			Expect(store.Put(ctx, "a", []byte("2"))).To(Succeed())
+			Expect(store.Close()).To(Succeed())
+
+			logPath := filepath.Join(dir, "wal.log")
+			data, err := os.ReadFile(logPath)
+			Expect(err).NotTo(HaveOccurred())
+			// the last byte of the first record's payload (its value)
+			data[len(data)/2-1] ^= 0xff
+			Expect(os.WriteFile(logPath, data, 0o600)).To(Succeed())
+
+			_, err = file.NewFileKeyValueStore(dir)
+			Expect(err).To(testutil.MatchStatusCode(codes.DataLoss))
+
+			By("leaving the log untouched")
+			after, err := os.ReadFile(logPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(after).To(Equal(data))
+		})
+	})
+
+	Context("Compaction", func() {
+		It("should retain only the configured number of revisions per key", func() {
+			store := open(file.WithHistoryLimit(3))
+			revisions := make([]int64, 10)
+			for i := range revisions {
+				Expect(store.Put(ctx, "a", []byte(fmt.Sprint(i)), storage.WithRevisionOut(&revisions[i]))).To(Succeed())
+			}
+			Expect(store.Put(ctx, "b", []byte("b"))).To(Succeed())
+			Expect(store.Delete(ctx, "b")).To(Succeed())
+			var lastRev int64
+			Expect(store.Put(ctx, "c", []byte("c"), storage.WithRevisionOut(&lastRev))).To(Succeed())
+			Expect(store.Delete(ctx, "c")).To(Succeed())
+
+			info, err := os.Stat(filepath.Join(dir, "wal.log"))
+			Expect(err).NotTo(HaveOccurred())
+			sizeBefore := info.Size()
+
+			Expect(store.Compact()).To(Succeed())
+
+			info, err = os.Stat(filepath.Join(dir, "wal.log"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Size()).To(BeNumerically("<", sizeBefore))
+
+			for _, s := range []*file.FileKeyValueStore{store, nil} {
+				if s == nil {
+					Expect(store.Close()).To(Succeed())
+					s = open(file.WithHistoryLimit(3))
+					defer s.Close()
+				}
+				hist, err := s.History(ctx, "a", storage.IncludeValues(true))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(hist).To(HaveLen(3))
+				for i, h := range hist {
+					Expect(h.Revision()).To(Equal(revisions[7+i]))
+					Expect(h.Value()).To(Equal([]byte(fmt.Sprint(7 + i))))
+				}
+				_, err = s.Get(ctx, "a", storage.WithRevision(revisions[0]))
+				Expect(err).To(testutil.MatchStatusCode(storage.ErrCompacted))
+				_, err = s.History(ctx, "a", storage.WithRevision(revisions[6]))
+				Expect(err).To(testutil.MatchStatusCode(storage.ErrCompacted))
+
+				keys, err := s.ListKeys(ctx, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(keys).To(ConsistOf("a"))
+
+				By("preserving the current revision even if its entry was discarded")
+				var rev int64
+				Expect(s.Put(ctx, "d", []byte("d"), storage.WithRevisionOut(&rev))).To(Succeed())
+				Expect(rev).To(BeNumerically(">", lastRev+1))
+				Expect(s.Delete(ctx, "d")).To(Succeed())
+				Expect(s.Compact()).To(Succeed())
+			}
+		})
+
+		It("should terminate watches starting at a compacted revision", func() {
+			store := open(file.WithHistoryLimit(2))
+			defer store.Close()
+			revisions := make([]int64, 5)
+			for i := range revisions {
+				Expect(store.Put(ctx, "a", []byte(fmt.Sprint(i)), storage.WithRevisionOut(&revisions[i]))).To(Succeed())
+			}
+			Expect(store.Compact()).To(Succeed())
+
+			for _, opts := range [][]storage.WatchOpt{
+				{storage.WithRevision(revisions[2])},
+				{storage.WithRevision(revisions[2]), storage.WithPrefix()},
+			} {
+				wc, err := store.Watch(ctx, "a", opts...)
+				Expect(err).NotTo(HaveOccurred())
+				var event storage.WatchEvent[storage.KeyRevision[[]byte]]
+				Eventually(wc).Should(Receive(&event))
+				Expect(event.EventType).To(Equal(storage.WatchEventError))
+				Expect(storage.IsCompacted(event.Err)).To(BeTrue())
+				Eventually(wc).Should(BeClosed())
+			}
+
+			By("replaying retained revisions")
+			wc, err := store.Watch(ctx, "a", storage.WithRevision(revisions[3]))
+			Expect(err).NotTo(HaveOccurred())
+			for _, rev := range revisions[3:] {
+				var event storage.WatchEvent[storage.KeyRevision[[]byte]]
+				Eventually(wc).Should(Receive(&event))
+				Expect(event.EventType).To(Equal(storage.WatchEventPut))
+				Expect(event.Current.Revision()).To(Equal(rev))
+			}
+		})
+	})
+})
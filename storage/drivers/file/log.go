@@ -0,0 +1,181 @@
+package file
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type recordType uint8
+
+const (
+	recordPut recordType = iota + 1
+	recordDelete
+	// Sets the current revision of the store. Written at the start of a
+	// compacted log, since the entry holding the latest revision may have
+	// been discarded. The create revision field holds the newest revision
+	// discarded by compaction.
+	recordRevision
+)
+
+// Log record wire format:
+//
+//	header:  [4] payload length | [4] crc32c(payload)
+//	payload: [1] type | [8] revision | [8] create revision | [8] timestamp (unix nanos)
+//	         | uvarint key length | key | uvarint value length | value
+//
+// All fixed-width integers are big-endian.
+type record struct {
+	typ            recordType
+	revision       int64
+	createRevision int64
+	timestamp      int64
+	key            string
+	value          []byte
+}
+
+const (
+	recordHeaderSize = 8
+	// Sanity limit to avoid allocating huge buffers when reading a corrupt
+	// length field.
+	maxRecordSize = 64 * 1024 * 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorruptRecord = errors.New("corrupt log record")
+
+// Appends the encoded record to buf.
+func (r *record) encode(buf []byte) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, recordHeaderSize)...)
+	buf = append(buf, byte(r.typ))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(r.revision))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(r.createRevision))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(r.timestamp))
+	buf = binary.AppendUvarint(buf, uint64(len(r.key)))
+	buf = append(buf, r.key...)
+	buf = binary.AppendUvarint(buf, uint64(len(r.value)))
+	buf = append(buf, r.value...)
+
+	header, payload := buf[start:start+recordHeaderSize], buf[start+recordHeaderSize:]
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, crcTable))
+	return buf
+}
+
+func (r *record) decode(payload []byte) error {
+	if len(payload) < 25 {
+		return errCorruptRecord
+	}
+	r.typ = recordType(payload[0])
+	r.revision = int64(binary.BigEndian.Uint64(payload[1:9]))
+	r.createRevision = int64(binary.BigEndian.Uint64(payload[9:17]))
+	r.timestamp = int64(binary.BigEndian.Uint64(payload[17:25]))
+	payload = payload[25:]
+
+	keyLen, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < keyLen {
+		return errCorruptRecord
+	}
+	r.key = string(payload[n : n+int(keyLen)])
+	payload = payload[n+int(keyLen):]
+
+	valueLen, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) != valueLen {
+		return errCorruptRecord
+	}
+	if valueLen > 0 {
+		r.value = payload[n:]
+	} else {
+		r.value = nil
+	}
+	switch r.typ {
+	case recordPut, recordDelete, recordRevision:
+	default:
+		return errCorruptRecord
+	}
+	return nil
+}
+
+// Reads records from the log until EOF. Returns the offset of the end of the
+// last valid record. If the final record cannot be read in full, or fails its
+// checksum, it is a torn write: it is skipped, and should be truncated by the
+// caller. An invalid record followed by more data cannot have been caused by
+// a torn write, and fails with a DataLoss error instead.
+func readLog(f *os.File, fn func(*record)) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(f)
+	var offset int64
+	header := make([]byte, recordHeaderSize)
+	var payload []byte
+	// Checks that the invalid record starting at offset, claiming the given
+	// payload size, is the last record in the log.
+	checkTail := func(size int64) error {
+		if offset+recordHeaderSize+size >= info.Size() {
+			return nil
+		}
+		return status.Errorf(codes.DataLoss, "corrupt log record at offset %d (log size %d)", offset, info.Size())
+	}
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return offset, nil
+			}
+			return offset, err
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if size > maxRecordSize {
+			return offset, checkTail(int64(size))
+		}
+		if cap(payload) < int(size) {
+			payload = make([]byte, size)
+		}
+		payload = payload[:size]
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return offset, nil
+			}
+			return offset, err
+		}
+		if crc32.Checksum(payload, crcTable) != checksum {
+			return offset, checkTail(int64(size))
+		}
+		var rec record
+		if err := rec.decode(payload); err != nil {
+			return offset, checkTail(int64(size))
+		}
+		// the payload buffer is reused, so the value must be copied
+		if rec.value != nil {
+			rec.value = append([]byte(nil), rec.value...)
+		}
+		fn(&rec)
+		offset += int64(recordHeaderSize) + int64(size)
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package storage_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/test/testutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+)
+
+type testDriverResult struct {
+	host, path string
+	name       string
+	verbose    bool
+	count      int
+	timeout    time.Duration
+	hasName    bool
+}
+
+var _ = Describe("Driver Registry", Label("unit"), func() {
+	var registry *storage.DriverRegistry[testDriverResult]
+	testDriver := storage.Driver[testDriverResult]{
+		Name:        "test",
+		Description: "a test driver",
+		Options: []storage.DriverOption{
+			{Name: "name", Type: storage.DriverOptionString, Description: "a string"},
+			{Name: "verbose", Type: storage.DriverOptionBool},
+			{Name: "count", Type: storage.DriverOptionInt, Default: "3"},
+			{Name: "timeout", Type: storage.DriverOptionDuration, Required: true},
+		},
+		Build: func(_ context.Context, conf storage.DriverConfig) (testDriverResult, error) {
+			return testDriverResult{
+				host:    conf.URI.Host,
+				path:    conf.URI.Path,
+				name:    conf.String("name"),
+				verbose: conf.Bool("verbose"),
+				count:   conf.Int("count"),
+				timeout: conf.Duration("timeout"),
+				hasName: conf.Has("name"),
+			}, nil
+		},
+	}
+	BeforeEach(func() {
+		registry = storage.NewDriverRegistry[testDriverResult]()
+		registry.Register(testDriver)
+	})
+
+	It("should build stores from uris", func(ctx SpecContext) {
+		res, err := registry.Open(ctx, "test://host:1234/a/b?name=foo&verbose=true&count=5&timeout=1m")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(testDriverResult{
+			host:    "host:1234",
+			path:    "/a/b",
+			name:    "foo",
+			verbose: true,
+			count:   5,
+			timeout: time.Minute,
+			hasName: true,
+		}))
+	})
+	It("should apply default values", func(ctx SpecContext) {
+		res, err := registry.Open(ctx, "TEST://?timeout=1s")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(testDriverResult{
+			count:   3,
+			timeout: time.Second,
+		}))
+	})
+	DescribeTable("rejecting invalid uris",
+		func(ctx SpecContext, uri string, msg string) {
+			_, err := registry.Open(ctx, uri)
+			Expect(err).To(testutil.MatchStatusCode(codes.InvalidArgument))
+			Expect(err.Error()).To(ContainSubstring(msg))
+		},
+		Entry("unknown driver", "foo://", `unknown storage driver "foo" (available drivers: test)`),
+		Entry("missing scheme", "/var/lib/cfg", "missing driver name"),
+		Entry("opaque uri", "test:foo", "expected test://"),
+		Entry("unknown option", "test://?timeout=1s&foo=bar", `unknown option "foo" (available options: name, verbose, count, timeout)`),
+		Entry("invalid bool", "test://?timeout=1s&verbose=maybe", `option "verbose": invalid bool "maybe"`),
+		Entry("invalid int", "test://?timeout=1s&count=x", `option "count": invalid int "x"`),
+		Entry("invalid duration", "test://?timeout=5", `option "timeout": invalid duration "5"`),
+		Entry("repeated option", "test://?timeout=1s&timeout=2s", `option "timeout" specified more than once`),
+		Entry("missing required option", "test://", `missing required option "timeout"`),
+	)
+	It("should list drivers by name", func() {
+		registry.Register(storage.Driver[testDriverResult]{
+			Name:  "a-test",
+			Build: testDriver.Build,
+		})
+		names := []string{}
+		for _, d := range registry.Drivers() {
+			names = append(names, d.Name)
+		}
+		Expect(names).To(Equal([]string{"a-test", "test"}))
+
+		registry.Unregister("a-test")
+		_, ok := registry.Lookup("a-test")
+		Expect(ok).To(BeFalse())
+	})
+	It("should describe the driver options", func() {
+		Expect(testDriver.Usage()).To(Equal(`
+test://
+  a test driver
+  name (string): a string
+  verbose (bool)
+  count (int) [default: 3]
+  timeout (duration) [required]`[1:]))
+	})
+	When("registering an invalid driver", func() {
+		It("should panic", func() {
+			Expect(func() { registry.Register(testDriver) }).To(PanicWith(ContainSubstring("already registered")))
+			Expect(func() {
+				registry.Register(storage.Driver[testDriverResult]{Name: "Invalid_Name", Build: testDriver.Build})
+			}).To(PanicWith(ContainSubstring("invalid driver name")))
+			Expect(func() {
+				registry.Register(storage.Driver[testDriverResult]{Name: "nobuild"})
+			}).To(PanicWith(ContainSubstring("no build function")))
+			Expect(func() {
+				registry.Register(storage.Driver[testDriverResult]{
+					Name:    "baddefault",
+					Options: []storage.DriverOption{{Name: "x", Type: storage.DriverOptionInt, Default: "x"}},
+					Build:   testDriver.Build,
+				})
+			}).To(PanicWith(ContainSubstring("invalid default value")))
+		})
+	})
+	It("should keep a separate value store registry for each value type", func() {
+		Expect(storage.ValueStoreDrivers[string]()).To(BeIdenticalTo(storage.ValueStoreDrivers[string]()))
+		Expect(storage.ValueStoreDrivers[[]byte]()).NotTo(BeIdenticalTo(storage.ValueStoreDrivers[string]()))
+	})
+})
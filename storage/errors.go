@@ -13,11 +13,16 @@ var (
 	ErrNotFound      = status.Error(codes.NotFound, "not found")
 	ErrAlreadyExists = status.Error(codes.AlreadyExists, "already exists")
 	ErrConflict      = lo.Must(status.New(codes.Aborted, "conflict").WithDetails(ErrDetailsConflict)).Err()
+	ErrLockNotHeld   = status.Error(codes.FailedPrecondition, "lock not held")
+	ErrNoTTL         = status.Error(codes.FailedPrecondition, "key does not have a ttl")
+	ErrCompacted     = lo.Must(status.New(codes.OutOfRange, "requested revision has been compacted").WithDetails(ErrDetailsCompacted)).Err()
+	ErrWatchOverflow = status.Error(codes.ResourceExhausted, "watch channel is full")
 )
 
 var (
 	ErrDetailsConflict      = &errdetails.ErrorInfo{Reason: "CONFLICT"}
 	ErrDetailsDiscontinuity = &errdetails.ErrorInfo{Reason: "DISCONTINUITY"}
+	ErrDetailsCompacted     = &errdetails.ErrorInfo{Reason: "COMPACTED"}
 )
 
 // Use this instead of errors.Is(err, ErrNotFound). The implementation of Is()
@@ -48,6 +53,23 @@ func IsConflict(err error) bool {
 	return false
 }
 
+// Reports whether the error indicates that a requested revision is no longer
+// available because it has been discarded from the store's history. This is
+// distinct from a NotFound error, which indicates that the key did not exist
+// at the requested revision.
+func IsCompacted(err error) bool {
+	stat := status.Convert(err)
+	if stat.Code() != codes.OutOfRange {
+		return false
+	}
+	for _, detail := range stat.Details() {
+		if proto.Equal(protoimpl.X.ProtoMessageV2Of(detail), ErrDetailsCompacted) {
+			return true
+		}
+	}
+	return false
+}
+
 func IsDiscontinuity(err error) bool {
 	stat := status.Convert(err)
 	if stat.Code() == codes.OK {
@@ -0,0 +1,323 @@
+package faulty
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/samber/lo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type Options struct {
+	seed               int64
+	minLatency         time.Duration
+	maxLatency         time.Duration
+	errorRates         map[codes.Code]float64
+	watchDropRate      float64
+	watchDuplicateRate float64
+	watchCloseRate     float64
+}
+
+type Option func(*Options)
+
+func (o *Options) apply(opts ...Option) {
+	for _, op := range opts {
+		op(o)
+	}
+}
+
+// Sets the seed used to decide which faults are injected. Two injectors
+// created with the same options and seed will inject the same faults, given
+// the same sequence of operations. Defaults to 0.
+func WithSeed(seed int64) Option {
+	return func(o *Options) {
+		o.seed = seed
+	}
+}
+
+// Delays each operation (and the start of each watch) by a random duration
+// between min and max, inclusive.
+func WithLatency(min, max time.Duration) Option {
+	if min < 0 || max < min {
+		panic(fmt.Sprintf("bug: invalid latency range [%s, %s]", min, max))
+	}
+	return func(o *Options) {
+		o.minLatency = min
+		o.maxLatency = max
+	}
+}
+
+// Fails the given fraction of operations with an error having the given
+// status code, without calling the underlying store. Errors with the Aborted
+// code are conflict errors (see [storage.IsConflict]), and are only injected
+// into write operations. Rates for different codes are cumulative, and must
+// not add up to more than 1.
+func WithErrorRate(code codes.Code, rate float64) Option {
+	if code == codes.OK {
+		panic("bug: cannot inject errors with code OK")
+	}
+	checkRate(rate)
+	return func(o *Options) {
+		if o.errorRates == nil {
+			o.errorRates = map[codes.Code]float64{}
+		}
+		o.errorRates[code] = rate
+	}
+}
+
+// Drops the given fraction of put and delete events from watches. Dropped
+// events are not sent again, even if the watch is resumed.
+func WithWatchDropRate(rate float64) Option {
+	checkRate(rate)
+	return func(o *Options) {
+		o.watchDropRate = rate
+	}
+}
+
+// Sends the given fraction of put and delete events from watches twice.
+func WithWatchDuplicateRate(rate float64) Option {
+	checkRate(rate)
+	return func(o *Options) {
+		o.watchDuplicateRate = rate
+	}
+}
+
+// Closes watch channels without sending an error event in place of the given
+// fraction of put and delete events. The event that would have been sent is
+// lost, and can be recovered by restarting the watch from its revision, as
+// kvutil.ResumeWatch does.
+func WithWatchCloseRate(rate float64) Option {
+	checkRate(rate)
+	return func(o *Options) {
+		o.watchCloseRate = rate
+	}
+}
+
+func checkRate(rate float64) {
+	if rate < 0 || rate > 1 {
+		panic(fmt.Sprintf("bug: invalid fault rate %v (must be between 0 and 1)", rate))
+	}
+}
+
+// Counts the faults injected by an [Injector].
+type Stats struct {
+	Errors           map[codes.Code]int
+	DroppedEvents    int
+	DuplicatedEvents int
+	ClosedWatches    int
+}
+
+// Decides which faults to inject into the stores it is used with. An injector
+// can be shared between several stores, in which case the faults injected
+// into each store depend on the order in which operations are made on all of
+// them.
+type Injector struct {
+	Options
+	errorCodes []codes.Code
+	disabled   atomic.Bool
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	stats Stats
+}
+
+func NewInjector(opts ...Option) *Injector {
+	options := Options{}
+	options.apply(opts...)
+
+	var total float64
+	for _, rate := range options.errorRates {
+		total += rate
+	}
+	if total > 1 {
+		panic(fmt.Sprintf("bug: error rates add up to %v (must be at most 1)", total))
+	}
+
+	// sorted, so that the same seed always selects the same code
+	errorCodes := lo.Keys(options.errorRates)
+	slices.Sort(errorCodes)
+
+	return &Injector{
+		Options:    options,
+		errorCodes: errorCodes,
+		rand:       rand.New(rand.NewSource(options.seed)),
+		stats: Stats{
+			Errors: map[codes.Code]int{},
+		},
+	}
+}
+
+// Stops injecting faults, including into the events of existing watches,
+// until [Injector.Enable] is called.
+func (i *Injector) Disable() {
+	i.disabled.Store(true)
+}
+
+// Resumes injecting faults after [Injector.Disable] was called.
+func (i *Injector) Enable() {
+	i.disabled.Store(false)
+}
+
+// Returns the number of faults injected so far.
+func (i *Injector) Stats() Stats {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	stats := i.stats
+	stats.Errors = maps.Clone(i.stats.Errors)
+	return stats
+}
+
+// Called before each operation. Waits for the injected latency, if any, then
+// returns the injected error, if any.
+func (i *Injector) before(ctx context.Context, write bool) error {
+	if i.disabled.Load() {
+		return nil
+	}
+	i.mu.Lock()
+	latency := i.minLatency
+	if i.maxLatency > i.minLatency {
+		latency += time.Duration(i.rand.Int63n(int64(i.maxLatency-i.minLatency) + 1))
+	}
+	var injected error
+	if len(i.errorCodes) > 0 {
+		n := i.rand.Float64()
+		for _, code := range i.errorCodes {
+			if n -= i.errorRates[code]; n >= 0 {
+				continue
+			}
+			if code == codes.Aborted {
+				if !write {
+					break
+				}
+				injected = storage.ErrConflict
+			} else {
+				injected = status.Errorf(code, "injected fault: %s", code)
+			}
+			i.stats.Errors[code]++
+			break
+		}
+	}
+	i.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(latency):
+		}
+	}
+	return injected
+}
+
+type watchFault int
+
+const (
+	watchFaultNone watchFault = iota
+	watchFaultDrop
+	watchFaultDuplicate
+	watchFaultClose
+)
+
+// Returns a function which decides the fault to inject for each event of a
+// new watch. Each watch has its own source of randomness, derived from the
+// injector's, so that the faults injected into a watch do not depend on how
+// its events are interleaved with other operations.
+func (i *Injector) newWatch() func() watchFault {
+	if i.watchDropRate+i.watchDuplicateRate+i.watchCloseRate == 0 {
+		return func() watchFault { return watchFaultNone }
+	}
+	i.mu.Lock()
+	rand := rand.New(rand.NewSource(i.rand.Int63()))
+	i.mu.Unlock()
+	return func() watchFault {
+		if i.disabled.Load() {
+			return watchFaultNone
+		}
+		var fault watchFault
+		switch n := rand.Float64(); {
+		case n < i.watchCloseRate:
+			fault = watchFaultClose
+		case n < i.watchCloseRate+i.watchDropRate:
+			fault = watchFaultDrop
+		case n < i.watchCloseRate+i.watchDropRate+i.watchDuplicateRate:
+			fault = watchFaultDuplicate
+		default:
+			return watchFaultNone
+		}
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		switch fault {
+		case watchFaultClose:
+			i.stats.ClosedWatches++
+		case watchFaultDrop:
+			i.stats.DroppedEvents++
+		case watchFaultDuplicate:
+			i.stats.DuplicatedEvents++
+		}
+		return fault
+	}
+}
+
+// Starts a watch using the given function, and injects faults into its
+// events.
+func injectWatchFaults[T any](
+	ctx context.Context,
+	i *Injector,
+	start func(ctx context.Context) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error),
+) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error) {
+	if err := i.before(ctx, false); err != nil {
+		return nil, err
+	}
+	next := i.newWatch()
+	ctx, ca := context.WithCancel(ctx)
+	wc, err := start(ctx)
+	if err != nil {
+		ca()
+		return nil, err
+	}
+	out := make(chan storage.WatchEvent[storage.KeyRevision[T]], 64)
+	go func() {
+		defer close(out)
+		defer ca()
+		send := func(ev storage.WatchEvent[storage.KeyRevision[T]]) bool {
+			select {
+			case out <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for ev := range wc {
+			switch ev.EventType {
+			case storage.WatchEventPut, storage.WatchEventDelete:
+			default:
+				if !send(ev) {
+					return
+				}
+				continue
+			}
+			switch next() {
+			case watchFaultClose:
+				return
+			case watchFaultDrop:
+				continue
+			case watchFaultDuplicate:
+				if !send(ev) {
+					return
+				}
+			}
+			if !send(ev) {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,36 @@
+package faulty_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/faulty"
+	"github.com/kralicky/protoconfig/storage/inmemory"
+	conformance_storage "github.com/kralicky/protoconfig/test/conformance/storage"
+	"github.com/kralicky/protoconfig/util/future"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestFaulty(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Faulty Suite")
+}
+
+// Stores which only inject latency should behave exactly like their base
+// stores.
+type latencyTestBroker struct{}
+
+func (latencyTestBroker) KeyValueStore(string) storage.KeyValueStore {
+	return faulty.NewKeyValueStore(inmemory.NewKeyValueStore(bytes.Clone),
+		faulty.NewInjector(faulty.WithLatency(0, time.Millisecond)))
+}
+
+var _ = Describe("Faulty KV Store", Ordered, Label("integration"), conformance_storage.KeyValueStoreTestSuite(future.Instant(latencyTestBroker{}), conformance_storage.NewBytes, Equal))
+
+var _ = Describe("Faulty Value Store", Label("integration"), conformance_storage.ValueStoreTestSuite(func() storage.ValueStoreT[[]byte] {
+	return faulty.NewValueStore(inmemory.NewValueStore(bytes.Clone),
+		faulty.NewInjector(faulty.WithLatency(0, time.Millisecond)))
+}, conformance_storage.NewBytes, Equal))
@@ -0,0 +1,239 @@
+package faulty_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/faulty"
+	"github.com/kralicky/protoconfig/storage/inmemory"
+	"github.com/kralicky/protoconfig/storage/kvutil"
+	"github.com/kralicky/protoconfig/test/testutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func putN(ctx context.Context, store storage.KeyValueStore, n int) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = store.Put(ctx, "key", []byte(fmt.Sprint(i)))
+	}
+	return errs
+}
+
+func codesOf(errs []error) []codes.Code {
+	result := make([]codes.Code, len(errs))
+	for i, err := range errs {
+		result[i] = status.Code(err)
+	}
+	return result
+}
+
+var _ = Describe("Fault Injection", Label("unit"), func() {
+	var base storage.KeyValueStore
+	BeforeEach(func() {
+		base = inmemory.NewKeyValueStore(bytes.Clone)
+	})
+
+	Context("errors", func() {
+		It("should inject errors at the configured rates", func(ctx SpecContext) {
+			injector := faulty.NewInjector(
+				faulty.WithSeed(GinkgoRandomSeed()),
+				faulty.WithErrorRate(codes.Unavailable, 0.25),
+				faulty.WithErrorRate(codes.Aborted, 0.25),
+			)
+			store := faulty.NewKeyValueStore(base, injector)
+
+			errs := putN(ctx, store, 1000)
+			stats := injector.Stats()
+			Expect(stats.Errors[codes.Unavailable]).To(BeNumerically("~", 250, 60))
+			Expect(stats.Errors[codes.Aborted]).To(BeNumerically("~", 250, 60))
+
+			var failed int
+			for _, err := range errs {
+				switch status.Code(err) {
+				case codes.OK:
+				case codes.Aborted:
+					Expect(storage.IsConflict(err)).To(BeTrue())
+					failed++
+				case codes.Unavailable:
+					failed++
+				default:
+					Fail(fmt.Sprintf("unexpected error: %v", err))
+				}
+			}
+			Expect(failed).To(Equal(stats.Errors[codes.Unavailable] + stats.Errors[codes.Aborted]))
+
+			By("checking that failed operations were not passed through")
+			var revision int64
+			_, err := base.Get(ctx, "key", storage.WithRevisionOut(&revision))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(revision).To(BeEquivalentTo(1000 - failed))
+		})
+
+		It("should be reproducible from a seed", func(ctx SpecContext) {
+			newStore := func(seed int64) storage.KeyValueStore {
+				return faulty.NewKeyValueStore(inmemory.NewKeyValueStore(bytes.Clone), faulty.NewInjector(
+					faulty.WithSeed(seed),
+					faulty.WithErrorRate(codes.Unavailable, 0.3),
+					faulty.WithErrorRate(codes.Internal, 0.1),
+				))
+			}
+			seed := GinkgoRandomSeed()
+			first := codesOf(putN(ctx, newStore(seed), 100))
+			Expect(codesOf(putN(ctx, newStore(seed), 100))).To(Equal(first))
+			Expect(codesOf(putN(ctx, newStore(seed+1), 100))).NotTo(Equal(first))
+		})
+
+		It("should only inject conflicts into writes", func(ctx SpecContext) {
+			Expect(base.Put(ctx, "key", []byte("value"))).To(Succeed())
+			store := faulty.NewKeyValueStore(base, faulty.NewInjector(faulty.WithErrorRate(codes.Aborted, 1)))
+
+			_, err := store.Get(ctx, "key")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = store.History(ctx, "key")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = store.ListKeys(ctx, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(storage.IsConflict(store.Put(ctx, "key", []byte("value2")))).To(BeTrue())
+			Expect(storage.IsConflict(store.Delete(ctx, "key"))).To(BeTrue())
+			_, err = store.(storage.Txner[[]byte]).Txn(ctx, storage.TxnRequest[[]byte]{
+				Ops: []storage.TxnOp[[]byte]{storage.TxnPut("key", []byte("value3"))},
+			})
+			Expect(storage.IsConflict(err)).To(BeTrue())
+		})
+
+		It("should stop injecting errors while disabled", func(ctx SpecContext) {
+			injector := faulty.NewInjector(faulty.WithErrorRate(codes.Unavailable, 1))
+			store := faulty.NewKeyValueStore(base, injector)
+			Expect(store.Put(ctx, "key", []byte("value"))).To(testutil.MatchStatusCode(codes.Unavailable))
+
+			injector.Disable()
+			Expect(store.Put(ctx, "key", []byte("value"))).To(Succeed())
+
+			injector.Enable()
+			Expect(store.Put(ctx, "key", []byte("value"))).To(testutil.MatchStatusCode(codes.Unavailable))
+			Expect(injector.Stats().Errors).To(HaveKeyWithValue(codes.Unavailable, 2))
+		})
+	})
+
+	Context("latency", func() {
+		It("should delay operations", func(ctx SpecContext) {
+			store := faulty.NewKeyValueStore(base, faulty.NewInjector(faulty.WithLatency(50*time.Millisecond, 60*time.Millisecond)))
+			start := time.Now()
+			Expect(store.Put(ctx, "key", []byte("value"))).To(Succeed())
+			Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+		})
+
+		It("should stop waiting when the context is canceled", func() {
+			store := faulty.NewKeyValueStore(base, faulty.NewInjector(faulty.WithLatency(time.Hour, time.Hour)))
+			ctx, ca := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer ca()
+			_, err := store.Get(ctx, "key")
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+		})
+	})
+
+	Context("watches", func() {
+		receiveAll := func(wc <-chan storage.WatchEvent[storage.KeyRevision[[]byte]]) []int64 {
+			var revisions []int64
+			for {
+				select {
+				case ev, ok := <-wc:
+					if !ok {
+						return revisions
+					}
+					revisions = append(revisions, ev.Current.Revision())
+				case <-time.After(100 * time.Millisecond):
+					return revisions
+				}
+			}
+		}
+		writeRevisions := func(ctx context.Context, n int) []int64 {
+			var revisions []int64
+			for i := 0; i < n; i++ {
+				var rev int64
+				Expect(base.Put(ctx, "key", []byte(fmt.Sprint(i)), storage.WithRevisionOut(&rev))).To(Succeed())
+				revisions = append(revisions, rev)
+			}
+			return revisions
+		}
+
+		It("should drop events", func(ctx SpecContext) {
+			injector := faulty.NewInjector(faulty.WithSeed(GinkgoRandomSeed()), faulty.WithWatchDropRate(0.5))
+			wc, err := faulty.NewKeyValueStore(base, injector).Watch(ctx, "key")
+			Expect(err).NotTo(HaveOccurred())
+
+			written := writeRevisions(ctx, 20)
+			received := receiveAll(wc)
+			Expect(written).To(ContainElements(received))
+			Expect(received).To(HaveLen(len(written) - injector.Stats().DroppedEvents))
+		})
+
+		It("should duplicate events", func(ctx SpecContext) {
+			wc, err := faulty.NewKeyValueStore(base, faulty.NewInjector(faulty.WithWatchDuplicateRate(1))).Watch(ctx, "key")
+			Expect(err).NotTo(HaveOccurred())
+
+			written := writeRevisions(ctx, 3)
+			Expect(receiveAll(wc)).To(Equal([]int64{
+				written[0], written[0],
+				written[1], written[1],
+				written[2], written[2],
+			}))
+		})
+
+		It("should close the watch channel without an error event", func(ctx SpecContext) {
+			injector := faulty.NewInjector(faulty.WithWatchCloseRate(1))
+			wc, err := faulty.NewKeyValueStore(base, injector).Watch(ctx, "key")
+			Expect(err).NotTo(HaveOccurred())
+
+			writeRevisions(ctx, 3)
+			Eventually(wc).Should(BeClosed())
+			Expect(injector.Stats().ClosedWatches).To(Equal(1))
+		})
+
+		It("should allow closed watches to be resumed without missing events", func(ctx SpecContext) {
+			injector := faulty.NewInjector(faulty.WithSeed(GinkgoRandomSeed()), faulty.WithWatchCloseRate(0.3))
+			store := faulty.NewKeyValueStore(base, injector)
+			written := writeRevisions(ctx, 1)
+			wc, err := kvutil.ResumeWatch(ctx, func(ctx context.Context, opts ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[[]byte]], error) {
+				return store.Watch(ctx, "key", opts...)
+			}, storage.WithRevision(written[0]))
+			Expect(err).NotTo(HaveOccurred())
+
+			written = append(written, writeRevisions(ctx, 20)...)
+			var received []int64
+			Eventually(func() []int64 {
+				received = append(received, receiveAll(wc)...)
+				return received
+			}).WithTimeout(10 * time.Second).Should(Equal(written))
+			Expect(injector.Stats().ClosedWatches).To(BeNumerically(">", 0))
+		})
+
+		It("should inject errors when starting watches", func(ctx SpecContext) {
+			store := faulty.NewValueStore(inmemory.NewValueStore(bytes.Clone), faulty.NewInjector(faulty.WithErrorRate(codes.Unavailable, 1)))
+			_, err := store.Watch(ctx)
+			Expect(err).To(testutil.MatchStatusCode(codes.Unavailable))
+		})
+	})
+
+	It("should preserve optional interfaces of the base store", func() {
+		store := faulty.NewKeyValueStore(base, faulty.NewInjector())
+		_, ok := store.(storage.Txner[[]byte])
+		Expect(ok).To(BeTrue())
+		_, ok = store.(storage.BatchReader[[]byte])
+		Expect(ok).To(BeTrue())
+
+		By("wrapping a store without any optional interfaces")
+		store = faulty.NewKeyValueStore(struct{ storage.KeyValueStore }{base}, faulty.NewInjector())
+		_, ok = store.(storage.Txner[[]byte])
+		Expect(ok).To(BeFalse())
+		_, ok = store.(storage.BatchReader[[]byte])
+		Expect(ok).To(BeFalse())
+	})
+})
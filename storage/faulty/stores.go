@@ -0,0 +1,143 @@
+package faulty
+
+import (
+	"context"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/kvutil"
+)
+
+// Returns a store which injects faults decided by the injector into each
+// operation before passing it through to the base store.
+//
+// The returned store implements each of [storage.Txner],
+// [storage.BatchReader], and [storage.KeepAliver] if the base store does.
+func NewKeyValueStore[T any](base storage.KeyValueStoreT[T], injector *Injector) storage.KeyValueStoreT[T] {
+	return kvutil.WithOptionalInterfaces(base, &kvStore[T]{
+		base:     base,
+		injector: injector,
+	})
+}
+
+type kvStore[T any] struct {
+	base     storage.KeyValueStoreT[T]
+	injector *Injector
+}
+
+func (s *kvStore[T]) Put(ctx context.Context, key string, value T, opts ...storage.PutOpt) error {
+	if err := s.injector.before(ctx, true); err != nil {
+		return err
+	}
+	return s.base.Put(ctx, key, value, opts...)
+}
+
+func (s *kvStore[T]) Get(ctx context.Context, key string, opts ...storage.GetOpt) (T, error) {
+	if err := s.injector.before(ctx, false); err != nil {
+		var zero T
+		return zero, err
+	}
+	return s.base.Get(ctx, key, opts...)
+}
+
+func (s *kvStore[T]) Watch(ctx context.Context, key string, opts ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error) {
+	return injectWatchFaults(ctx, s.injector, func(ctx context.Context) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error) {
+		return s.base.Watch(ctx, key, opts...)
+	})
+}
+
+func (s *kvStore[T]) Delete(ctx context.Context, key string, opts ...storage.DeleteOpt) error {
+	if err := s.injector.before(ctx, true); err != nil {
+		return err
+	}
+	return s.base.Delete(ctx, key, opts...)
+}
+
+func (s *kvStore[T]) ListKeys(ctx context.Context, prefix string, opts ...storage.ListOpt) ([]string, error) {
+	if err := s.injector.before(ctx, false); err != nil {
+		return nil, err
+	}
+	return s.base.ListKeys(ctx, prefix, opts...)
+}
+
+func (s *kvStore[T]) History(ctx context.Context, key string, opts ...storage.HistoryOpt) ([]storage.KeyRevision[T], error) {
+	if err := s.injector.before(ctx, false); err != nil {
+		return nil, err
+	}
+	return s.base.History(ctx, key, opts...)
+}
+
+func (s *kvStore[T]) Txn(ctx context.Context, req storage.TxnRequest[T]) (*storage.TxnResponse, error) {
+	if err := s.injector.before(ctx, true); err != nil {
+		return nil, err
+	}
+	return s.base.(storage.Txner[T]).Txn(ctx, req)
+}
+
+func (s *kvStore[T]) List(ctx context.Context, prefix string, opts ...storage.ListOpt) ([]storage.KeyRevision[T], error) {
+	if err := s.injector.before(ctx, false); err != nil {
+		return nil, err
+	}
+	return s.base.(storage.BatchReader[T]).List(ctx, prefix, opts...)
+}
+
+func (s *kvStore[T]) GetMany(ctx context.Context, keys []string) ([]storage.KeyRevision[T], error) {
+	if err := s.injector.before(ctx, false); err != nil {
+		return nil, err
+	}
+	return s.base.(storage.BatchReader[T]).GetMany(ctx, keys)
+}
+
+func (s *kvStore[T]) KeepAlive(ctx context.Context, key string) error {
+	if err := s.injector.before(ctx, false); err != nil {
+		return err
+	}
+	return s.base.(storage.KeepAliver).KeepAlive(ctx, key)
+}
+
+// Like [NewKeyValueStore], but for a single value store.
+func NewValueStore[T any](base storage.ValueStoreT[T], injector *Injector) storage.ValueStoreT[T] {
+	return &valueStore[T]{
+		base:     base,
+		injector: injector,
+	}
+}
+
+type valueStore[T any] struct {
+	base     storage.ValueStoreT[T]
+	injector *Injector
+}
+
+func (s *valueStore[T]) Put(ctx context.Context, value T, opts ...storage.PutOpt) error {
+	if err := s.injector.before(ctx, true); err != nil {
+		return err
+	}
+	return s.base.Put(ctx, value, opts...)
+}
+
+func (s *valueStore[T]) Get(ctx context.Context, opts ...storage.GetOpt) (T, error) {
+	if err := s.injector.before(ctx, false); err != nil {
+		var zero T
+		return zero, err
+	}
+	return s.base.Get(ctx, opts...)
+}
+
+func (s *valueStore[T]) Watch(ctx context.Context, opts ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error) {
+	return injectWatchFaults(ctx, s.injector, func(ctx context.Context) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error) {
+		return s.base.Watch(ctx, opts...)
+	})
+}
+
+func (s *valueStore[T]) Delete(ctx context.Context, opts ...storage.DeleteOpt) error {
+	if err := s.injector.before(ctx, true); err != nil {
+		return err
+	}
+	return s.base.Delete(ctx, opts...)
+}
+
+func (s *valueStore[T]) History(ctx context.Context, opts ...storage.HistoryOpt) ([]storage.KeyRevision[T], error) {
+	if err := s.injector.before(ctx, false); err != nil {
+		return nil, err
+	}
+	return s.base.History(ctx, opts...)
+}
@@ -0,0 +1,124 @@
+package inmemory
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/samber/lo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type inMemoryKeyValueStoreBroker[T any] struct {
+	mu         sync.Mutex
+	newStore   func() storage.KeyValueStoreT[T]
+	namespaces map[string]storage.KeyValueStoreT[T]
+}
+
+// Returns a broker which keeps a separate in-memory key-value store for each
+// namespace, created with [NewKeyValueStore] and the given clone function and
+// options. Requesting the same namespace again returns the same store.
+//
+// The broker implements [storage.NamespaceManager]. Namespaces must be
+// non-empty and must not contain "/", so that they can be used
+// interchangeably with brokers which map namespaces to key prefixes.
+func NewKeyValueStoreBroker[T any](cloneFunc func(T) T, opts ...ValueStoreOption) storage.KeyValueStoreTBroker[T] {
+	return &inMemoryKeyValueStoreBroker[T]{
+		newStore: func() storage.KeyValueStoreT[T] {
+			return NewKeyValueStore(cloneFunc, opts...)
+		},
+		namespaces: map[string]storage.KeyValueStoreT[T]{},
+	}
+}
+
+// KeyValueStore implements storage.KeyValueStoreTBroker.
+func (b *inMemoryKeyValueStoreBroker[T]) KeyValueStore(namespace string) storage.KeyValueStoreT[T] {
+	if err := validateNamespace(namespace); err != nil {
+		panic(fmt.Sprintf("bug: %v", err))
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if store, ok := b.namespaces[namespace]; ok {
+		return store
+	}
+	store := b.newStore()
+	b.namespaces[namespace] = store
+	return store
+}
+
+// ListNamespaces implements storage.NamespaceManager.
+func (b *inMemoryKeyValueStoreBroker[T]) ListNamespaces(ctx context.Context) ([]string, error) {
+	b.mu.Lock()
+	stores := lo.Entries(b.namespaces)
+	b.mu.Unlock()
+
+	var namespaces []string
+	for _, e := range stores {
+		keys, err := e.Value.ListKeys(ctx, "", storage.WithLimit(1))
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 {
+			namespaces = append(namespaces, e.Key)
+		}
+	}
+	slices.Sort(namespaces)
+	return namespaces, nil
+}
+
+// DeleteNamespace implements storage.NamespaceManager.
+//
+// The store for the namespace is kept, along with the history of its keys,
+// so that stores previously obtained from the broker remain consistent with
+// stores obtained later.
+func (b *inMemoryKeyValueStoreBroker[T]) DeleteNamespace(ctx context.Context, namespace string) error {
+	store, ok, err := b.lookup(namespace)
+	if err != nil || !ok {
+		return err
+	}
+	return store.Delete(ctx, "", storage.WithPrefix())
+}
+
+// NamespaceStats implements storage.NamespaceManager.
+func (b *inMemoryKeyValueStoreBroker[T]) NamespaceStats(ctx context.Context, namespace string) (storage.NamespaceStats, error) {
+	store, ok, err := b.lookup(namespace)
+	if err != nil || !ok {
+		return storage.NamespaceStats{}, err
+	}
+	entries, err := store.(storage.BatchReader[T]).List(ctx, "")
+	if err != nil {
+		return storage.NamespaceStats{}, err
+	}
+	stats := storage.NamespaceStats{
+		Keys: int64(len(entries)),
+	}
+	for _, kr := range entries {
+		stats.Revision = max(stats.Revision, kr.Revision())
+	}
+	return stats, nil
+}
+
+// Returns the store for the namespace, if it has been created.
+func (b *inMemoryKeyValueStoreBroker[T]) lookup(namespace string) (storage.KeyValueStoreT[T], bool, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, false, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	store, ok := b.namespaces[namespace]
+	return store, ok, nil
+}
+
+func validateNamespace(namespace string) error {
+	if namespace == "" {
+		return status.Errorf(codes.InvalidArgument, "namespace cannot be empty")
+	}
+	if strings.Contains(namespace, "/") {
+		return status.Errorf(codes.InvalidArgument, "namespace cannot contain '/': %q", namespace)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package inmemory
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/kralicky/protoconfig/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	storage.KeyValueStoreDrivers.Register(storage.Driver[storage.KeyValueStore]{
+		Name:        "memory",
+		Description: "Stores keys in memory. Each URI opens a new, empty store; the URI must not have a host or path.",
+		Options: []storage.DriverOption{
+			{
+				Name:        "history-limit",
+				Type:        storage.DriverOptionInt,
+				Description: "maximum number of revisions to retain for each key, or 0 for no limit",
+				Default:     "64",
+			},
+			{
+				Name:        "history-max-age",
+				Type:        storage.DriverOptionDuration,
+				Description: "discard revisions older than this age",
+			},
+		},
+		Build: func(_ context.Context, conf storage.DriverConfig) (storage.KeyValueStore, error) {
+			if conf.URI.Host != "" || (conf.URI.Path != "" && conf.URI.Path != "/") {
+				return nil, status.Errorf(codes.InvalidArgument, "memory: unexpected host or path in uri %q", conf.URI.Redacted())
+			}
+			if conf.Int("history-limit") < 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "memory: history-limit must not be negative")
+			}
+			if conf.Duration("history-max-age") < 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "memory: history-max-age must not be negative")
+			}
+			return NewKeyValueStore(bytes.Clone,
+				WithHistoryLimit(conf.Int("history-limit")),
+				WithHistoryMaxAge(conf.Duration("history-max-age")),
+			), nil
+		},
+	})
+}
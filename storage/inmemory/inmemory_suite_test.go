@@ -17,10 +17,14 @@ func TestInmemory(t *testing.T) {
 	RunSpecs(t, "Inmemory Suite")
 }
 
-type testBroker struct{}
+var testBroker = future.Instant(inmemory.NewKeyValueStoreBroker(bytes.Clone))
 
-func (t testBroker) KeyValueStore(string) storage.KeyValueStore {
-	return inmemory.NewKeyValueStore(bytes.Clone)
-}
+var _ = Describe("In-memory KV Store", Ordered, Label("integration"), conformance_storage.KeyValueStoreTestSuite(testBroker, conformance_storage.NewBytes, Equal))
+
+var _ = Describe("In-memory KV Store Broker", Ordered, Label("integration"), conformance_storage.KeyValueStoreBrokerTestSuite(testBroker, conformance_storage.NewBytes, Equal))
+
+var _ = Describe("In-memory Lock Manager", Ordered, Label("integration"), conformance_storage.LockManagerTestSuite(future.Instant(inmemory.NewLockManager())))
 
-var _ = Describe("In-memory KV Store", Ordered, Label("integration"), conformance_storage.KeyValueStoreTestSuite(future.Instant(testBroker{}), conformance_storage.NewBytes, Equal))
+var _ = Describe("In-memory Value Store", Label("integration"), conformance_storage.ValueStoreTestSuite(func() storage.ValueStoreT[[]byte] {
+	return inmemory.NewValueStore(bytes.Clone)
+}, conformance_storage.NewBytes, Equal))
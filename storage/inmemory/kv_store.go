@@ -1,8 +1,11 @@
 package inmemory
 
 import (
+	"cmp"
 	"context"
 	"errors"
+	"fmt"
+	"slices"
 	"strings"
 	"sync"
 
@@ -25,17 +28,18 @@ type activeWatch[T any] struct {
 	ctx           context.Context
 	cancel        context.CancelFunc
 	watchedStores map[string]storage.ValueStoreT[T]
-	ch            chan storage.WatchEvent[storage.KeyRevision[T]]
-	wg            sync.WaitGroup
 	addWatch      func(string, storage.ValueStoreT[T]) error
 }
 
-func NewKeyValueStore[T any](cloneFunc func(T) T) storage.KeyValueStoreT[T] {
+// Returns a new key-value store for any type T that can be cloned using the
+// provided clone function. The options are applied to the value store
+// created for each key.
+func NewKeyValueStore[T any](cloneFunc func(T) T, opts ...ValueStoreOption) storage.KeyValueStoreT[T] {
 	return &inMemoryKeyValueStore[T]{
 		keys:    art.New(),
 		watches: map[string]*activeWatch[T]{},
 		newValueStore: func(string) storage.ValueStoreT[T] {
-			return NewValueStore[T](cloneFunc)
+			return NewValueStore[T](cloneFunc, opts...)
 		},
 	}
 }
@@ -50,6 +54,17 @@ func NewCustomKeyValueStore[T any](newValueStore func(string) storage.ValueStore
 
 // Delete implements storage.KeyValueStoreT.
 func (m *inMemoryKeyValueStore[T]) Delete(ctx context.Context, key string, opts ...storage.DeleteOpt) error {
+	options := storage.DeleteOptions{}
+	options.Apply(opts...)
+	if options.Prefix {
+		if options.Revision != nil {
+			return status.Errorf(codes.InvalidArgument, "revision cannot be used when deleting a prefix")
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.deletePrefixLocked(ctx, key)
+	}
+
 	if err := validateKey(key); err != nil {
 		return err
 	}
@@ -85,11 +100,14 @@ func (m *inMemoryKeyValueStore[T]) Get(ctx context.Context, key string, opts ...
 
 // Watch implements storage.KeyValueStoreT.
 func (m *inMemoryKeyValueStore[T]) Watch(ctx context.Context, key string, opts ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error) {
-	if err := validateKey(key); err != nil {
-		return nil, err
-	}
 	options := storage.WatchOptions{}
 	options.Apply(opts...)
+	// in prefix mode, key can be "" to watch all keys
+	if !options.Prefix {
+		if err := validateKey(key); err != nil {
+			return nil, err
+		}
+	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -114,10 +132,8 @@ func (m *inMemoryKeyValueStore[T]) Watch(ctx context.Context, key string, opts .
 		vsOpts = append(vsOpts, storage.WithRevision(*options.Revision))
 	}
 
-	aggregated := make(chan storage.WatchEvent[storage.KeyRevision[T]], 128)
 	watch := activeWatch[T]{
 		watchedStores: matchingStores,
-		ch:            aggregated,
 	}
 	if options.Prefix {
 		watch.matchesKey = func(k string) bool {
@@ -128,38 +144,57 @@ func (m *inMemoryKeyValueStore[T]) Watch(ctx context.Context, key string, opts .
 			return k == key
 		}
 	}
-	watch.ctx, watch.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	watch.ctx, watch.cancel = context.WithCancel(ctx)
 
+	// Events of each key are sent to the queue, which applies the overflow
+	// policy. Until the queue is created, events (including replayed events)
+	// are collected so that they can be sent in revision order.
+	var (
+		queueMu sync.Mutex
+		queue   *storage.WatchQueue[T]
+		initial []storage.WatchEvent[storage.KeyRevision[T]]
+	)
+	sendFunc := func(key string) func(storage.WatchEvent[storage.KeyRevision[T]]) {
+		return func(event storage.WatchEvent[storage.KeyRevision[T]]) {
+			setEventKey(event, key)
+			queueMu.Lock()
+			defer queueMu.Unlock()
+			if queue == nil {
+				initial = append(initial, event)
+				return
+			}
+			queue.Send(event)
+		}
+	}
 	addWatch := func(key string, vs storage.ValueStoreT[T]) error {
+		if l, ok := vs.(listener[T]); ok {
+			vsOptions := storage.WatchOptions{}
+			vsOptions.Apply(vsOpts...)
+			return l.listen(vsOptions, func(replay []storage.WatchEvent[storage.KeyRevision[T]]) (func(storage.WatchEvent[storage.KeyRevision[T]]), <-chan struct{}) {
+				send := sendFunc(key)
+				for _, event := range replay {
+					send(event)
+				}
+				return send, watch.ctx.Done()
+			})
+		}
+		// custom value stores are watched using their channels, whose events are
+		// forwarded to the queue
 		ch, err := vs.Watch(watch.ctx, vsOpts...)
 		if err != nil {
 			return err
 		}
-		watch.wg.Add(1)
+		send := sendFunc(key)
+		for i := len(ch); i > 0; i-- {
+			send(<-ch)
+		}
 		go func() {
-			defer watch.wg.Done()
-			for {
-				select {
-				case <-watch.ctx.Done():
-					return
-				case event, ok := <-ch:
-					if !ok {
-						return
-					}
-					if event.Current != nil {
-						event.Current.SetKey(key)
-					}
-					if event.Previous != nil {
-						event.Previous.SetKey(key)
-					}
-
-					aggregated <- event
-				}
+			for event := range ch {
+				send(event)
 			}
 		}()
 		return nil
 	}
-	watch.addWatch = addWatch
 
 	var errs []error
 	for key, vs := range matchingStores {
@@ -168,27 +203,41 @@ func (m *inMemoryKeyValueStore[T]) Watch(ctx context.Context, key string, opts .
 		}
 	}
 	if len(matchingStores) > 0 && len(errs) == len(matchingStores) {
-		// only bail out if we know none of the watches started successfully,
-		// otherwise it's not safe to close the channel
-		close(aggregated)
+		// only bail out if we know none of the watches started successfully
+		watch.cancel()
 		return nil, errors.Join(errs...)
 	}
+	watch.addWatch = addWatch
+
+	// the collected events are sent regardless of the overflow policy
+	queueMu.Lock()
+	slices.SortStableFunc(initial, func(a, b storage.WatchEvent[storage.KeyRevision[T]]) int {
+		return cmp.Compare(a.Revision, b.Revision)
+	})
+	var eventC <-chan storage.WatchEvent[storage.KeyRevision[T]]
+	queue, eventC = storage.NewWatchQueue(watch.ctx, options.OverflowPolicy, initial...)
+	queueMu.Unlock()
 
 	watchId := uuid.NewString()
 	m.watches[watchId] = &watch
 
-	if ctx != context.Background() && ctx != context.TODO() {
-		context.AfterFunc(ctx, func() {
-			m.mu.Lock()
-			delete(m.watches, watchId)
-			m.mu.Unlock()
+	go func() {
+		<-queue.Done()
+		m.mu.Lock()
+		delete(m.watches, watchId)
+		m.mu.Unlock()
+		watch.cancel()
+	}()
+	return eventC, nil
+}
 
-			watch.cancel()
-			watch.wg.Wait()
-			close(aggregated)
-		})
+func setEventKey[T any](event storage.WatchEvent[storage.KeyRevision[T]], key string) {
+	if event.Current != nil {
+		event.Current.SetKey(key)
+	}
+	if event.Previous != nil {
+		event.Previous.SetKey(key)
 	}
-	return aggregated, nil
 }
 
 // History implements storage.KeyValueStoreT.
@@ -224,7 +273,7 @@ func (m *inMemoryKeyValueStore[T]) ListKeys(ctx context.Context, prefix string,
 	var keys []string
 	m.keys.ForEachPrefix(art.Key([]byte(prefix)), func(node art.Node) (cont bool) {
 		if node.Value() != nil {
-			if _, err := node.Value().(storage.ValueStoreT[T]).Get(ctx); err != nil {
+			if _, err := node.Value().(storage.ValueStoreT[T]).Get(ctx); err != nil && !options.IncludeDeleted {
 				return true
 			}
 			keys = append(keys, string(node.Key()))
@@ -234,6 +283,74 @@ func (m *inMemoryKeyValueStore[T]) ListKeys(ctx context.Context, prefix string,
 	return keys, nil
 }
 
+// List implements storage.BatchReader.
+func (m *inMemoryKeyValueStore[T]) List(ctx context.Context, prefix string, opts ...storage.ListOpt) ([]storage.KeyRevision[T], error) {
+	options := storage.ListKeysOptions{}
+	options.Apply(opts...)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var results []storage.KeyRevision[T]
+	var more bool
+	m.keys.ForEachPrefix(art.Key([]byte(prefix)), func(node art.Node) (cont bool) {
+		if node.Kind() != art.Leaf {
+			return true
+		}
+		key := string(node.Key())
+		if options.StartAfter != nil && key <= *options.StartAfter {
+			return true
+		}
+		kr, err := getLatest(ctx, node.Value().(storage.ValueStoreT[T]))
+		if err != nil {
+			return true
+		}
+		if options.Limit != nil && int64(len(results)) == *options.Limit {
+			more = true
+			return false
+		}
+		kr.K = key
+		results = append(results, kr)
+		return true
+	})
+	if options.ContinueOut != nil {
+		*options.ContinueOut = ""
+		if more {
+			*options.ContinueOut = results[len(results)-1].Key()
+		}
+	}
+	return results, nil
+}
+
+// GetMany implements storage.BatchReader.
+func (m *inMemoryKeyValueStore[T]) GetMany(ctx context.Context, keys []string) ([]storage.KeyRevision[T], error) {
+	for _, key := range keys {
+		if err := validateKey(key); err != nil {
+			return nil, err
+		}
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	results := make([]storage.KeyRevision[T], 0, len(keys))
+	for _, key := range keys {
+		vs, ok := m.keys.Search(art.Key([]byte(key)))
+		if !ok {
+			continue
+		}
+		kr, err := getLatest(ctx, vs.(storage.ValueStoreT[T]))
+		if err != nil {
+			if storage.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		kr.K = key
+		results = append(results, kr)
+	}
+	return results, nil
+}
+
 // Put implements storage.KeyValueStoreT.
 func (m *inMemoryKeyValueStore[T]) Put(ctx context.Context, key string, value T, opts ...storage.PutOpt) error {
 	if err := validateKey(key); err != nil {
@@ -241,22 +358,264 @@ func (m *inMemoryKeyValueStore[T]) Put(ctx context.Context, key string, value T,
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	vs, ok := m.keys.Search(art.Key([]byte(key)))
-	var vst storage.ValueStoreT[T]
+	vst, err := m.getOrCreateLocked(key)
+	if err != nil {
+		return err
+	}
+	return vst.Put(ctx, value, opts...)
+}
+
+// KeepAlive implements storage.KeepAliver.
+func (m *inMemoryKeyValueStore[T]) KeepAlive(ctx context.Context, key string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok := m.keys.Search(art.Key([]byte(key)))
 	if !ok {
-		vst = m.newValueStore(key)
-		m.keys.Insert(art.Key([]byte(key)), vst)
-		for _, watch := range m.watches {
-			if watch.matchesKey(key) {
-				if err := watch.addWatch(key, vst); err != nil {
-					return err
+		return storage.ErrNotFound
+	}
+	ka, ok := value.(interface{ KeepAlive(context.Context) error })
+	if !ok {
+		return status.Errorf(codes.Unimplemented, "value store does not support ttls")
+	}
+	return ka.KeepAlive(ctx)
+}
+
+// Txn implements storage.Txner.
+func (m *inMemoryKeyValueStore[T]) Txn(ctx context.Context, req storage.TxnRequest[T]) (*storage.TxnResponse, error) {
+	if err := validateTxn(req); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, cmp := range req.Compare {
+		var rev int64
+		if value, ok := m.keys.Search(art.Key([]byte(cmp.Key))); ok {
+			_, err := value.(storage.ValueStoreT[T]).Get(ctx, storage.WithRevisionOut(&rev))
+			if err != nil && !storage.IsNotFound(err) {
+				return nil, err
+			}
+		}
+		if rev != cmp.Revision {
+			return nil, fmt.Errorf("%w: revision mismatch for key %q: %v (requested) != %v (actual)", storage.ErrConflict, cmp.Key, cmp.Revision, rev)
+		}
+	}
+
+	// Revisions are tracked per key, so for all keys in the transaction to share
+	// a single revision, each key's next revision is advanced to the smallest
+	// revision that is newer than all of them.
+	var txnRevision int64
+	for _, op := range req.Ops {
+		if value, ok := m.keys.Search(art.Key([]byte(op.Key))); ok {
+			if rs, ok := value.(revisionAdvancer); ok {
+				txnRevision = max(txnRevision, rs.currentRevision()+1)
+			}
+		} else {
+			txnRevision = max(txnRevision, 1)
+		}
+	}
+
+	resp := &storage.TxnResponse{}
+	// If an op fails, the ops applied before it are reverted, so that the
+	// transaction is never partially visible once Txn returns.
+	var undo []func(context.Context) error
+	rollback := func(err error) (*storage.TxnResponse, error) {
+		errs := []error{err}
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](ctx); err != nil {
+				errs = append(errs, fmt.Errorf("failed to roll back transaction: %w", err))
+			}
+		}
+		return nil, errors.Join(errs...)
+	}
+	for _, op := range req.Ops {
+		switch op.Type {
+		case storage.TxnOpPut:
+			vst, err := m.getOrCreateLocked(op.Key)
+			if err != nil {
+				return rollback(err)
+			}
+			restore, err := restoreFunc(ctx, vst)
+			if err != nil {
+				return rollback(err)
+			}
+			if rs, ok := vst.(revisionAdvancer); ok {
+				rs.advanceRevision(txnRevision)
+			}
+			var rev int64
+			if err := vst.Put(ctx, op.Value, storage.WithRevisionOut(&rev)); err != nil {
+				return rollback(err)
+			}
+			undo = append(undo, restore)
+			resp.Revision = max(resp.Revision, rev)
+		case storage.TxnOpDelete:
+			value, ok := m.keys.Search(art.Key([]byte(op.Key)))
+			if !ok {
+				continue
+			}
+			vst := value.(storage.ValueStoreT[T])
+			restore, err := restoreFunc(ctx, vst)
+			if err != nil {
+				return rollback(err)
+			}
+			if rs, ok := vst.(revisionAdvancer); ok {
+				rs.advanceRevision(txnRevision)
+			}
+			if err := vst.Delete(ctx); err != nil {
+				if storage.IsNotFound(err) {
+					continue
 				}
+				return rollback(err)
+			}
+			undo = append(undo, restore)
+			if rs, ok := vst.(revisionAdvancer); ok {
+				resp.Revision = max(resp.Revision, rs.currentRevision())
 			}
 		}
-	} else {
-		vst = vs.(storage.ValueStoreT[T])
 	}
-	return vst.Put(ctx, value, opts...)
+	return resp, nil
+}
+
+// Returns a function which writes the current value of vst back to it, or
+// deletes it if it has no value.
+func restoreFunc[T any](ctx context.Context, vst storage.ValueStoreT[T]) (func(context.Context) error, error) {
+	prev, err := vst.Get(ctx)
+	if err != nil {
+		if !storage.IsNotFound(err) {
+			return nil, err
+		}
+		return func(ctx context.Context) error {
+			if err := vst.Delete(ctx); err != nil && !storage.IsNotFound(err) {
+				return err
+			}
+			return nil
+		}, nil
+	}
+	return func(ctx context.Context) error {
+		return vst.Put(ctx, prev)
+	}, nil
+}
+
+// Deletes all keys starting with prefix at a single revision, in the same way
+// as a transaction deleting each of them.
+func (m *inMemoryKeyValueStore[T]) deletePrefixLocked(ctx context.Context, prefix string) error {
+	var live []storage.ValueStoreT[T]
+	var err error
+	m.keys.ForEachPrefix(art.Key([]byte(prefix)), func(node art.Node) (cont bool) {
+		if node.Value() == nil {
+			return true
+		}
+		vst := node.Value().(storage.ValueStoreT[T])
+		if _, err = vst.Get(ctx); err != nil {
+			if !storage.IsNotFound(err) {
+				return false
+			}
+			err = nil
+			return true
+		}
+		live = append(live, vst)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	var revision int64
+	for _, vst := range live {
+		if rs, ok := vst.(revisionAdvancer); ok {
+			revision = max(revision, rs.currentRevision()+1)
+		}
+	}
+	for _, vst := range live {
+		if rs, ok := vst.(revisionAdvancer); ok {
+			rs.advanceRevision(revision)
+		}
+		if err := vst.Delete(ctx); err != nil && !storage.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *inMemoryKeyValueStore[T]) getOrCreateLocked(key string) (storage.ValueStoreT[T], error) {
+	if vs, ok := m.keys.Search(art.Key([]byte(key))); ok {
+		return vs.(storage.ValueStoreT[T]), nil
+	}
+	vst := m.newValueStore(key)
+	m.keys.Insert(art.Key([]byte(key)), vst)
+	for _, watch := range m.watches {
+		if watch.matchesKey(key) {
+			if err := watch.addWatch(key, vst); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return vst, nil
+}
+
+// Implemented by value stores created by NewValueStore, so that events can be
+// sent to the watches of the key-value store without waiting for them to be
+// forwarded from the channel of each key. Custom value stores are watched
+// using their channels instead.
+type listener[T any] interface {
+	listen(
+		options storage.WatchOptions,
+		newListener func(replay []storage.WatchEvent[storage.KeyRevision[T]]) (send func(storage.WatchEvent[storage.KeyRevision[T]]), done <-chan struct{}),
+	) error
+}
+
+// Implemented by value stores created by NewValueStore, so that batch reads
+// can return the creation revision and version of each key. Custom value
+// stores are read using Get instead, without this metadata.
+type latestReader[T any] interface {
+	latest() (*storage.KeyRevisionImpl[T], error)
+}
+
+func getLatest[T any](ctx context.Context, vs storage.ValueStoreT[T]) (*storage.KeyRevisionImpl[T], error) {
+	if lr, ok := vs.(latestReader[T]); ok {
+		return lr.latest()
+	}
+	var rev int64
+	value, err := vs.Get(ctx, storage.WithRevisionOut(&rev))
+	if err != nil {
+		return nil, err
+	}
+	return &storage.KeyRevisionImpl[T]{V: value, Rev: rev}, nil
+}
+
+// Implemented by value stores created by NewValueStore. Custom value stores
+// which do not implement this interface can still be used in transactions,
+// but keys written in the same transaction may not share the same revision.
+type revisionAdvancer interface {
+	currentRevision() int64
+	advanceRevision(rev int64)
+}
+
+func validateTxn[T any](req storage.TxnRequest[T]) error {
+	for _, cmp := range req.Compare {
+		if err := validateKey(cmp.Key); err != nil {
+			return err
+		}
+	}
+	seen := make(map[string]struct{}, len(req.Ops))
+	for _, op := range req.Ops {
+		if err := validateKey(op.Key); err != nil {
+			return err
+		}
+		if _, ok := seen[op.Key]; ok {
+			return status.Errorf(codes.InvalidArgument, "duplicate key in transaction: %q", op.Key)
+		}
+		seen[op.Key] = struct{}{}
+		switch op.Type {
+		case storage.TxnOpPut, storage.TxnOpDelete:
+		default:
+			return status.Errorf(codes.InvalidArgument, "unknown transaction operation type: %v", op.Type)
+		}
+	}
+	return nil
 }
 
 func validateKey(key string) error {
@@ -136,4 +136,53 @@ var _ = Describe("InMemoryKeyValueStore", Label("unit"), func() {
 			})
 		})
 	})
+
+	Describe("Txn operation", func() {
+		When("an op fails after earlier ops were applied", func() {
+			It("should roll back the earlier ops", func() {
+				keyValueStore = inmemory.NewCustomKeyValueStore(func(string) storage.ValueStoreT[string] {
+					return &rejectingValueStore{
+						ValueStoreT: inmemory.NewValueStore(func(val string) string { return val }),
+						reject:      "bad",
+					}
+				})
+				Expect(keyValueStore.Put(ctx, "key1", "value1")).To(Succeed())
+				Expect(keyValueStore.Put(ctx, "key2", "value2")).To(Succeed())
+
+				txner := keyValueStore.(storage.Txner[string])
+				_, err := txner.Txn(ctx, storage.TxnRequest[string]{
+					Ops: []storage.TxnOp[string]{
+						{Type: storage.TxnOpPut, Key: "key1", Value: "value1-updated"},
+						{Type: storage.TxnOpDelete, Key: "key2"},
+						{Type: storage.TxnOpPut, Key: "key3", Value: "value3"},
+						{Type: storage.TxnOpPut, Key: "key4", Value: "bad"},
+					},
+				})
+				Expect(err).To(MatchError(ContainSubstring("rejected")))
+
+				value, err := keyValueStore.Get(ctx, "key1")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(Equal("value1"))
+				value, err = keyValueStore.Get(ctx, "key2")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(Equal("value2"))
+				_, err = keyValueStore.Get(ctx, "key3")
+				Expect(err).To(Equal(storage.ErrNotFound))
+				_, err = keyValueStore.Get(ctx, "key4")
+				Expect(err).To(Equal(storage.ErrNotFound))
+			})
+		})
+	})
 })
+
+type rejectingValueStore struct {
+	storage.ValueStoreT[string]
+	reject string
+}
+
+func (s *rejectingValueStore) Put(ctx context.Context, value string, opts ...storage.PutOpt) error {
+	if value == s.reject {
+		return status.Errorf(codes.InvalidArgument, "value %q rejected", value)
+	}
+	return s.ValueStoreT.Put(ctx, value, opts...)
+}
@@ -0,0 +1,123 @@
+package inmemory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kralicky/protoconfig/storage"
+)
+
+type inMemoryLockManager struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+// keyLock is shared between all Lock instances for the same key. The
+// semaphore has a capacity of 1; holding the lock means having sent a
+// value into it.
+type keyLock struct {
+	sem  chan struct{}
+	refs int
+}
+
+// Returns a new lock manager whose locks are only shared within the current
+// process. Because all state is held in memory, locks are always released
+// when the process exits, satisfying Liveliness A and B trivially.
+func NewLockManager() storage.LockManager {
+	return &inMemoryLockManager{
+		locks: map[string]*keyLock{},
+	}
+}
+
+// Locker implements storage.LockManager.
+func (m *inMemoryLockManager) Locker(key string) storage.Lock {
+	return &inMemoryLock{
+		manager: m,
+		key:     key,
+	}
+}
+
+func (m *inMemoryLockManager) ref(key string) *keyLock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kl, ok := m.locks[key]
+	if !ok {
+		kl = &keyLock{
+			sem: make(chan struct{}, 1),
+		}
+		m.locks[key] = kl
+	}
+	kl.refs++
+	return kl
+}
+
+func (m *inMemoryLockManager) unref(key string, kl *keyLock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kl.refs--
+	if kl.refs == 0 {
+		delete(m.locks, key)
+	}
+}
+
+type inMemoryLock struct {
+	manager *inMemoryLockManager
+	key     string
+
+	mu      sync.Mutex
+	held    *keyLock
+	expired chan struct{}
+}
+
+// Lock implements storage.Lock.
+func (l *inMemoryLock) Lock(ctx context.Context) (chan struct{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	kl := l.manager.ref(l.key)
+	select {
+	case kl.sem <- struct{}{}:
+		return l.acquired(kl), nil
+	case <-ctx.Done():
+		l.manager.unref(l.key, kl)
+		return nil, ctx.Err()
+	}
+}
+
+// TryLock implements storage.Lock.
+func (l *inMemoryLock) TryLock(ctx context.Context) (bool, chan struct{}, error) {
+	if err := ctx.Err(); err != nil {
+		return false, nil, err
+	}
+	kl := l.manager.ref(l.key)
+	select {
+	case kl.sem <- struct{}{}:
+		return true, l.acquired(kl), nil
+	default:
+		l.manager.unref(l.key, kl)
+		return false, nil, nil
+	}
+}
+
+func (l *inMemoryLock) acquired(kl *keyLock) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held = kl
+	l.expired = make(chan struct{})
+	return l.expired
+}
+
+// Unlock implements storage.Lock.
+func (l *inMemoryLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held == nil {
+		return storage.ErrLockNotHeld
+	}
+	close(l.expired)
+	<-l.held.sem
+	l.manager.unref(l.key, l.held)
+	l.held = nil
+	l.expired = nil
+	return nil
+}
@@ -1,44 +1,123 @@
 package inmemory
 
 import (
-	"container/ring"
+	"cmp"
 	"context"
 	"fmt"
-	"os"
-	"runtime"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/kralicky/protoconfig/storage"
 	"github.com/samber/lo"
-	"github.com/ttacon/chalk"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 type valueStoreElement[T any] struct {
-	revision  int64
-	timestamp time.Time
-	value     T
-	deleted   bool
+	revision       int64
+	createRevision int64
+	version        int64
+	timestamp      time.Time
+	value          T
+	deleted        bool
+}
+
+// Returns the element as a key revision, cloning its value if includeValue
+// is true.
+func (e *valueStoreElement[T]) keyRevision(cloneFunc func(T) T, includeValue bool) *storage.KeyRevisionImpl[T] {
+	kr := &storage.KeyRevisionImpl[T]{
+		Rev:       e.revision,
+		Time:      e.timestamp,
+		CreateRev: e.createRevision,
+		Ver:       e.version,
+		Tombstone: e.deleted,
+	}
+	if includeValue && !e.deleted {
+		kr.V = cloneFunc(e.value)
+	}
+	return kr
 }
 
 type inMemoryValueStore[T any] struct {
-	lock        sync.RWMutex
-	revision    int64
-	values      *ring.Ring
-	cloneFunc   func(T) T
+	ValueStoreOptions
+	lock     sync.RWMutex
+	revision int64
+	// Retained revisions, in order from oldest to newest. The latest revision
+	// is always retained.
+	values []*valueStoreElement[T]
+	// All revisions less than or equal to this revision have been discarded.
+	compactedRevision int64
+	cloneFunc         func(T) T
+	// If the value was written with a TTL, this timer will delete the value
+	// once it expires. The generation is incremented each time the timer is
+	// replaced so that stale timers which could not be stopped are ignored.
+	ttl           time.Duration
+	ttlTimer      *time.Timer
+	ttlGeneration int64
+	// Held while events are sent to watches, so that events are sent in the
+	// order in which they were written. Writers acquire it before releasing
+	// lock, and must not wait on watches while holding lock.
+	notifyLock  sync.Mutex
 	watchesLock sync.RWMutex
 	watches     map[string]func(storage.WatchEvent[storage.KeyRevision[T]])
 }
 
+type ValueStoreOptions struct {
+	historyLimit  int
+	historyMaxAge time.Duration
+}
+
+type ValueStoreOption func(*ValueStoreOptions)
+
+func (o *ValueStoreOptions) apply(opts ...ValueStoreOption) {
+	for _, op := range opts {
+		op(o)
+	}
+}
+
+// Sets the maximum number of revisions (including deletes) to retain. Once
+// the limit is reached, the oldest revisions are discarded. A limit of 0
+// retains an unlimited number of revisions. Defaults to 64.
+func WithHistoryLimit(limit int) ValueStoreOption {
+	return func(o *ValueStoreOptions) {
+		o.historyLimit = max(limit, 0)
+	}
+}
+
+// Discards revisions older than the given age. Revisions are only discarded
+// when a new revision is written, and the latest revision is never discarded
+// regardless of its age. An age of 0 disables age-based retention (default).
+func WithHistoryMaxAge(age time.Duration) ValueStoreOption {
+	return func(o *ValueStoreOptions) {
+		o.historyMaxAge = max(age, 0)
+	}
+}
+
+// Retains all revisions indefinitely.
+func WithUnboundedHistory() ValueStoreOption {
+	return func(o *ValueStoreOptions) {
+		o.historyLimit = 0
+		o.historyMaxAge = 0
+	}
+}
+
 // Returns a new value store for any type T that can be cloned using the provided clone function.
-func NewValueStore[T any](cloneFunc func(T) T) storage.ValueStoreT[T] {
+//
+// Requests for revisions which have been discarded according to the configured
+// retention options will return an error for which [storage.IsCompacted]
+// returns true.
+func NewValueStore[T any](cloneFunc func(T) T, opts ...ValueStoreOption) storage.ValueStoreT[T] {
+	options := ValueStoreOptions{
+		historyLimit: 64,
+	}
+	options.apply(opts...)
+
 	return &inMemoryValueStore[T]{
-		values:    ring.New(64),
-		watches:   make(map[string]func(storage.WatchEvent[storage.KeyRevision[T]])),
-		cloneFunc: cloneFunc,
+		ValueStoreOptions: options,
+		watches:           make(map[string]func(storage.WatchEvent[storage.KeyRevision[T]])),
+		cloneFunc:         cloneFunc,
 	}
 }
 
@@ -46,72 +125,163 @@ func (s *inMemoryValueStore[T]) isEmptyLocked() bool {
 	return s.revision == 0
 }
 
+func (s *inMemoryValueStore[T]) latestLocked() *valueStoreElement[T] {
+	if len(s.values) == 0 {
+		return nil
+	}
+	return s.values[len(s.values)-1]
+}
+
+// Returns the index of the element at the given revision, or an error if
+// the revision is not available. Deleted elements are not matched.
+func (s *inMemoryValueStore[T]) indexLocked(revision int64) (int, error) {
+	if revision > 0 && revision <= s.compactedRevision {
+		return 0, storage.ErrCompacted
+	}
+	idx, ok := slices.BinarySearchFunc(s.values, revision, func(e *valueStoreElement[T], rev int64) int {
+		return cmp.Compare(e.revision, rev)
+	})
+	if !ok || s.values[idx].deleted {
+		return 0, storage.ErrNotFound
+	}
+	return idx, nil
+}
+
+// Appends a new element and discards old elements according to the
+// configured retention options.
+func (s *inMemoryValueStore[T]) appendLocked(elem *valueStoreElement[T]) {
+	s.values = append(s.values, elem)
+
+	drop := 0
+	if s.historyLimit > 0 && len(s.values) > s.historyLimit {
+		drop = len(s.values) - s.historyLimit
+	}
+	if s.historyMaxAge > 0 {
+		cutoff := elem.timestamp.Add(-s.historyMaxAge)
+		for drop < len(s.values)-1 && s.values[drop].timestamp.Before(cutoff) {
+			drop++
+		}
+	}
+	if drop > 0 {
+		s.compactedRevision = s.values[drop-1].revision
+		clear(s.values[:drop])
+		s.values = s.values[drop:]
+	}
+}
+
+// Returns the current value with its metadata, or ErrNotFound if it does not
+// exist.
+func (s *inMemoryValueStore[T]) latest() (*storage.KeyRevisionImpl[T], error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.isEmptyLocked() || s.latestLocked().deleted {
+		return nil, storage.ErrNotFound
+	}
+	return s.latestLocked().keyRevision(s.cloneFunc, true), nil
+}
+
+// Returns the revision of the most recent write, including deletes.
+func (s *inMemoryValueStore[T]) currentRevision() int64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.revision
+}
+
+// Ensures the next write will be assigned a revision of at least rev.
+func (s *inMemoryValueStore[T]) advanceRevision(rev int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.revision < rev-1 {
+		s.revision = rev - 1
+	}
+}
+
 func (s *inMemoryValueStore[T]) Put(_ context.Context, value T, opts ...storage.PutOpt) error {
 	options := storage.PutOptions{}
 	options.Apply(opts...)
 
 	s.lock.Lock()
-	defer s.lock.Unlock()
+	newEvent, err := s.putLocked(value, options)
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	s.notifyAndUnlock(newEvent)
+	return nil
+}
+
+// Writes a new value, and returns a function which creates the corresponding
+// watch event.
+func (s *inMemoryValueStore[T]) putLocked(value T, options storage.PutOptions) (func() storage.WatchEvent[storage.KeyRevision[T]], error) {
 	if options.Revision != nil {
 		if *options.Revision == 0 {
-			if s.revision != 0 && !s.values.Value.(*valueStoreElement[T]).deleted {
-				return fmt.Errorf("%w: expected value not to exist (requested revision 0)", storage.ErrConflict)
+			if s.revision != 0 && !s.latestLocked().deleted {
+				return nil, fmt.Errorf("%w: expected value not to exist (requested revision 0)", storage.ErrConflict)
 			}
 		} else if *options.Revision != s.revision {
-			return fmt.Errorf("%w: revision mismatch: %v (requested) != %v (actual)", storage.ErrConflict, *options.Revision, s.revision)
+			return nil, fmt.Errorf("%w: revision mismatch: %v (requested) != %v (actual)", storage.ErrConflict, *options.Revision, s.revision)
 		}
 	}
-	previous := s.values.Value
+	if options.TTL != nil && *options.TTL <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "ttl must be positive")
+	}
+	previous := s.latestLocked()
 	s.revision++
-	next := s.values.Next()
+	revision := s.revision
 	timestamp := time.Now()
-	next.Value = &valueStoreElement[T]{
-		revision:  s.revision,
-		timestamp: timestamp,
-		value:     value,
+	if options.TTL != nil {
+		s.ttl = *options.TTL
+		s.resetTTLLocked()
+	}
+	var prevValue *valueStoreElement[T]
+	if previous != nil && !previous.deleted {
+		prevValue = previous
 	}
+	elem := &valueStoreElement[T]{
+		revision:       revision,
+		createRevision: revision,
+		version:        1,
+		timestamp:      timestamp,
+		value:          value,
+	}
+	if prevValue != nil {
+		elem.createRevision = prevValue.createRevision
+		elem.version = prevValue.version + 1
+	}
+	s.appendLocked(elem)
 	if options.RevisionOut != nil {
-		*options.RevisionOut = s.revision
+		*options.RevisionOut = revision
 	}
-	s.values = next
 
-	var prevValue *valueStoreElement[T]
-	if previous != nil && !previous.(*valueStoreElement[T]).deleted {
-		prevValue = previous.(*valueStoreElement[T])
-	}
-	var wg sync.WaitGroup
+	return func() storage.WatchEvent[storage.KeyRevision[T]] {
+		current := elem.keyRevision(s.cloneFunc, true)
+
+		var prev storage.KeyRevision[T]
+		if prevValue != nil {
+			prev = prevValue.keyRevision(s.cloneFunc, true)
+		}
+
+		return storage.WatchEvent[storage.KeyRevision[T]]{
+			EventType: storage.WatchEventPut,
+			Current:   current,
+			Previous:  prev,
+			Revision:  current.Rev,
+		}
+	}, nil
+}
+
+// Releases the store lock, then sends an event created by newEvent to each
+// active watch. Must be called with the store lock held for writing.
+func (s *inMemoryValueStore[T]) notifyAndUnlock(newEvent func() storage.WatchEvent[storage.KeyRevision[T]]) {
+	s.notifyLock.Lock()
+	defer s.notifyLock.Unlock()
+	s.lock.Unlock()
+
 	s.watchesLock.RLock()
 	defer s.watchesLock.RUnlock()
-	wg.Add(len(s.watches))
 	for _, listener := range s.watches {
-		listener := listener
-		go func() {
-			defer wg.Done()
-			current := &storage.KeyRevisionImpl[T]{
-				V:    s.cloneFunc(value),
-				Rev:  s.revision,
-				Time: timestamp,
-			}
-
-			var prev storage.KeyRevision[T]
-			if prevValue != nil {
-				prev = &storage.KeyRevisionImpl[T]{
-					V:    s.cloneFunc(prevValue.value),
-					Rev:  prevValue.revision,
-					Time: prevValue.timestamp,
-				}
-			}
-
-			listener(storage.WatchEvent[storage.KeyRevision[T]]{
-				EventType: storage.WatchEventPut,
-				Current:   current,
-				Previous:  prev,
-			})
-		}()
+		listener(newEvent())
 	}
-	wg.Wait()
-
-	return nil
 }
 
 func (s *inMemoryValueStore[T]) Get(_ context.Context, opts ...storage.GetOpt) (T, error) {
@@ -120,42 +290,24 @@ func (s *inMemoryValueStore[T]) Get(_ context.Context, opts ...storage.GetOpt) (
 
 	s.lock.RLock()
 	defer s.lock.RUnlock()
+	var zero T
 	if s.isEmptyLocked() {
-		var zero T
 		if options.Revision != nil && *options.Revision != 0 {
 			return zero, status.Errorf(codes.OutOfRange, "revision %d is a future revision", *options.Revision)
 		}
 		return zero, storage.ErrNotFound
 	}
 
-	var found *valueStoreElement[T]
+	found := s.latestLocked()
 	if options.Revision != nil {
-		if s.revision == *options.Revision {
-			found = s.values.Value.(*valueStoreElement[T])
-		} else if *options.Revision > s.revision {
-			var zero T
+		if *options.Revision > s.revision {
 			return zero, status.Errorf(codes.OutOfRange, "revision %d is a future revision", *options.Revision)
-		} else {
-			for elem := s.values.Prev(); elem != s.values; elem = elem.Prev() {
-				if elem.Value == nil {
-					break
-				}
-				v := elem.Value.(*valueStoreElement[T])
-				if v.deleted {
-					continue
-				}
-				if v.revision == *options.Revision {
-					found = v
-					break
-				}
-			}
 		}
-	} else {
-		found = s.values.Value.(*valueStoreElement[T])
-	}
-	var zero T
-	if found == nil {
-		return zero, storage.ErrNotFound
+		idx, err := s.indexLocked(*options.Revision)
+		if err != nil {
+			return zero, err
+		}
+		found = s.values[idx]
 	}
 	if found.deleted {
 		return zero, storage.ErrNotFound
@@ -172,142 +324,100 @@ func (s *inMemoryValueStore[T]) Watch(ctx context.Context, opts ...storage.Watch
 	options := storage.WatchOptions{}
 	options.Apply(opts...)
 
-	updateC := make(chan storage.WatchEvent[storage.KeyRevision[T]], 64)
-	buffer := make(chan storage.WatchEvent[storage.KeyRevision[T]], 8)
+	var updateC <-chan storage.WatchEvent[storage.KeyRevision[T]]
+	err := s.listen(options, func(replay []storage.WatchEvent[storage.KeyRevision[T]]) (func(storage.WatchEvent[storage.KeyRevision[T]]), <-chan struct{}) {
+		var queue *storage.WatchQueue[T]
+		queue, updateC = storage.NewWatchQueue(ctx, options.OverflowPolicy, replay...)
+		return queue.Send, queue.Done()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updateC, nil
+}
 
+// Collects the events to replay for the watch options, then passes them to
+// newListener, which returns a function that is called with each future
+// event until done is closed. The function must not block.
+func (s *inMemoryValueStore[T]) listen(
+	options storage.WatchOptions,
+	newListener func(replay []storage.WatchEvent[storage.KeyRevision[T]]) (send func(storage.WatchEvent[storage.KeyRevision[T]]), done <-chan struct{}),
+) error {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
-	current := s.values
+	start := len(s.values)
 	if options.Revision != nil {
 		// revision 0 indicates that the first event should be the current value
 		if *options.Revision > 0 {
-			// walk back until we find the starting revision
-			for ; current != s.values.Next(); current = current.Prev() {
-				if current.Value == nil {
-					return nil, storage.ErrNotFound
-				}
-				curElem := current.Value.(*valueStoreElement[T])
-				if curElem.deleted {
-					continue
-				}
-				if curElem.revision == *options.Revision {
-					break
-				}
+			idx, err := s.indexLocked(*options.Revision)
+			if err != nil {
+				return err
 			}
+			start = idx
+		} else if len(s.values) > 0 {
+			start = len(s.values) - 1
 		}
-	} else {
-		current = current.Next()
 	}
 
 	// if there is a previous value for the target revision, keep track of it
 	var previous storage.KeyRevision[T]
-	if current.Prev().Value != nil {
-		prevValue := current.Prev().Value.(*valueStoreElement[T])
-		if !prevValue.deleted {
-			previous = &storage.KeyRevisionImpl[T]{
-				V:    s.cloneFunc(prevValue.value),
-				Rev:  prevValue.revision,
-				Time: prevValue.timestamp,
-			}
-		} else {
-			previous = nil
+	if start > 0 && start <= len(s.values) {
+		if prevValue := s.values[start-1]; !prevValue.deleted {
+			previous = prevValue.keyRevision(s.cloneFunc, true)
 		}
 	}
 
 	// walk forward until we reach the current value and write the events
-	for ; current != s.values.Next(); current = current.Next() {
-		if current.Value == nil {
-			continue
-		}
-		curElem := current.Value.(*valueStoreElement[T])
+	var replay []storage.WatchEvent[storage.KeyRevision[T]]
+	for _, curElem := range s.values[start:] {
 		if curElem.deleted {
 			// revision 0 indicates that the first event should be the current value
 			// if the current value is deleted, don't send a delete event first
 			if options.Revision == nil || *options.Revision > 0 {
-				updateC <- storage.WatchEvent[storage.KeyRevision[T]]{
+				replay = append(replay, storage.WatchEvent[storage.KeyRevision[T]]{
 					EventType: storage.WatchEventDelete,
 					Previous:  previous,
-				}
+					Revision:  curElem.revision,
+				})
 			}
 			previous = nil
 			continue
 		}
-		current := &storage.KeyRevisionImpl[T]{
-			V:    s.cloneFunc(curElem.value),
-			Rev:  curElem.revision,
-			Time: curElem.timestamp,
-		}
+		current := curElem.keyRevision(s.cloneFunc, true)
 		ev := storage.WatchEvent[storage.KeyRevision[T]]{
 			EventType: storage.WatchEventPut,
 			Current:   current,
+			Revision:  current.Rev,
 		}
 		if previous != nil {
 			ev.Previous = previous
 		}
 
-		updateC <- ev
+		replay = append(replay, ev)
 
-		previous = &storage.KeyRevisionImpl[T]{
-			V:    curElem.value,
-			Rev:  curElem.revision,
-			Time: curElem.timestamp,
-		}
+		previous = curElem.keyRevision(s.cloneFunc, true)
 	}
 
+	send, done := newListener(replay)
+
 	// watch for future updates
 	id := uuid.NewString()
 
-	callback := func(ev storage.WatchEvent[storage.KeyRevision[T]]) {
-		buffer <- ev
-	}
-
+	// wait for events written before the replayed revisions to be sent to
+	// the other watches, so that they are not sent to this watch twice
+	s.notifyLock.Lock()
 	s.watchesLock.Lock()
-	s.watches[id] = callback
+	s.watches[id] = send
 	s.watchesLock.Unlock()
+	s.notifyLock.Unlock()
 
-	_, file, line, _ := runtime.Caller(1)
 	go func() {
-		defer func() {
-			defer func() {
-				if err := recover(); err != nil {
-					panic(err)
-				}
-			}()
-			s.lock.RLock()
-			defer s.lock.RUnlock()
-			s.watchesLock.Lock()
-			delete(s.watches, id)
-			s.watchesLock.Unlock()
-			for {
-				select {
-				case ev := <-buffer:
-					updateC <- ev
-				default:
-					close(buffer)
-					close(updateC)
-					return
-				}
-			}
-		}()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case ev := <-buffer:
-				select {
-				case updateC <- ev:
-				default:
-					if len(updateC) == cap(updateC) {
-						fmt.Fprintf(os.Stderr, chalk.Red.Color("WARNING: canceling watch, event channel is not being read from\n=> caller: %s:%d\n"), file, line)
-						return
-					}
-					updateC <- ev
-				}
-			}
-		}
+		<-done
+		s.watchesLock.Lock()
+		delete(s.watches, id)
+		s.watchesLock.Unlock()
 	}()
-
-	return updateC, nil
+	return nil
 }
 
 func (s *inMemoryValueStore[T]) Delete(_ context.Context, opts ...storage.DeleteOpt) error {
@@ -315,49 +425,86 @@ func (s *inMemoryValueStore[T]) Delete(_ context.Context, opts ...storage.Delete
 	options.Apply(opts...)
 
 	s.lock.Lock()
-	defer s.lock.Unlock()
+	if err := s.checkDeleteLocked(options); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	s.notifyAndUnlock(s.deleteLocked())
+	return nil
+}
+
+func (s *inMemoryValueStore[T]) checkDeleteLocked(options storage.DeleteOptions) error {
 	if s.isEmptyLocked() {
 		return storage.ErrNotFound
 	}
 	if options.Revision != nil && *options.Revision != s.revision {
 		return fmt.Errorf("%w: revision mismatch: %v (requested) != %v (actual)", storage.ErrConflict, *options.Revision, s.revision)
 	}
-	if s.values.Value.(*valueStoreElement[T]).deleted {
+	if s.latestLocked().deleted {
 		return storage.ErrNotFound
 	}
-	previous := s.values.Value
-	s.revision++
-	next := s.values.Next()
-	next.Value = &valueStoreElement[T]{
-		revision:  s.revision,
-		timestamp: time.Now(),
-		deleted:   true,
-	}
-	s.values = next
+	return nil
+}
 
-	prevValue := previous.(*valueStoreElement[T])
-	var wg sync.WaitGroup
-	s.watchesLock.RLock()
-	defer s.watchesLock.RUnlock()
-	wg.Add(len(s.watches))
-	for _, listener := range s.watches {
-		listener := listener
-		go func() {
-			defer wg.Done()
-			listener(storage.WatchEvent[storage.KeyRevision[T]]{
-				EventType: storage.WatchEventDelete,
-				Previous: &storage.KeyRevisionImpl[T]{
-					V:    s.cloneFunc(prevValue.value),
-					Rev:  prevValue.revision,
-					Time: prevValue.timestamp,
-				},
-			})
-		}()
+// KeepAlive resets the TTL of the current value. See [storage.KeepAliver].
+func (s *inMemoryValueStore[T]) KeepAlive(_ context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isEmptyLocked() || s.latestLocked().deleted {
+		return storage.ErrNotFound
+	}
+	if s.ttlTimer == nil {
+		return storage.ErrNoTTL
 	}
-	wg.Wait()
+	s.resetTTLLocked()
 	return nil
 }
 
+func (s *inMemoryValueStore[T]) resetTTLLocked() {
+	s.stopTTLLocked()
+	s.ttlGeneration++
+	generation := s.ttlGeneration
+	s.ttlTimer = time.AfterFunc(s.ttl, func() {
+		s.lock.Lock()
+		if s.ttlGeneration != generation || s.latestLocked().deleted {
+			s.lock.Unlock()
+			return
+		}
+		s.notifyAndUnlock(s.deleteLocked())
+	})
+}
+
+func (s *inMemoryValueStore[T]) stopTTLLocked() {
+	if s.ttlTimer != nil {
+		s.ttlTimer.Stop()
+		s.ttlTimer = nil
+		s.ttlGeneration++
+	}
+}
+
+// Deletes the current value, which must exist, and returns a function which
+// creates the corresponding watch event.
+func (s *inMemoryValueStore[T]) deleteLocked() func() storage.WatchEvent[storage.KeyRevision[T]] {
+	s.stopTTLLocked()
+	prevValue := s.latestLocked()
+	s.revision++
+	revision := s.revision
+	s.appendLocked(&valueStoreElement[T]{
+		revision:       revision,
+		createRevision: prevValue.createRevision,
+		timestamp:      time.Now(),
+		deleted:        true,
+	})
+
+	return func() storage.WatchEvent[storage.KeyRevision[T]] {
+		return storage.WatchEvent[storage.KeyRevision[T]]{
+			EventType: storage.WatchEventDelete,
+			Previous:  prevValue.keyRevision(s.cloneFunc, true),
+			Revision:  revision,
+		}
+	}
+}
+
 func (s *inMemoryValueStore[T]) History(_ context.Context, opts ...storage.HistoryOpt) ([]storage.KeyRevision[T], error) {
 	options := storage.HistoryOptions{}
 	options.Apply(opts...)
@@ -367,43 +514,35 @@ func (s *inMemoryValueStore[T]) History(_ context.Context, opts ...storage.Histo
 	if s.isEmptyLocked() {
 		return nil, storage.ErrNotFound
 	}
-	var revisions []storage.KeyRevision[T]
-	current := s.values
+	end := len(s.values) - 1
 	if options.Revision != nil {
-		for ; current != s.values.Next(); current = current.Prev() {
-			if current.Value == nil {
-				return nil, storage.ErrNotFound
-			}
-			curElem := current.Value.(*valueStoreElement[T])
-			if curElem.deleted {
-				continue
+		idx, err := s.indexLocked(*options.Revision)
+		if err != nil {
+			if !options.IncludeDeleted || !storage.IsNotFound(err) {
+				return nil, err
 			}
-			if curElem.revision == *options.Revision {
-				break
+			// the revision may be a tombstone
+			var ok bool
+			idx, ok = slices.BinarySearchFunc(s.values, *options.Revision, func(e *valueStoreElement[T], rev int64) int {
+				return cmp.Compare(e.revision, rev)
+			})
+			if !ok {
+				return nil, err
 			}
 		}
+		end = idx
 	}
-
-	if current != nil && current.Value != nil && current.Value.(*valueStoreElement[T]).deleted {
+	if s.values[end].deleted && !options.IncludeDeleted {
 		return nil, storage.ErrNotFound
 	}
 
-	for ; current != s.values.Next(); current = current.Prev() {
-		if current.Value == nil {
-			break
-		}
-		curElem := current.Value.(*valueStoreElement[T])
-		if curElem.deleted {
+	var revisions []storage.KeyRevision[T]
+	for i := end; i >= 0; i-- {
+		curElem := s.values[i]
+		if curElem.deleted && !options.IncludeDeleted {
 			break
 		}
-		rev := &storage.KeyRevisionImpl[T]{
-			Rev:  curElem.revision,
-			Time: curElem.timestamp,
-		}
-		if options.IncludeValues {
-			rev.V = s.cloneFunc(curElem.value)
-		}
-		revisions = append(revisions, rev)
+		revisions = append(revisions, curElem.keyRevision(s.cloneFunc, options.IncludeValues))
 	}
 	return lo.Reverse(revisions), nil
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/kralicky/protoconfig/storage"
 	"github.com/kralicky/protoconfig/storage/inmemory"
@@ -267,3 +268,119 @@ var _ = Describe("Value Store", Ordered, Label("unit"), func() {
 		})
 	})
 })
+
+var _ = Describe("Value Store History Retention", Label("unit"), func() {
+	var ctx context.Context
+	BeforeEach(func() {
+		ctx = context.Background()
+	})
+	putN := func(vs storage.ValueStoreT[string], n int) []int64 {
+		revisions := make([]int64, n)
+		for i := range revisions {
+			Expect(vs.Put(ctx, fmt.Sprint(i), storage.WithRevisionOut(&revisions[i]))).To(Succeed())
+		}
+		return revisions
+	}
+
+	When("no retention options are given", func() {
+		It("should retain 64 revisions", func() {
+			vs := inmemory.NewValueStore(strings.Clone)
+			revisions := putN(vs, 100)
+			history, err := vs.History(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(history).To(HaveLen(64))
+			Expect(history[0].Revision()).To(Equal(revisions[36]))
+		})
+	})
+
+	When("a history limit is set", func() {
+		It("should retain only the configured number of revisions", func() {
+			vs := inmemory.NewValueStore(strings.Clone, inmemory.WithHistoryLimit(5))
+			revisions := putN(vs, 10)
+			history, err := vs.History(ctx, storage.IncludeValues(true))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(history).To(HaveLen(5))
+			for i, h := range history {
+				Expect(h.Revision()).To(Equal(revisions[5+i]))
+				Expect(h.Value()).To(Equal(fmt.Sprint(5 + i)))
+			}
+		})
+
+		It("should return a compacted error for discarded revisions", func() {
+			vs := inmemory.NewValueStore(strings.Clone, inmemory.WithHistoryLimit(5))
+			revisions := putN(vs, 10)
+
+			_, err := vs.Get(ctx, storage.WithRevision(revisions[4]))
+			Expect(storage.IsCompacted(err)).To(BeTrue(), "expected compacted error, got %v", err)
+			Expect(storage.IsNotFound(err)).To(BeFalse())
+
+			_, err = vs.History(ctx, storage.WithRevision(revisions[0]))
+			Expect(storage.IsCompacted(err)).To(BeTrue(), "expected compacted error, got %v", err)
+
+			_, err = vs.Watch(ctx, storage.WithRevision(revisions[2]))
+			Expect(storage.IsCompacted(err)).To(BeTrue(), "expected compacted error, got %v", err)
+
+			value, err := vs.Get(ctx, storage.WithRevision(revisions[5]))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("5"))
+		})
+
+		It("should count deletes towards the limit", func() {
+			vs := inmemory.NewValueStore(strings.Clone, inmemory.WithHistoryLimit(2))
+			revisions := putN(vs, 2)
+			Expect(vs.Delete(ctx)).To(Succeed())
+
+			_, err := vs.Get(ctx, storage.WithRevision(revisions[0]))
+			Expect(storage.IsCompacted(err)).To(BeTrue(), "expected compacted error, got %v", err)
+			value, err := vs.Get(ctx, storage.WithRevision(revisions[1]))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("1"))
+			_, err = vs.Get(ctx)
+			Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+		})
+	})
+
+	When("a maximum age is set", func() {
+		It("should discard revisions older than the maximum age", func() {
+			vs := inmemory.NewValueStore(strings.Clone, inmemory.WithHistoryLimit(0), inmemory.WithHistoryMaxAge(50*time.Millisecond))
+			old := putN(vs, 3)
+			time.Sleep(100 * time.Millisecond)
+
+			By("retaining the latest revision regardless of its age")
+			value, err := vs.Get(ctx, storage.WithRevision(old[2]))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("2"))
+
+			Expect(vs.Put(ctx, "new")).To(Succeed())
+			_, err = vs.Get(ctx, storage.WithRevision(old[2]))
+			Expect(storage.IsCompacted(err)).To(BeTrue(), "expected compacted error, got %v", err)
+			history, err := vs.History(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(history).To(HaveLen(1))
+		})
+	})
+
+	When("history is unbounded", func() {
+		It("should retain all revisions", func() {
+			vs := inmemory.NewValueStore(strings.Clone, inmemory.WithUnboundedHistory())
+			revisions := putN(vs, 500)
+			history, err := vs.History(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(history).To(HaveLen(500))
+			value, err := vs.Get(ctx, storage.WithRevision(revisions[0]))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("0"))
+
+			By("replaying all revisions to a watch")
+			wctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			updateC, err := vs.Watch(wctx, storage.WithRevision(revisions[0]))
+			Expect(err).NotTo(HaveOccurred())
+			for i := range revisions {
+				var ev storage.WatchEvent[storage.KeyRevision[string]]
+				Eventually(updateC).Should(Receive(&ev))
+				Expect(ev.Current.Revision()).To(Equal(revisions[i]))
+			}
+		})
+	})
+})
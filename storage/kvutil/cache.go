@@ -0,0 +1,455 @@
+package kvutil
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kralicky/protoconfig/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type CacheOptions struct {
+	staleReads bool
+}
+
+type CacheOption func(*CacheOptions)
+
+func (o *CacheOptions) apply(opts ...CacheOption) {
+	for _, op := range opts {
+		op(o)
+	}
+}
+
+// If the backend returns an Unavailable error while the cache is not able to
+// serve a read (for example, because its watch was terminated), the last
+// known value of the key will be returned instead of the error. Keys which
+// do not exist are not cached, so reads of them still return the error.
+func AllowStaleReads() CacheOption {
+	return func(o *CacheOptions) {
+		o.staleReads = true
+	}
+}
+
+type cacheEntry[T any] struct {
+	value    T
+	revision int64
+	// Whether value and revision have been observed at any point. Only keys
+	// which exist are cached.
+	known bool
+	// Whether the entry is known to be current, and is kept up to date by the
+	// cache's watch.
+	valid bool
+	// Incremented on every change to the entry, so that reads that started
+	// before the change do not overwrite it with an older value.
+	seq uint64
+}
+
+type readCache[T any] struct {
+	CacheOptions
+	mu       sync.Mutex
+	clone    func(T) T
+	keyOf    func(storage.WatchEvent[storage.KeyRevision[T]]) string
+	entries  map[string]*cacheEntry[T]
+	watching bool
+	// Incremented every time the watch is started or stopped.
+	generation uint64
+	// Incremented every time the watch observes a delete. Deleted keys are
+	// removed from the cache, so this is used to detect deletes that happened
+	// while a value was being written through the cache.
+	deletes uint64
+}
+
+func newReadCache[T any](cloneFunc func(T) T, keyOf func(storage.WatchEvent[storage.KeyRevision[T]]) string, opts ...CacheOption) *readCache[T] {
+	options := CacheOptions{}
+	options.apply(opts...)
+	return &readCache[T]{
+		CacheOptions: options,
+		clone:        cloneFunc,
+		keyOf:        keyOf,
+		entries:      map[string]*cacheEntry[T]{},
+	}
+}
+
+// Starts the watch which keeps the cache up to date. The watch is restarted
+// if it is terminated, until the context is canceled. While the watch is not
+// running, all reads are passed through to the backend.
+func (c *readCache[T]) start(ctx context.Context, watch func(context.Context) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error)) error {
+	wc, err := watch(ctx)
+	if err != nil {
+		return err
+	}
+	c.setWatching(true)
+	go func() {
+		backoff := resumeWatchInitialBackoff
+		for {
+			for ev := range wc {
+				switch ev.EventType {
+				case storage.WatchEventPut, storage.WatchEventDelete:
+					c.applyEvent(ev)
+				}
+			}
+			c.setWatching(false)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				wc, err = watch(ctx)
+				if err == nil {
+					break
+				}
+				backoff = min(backoff*2, resumeWatchMaxBackoff)
+			}
+			backoff = resumeWatchInitialBackoff
+			c.setWatching(true)
+		}
+	}()
+	return nil
+}
+
+func (c *readCache[T]) setWatching(watching bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.watching = watching
+	c.generation++
+	if !watching {
+		for _, e := range c.entries {
+			e.valid = false
+		}
+	}
+}
+
+func (c *readCache[T]) entryLocked(key string) *cacheEntry[T] {
+	e, ok := c.entries[key]
+	if !ok {
+		e = &cacheEntry[T]{}
+		c.entries[key] = e
+	}
+	return e
+}
+
+// Applies an event observed by the watch. Events which are not newer than the
+// cached revision of the key are ignored, so that values written through the
+// cache are not replaced by older values from the watch. Deleted keys are
+// removed from the cache.
+func (c *readCache[T]) applyEvent(ev storage.WatchEvent[storage.KeyRevision[T]]) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := c.keyOf(ev)
+	var revision int64
+	switch ev.EventType {
+	case storage.WatchEventPut:
+		revision = ev.Current.Revision()
+	case storage.WatchEventDelete:
+		revision = ev.Revision
+		if ev.Previous != nil {
+			revision = max(revision, ev.Previous.Revision())
+		}
+	}
+	e, ok := c.entries[key]
+	if ok && e.known && revision != 0 && revision <= e.revision {
+		return
+	}
+	switch ev.EventType {
+	case storage.WatchEventPut:
+		if !ok {
+			e = c.entryLocked(key)
+		}
+		e.seq++
+		e.value = c.clone(ev.Current.Value())
+		e.revision = revision
+		e.known = true
+		e.valid = c.watching
+	case storage.WatchEventDelete:
+		c.deletes++
+		if ok {
+			e.seq++
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Writes a value through the cache using put, and records it unless the
+// watch has already observed a newer revision of the key. If the watch
+// observed any delete while the value was being written, the key is
+// invalidated instead, since the value may already have been deleted.
+func (c *readCache[T]) write(key string, value T, put func(...storage.PutOpt) error, opts ...storage.PutOpt) error {
+	c.mu.Lock()
+	deletes := c.deletes
+	c.mu.Unlock()
+
+	revision, err := putWithRevision(put, opts...)
+	if err != nil {
+		c.invalidate(key)
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entryLocked(key)
+	e.seq++
+	if c.deletes != deletes {
+		e.valid = false
+		return nil
+	}
+	if e.valid && e.revision > revision {
+		return nil
+	}
+	e.value = c.clone(value)
+	e.revision = revision
+	e.known = true
+	e.valid = c.watching
+	return nil
+}
+
+// Forces the next read of the key to be served by the backend.
+func (c *readCache[T]) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.seq++
+		e.valid = false
+	}
+}
+
+// Invalidates the entries of all keys starting with prefix.
+func (c *readCache[T]) invalidatePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			e.seq++
+			e.valid = false
+		}
+	}
+}
+
+func (c *readCache[T]) get(key string, fetch func(...storage.GetOpt) (T, error), opts ...storage.GetOpt) (T, error) {
+	options := storage.GetOptions{}
+	options.Apply(opts...)
+	if options.Revision != nil {
+		return fetch(opts...)
+	}
+
+	c.mu.Lock()
+	e := c.entryLocked(key)
+	if e.valid {
+		defer c.mu.Unlock()
+		return c.resultLocked(e, options.RevisionOut)
+	}
+	seq, generation := e.seq, c.generation
+	c.mu.Unlock()
+
+	var revision int64
+	value, err := fetch(storage.WithRevisionOut(&revision))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	unchanged := e.seq == seq && c.generation == generation
+	switch {
+	case err == nil:
+		if unchanged {
+			e.value = c.clone(value)
+			e.revision = revision
+			e.known = true
+			e.valid = c.watching
+		}
+		if options.RevisionOut != nil {
+			*options.RevisionOut = revision
+		}
+		return value, nil
+	case storage.IsNotFound(err):
+		// Keys which do not exist are not cached, so that reads of arbitrary
+		// keys do not grow the cache.
+		if unchanged && c.entries[key] == e {
+			e.seq++
+			delete(c.entries, key)
+		}
+		return value, err
+	case c.staleReads && e.known && status.Code(err) == codes.Unavailable:
+		return c.resultLocked(e, options.RevisionOut)
+	default:
+		return value, err
+	}
+}
+
+func (c *readCache[T]) resultLocked(e *cacheEntry[T], revisionOut *int64) (T, error) {
+	if revisionOut != nil {
+		*revisionOut = e.revision
+	}
+	return c.clone(e.value), nil
+}
+
+// Calls put with an additional revision output option, and returns the
+// revision of the written value while still filling in any revision output
+// requested by the caller.
+func putWithRevision(put func(...storage.PutOpt) error, opts ...storage.PutOpt) (int64, error) {
+	options := storage.PutOptions{}
+	options.Apply(opts...)
+	var revision int64
+	if err := put(append(opts, storage.WithRevisionOut(&revision))...); err != nil {
+		return 0, err
+	}
+	if options.RevisionOut != nil {
+		*options.RevisionOut = revision
+	}
+	return revision, nil
+}
+
+type kvStoreCacheImpl[T any] struct {
+	base   storage.KeyValueStoreT[T]
+	prefix string
+	cache  *readCache[T]
+}
+
+func (s *kvStoreCacheImpl[T]) cached(key string) bool {
+	return strings.HasPrefix(key, s.prefix)
+}
+
+func (s *kvStoreCacheImpl[T]) Put(ctx context.Context, key string, value T, opts ...storage.PutOpt) error {
+	if !s.cached(key) {
+		return s.base.Put(ctx, key, value, opts...)
+	}
+	return s.cache.write(key, value, func(opts ...storage.PutOpt) error {
+		return s.base.Put(ctx, key, value, opts...)
+	}, opts...)
+}
+
+func (s *kvStoreCacheImpl[T]) Get(ctx context.Context, key string, opts ...storage.GetOpt) (T, error) {
+	if !s.cached(key) {
+		return s.base.Get(ctx, key, opts...)
+	}
+	return s.cache.get(key, func(opts ...storage.GetOpt) (T, error) {
+		return s.base.Get(ctx, key, opts...)
+	}, opts...)
+}
+
+func (s *kvStoreCacheImpl[T]) Watch(ctx context.Context, key string, opts ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error) {
+	return s.base.Watch(ctx, key, opts...)
+}
+
+func (s *kvStoreCacheImpl[T]) Delete(ctx context.Context, key string, opts ...storage.DeleteOpt) error {
+	err := s.base.Delete(ctx, key, opts...)
+	options := storage.DeleteOptions{}
+	options.Apply(opts...)
+	if options.Prefix {
+		s.cache.invalidatePrefix(key)
+	} else if s.cached(key) {
+		s.cache.invalidate(key)
+	}
+	return err
+}
+
+func (s *kvStoreCacheImpl[T]) ListKeys(ctx context.Context, prefix string, opts ...storage.ListOpt) ([]string, error) {
+	return s.base.ListKeys(ctx, prefix, opts...)
+}
+
+func (s *kvStoreCacheImpl[T]) History(ctx context.Context, key string, opts ...storage.HistoryOpt) ([]storage.KeyRevision[T], error) {
+	return s.base.History(ctx, key, opts...)
+}
+
+func (s *kvStoreCacheImpl[T]) Txn(ctx context.Context, req storage.TxnRequest[T]) (*storage.TxnResponse, error) {
+	resp, err := s.base.(storage.Txner[T]).Txn(ctx, req)
+	for _, op := range req.Ops {
+		if s.cached(op.Key) {
+			s.cache.invalidate(op.Key)
+		}
+	}
+	return resp, err
+}
+
+func (s *kvStoreCacheImpl[T]) List(ctx context.Context, prefix string, opts ...storage.ListOpt) ([]storage.KeyRevision[T], error) {
+	return s.base.(storage.BatchReader[T]).List(ctx, prefix, opts...)
+}
+
+func (s *kvStoreCacheImpl[T]) GetMany(ctx context.Context, keys []string) ([]storage.KeyRevision[T], error) {
+	return s.base.(storage.BatchReader[T]).GetMany(ctx, keys)
+}
+
+func (s *kvStoreCacheImpl[T]) KeepAlive(ctx context.Context, key string) error {
+	return s.base.(storage.KeepAliver).KeepAlive(ctx, key)
+}
+
+// Returns a key-value store which caches the latest revision of each key
+// under the given prefix in memory. The cache is kept up to date using a
+// prefix watch on the base store, which runs until the context is canceled.
+// Keys outside the prefix, keys which do not exist, reads at specific
+// revisions, and all other operations are passed through to the base store. Values are cloned using
+// cloneFunc whenever they are stored in or returned from the cache.
+//
+// Writes made through the returned store are visible to subsequent reads
+// immediately; writes made by other clients are visible once the watch
+// observes them. If the watch is terminated by the backend, reads are passed
+// through to the base store until it has been re-established. See
+// [AllowStaleReads] to serve reads from the cache while the backend is
+// unavailable.
+//
+// The returned store implements each of [storage.Txner],
+// [storage.BatchReader], and [storage.KeepAliver] if the base store does.
+func WithCache[T any](
+	ctx context.Context,
+	base storage.KeyValueStoreT[T],
+	prefix string,
+	cloneFunc func(T) T,
+	opts ...CacheOption,
+) (storage.KeyValueStoreT[T], error) {
+	cache := newReadCache(cloneFunc, func(ev storage.WatchEvent[storage.KeyRevision[T]]) string {
+		if ev.Current != nil {
+			return ev.Current.Key()
+		}
+		return ev.Previous.Key()
+	}, opts...)
+	err := cache.start(ctx, func(ctx context.Context) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error) {
+		return base.Watch(ctx, prefix, storage.WithPrefix())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return WithOptionalInterfaces(base, &kvStoreCacheImpl[T]{
+		base:   base,
+		prefix: prefix,
+		cache:  cache,
+	}), nil
+}
+
+// Like [WithCache], but for a single value store.
+func WithValueCache[T any](
+	ctx context.Context,
+	base storage.ValueStoreT[T],
+	cloneFunc func(T) T,
+	opts ...CacheOption,
+) (storage.ValueStoreT[T], error) {
+	const key = ""
+	cache := newReadCache(cloneFunc, func(storage.WatchEvent[storage.KeyRevision[T]]) string {
+		return key
+	}, opts...)
+	err := cache.start(ctx, func(ctx context.Context) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error) {
+		return base.Watch(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ValueStoreAdapter[T]{
+		PutFunc: func(ctx context.Context, value T, opts ...storage.PutOpt) error {
+			return cache.write(key, value, func(opts ...storage.PutOpt) error {
+				return base.Put(ctx, value, opts...)
+			}, opts...)
+		},
+		GetFunc: func(ctx context.Context, opts ...storage.GetOpt) (T, error) {
+			return cache.get(key, func(opts ...storage.GetOpt) (T, error) {
+				return base.Get(ctx, opts...)
+			}, opts...)
+		},
+		WatchFunc: base.Watch,
+		DeleteFunc: func(ctx context.Context, opts ...storage.DeleteOpt) error {
+			err := base.Delete(ctx, opts...)
+			cache.invalidate(key)
+			return err
+		},
+		HistoryFunc: base.History,
+	}, nil
+}
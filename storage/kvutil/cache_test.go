@@ -0,0 +1,282 @@
+package kvutil_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/inmemory"
+	"github.com/kralicky/protoconfig/storage/kvutil"
+	"github.com/kralicky/protoconfig/test/testutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Counts reads, and simulates the backend becoming unavailable.
+type unreliableStore struct {
+	storage.KeyValueStoreT[[]byte]
+	gets        atomic.Int32
+	unavailable atomic.Bool
+
+	mu            sync.Mutex
+	cancelWatches []context.CancelFunc
+}
+
+func (s *unreliableStore) Get(ctx context.Context, key string, opts ...storage.GetOpt) ([]byte, error) {
+	s.gets.Add(1)
+	if s.unavailable.Load() {
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	}
+	return s.KeyValueStoreT.Get(ctx, key, opts...)
+}
+
+func (s *unreliableStore) Watch(ctx context.Context, key string, opts ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[[]byte]], error) {
+	if s.unavailable.Load() {
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ctx, ca := context.WithCancel(ctx)
+	s.cancelWatches = append(s.cancelWatches, ca)
+	return s.KeyValueStoreT.Watch(ctx, key, opts...)
+}
+
+func (s *unreliableStore) SetUnavailable() {
+	s.unavailable.Store(true)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ca := range s.cancelWatches {
+		ca()
+	}
+	s.cancelWatches = nil
+}
+
+var _ = Describe("Cache", Label("unit"), func() {
+	var (
+		base  *unreliableStore
+		store storage.KeyValueStoreT[[]byte]
+	)
+	newCache := func(ctx context.Context, opts ...kvutil.CacheOption) {
+		base = &unreliableStore{KeyValueStoreT: inmemory.NewKeyValueStore(bytes.Clone)}
+		var err error
+		store, err = kvutil.WithCache(ctx, base, "cached/", bytes.Clone, opts...)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("should serve repeated reads from the cache", func(ctx SpecContext) {
+		newCache(ctx)
+		var rev int64
+		Expect(base.Put(ctx, "cached/a", []byte("1"), storage.WithRevisionOut(&rev))).To(Succeed())
+
+		for i := 0; i < 3; i++ {
+			var revOut int64
+			value, err := store.Get(ctx, "cached/a", storage.WithRevisionOut(&revOut))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal([]byte("1")))
+			Expect(revOut).To(Equal(rev))
+		}
+		Expect(base.gets.Load()).To(BeEquivalentTo(1))
+
+		By("not caching keys that do not exist")
+		for i := 0; i < 3; i++ {
+			_, err := store.Get(ctx, "cached/b")
+			Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+		}
+		Expect(base.gets.Load()).To(BeEquivalentTo(4))
+
+		By("returning copies of cached values")
+		value, err := store.Get(ctx, "cached/a")
+		Expect(err).NotTo(HaveOccurred())
+		value[0] = 'x'
+		value, err = store.Get(ctx, "cached/a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal([]byte("1")))
+	})
+
+	It("should observe changes made by other clients", func(ctx SpecContext) {
+		newCache(ctx)
+		Expect(base.Put(ctx, "cached/a", []byte("1"))).To(Succeed())
+		_, err := store.Get(ctx, "cached/a")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = store.Get(ctx, "cached/b")
+		Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+
+		Expect(base.Put(ctx, "cached/a", []byte("2"))).To(Succeed())
+		Expect(base.Put(ctx, "cached/b", []byte("3"))).To(Succeed())
+		Eventually(func() ([]byte, error) {
+			return store.Get(ctx, "cached/a")
+		}).Should(Equal([]byte("2")))
+		Eventually(func() ([]byte, error) {
+			return store.Get(ctx, "cached/b")
+		}).Should(Equal([]byte("3")))
+		Expect(base.gets.Load()).To(BeEquivalentTo(2))
+
+		By("removing deleted keys from the cache")
+		Expect(base.Delete(ctx, "cached/a")).To(Succeed())
+		Eventually(func() error {
+			_, err := store.Get(ctx, "cached/a")
+			return err
+		}).Should(testutil.MatchStatusCode(codes.NotFound))
+		gets := base.gets.Load()
+		_, err = store.Get(ctx, "cached/a")
+		Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+		Expect(base.gets.Load()).To(Equal(gets + 1))
+	})
+
+	It("should read its own writes", func(ctx SpecContext) {
+		newCache(ctx)
+		for i := 0; i < 10; i++ {
+			var putRev, getRev int64
+			value := []byte{byte(i)}
+			Expect(store.Put(ctx, "cached/a", value, storage.WithRevisionOut(&putRev))).To(Succeed())
+			Expect(putRev).NotTo(BeZero())
+			got, err := store.Get(ctx, "cached/a", storage.WithRevisionOut(&getRev))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(value))
+			Expect(getRev).To(Equal(putRev))
+		}
+		Expect(store.Delete(ctx, "cached/a")).To(Succeed())
+		_, err := store.Get(ctx, "cached/a")
+		Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+	})
+
+	It("should read its own prefix deletes", func(ctx SpecContext) {
+		newCache(ctx)
+		for _, key := range []string{"cached/a/1", "cached/a/2", "cached/b"} {
+			Expect(store.Put(ctx, key, []byte(key))).To(Succeed())
+			_, err := store.Get(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(store.Delete(ctx, "cached/a/", storage.WithPrefix())).To(Succeed())
+		for _, key := range []string{"cached/a/1", "cached/a/2"} {
+			_, err := store.Get(ctx, key)
+			Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+		}
+		value, err := store.Get(ctx, "cached/b")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal([]byte("cached/b")))
+	})
+
+	It("should pass through reads at specific revisions and keys outside the prefix", func(ctx SpecContext) {
+		newCache(ctx)
+		var rev1 int64
+		Expect(store.Put(ctx, "cached/a", []byte("1"), storage.WithRevisionOut(&rev1))).To(Succeed())
+		Expect(store.Put(ctx, "cached/a", []byte("2"))).To(Succeed())
+
+		value, err := store.Get(ctx, "cached/a", storage.WithRevision(rev1))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal([]byte("1")))
+		Expect(base.gets.Load()).To(BeEquivalentTo(1))
+
+		Expect(store.Put(ctx, "other", []byte("3"))).To(Succeed())
+		for i := 0; i < 2; i++ {
+			_, err := store.Get(ctx, "other")
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(base.gets.Load()).To(BeEquivalentTo(3))
+	})
+
+	When("the backend is unavailable", func() {
+		It("should not serve reads from the cache by default", func(ctx SpecContext) {
+			newCache(ctx)
+			Expect(store.Put(ctx, "cached/a", []byte("1"))).To(Succeed())
+			base.SetUnavailable()
+			Eventually(func() error {
+				_, err := store.Get(ctx, "cached/a")
+				return err
+			}).Should(testutil.MatchStatusCode(codes.Unavailable))
+		})
+
+		It("should serve stale reads if allowed", func(ctx SpecContext) {
+			newCache(ctx, kvutil.AllowStaleReads())
+			Expect(store.Put(ctx, "cached/a", []byte("1"))).To(Succeed())
+			_, err := store.Get(ctx, "cached/b")
+			Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+			base.SetUnavailable()
+
+			By("waiting for reads to be passed through to the backend")
+			Eventually(func() int32 {
+				store.Get(ctx, "cached/a")
+				return base.gets.Load()
+			}).Should(BeNumerically(">", 1))
+			value, err := store.Get(ctx, "cached/a")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal([]byte("1")))
+			_, err = store.Get(ctx, "cached/b")
+			Expect(err).To(testutil.MatchStatusCode(codes.Unavailable))
+
+			By("resuming caching once the backend is available again")
+			base.unavailable.Store(false)
+			Expect(base.Put(ctx, "cached/a", []byte("2"))).To(Succeed())
+			Eventually(func() ([]byte, error) {
+				return store.Get(ctx, "cached/a")
+			}).Should(Equal([]byte("2")))
+		})
+	})
+
+	It("should cache a single value store", func(ctx SpecContext) {
+		baseValue := inmemory.NewValueStore(bytes.Clone)
+		valueStore, err := kvutil.WithValueCache(ctx, baseValue, bytes.Clone)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = valueStore.Get(ctx)
+		Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+		Expect(valueStore.Put(ctx, []byte("1"))).To(Succeed())
+		value, err := valueStore.Get(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal([]byte("1")))
+
+		Expect(baseValue.Put(ctx, []byte("2"))).To(Succeed())
+		Eventually(func() ([]byte, error) {
+			return valueStore.Get(ctx)
+		}).Should(Equal([]byte("2")))
+	})
+
+	It("should ignore watch events older than the cached revision", func(ctx SpecContext) {
+		events := make(chan storage.WatchEvent[storage.KeyRevision[[]byte]])
+		var gets atomic.Int32
+		baseValue := kvutil.ValueStoreAdapter[[]byte]{
+			PutFunc: func(_ context.Context, _ []byte, opts ...storage.PutOpt) error {
+				options := storage.PutOptions{}
+				options.Apply(opts...)
+				if options.RevisionOut != nil {
+					*options.RevisionOut = 5
+				}
+				return nil
+			},
+			GetFunc: func(context.Context, ...storage.GetOpt) ([]byte, error) {
+				gets.Add(1)
+				return nil, storage.ErrNotFound
+			},
+			WatchFunc: func(context.Context, ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[[]byte]], error) {
+				return events, nil
+			},
+		}
+		valueStore, err := kvutil.WithValueCache(ctx, baseValue, bytes.Clone)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(valueStore.Put(ctx, []byte("new"))).To(Succeed())
+
+		// The channel is unbuffered, so each event has been applied once the
+		// next one is received.
+		for _, rev := range []int64{3, 5, 5} {
+			select {
+			case events <- storage.WatchEvent[storage.KeyRevision[[]byte]]{
+				EventType: storage.WatchEventPut,
+				Current:   &storage.KeyRevisionImpl[[]byte]{V: []byte("old"), Rev: rev},
+			}:
+			case <-ctx.Done():
+				Fail("timed out sending watch events")
+			}
+		}
+		var rev int64
+		value, err := valueStore.Get(ctx, storage.WithRevisionOut(&rev))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal([]byte("new")))
+		Expect(rev).To(BeEquivalentTo(5))
+		Expect(gets.Load()).To(BeZero())
+	})
+})
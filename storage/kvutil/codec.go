@@ -0,0 +1,276 @@
+package kvutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/kralicky/protoconfig/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"sigs.k8s.io/yaml"
+)
+
+// The format used to encode messages stored by [WithMessageCodec].
+type Encoding string
+
+const (
+	// The protobuf binary wire format. This is the default.
+	EncodingBinary Encoding = "binary"
+	// The protobuf JSON format, as produced by protojson. Fields are named
+	// using their JSON names.
+	EncodingJSON Encoding = "json"
+	// The protobuf JSON format, converted to YAML.
+	EncodingYAML Encoding = "yaml"
+)
+
+type MessageCodecOptions struct {
+	encoding Encoding
+	schema   messageSchema
+}
+
+type MessageCodecOption func(*MessageCodecOptions)
+
+func (o *MessageCodecOptions) apply(opts ...MessageCodecOption) {
+	for _, op := range opts {
+		op(o)
+	}
+}
+
+// Sets the format used to encode messages when they are written. Messages in
+// any format can always be read, regardless of this setting, so the encoding
+// of an existing store can be changed at any time.
+func WithEncoding(encoding Encoding) MessageCodecOption {
+	return func(o *MessageCodecOptions) {
+		o.encoding = encoding
+	}
+}
+
+// Stores the latest version of the schema alongside each message when it is
+// written, and upgrades messages stored with older versions of the schema
+// when they are read. Messages stored without a version are treated as
+// version 1.
+func WithSchema[T proto.Message](schema *Schema[T]) MessageCodecOption {
+	return func(o *MessageCodecOptions) {
+		o.schema = schema
+	}
+}
+
+// The name of the field added to JSON and YAML objects to hold the schema
+// version. Protobuf JSON field names cannot contain '@', so this cannot
+// conflict with any field in the message.
+const schemaVersionField = "@schemaVersion"
+
+// The first byte of binary messages which are stored with a schema version,
+// followed by the version as a uvarint and then the message. This can never
+// be the first byte of a message in the binary format, since 0 is not a valid
+// field number.
+const schemaVersionMarker byte = 0
+
+func encodeMessage(encoding Encoding, msg proto.Message, version int) ([]byte, error) {
+	switch encoding {
+	case EncodingJSON, EncodingYAML:
+		jsonData, err := protojson.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		if version > 0 {
+			jsonData = addSchemaVersion(jsonData, version)
+		}
+		if encoding == EncodingYAML {
+			return yaml.JSONToYAML(jsonData)
+		}
+		// protojson output is intentionally unstable; reformat it so that
+		// identical messages are always stored identically.
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, jsonData, "", "  "); err != nil {
+			return nil, err
+		}
+		buf.WriteByte('\n')
+		return buf.Bytes(), nil
+	default:
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		if version > 0 {
+			header := binary.AppendUvarint([]byte{schemaVersionMarker}, uint64(version))
+			data = append(header, data...)
+		}
+		return data, nil
+	}
+}
+
+func addSchemaVersion(jsonObject []byte, version int) []byte {
+	field := fmt.Sprintf("{%q:%d", schemaVersionField, version)
+	rest := bytes.TrimSpace(jsonObject)[1:]
+	if len(bytes.TrimSpace(rest)) > 1 {
+		field += ","
+	}
+	return append([]byte(field), rest...)
+}
+
+// A message read from a store, in any supported encoding.
+type storedMessage struct {
+	// The schema version the message was stored with, or 0 if none.
+	version int
+	// The message in the JSON format, if it may have been stored in a text
+	// encoding.
+	json []byte
+	// The message in the binary format, if it may have been stored in the
+	// binary format. If both json and binary are set, the encoding is decided
+	// when the message is unmarshaled.
+	binary []byte
+}
+
+// Separates a stored message from its schema version, and determines which
+// encodings it may have been stored in. Messages stored with a schema version
+// are unambiguous, as are messages which are not valid JSON or YAML objects.
+// Otherwise, the encoding is detected by [storedMessage.unmarshal].
+func parseStoredMessage(data []byte) (storedMessage, error) {
+	if len(data) > 0 && data[0] == schemaVersionMarker {
+		version, n := binary.Uvarint(data[1:])
+		if n <= 0 || version == 0 || version > uint64(maxSchemaVersion) {
+			return storedMessage{}, status.Error(codes.DataLoss, "stored message has an invalid schema version")
+		}
+		return storedMessage{version: int(version), binary: data[1+n:]}, nil
+	}
+	msg := storedMessage{binary: data}
+	if len(data) == 0 || !utf8.Valid(data) {
+		return msg, nil
+	}
+	var jsonData []byte
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte("{")) && json.Valid(trimmed) {
+		jsonData = trimmed
+	} else if converted, err := yaml.YAMLToJSON(data); err == nil && bytes.HasPrefix(converted, []byte("{")) {
+		jsonData = converted
+	} else {
+		return msg, nil
+	}
+	msg.json = jsonData
+	if bytes.Contains(jsonData, []byte(strconv.Quote(schemaVersionField))) {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(jsonData, &fields); err != nil {
+			return msg, nil
+		}
+		if raw, ok := fields[schemaVersionField]; ok {
+			version, err := strconv.Atoi(string(raw))
+			if err != nil || version <= 0 || version > maxSchemaVersion {
+				return storedMessage{}, status.Error(codes.DataLoss, "stored message has an invalid schema version")
+			}
+			delete(fields, schemaVersionField)
+			msg.version = version
+			msg.json, _ = json.Marshal(fields)
+			msg.binary = nil
+		}
+	}
+	return msg, nil
+}
+
+// Unmarshals the stored message into msg. If the message may be in either
+// the binary or a text encoding, the binary encoding is tried first, and is
+// only accepted if msg contains no unknown fields. Otherwise, the message is
+// unmarshaled as JSON, and any unknown fields are reported as an error. A
+// text document is very unlikely to be a valid binary message without unknown
+// fields, whereas some binary messages are also valid YAML objects.
+func (m storedMessage) unmarshal(msg proto.Message) error {
+	if m.json == nil {
+		return proto.Unmarshal(m.binary, msg)
+	}
+	if m.binary != nil {
+		if err := proto.Unmarshal(m.binary, msg); err == nil && !hasUnknownFields(msg.ProtoReflect()) {
+			return nil
+		}
+		proto.Reset(msg)
+	}
+	return protojson.Unmarshal(m.json, msg)
+}
+
+// Reports whether msg or any message nested within it has unknown fields.
+func hasUnknownFields(msg protoreflect.Message) bool {
+	if len(msg.GetUnknown()) > 0 {
+		return true
+	}
+	found := false
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() == nil {
+				return true
+			}
+			v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+				found = hasUnknownFields(v.Message())
+				return !found
+			})
+		case fd.Message() == nil:
+		case fd.IsList():
+			list := v.List()
+			for i := 0; i < list.Len() && !found; i++ {
+				found = hasUnknownFields(list.Get(i).Message())
+			}
+		default:
+			found = hasUnknownFields(v.Message())
+		}
+		return !found
+	})
+	return found
+}
+
+type messageCodec[T proto.Message] struct {
+	MessageCodecOptions
+}
+
+func newMessageCodec[T proto.Message](opts ...MessageCodecOption) messageCodec[T] {
+	options := MessageCodecOptions{
+		encoding: EncodingBinary,
+	}
+	options.apply(opts...)
+	return messageCodec[T]{MessageCodecOptions: options}
+}
+
+func (c messageCodec[T]) validate() error {
+	if c.schema == nil {
+		return nil
+	}
+	return c.schema.validate(util.NewMessage[T]().ProtoReflect().Descriptor())
+}
+
+func (c messageCodec[T]) encode(msg T) ([]byte, error) {
+	version := 0
+	if c.schema != nil {
+		version = c.schema.latestVersion()
+	}
+	return encodeMessage(c.encoding, msg, version)
+}
+
+// Decodes a stored message, upgrading it to the latest version of the schema
+// if necessary.
+func (c messageCodec[T]) decode(data []byte) (T, error) {
+	var zero T
+	stored, err := parseStoredMessage(data)
+	if err != nil {
+		return zero, err
+	}
+	if c.schema == nil {
+		msg := util.NewMessage[T]()
+		if err := stored.unmarshal(msg); err != nil {
+			return zero, err
+		}
+		return msg, nil
+	}
+	upgraded, err := c.schema.upgrade(max(stored.version, 1), stored)
+	if err != nil {
+		return zero, err
+	}
+	msg, ok := upgraded.(T)
+	if !ok {
+		return zero, status.Errorf(codes.Internal, "schema produced a message of type %T, expected %T", upgraded, zero)
+	}
+	return msg, nil
+}
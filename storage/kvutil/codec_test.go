@@ -0,0 +1,150 @@
+package kvutil_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/inmemory"
+	"github.com/kralicky/protoconfig/storage/kvutil"
+	"github.com/kralicky/protoconfig/test/ext"
+	"github.com/kralicky/protoconfig/test/testutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/samber/lo"
+	"google.golang.org/protobuf/proto"
+)
+
+var _ = Describe("Message Codec", Label("unit"), func() {
+	var (
+		ctx  context.Context
+		base storage.ValueStoreT[[]byte]
+		conf *ext.SampleConfiguration
+	)
+	BeforeEach(func() {
+		ctx = context.Background()
+		base = kvutil.WithKey(inmemory.NewKeyValueStore(bytes.Clone), "config")
+		conf = &ext.SampleConfiguration{
+			Enabled:     lo.ToPtr(true),
+			StringField: lo.ToPtr("foo"),
+			MapField:    map[string]string{"a": "b"},
+			EnumField:   ext.SampleEnum_Foo.Enum(),
+		}
+	})
+
+	DescribeTable("encoding values",
+		func(encoding kvutil.Encoding, matchStored func([]byte)) {
+			store := kvutil.WithMessageCodec[*ext.SampleConfiguration](base, kvutil.WithEncoding(encoding))
+			Expect(store.Put(ctx, conf)).To(Succeed())
+
+			stored, err := base.Get(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			matchStored(stored)
+
+			value, err := store.Get(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(testutil.ProtoEqual(conf))
+
+			By("decoding values with any encoding")
+			for _, other := range []kvutil.Encoding{kvutil.EncodingBinary, kvutil.EncodingJSON, kvutil.EncodingYAML} {
+				value, err := kvutil.WithMessageCodec[*ext.SampleConfiguration](base, kvutil.WithEncoding(other)).Get(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(testutil.ProtoEqual(conf))
+			}
+		},
+		Entry("binary", kvutil.EncodingBinary, func(stored []byte) {
+			Expect(stored).To(Equal(lo.Must(proto.Marshal(conf))))
+		}),
+		Entry("json", kvutil.EncodingJSON, func(stored []byte) {
+			Expect(string(stored)).To(HavePrefix("{"))
+			Expect(string(stored)).To(ContainSubstring(`"stringField": "foo"`))
+			Expect(string(stored)).To(ContainSubstring(`"enumField": "Foo"`))
+		}),
+		Entry("yaml", kvutil.EncodingYAML, func(stored []byte) {
+			Expect(string(stored)).To(ContainSubstring("stringField: foo\n"))
+			Expect(string(stored)).To(ContainSubstring("enumField: Foo\n"))
+		}),
+	)
+
+	It("should use the binary encoding by default", func() {
+		store := kvutil.WithMessageCodec[*ext.SampleConfiguration](base)
+		Expect(store.Put(ctx, conf)).To(Succeed())
+		stored, err := base.Get(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stored).To(Equal(lo.Must(proto.Marshal(conf))))
+	})
+
+	It("should decode history and watch events containing mixed encodings", func() {
+		binaryStore := kvutil.WithMessageCodec[*ext.SampleConfiguration](base)
+		yamlStore := kvutil.WithMessageCodec[*ext.SampleConfiguration](base, kvutil.WithEncoding(kvutil.EncodingYAML))
+
+		wctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		wc, err := yamlStore.Watch(wctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(binaryStore.Put(ctx, conf)).To(Succeed())
+		updated := proto.Clone(conf).(*ext.SampleConfiguration)
+		updated.StringField = lo.ToPtr("bar")
+		Expect(yamlStore.Put(ctx, updated)).To(Succeed())
+
+		hist, err := yamlStore.History(ctx, storage.IncludeValues(true))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hist).To(HaveLen(2))
+		Expect(hist[0].Value()).To(testutil.ProtoEqual(conf))
+		Expect(hist[1].Value()).To(testutil.ProtoEqual(updated))
+
+		var event storage.WatchEvent[storage.KeyRevision[*ext.SampleConfiguration]]
+		Eventually(wc).Should(Receive(&event))
+		Expect(event.Current.Value()).To(testutil.ProtoEqual(conf))
+		Eventually(wc).Should(Receive(&event))
+		Expect(event.Current.Value()).To(testutil.ProtoEqual(updated))
+		Expect(event.Previous.Value()).To(testutil.ProtoEqual(conf))
+	})
+
+	It("should decode values edited by hand", func() {
+		store := kvutil.WithMessageCodec[*ext.SampleConfiguration](base, kvutil.WithEncoding(kvutil.EncodingYAML))
+		Expect(base.Put(ctx, []byte("# edited\nstringField: baz\nenabled: false\n"))).To(Succeed())
+		value, err := store.Get(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(testutil.ProtoEqual(&ext.SampleConfiguration{
+			StringField: lo.ToPtr("baz"),
+			Enabled:     lo.ToPtr(false),
+		}))
+
+		Expect(base.Put(ctx, []byte(`  {"stringField": "qux"}`))).To(Succeed())
+		value, err = store.Get(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.GetStringField()).To(Equal("qux"))
+
+		By("rejecting unknown fields")
+		Expect(base.Put(ctx, []byte("stringField: baz\nunknownField: 1\n"))).To(Succeed())
+		_, err = store.Get(ctx)
+		Expect(err).To(MatchError(ContainSubstring("unknownField")))
+	})
+
+	It("should decode binary messages which are also valid YAML objects", func() {
+		// Field 4 has the tag '"', and a length of 32 is encoded as ' ', so this
+		// message is stored as the YAML object {" k": "vvv..."}.
+		conf := &ext.SampleConfiguration{SecretField: lo.ToPtr(`k": ` + strings.Repeat("v", 28))}
+		data := lo.Must(proto.Marshal(conf))
+		Expect(string(data)).To(HavePrefix(`" k": v`))
+		Expect(base.Put(ctx, data)).To(Succeed())
+
+		store := kvutil.WithMessageCodec[*ext.SampleConfiguration](base, kvutil.WithEncoding(kvutil.EncodingYAML))
+		value, err := store.Get(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(testutil.ProtoEqual(conf))
+	})
+
+	It("should decode empty messages", func() {
+		for _, encoding := range []kvutil.Encoding{kvutil.EncodingBinary, kvutil.EncodingJSON, kvutil.EncodingYAML} {
+			store := kvutil.WithMessageCodec[*ext.SampleConfiguration](base, kvutil.WithEncoding(encoding))
+			Expect(store.Put(ctx, &ext.SampleConfiguration{})).To(Succeed())
+			value, err := store.Get(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(proto.Equal(value, &ext.SampleConfiguration{})).To(BeTrue())
+		}
+	})
+})
@@ -0,0 +1,438 @@
+package kvutil
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/kralicky/protoconfig/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Version of the header prepended to encrypted values. The header has the
+// following layout, and is authenticated along with the ciphertext and the
+// storage key of the value:
+//
+//	| version (1) | key id length (1) | key id (n) | nonce (12) |
+const encryptionHeaderVersion byte = 1
+
+// An AES key used to encrypt stored values. The ID is stored in the header
+// of each encrypted value to identify the key needed to decrypt it, and must
+// be unique within a keyring. The secret must be 16, 24, or 32 bytes long
+// (for AES-128, AES-192, or AES-256 respectively).
+type EncryptionKey struct {
+	ID     string
+	Secret []byte
+}
+
+// A set of keys used to encrypt and decrypt stored values with AES-GCM.
+// New values are always encrypted with the primary key, and values encrypted
+// with any key in the keyring can be decrypted.
+//
+// To rotate keys, create a new keyring with the new key as the primary key
+// and the old keys as previous keys, then use [ReEncrypt] to rewrite existing
+// values with the new key. Old keys should be kept in the keyring for as long
+// as any revision in the history of a key may have been encrypted with them.
+type Keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+func NewKeyring(primary EncryptionKey, previous ...EncryptionKey) (*Keyring, error) {
+	kr := &Keyring{
+		primary: primary.ID,
+		aeads:   make(map[string]cipher.AEAD, len(previous)+1),
+	}
+	for _, key := range append([]EncryptionKey{primary}, previous...) {
+		if key.ID == "" || len(key.ID) > 255 {
+			return nil, fmt.Errorf("invalid key id %q: must be between 1 and 255 bytes long", key.ID)
+		}
+		if _, ok := kr.aeads[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id %q", key.ID)
+		}
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", key.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", key.ID, err)
+		}
+		kr.aeads[key.ID] = aead
+	}
+	return kr, nil
+}
+
+// Returns the ID of the key used to encrypt new values.
+func (kr *Keyring) PrimaryKeyID() string {
+	return kr.primary
+}
+
+// Encrypts the plaintext using the primary key. The storage key is the full
+// key the value will be stored under; it is not stored in the ciphertext, but
+// the same key must be given to decrypt it. This prevents values from being
+// swapped between keys by anyone with write access to the underlying store.
+func (kr *Keyring) Encrypt(plaintext []byte, storageKey string) ([]byte, error) {
+	aead := kr.aeads[kr.primary]
+	header := make([]byte, 0, 2+len(kr.primary)+aead.NonceSize())
+	header = append(header, encryptionHeaderVersion, byte(len(kr.primary)))
+	header = append(header, kr.primary...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate nonce: %v", err)
+	}
+	header = append(header, nonce...)
+	return aead.Seal(header, nonce, plaintext, additionalData(header, storageKey)), nil
+}
+
+// Decrypts a value previously encrypted with any key in the keyring for the
+// given storage key, and returns the plaintext along with the ID of the key
+// that was used.
+//
+// Returns a FailedPrecondition error if the value was encrypted with a key
+// that is not in the keyring, and a DataLoss error if the value is malformed
+// or fails authentication, including if it was encrypted for a different
+// storage key.
+func (kr *Keyring) Decrypt(ciphertext []byte, storageKey string) (plaintext []byte, keyID string, err error) {
+	if len(ciphertext) < 2 || ciphertext[0] != encryptionHeaderVersion {
+		return nil, "", status.Error(codes.DataLoss, "value is not encrypted or has an unknown format")
+	}
+	idLen := int(ciphertext[1])
+	if len(ciphertext) < 2+idLen {
+		return nil, "", status.Error(codes.DataLoss, "encrypted value is truncated")
+	}
+	keyID = string(ciphertext[2 : 2+idLen])
+	aead, ok := kr.aeads[keyID]
+	if !ok {
+		return nil, keyID, status.Errorf(codes.FailedPrecondition, "value was encrypted with unknown key %q", keyID)
+	}
+	headerLen := 2 + idLen + aead.NonceSize()
+	if len(ciphertext) < headerLen+aead.Overhead() {
+		return nil, keyID, status.Error(codes.DataLoss, "encrypted value is truncated")
+	}
+	header := ciphertext[:headerLen]
+	nonce := header[2+idLen:]
+	plaintext, err = aead.Open(nil, nonce, ciphertext[headerLen:], additionalData(header, storageKey))
+	if err != nil {
+		return nil, keyID, status.Errorf(codes.DataLoss, "failed to decrypt value with key %q: %v", keyID, err)
+	}
+	return plaintext, keyID, nil
+}
+
+// The header has a self-describing length, so it can be followed directly by
+// the storage key.
+func additionalData(header []byte, storageKey string) []byte {
+	return append(header[:len(header):len(header)], storageKey...)
+}
+
+// Returns the storage key of a key revision read from a store.
+type storageKeyFunc func(rev storage.KeyRevision[[]byte]) string
+
+// Empty values are not encrypted or decrypted. Values are only empty if they
+// were not requested (e.g. history without values), as encrypting an empty
+// plaintext always produces a non-empty ciphertext.
+func (kr *Keyring) decryptKeyRevision(rev storage.KeyRevision[[]byte], storageKey storageKeyFunc) (storage.KeyRevision[[]byte], error) {
+	if rev == nil {
+		return nil, nil
+	}
+	impl := storage.CopyKeyRevision[[]byte](rev, nil)
+	if value := rev.Value(); len(value) > 0 {
+		plaintext, _, err := kr.Decrypt(value, storageKey(rev))
+		if err != nil {
+			return nil, err
+		}
+		impl.V = plaintext
+	}
+	return impl, nil
+}
+
+func (kr *Keyring) decryptAll(revisions []storage.KeyRevision[[]byte], storageKey storageKeyFunc) ([]storage.KeyRevision[[]byte], error) {
+	out := make([]storage.KeyRevision[[]byte], len(revisions))
+	for i, rev := range revisions {
+		decrypted, err := kr.decryptKeyRevision(rev, storageKey)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = decrypted
+	}
+	return out, nil
+}
+
+// Decrypts the values in watch events. If a value cannot be decrypted, the
+// watch is terminated with a [storage.WatchEventError] event carrying the
+// decryption error, and cancel is called to stop the base watch.
+func (kr *Keyring) decryptWatch(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	c <-chan storage.WatchEvent[storage.KeyRevision[[]byte]],
+	storageKey storageKeyFunc,
+) <-chan storage.WatchEvent[storage.KeyRevision[[]byte]] {
+	out := make(chan storage.WatchEvent[storage.KeyRevision[[]byte]], storage.WatchBufferSize)
+	go func() {
+		defer close(out)
+		defer func() {
+			cancel()
+			for range c {
+			}
+		}()
+		for e := range c {
+			var err error
+			if e.Current, err = kr.decryptKeyRevision(e.Current, storageKey); err == nil {
+				e.Previous, err = kr.decryptKeyRevision(e.Previous, storageKey)
+			}
+			if err != nil {
+				e = storage.WatchEvent[storage.KeyRevision[[]byte]]{
+					EventType: storage.WatchEventError,
+					Revision:  e.Revision,
+					Err:       err,
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case out <- e:
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+type kvStoreEncryptionImpl struct {
+	base    storage.KeyValueStoreT[[]byte]
+	keyring *Keyring
+}
+
+func (s *kvStoreEncryptionImpl) storageKey(rev storage.KeyRevision[[]byte]) string {
+	return rev.Key()
+}
+
+func (s *kvStoreEncryptionImpl) Put(ctx context.Context, key string, value []byte, opts ...storage.PutOpt) error {
+	ciphertext, err := s.keyring.Encrypt(value, key)
+	if err != nil {
+		return err
+	}
+	return s.base.Put(ctx, key, ciphertext, opts...)
+}
+
+func (s *kvStoreEncryptionImpl) Get(ctx context.Context, key string, opts ...storage.GetOpt) ([]byte, error) {
+	ciphertext, err := s.base.Get(ctx, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, _, err := s.keyring.Decrypt(ciphertext, key)
+	return plaintext, err
+}
+
+func (s *kvStoreEncryptionImpl) Watch(ctx context.Context, key string, opts ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[[]byte]], error) {
+	ctx, cancel := context.WithCancel(ctx)
+	c, err := s.base.Watch(ctx, key, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return s.keyring.decryptWatch(ctx, cancel, c, s.storageKey), nil
+}
+
+func (s *kvStoreEncryptionImpl) Delete(ctx context.Context, key string, opts ...storage.DeleteOpt) error {
+	return s.base.Delete(ctx, key, opts...)
+}
+
+func (s *kvStoreEncryptionImpl) ListKeys(ctx context.Context, prefix string, opts ...storage.ListOpt) ([]string, error) {
+	return s.base.ListKeys(ctx, prefix, opts...)
+}
+
+func (s *kvStoreEncryptionImpl) History(ctx context.Context, key string, opts ...storage.HistoryOpt) ([]storage.KeyRevision[[]byte], error) {
+	history, err := s.base.History(ctx, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s.keyring.decryptAll(history, s.storageKey)
+}
+
+func (s *kvStoreEncryptionImpl) Txn(ctx context.Context, req storage.TxnRequest[[]byte]) (*storage.TxnResponse, error) {
+	encrypted := storage.TxnRequest[[]byte]{
+		Compare: req.Compare,
+		Ops:     make([]storage.TxnOp[[]byte], len(req.Ops)),
+	}
+	for i, op := range req.Ops {
+		if op.Type == storage.TxnOpPut {
+			ciphertext, err := s.keyring.Encrypt(op.Value, op.Key)
+			if err != nil {
+				return nil, err
+			}
+			op.Value = ciphertext
+		}
+		encrypted.Ops[i] = op
+	}
+	return s.base.(storage.Txner[[]byte]).Txn(ctx, encrypted)
+}
+
+func (s *kvStoreEncryptionImpl) List(ctx context.Context, prefix string, opts ...storage.ListOpt) ([]storage.KeyRevision[[]byte], error) {
+	revisions, err := s.base.(storage.BatchReader[[]byte]).List(ctx, prefix, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s.keyring.decryptAll(revisions, s.storageKey)
+}
+
+func (s *kvStoreEncryptionImpl) GetMany(ctx context.Context, keys []string) ([]storage.KeyRevision[[]byte], error) {
+	revisions, err := s.base.(storage.BatchReader[[]byte]).GetMany(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	return s.keyring.decryptAll(revisions, s.storageKey)
+}
+
+func (s *kvStoreEncryptionImpl) KeepAlive(ctx context.Context, key string) error {
+	return s.base.(storage.KeepAliver).KeepAlive(ctx, key)
+}
+
+// Returns a key-value store which encrypts values with the primary key of
+// the keyring before writing them to the base store, and decrypts values
+// read from the base store (including history and watch events) with any key
+// in the keyring. Keys and revisions are not encrypted. The returned store
+// implements each of [storage.Txner], [storage.BatchReader], and
+// [storage.KeepAliver] if the base store does.
+//
+// Each value is authenticated along with the key it is stored under in the
+// base store, so that values cannot be moved between keys without failing to
+// decrypt. Values which cannot be decrypted are reported with the error
+// returned by [Keyring.Decrypt]; in watches, such values terminate the watch
+// with a [storage.WatchEventError] event carrying the error.
+func WithEncryption(base storage.KeyValueStoreT[[]byte], keyring *Keyring) storage.KeyValueStoreT[[]byte] {
+	return WithOptionalInterfaces(base, &kvStoreEncryptionImpl{
+		base:    base,
+		keyring: keyring,
+	})
+}
+
+// Like [WithEncryption], but for a single value store. The value is
+// authenticated along with the given storage key, which should identify the
+// store among all stores sharing the keyring.
+func WithValueEncryption(base storage.ValueStoreT[[]byte], keyring *Keyring, storageKey string) storage.ValueStoreT[[]byte] {
+	fixedKey := func(storage.KeyRevision[[]byte]) string { return storageKey }
+	return ValueStoreAdapter[[]byte]{
+		PutFunc: func(ctx context.Context, value []byte, opts ...storage.PutOpt) error {
+			ciphertext, err := keyring.Encrypt(value, storageKey)
+			if err != nil {
+				return err
+			}
+			return base.Put(ctx, ciphertext, opts...)
+		},
+		GetFunc: func(ctx context.Context, opts ...storage.GetOpt) ([]byte, error) {
+			ciphertext, err := base.Get(ctx, opts...)
+			if err != nil {
+				return nil, err
+			}
+			plaintext, _, err := keyring.Decrypt(ciphertext, storageKey)
+			return plaintext, err
+		},
+		WatchFunc: func(ctx context.Context, opts ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[[]byte]], error) {
+			ctx, cancel := context.WithCancel(ctx)
+			c, err := base.Watch(ctx, opts...)
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			return keyring.decryptWatch(ctx, cancel, c, fixedKey), nil
+		},
+		DeleteFunc: func(ctx context.Context, opts ...storage.DeleteOpt) error {
+			return base.Delete(ctx, opts...)
+		},
+		HistoryFunc: func(ctx context.Context, opts ...storage.HistoryOpt) ([]storage.KeyRevision[[]byte], error) {
+			history, err := base.History(ctx, opts...)
+			if err != nil {
+				return nil, err
+			}
+			return keyring.decryptAll(history, fixedKey)
+		},
+	}
+}
+
+// Rewrites all values under the given prefix in the base store which were
+// not encrypted with the primary key of the keyring, so that they are
+// encrypted with the primary key. The base store must be the store that was
+// passed to [WithEncryption], not the encrypted store itself. Returns the
+// number of values that were rewritten.
+//
+// Values are rewritten using the revision they were read at, so concurrent
+// writes are never overwritten. Values which were modified or deleted while
+// re-encrypting are skipped, since any concurrent write through an encrypted
+// store will already have used the primary key.
+//
+// Only the latest revision of each key is rewritten; earlier revisions in
+// the history of each key remain encrypted with their original keys.
+func ReEncrypt(ctx context.Context, base storage.KeyValueStoreT[[]byte], keyring *Keyring, prefix string) (int, error) {
+	keys, err := base.ListKeys(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, key := range keys {
+		rewritten, err := reEncrypt(ctx, keyring, key,
+			func(opts ...storage.GetOpt) ([]byte, error) { return base.Get(ctx, key, opts...) },
+			func(value []byte, opts ...storage.PutOpt) error { return base.Put(ctx, key, value, opts...) },
+		)
+		if err != nil {
+			return count, fmt.Errorf("failed to re-encrypt key %q: %w", key, err)
+		}
+		if rewritten {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Like [ReEncrypt], but for a single value store. The storage key must be the
+// one that was passed to [WithValueEncryption]. Reports whether the value was
+// rewritten.
+func ReEncryptValue(ctx context.Context, base storage.ValueStoreT[[]byte], keyring *Keyring, storageKey string) (bool, error) {
+	return reEncrypt(ctx, keyring, storageKey,
+		func(opts ...storage.GetOpt) ([]byte, error) { return base.Get(ctx, opts...) },
+		func(value []byte, opts ...storage.PutOpt) error { return base.Put(ctx, value, opts...) },
+	)
+}
+
+func reEncrypt(
+	ctx context.Context,
+	keyring *Keyring,
+	storageKey string,
+	get func(...storage.GetOpt) ([]byte, error),
+	put func([]byte, ...storage.PutOpt) error,
+) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	var revision int64
+	ciphertext, err := get(storage.WithRevisionOut(&revision))
+	if err != nil {
+		if storage.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	plaintext, keyID, err := keyring.Decrypt(ciphertext, storageKey)
+	if err != nil {
+		return false, err
+	}
+	if keyID == keyring.PrimaryKeyID() {
+		return false, nil
+	}
+	updated, err := keyring.Encrypt(plaintext, storageKey)
+	if err != nil {
+		return false, err
+	}
+	if err := put(updated, storage.WithRevision(revision)); err != nil {
+		if storage.IsConflict(err) || storage.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
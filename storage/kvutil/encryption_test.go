@@ -0,0 +1,207 @@
+package kvutil_test
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/inmemory"
+	"github.com/kralicky/protoconfig/storage/kvutil"
+	"github.com/kralicky/protoconfig/test/testutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+)
+
+var _ = Describe("Encryption", Label("unit"), func() {
+	var (
+		ctx        context.Context
+		key1, key2 kvutil.EncryptionKey
+		base       storage.KeyValueStoreT[[]byte]
+	)
+	BeforeEach(func() {
+		ctx = context.Background()
+		key1 = kvutil.EncryptionKey{ID: "key1", Secret: bytes.Repeat([]byte{1}, 32)}
+		key2 = kvutil.EncryptionKey{ID: "key2", Secret: bytes.Repeat([]byte{2}, 16)}
+		base = inmemory.NewKeyValueStore(bytes.Clone)
+	})
+
+	It("should validate keys", func() {
+		_, err := kvutil.NewKeyring(kvutil.EncryptionKey{ID: "", Secret: key1.Secret})
+		Expect(err).To(HaveOccurred())
+		_, err = kvutil.NewKeyring(kvutil.EncryptionKey{ID: "key", Secret: []byte("too short")})
+		Expect(err).To(HaveOccurred())
+		_, err = kvutil.NewKeyring(key1, kvutil.EncryptionKey{ID: key1.ID, Secret: key2.Secret})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should store values encrypted", func() {
+		keyring, err := kvutil.NewKeyring(key1)
+		Expect(err).NotTo(HaveOccurred())
+		store := kvutil.WithEncryption(base, keyring)
+
+		plaintext := []byte("secret value")
+		Expect(store.Put(ctx, "key", plaintext)).To(Succeed())
+
+		raw, err := base.Get(ctx, "key")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Contains(raw, plaintext)).To(BeFalse())
+
+		value, err := store.Get(ctx, "key")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal(plaintext))
+
+		By("rejecting values that have been tampered with")
+		raw[len(raw)-1] ^= 0xFF
+		Expect(base.Put(ctx, "key", raw)).To(Succeed())
+		_, err = store.Get(ctx, "key")
+		Expect(err).To(testutil.MatchStatusCode(codes.DataLoss))
+
+		By("rejecting values that are not encrypted")
+		Expect(base.Put(ctx, "key", plaintext)).To(Succeed())
+		_, err = store.Get(ctx, "key")
+		Expect(err).To(testutil.MatchStatusCode(codes.DataLoss))
+	})
+
+	It("should decrypt history and watch events", func(ctx SpecContext) {
+		keyring, err := kvutil.NewKeyring(key1)
+		Expect(err).NotTo(HaveOccurred())
+		store := kvutil.WithEncryption(base, keyring)
+
+		wc, err := store.Watch(ctx, "key")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(store.Put(ctx, "key", []byte("a"))).To(Succeed())
+		Expect(store.Put(ctx, "key", []byte("b"))).To(Succeed())
+
+		var event storage.WatchEvent[storage.KeyRevision[[]byte]]
+		Eventually(wc).Should(Receive(&event))
+		Expect(event.Current.Value()).To(Equal([]byte("a")))
+		Eventually(wc).Should(Receive(&event))
+		Expect(event.Current.Value()).To(Equal([]byte("b")))
+		Expect(event.Previous.Value()).To(Equal([]byte("a")))
+
+		history, err := store.History(ctx, "key", storage.IncludeValues(true))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(history).To(HaveLen(2))
+		Expect(history[0].Value()).To(Equal([]byte("a")))
+		Expect(history[1].Value()).To(Equal([]byte("b")))
+
+		By("terminating the watch when a value cannot be decrypted")
+		Expect(base.Put(ctx, "key", []byte("not encrypted"))).To(Succeed())
+		Eventually(wc).Should(Receive(&event))
+		Expect(event.EventType).To(Equal(storage.WatchEventError))
+		Expect(event.Err).To(testutil.MatchStatusCode(codes.DataLoss))
+		Eventually(wc).Should(BeClosed())
+	})
+
+	It("should reject values moved to a different key or store", func() {
+		keyring, err := kvutil.NewKeyring(key1)
+		Expect(err).NotTo(HaveOccurred())
+		store := kvutil.WithEncryption(base, keyring)
+		Expect(store.Put(ctx, "a", []byte("a"))).To(Succeed())
+		Expect(store.Put(ctx, "b", []byte("b"))).To(Succeed())
+
+		By("swapping the ciphertexts of two keys")
+		rawA, err := base.Get(ctx, "a")
+		Expect(err).NotTo(HaveOccurred())
+		rawB, err := base.Get(ctx, "b")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(base.Put(ctx, "a", rawB)).To(Succeed())
+		Expect(base.Put(ctx, "b", rawA)).To(Succeed())
+		_, err = store.Get(ctx, "a")
+		Expect(err).To(testutil.MatchStatusCode(codes.DataLoss))
+		_, err = store.Get(ctx, "b")
+		Expect(err).To(testutil.MatchStatusCode(codes.DataLoss))
+
+		By("copying a ciphertext into a single value store")
+		baseValue := inmemory.NewValueStore(bytes.Clone)
+		Expect(baseValue.Put(ctx, rawA)).To(Succeed())
+		_, err = kvutil.WithValueEncryption(baseValue, keyring, "b").Get(ctx)
+		Expect(err).To(testutil.MatchStatusCode(codes.DataLoss))
+	})
+
+	When("rotating keys", func() {
+		It("should read values encrypted with previous keys", func() {
+			oldKeyring, err := kvutil.NewKeyring(key1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(kvutil.WithEncryption(base, oldKeyring).Put(ctx, "key", []byte("a"))).To(Succeed())
+
+			newKeyring, err := kvutil.NewKeyring(key2, key1)
+			Expect(err).NotTo(HaveOccurred())
+			store := kvutil.WithEncryption(base, newKeyring)
+			value, err := store.Get(ctx, "key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal([]byte("a")))
+
+			By("encrypting new values with the primary key")
+			Expect(store.Put(ctx, "key", []byte("b"))).To(Succeed())
+			raw, err := base.Get(ctx, "key")
+			Expect(err).NotTo(HaveOccurred())
+			_, keyID, err := newKeyring.Decrypt(raw, "key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keyID).To(Equal("key2"))
+
+			By("failing to read values encrypted with unknown keys")
+			_, err = kvutil.WithEncryption(base, oldKeyring).Get(ctx, "key")
+			Expect(err).To(testutil.MatchStatusCode(codes.FailedPrecondition))
+		})
+
+		It("should re-encrypt existing values with the primary key", func() {
+			oldKeyring, err := kvutil.NewKeyring(key1)
+			Expect(err).NotTo(HaveOccurred())
+			oldStore := kvutil.WithEncryption(base, oldKeyring)
+			Expect(oldStore.Put(ctx, "a/1", []byte("1"))).To(Succeed())
+			Expect(oldStore.Put(ctx, "a/2", []byte("2"))).To(Succeed())
+			Expect(oldStore.Put(ctx, "b/1", []byte("3"))).To(Succeed())
+
+			newKeyring, err := kvutil.NewKeyring(key2, key1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(kvutil.WithEncryption(base, newKeyring).Put(ctx, "a/2", []byte("4"))).To(Succeed())
+
+			count, err := kvutil.ReEncrypt(ctx, base, newKeyring, "a/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(1))
+
+			count, err = kvutil.ReEncrypt(ctx, base, newKeyring, "a/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(0))
+
+			onlyNewKeyring, err := kvutil.NewKeyring(key2)
+			Expect(err).NotTo(HaveOccurred())
+			store := kvutil.WithEncryption(base, onlyNewKeyring)
+			value, err := store.Get(ctx, "a/1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal([]byte("1")))
+			value, err = store.Get(ctx, "a/2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal([]byte("4")))
+			_, err = store.Get(ctx, "b/1")
+			Expect(err).To(testutil.MatchStatusCode(codes.FailedPrecondition))
+
+			By("re-encrypting a single value")
+			rewritten, err := kvutil.ReEncryptValue(ctx, kvutil.WithKey(base, "b/1"), newKeyring, "b/1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rewritten).To(BeTrue())
+			value, err = store.Get(ctx, "b/1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal([]byte("3")))
+		})
+	})
+
+	It("should encrypt values in a single value store", func() {
+		keyring, err := kvutil.NewKeyring(key1)
+		Expect(err).NotTo(HaveOccurred())
+		baseValue := inmemory.NewValueStore(bytes.Clone)
+		store := kvutil.WithValueEncryption(baseValue, keyring, "value")
+		Expect(store.Put(ctx, []byte("a"))).To(Succeed())
+
+		raw, err := baseValue.Get(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(raw).NotTo(Equal([]byte("a")))
+
+		value, err := store.Get(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal([]byte("a")))
+	})
+})
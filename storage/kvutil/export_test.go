@@ -0,0 +1,6 @@
+package kvutil
+
+var (
+	ResumeWatchInitialBackoff = &resumeWatchInitialBackoff
+	ResumeWatchMaxBackoff     = &resumeWatchMaxBackoff
+)
@@ -110,11 +110,29 @@ func (s *kvStorePrefixImpl[T]) History(ctx context.Context, key string, opts ...
 	return s.base.History(ctx, s.prefix+key, opts...)
 }
 
+func (s *kvStorePrefixImpl[T]) Txn(ctx context.Context, req storage.TxnRequest[T]) (*storage.TxnResponse, error) {
+	prefixed := storage.TxnRequest[T]{
+		Compare: make([]storage.TxnCompare, len(req.Compare)),
+		Ops:     make([]storage.TxnOp[T], len(req.Ops)),
+	}
+	for i, cmp := range req.Compare {
+		cmp.Key = s.prefix + cmp.Key
+		prefixed.Compare[i] = cmp
+	}
+	for i, op := range req.Ops {
+		op.Key = s.prefix + op.Key
+		prefixed.Ops[i] = op
+	}
+	return s.base.(storage.Txner[T]).Txn(ctx, prefixed)
+}
+
+// Returns a key-value store which prepends the given prefix to all keys. If
+// the base store implements [storage.Txner], so will the returned store.
 func WithPrefix[T any](base storage.KeyValueStoreT[T], prefix string) storage.KeyValueStoreT[T] {
-	return &kvStorePrefixImpl[T]{
+	return WithOptionalInterfaces(base, &kvStorePrefixImpl[T]{
 		base:   base,
 		prefix: prefix,
-	}
+	})
 }
 
 type singleValueStoreImpl[T any] struct {
@@ -194,26 +212,44 @@ func (s ValueStoreAdapter[T]) History(ctx context.Context, opts ...storage.Histo
 	return s.HistoryFunc(ctx, opts...)
 }
 
-func WithMessageCodec[T proto.Message](base storage.ValueStoreT[[]byte]) storage.ValueStoreT[T] {
-	decodeKeyRevision := func(kr storage.KeyRevision[[]byte]) storage.KeyRevision[T] {
+// Returns a value store which encodes messages before writing them to the
+// base store, and decodes them when they are read. Messages are encoded in
+// the binary format unless a different encoding is set using [WithEncoding].
+//
+// If a schema is set using [WithSchema], messages read from the base store
+// (including history and watch events) are upgraded to the latest version of
+// the schema. Panics if the schema is missing any upgrades.
+func WithMessageCodec[T proto.Message](base storage.ValueStoreT[[]byte], opts ...MessageCodecOption) storage.ValueStoreT[T] {
+	codec := newMessageCodec[T](opts...)
+	if err := codec.validate(); err != nil {
+		panic(err)
+	}
+
+	// If includeValue is false, the value is left unset (nil) regardless of the
+	// contents of the base revision.
+	decodeKeyRevision := func(kr storage.KeyRevision[[]byte], includeValue bool) storage.KeyRevision[T] {
 		if kr == nil {
 			return nil
 		}
-		impl := &storage.KeyRevisionImpl[T]{
-			K:    kr.Key(),
-			V:    util.NewMessage[T](),
-			Rev:  kr.Revision(),
-			Time: kr.Timestamp(),
+		impl := storage.CopyKeyRevision(kr, lo.Empty[T]())
+		if !includeValue {
+			return impl
 		}
-		if err := proto.Unmarshal(kr.Value(), impl.V); err != nil {
-			impl.V = lo.Empty[T]()
+		impl.V = util.NewMessage[T]()
+		// an empty message may be encoded as an empty value
+		if len(kr.Value()) > 0 {
+			msg, err := codec.decode(kr.Value())
+			if err != nil {
+				msg = lo.Empty[T]()
+			}
+			impl.V = msg
 		}
 		return impl
 	}
 
 	return ValueStoreAdapter[T]{
 		PutFunc: func(ctx context.Context, value T, opts ...storage.PutOpt) error {
-			bytes, err := proto.Marshal(value)
+			bytes, err := codec.encode(value)
 			if err != nil {
 				return err
 			}
@@ -224,8 +260,8 @@ func WithMessageCodec[T proto.Message](base storage.ValueStoreT[[]byte]) storage
 			if err != nil {
 				return lo.Empty[T](), err
 			}
-			msg := util.NewMessage[T]()
-			if err := proto.Unmarshal(bytes, msg); err != nil {
+			msg, err := codec.decode(bytes)
+			if err != nil {
 				return lo.Empty[T](), err
 			}
 			return msg, nil
@@ -241,8 +277,10 @@ func WithMessageCodec[T proto.Message](base storage.ValueStoreT[[]byte]) storage
 				for e := range c {
 					typed := storage.WatchEvent[storage.KeyRevision[T]]{
 						EventType: e.EventType,
-						Current:   decodeKeyRevision(e.Current),
-						Previous:  decodeKeyRevision(e.Previous),
+						Current:   decodeKeyRevision(e.Current, true),
+						Previous:  decodeKeyRevision(e.Previous, true),
+						Revision:  e.Revision,
+						Err:       e.Err,
 					}
 					out <- typed
 				}
@@ -253,13 +291,15 @@ func WithMessageCodec[T proto.Message](base storage.ValueStoreT[[]byte]) storage
 			return base.Delete(ctx, opts...)
 		},
 		HistoryFunc: func(ctx context.Context, opts ...storage.HistoryOpt) ([]storage.KeyRevision[T], error) {
+			options := storage.HistoryOptions{}
+			options.Apply(opts...)
 			resp, err := base.History(ctx, opts...)
 			if err != nil {
 				return nil, err
 			}
 			out := make([]storage.KeyRevision[T], len(resp))
 			for i, kr := range resp {
-				out[i] = decodeKeyRevision(kr)
+				out[i] = decodeKeyRevision(kr, options.IncludeValues)
 			}
 			return out, nil
 		},
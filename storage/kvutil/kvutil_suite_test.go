@@ -0,0 +1,57 @@
+package kvutil_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/inmemory"
+	"github.com/kralicky/protoconfig/storage/kvutil"
+	conformance_storage "github.com/kralicky/protoconfig/test/conformance/storage"
+	"github.com/kralicky/protoconfig/test/ext"
+	"github.com/kralicky/protoconfig/util/future"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/samber/lo"
+)
+
+func TestKvutil(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Kvutil Suite")
+}
+
+type encryptedTestBroker struct {
+	keyring *kvutil.Keyring
+}
+
+func (t encryptedTestBroker) KeyValueStore(string) storage.KeyValueStore {
+	return kvutil.WithEncryption(inmemory.NewKeyValueStore(bytes.Clone), t.keyring)
+}
+
+var testKeyring = lo.Must(kvutil.NewKeyring(kvutil.EncryptionKey{
+	ID:     "test",
+	Secret: bytes.Repeat([]byte{1}, 32),
+}))
+
+var _ = Describe("Encrypted KV Store", Ordered, Label("integration"), conformance_storage.KeyValueStoreTestSuite(future.Instant(encryptedTestBroker{keyring: testKeyring}), conformance_storage.NewBytes, Equal))
+
+type quotaTestBroker struct{}
+
+func (quotaTestBroker) KeyValueStore(string) storage.KeyValueStore {
+	store, _ := kvutil.WithQuota(inmemory.NewKeyValueStore(bytes.Clone),
+		kvutil.WithMaxValueSize(1024),
+		kvutil.WithMaxKeys("", 1000),
+		kvutil.WithMaxWriteRate(1000),
+	)
+	return store
+}
+
+var _ = Describe("Quota KV Store", Ordered, Label("integration"), conformance_storage.KeyValueStoreTestSuite(future.Instant(quotaTestBroker{}), conformance_storage.NewBytes, Equal))
+
+var _ = Describe("Single Key Value Store", Label("integration"), conformance_storage.ValueStoreTestSuite(func() storage.ValueStoreT[[]byte] {
+	return kvutil.WithKey(inmemory.NewKeyValueStore(bytes.Clone), "value")
+}, conformance_storage.NewBytes, Equal))
+
+var _ = Describe("Message Codec Value Store", Label("integration"), conformance_storage.ValueStoreTestSuite(func() storage.ValueStoreT[*ext.SampleConfiguration] {
+	return kvutil.WithMessageCodec[*ext.SampleConfiguration](inmemory.NewValueStore(bytes.Clone))
+}, conformance_storage.NewSampleConfiguration, conformance_storage.ProtoEqual))
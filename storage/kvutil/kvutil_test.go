@@ -0,0 +1,44 @@
+package kvutil_test
+
+import (
+	"bytes"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/inmemory"
+	"github.com/kralicky/protoconfig/storage/kvutil"
+	"github.com/kralicky/protoconfig/test/testutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+)
+
+var _ = Describe("Prefixed Key Value Store", Label("unit"), func() {
+	var (
+		base  storage.KeyValueStoreT[[]byte]
+		store storage.KeyValueStoreT[[]byte]
+	)
+	BeforeEach(func(ctx SpecContext) {
+		base = inmemory.NewKeyValueStore(bytes.Clone)
+		store = kvutil.WithPrefix(base, "tenant1/")
+		for _, key := range []string{"tenant1/a", "tenant1/b/c", "tenant2/a"} {
+			Expect(base.Put(ctx, key, []byte(key))).To(Succeed())
+		}
+	})
+
+	It("should delete keys by prefix within the store's prefix", func(ctx SpecContext) {
+		Expect(store.Delete(ctx, "b/", storage.WithPrefix())).To(Succeed())
+		keys, err := base.ListKeys(ctx, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(ConsistOf("tenant1/a", "tenant2/a"))
+	})
+
+	It("should delete all of its keys if the prefix is empty", func(ctx SpecContext) {
+		Expect(store.Delete(ctx, "", storage.WithPrefix())).To(Succeed())
+		keys, err := base.ListKeys(ctx, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(ConsistOf("tenant2/a"))
+
+		_, err = store.Get(ctx, "a")
+		Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+	})
+})
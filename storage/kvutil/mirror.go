@@ -0,0 +1,439 @@
+package kvutil
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kralicky/protoconfig/storage"
+)
+
+type MirrorDivergenceType string
+
+const (
+	// The key exists in the primary store, but not in the secondary store.
+	DivergenceMissing MirrorDivergenceType = "Missing"
+	// The key exists in the secondary store, but not in the primary store.
+	DivergenceExtra MirrorDivergenceType = "Extra"
+	// The key exists in both stores, but with different values.
+	DivergenceMismatch MirrorDivergenceType = "Mismatch"
+	// A write was applied to the primary store, but could not be applied to
+	// the secondary store. Err contains the error returned by the secondary.
+	DivergenceWriteFailed MirrorDivergenceType = "WriteFailed"
+	// The background consistency check could not be completed, so the stores
+	// may have diverged without being reported. Err contains the error
+	// returned by the check. Key is always empty.
+	DivergenceCheckFailed MirrorDivergenceType = "CheckFailed"
+)
+
+// Describes a difference between the primary and secondary stores of a
+// mirror. For value stores, Key is always empty.
+type MirrorDivergence struct {
+	Key  string
+	Type MirrorDivergenceType
+	Err  error
+}
+
+func (d MirrorDivergence) String() string {
+	if d.Err != nil {
+		return fmt.Sprintf("%s: %q: %v", d.Type, d.Key, d.Err)
+	}
+	return fmt.Sprintf("%s: %q", d.Type, d.Key)
+}
+
+type MirrorOptions struct {
+	checkInterval time.Duration
+	checkPrefix   string
+	onDivergence  func(MirrorDivergence)
+}
+
+type MirrorOption func(*MirrorOptions)
+
+func (o *MirrorOptions) apply(opts ...MirrorOption) {
+	for _, op := range opts {
+		op(o)
+	}
+}
+
+// Periodically runs a consistency check in the background, and reports any
+// divergence to the handler set by [WithDivergenceHandler]. The check stops
+// when the context passed to the mirror is canceled. Disabled by default.
+func WithCheckInterval(interval time.Duration) MirrorOption {
+	return func(o *MirrorOptions) {
+		o.checkInterval = interval
+	}
+}
+
+// Sets the prefix of keys compared by the background consistency check of a
+// key-value store mirror. Defaults to the empty prefix.
+func WithCheckPrefix(prefix string) MirrorOption {
+	return func(o *MirrorOptions) {
+		o.checkPrefix = prefix
+	}
+}
+
+// Sets a function which is called for each divergence found by the
+// background consistency check, for each check which could not be
+// completed, and for each write which could not be applied to the secondary
+// store.
+func WithDivergenceHandler(handler func(MirrorDivergence)) MirrorOption {
+	return func(o *MirrorOptions) {
+		o.onDivergence = handler
+	}
+}
+
+type mirrorCore[T any] struct {
+	MirrorOptions
+	// Held while writing to both stores, and while comparing or repairing a
+	// key, so that writes made through the mirror are applied to the
+	// secondary store in the same order as the primary store.
+	writeMu sync.Mutex
+	equal   func(T, T) bool
+}
+
+func newMirrorCore[T any](equal func(T, T) bool, opts ...MirrorOption) *mirrorCore[T] {
+	options := MirrorOptions{}
+	options.apply(opts...)
+	return &mirrorCore[T]{
+		MirrorOptions: options,
+		equal:         equal,
+	}
+}
+
+func (m *mirrorCore[T]) report(d MirrorDivergence) {
+	if m.onDivergence != nil {
+		m.onDivergence(d)
+	}
+}
+
+func (m *mirrorCore[T]) runChecks(ctx context.Context, check func(context.Context) ([]MirrorDivergence, error)) {
+	if m.checkInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(m.checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			divergences, err := check(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					m.report(MirrorDivergence{Type: DivergenceCheckFailed, Err: err})
+				}
+				continue
+			}
+			for _, d := range divergences {
+				m.report(d)
+			}
+		}
+	}()
+}
+
+// Returns the options which should be applied to the secondary store for a
+// put. Revisions are only meaningful in the primary store.
+func secondaryPutOpts(opts []storage.PutOpt) []storage.PutOpt {
+	options := storage.PutOptions{}
+	options.Apply(opts...)
+	if options.TTL != nil {
+		return []storage.PutOpt{storage.WithTTL(*options.TTL)}
+	}
+	return nil
+}
+
+// Compares the values of a key in both stores, and returns the value in the
+// primary store along with the divergence, if any. Must be called with
+// writeMu held.
+func (m *mirrorCore[T]) compareLocked(
+	key string,
+	getPrimary, getSecondary func() (T, error),
+) (*MirrorDivergence, T, error) {
+	pv, perr := getPrimary()
+	if perr != nil && !storage.IsNotFound(perr) {
+		return nil, pv, perr
+	}
+	sv, serr := getSecondary()
+	if serr != nil && !storage.IsNotFound(serr) {
+		return nil, pv, serr
+	}
+	switch {
+	case perr != nil && serr != nil:
+		return nil, pv, nil
+	case serr != nil:
+		return &MirrorDivergence{Key: key, Type: DivergenceMissing}, pv, nil
+	case perr != nil:
+		return &MirrorDivergence{Key: key, Type: DivergenceExtra}, pv, nil
+	case !m.equal(pv, sv):
+		return &MirrorDivergence{Key: key, Type: DivergenceMismatch}, pv, nil
+	}
+	return nil, pv, nil
+}
+
+// A key-value store which writes to both a primary and a secondary store,
+// and reads from the primary store. See [Mirror].
+type KeyValueStoreMirror[T any] struct {
+	core      *mirrorCore[T]
+	primary   storage.KeyValueStoreT[T]
+	secondary storage.KeyValueStoreT[T]
+}
+
+// Returns a key-value store which applies all writes to both the primary and
+// secondary stores, and serves all reads (including watches and history)
+// from the primary store. The equal function is used to compare values
+// during consistency checks.
+//
+// Writes are applied to the primary store first, and are only applied to the
+// secondary store if they succeed. Revisions are authoritative from the
+// primary store: revision options are only applied to the primary store, and
+// all returned revisions are those of the primary store. If a write to the
+// secondary store fails, the write is still considered successful, and the
+// failure is reported to the divergence handler. Use
+// [KeyValueStoreMirror.Resync] to repair the secondary store.
+//
+// Transactions and other optional interfaces are not supported, since they
+// cannot be applied atomically to both stores.
+func Mirror[T any](
+	ctx context.Context,
+	primary, secondary storage.KeyValueStoreT[T],
+	equal func(T, T) bool,
+	opts ...MirrorOption,
+) *KeyValueStoreMirror[T] {
+	m := &KeyValueStoreMirror[T]{
+		core:      newMirrorCore(equal, opts...),
+		primary:   primary,
+		secondary: secondary,
+	}
+	m.core.runChecks(ctx, func(ctx context.Context) ([]MirrorDivergence, error) {
+		return m.Check(ctx, m.core.checkPrefix)
+	})
+	return m
+}
+
+func (m *KeyValueStoreMirror[T]) Put(ctx context.Context, key string, value T, opts ...storage.PutOpt) error {
+	m.core.writeMu.Lock()
+	defer m.core.writeMu.Unlock()
+	if err := m.primary.Put(ctx, key, value, opts...); err != nil {
+		return err
+	}
+	if err := m.secondary.Put(ctx, key, value, secondaryPutOpts(opts)...); err != nil {
+		m.core.report(MirrorDivergence{Key: key, Type: DivergenceWriteFailed, Err: err})
+	}
+	return nil
+}
+
+func (m *KeyValueStoreMirror[T]) Get(ctx context.Context, key string, opts ...storage.GetOpt) (T, error) {
+	return m.primary.Get(ctx, key, opts...)
+}
+
+func (m *KeyValueStoreMirror[T]) Watch(ctx context.Context, key string, opts ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error) {
+	return m.primary.Watch(ctx, key, opts...)
+}
+
+func (m *KeyValueStoreMirror[T]) Delete(ctx context.Context, key string, opts ...storage.DeleteOpt) error {
+	m.core.writeMu.Lock()
+	defer m.core.writeMu.Unlock()
+	if err := m.primary.Delete(ctx, key, opts...); err != nil {
+		return err
+	}
+	options := storage.DeleteOptions{}
+	options.Apply(opts...)
+	var secondaryOpts []storage.DeleteOpt
+	if options.Prefix {
+		secondaryOpts = append(secondaryOpts, storage.WithPrefix())
+	}
+	if err := m.secondary.Delete(ctx, key, secondaryOpts...); err != nil && !storage.IsNotFound(err) {
+		m.core.report(MirrorDivergence{Key: key, Type: DivergenceWriteFailed, Err: err})
+	}
+	return nil
+}
+
+func (m *KeyValueStoreMirror[T]) ListKeys(ctx context.Context, prefix string, opts ...storage.ListOpt) ([]string, error) {
+	return m.primary.ListKeys(ctx, prefix, opts...)
+}
+
+func (m *KeyValueStoreMirror[T]) History(ctx context.Context, key string, opts ...storage.HistoryOpt) ([]storage.KeyRevision[T], error) {
+	return m.primary.History(ctx, key, opts...)
+}
+
+// Compares the latest values of all keys under the given prefix in both
+// stores, and returns any differences, sorted by key.
+func (m *KeyValueStoreMirror[T]) Check(ctx context.Context, prefix string) ([]MirrorDivergence, error) {
+	keys, err := m.unionKeys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var divergences []MirrorDivergence
+	for _, key := range keys {
+		d, err := m.compareKey(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			divergences = append(divergences, *d)
+		}
+	}
+	return divergences, nil
+}
+
+// Copies the latest value of every key under the given prefix which differs
+// between the two stores from the primary store to the secondary store, and
+// deletes keys from the secondary store which do not exist in the primary
+// store. Returns the number of keys that were repaired.
+func (m *KeyValueStoreMirror[T]) Resync(ctx context.Context, prefix string) (int, error) {
+	keys, err := m.unionKeys(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	repaired := 0
+	for _, key := range keys {
+		ok, err := m.repairKey(ctx, key)
+		if err != nil {
+			return repaired, fmt.Errorf("failed to resync key %q: %w", key, err)
+		}
+		if ok {
+			repaired++
+		}
+	}
+	return repaired, nil
+}
+
+func (m *KeyValueStoreMirror[T]) unionKeys(ctx context.Context, prefix string) ([]string, error) {
+	primaryKeys, err := m.primary.ListKeys(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys in primary store: %w", err)
+	}
+	secondaryKeys, err := m.secondary.ListKeys(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys in secondary store: %w", err)
+	}
+	keys := append(primaryKeys, secondaryKeys...)
+	slices.Sort(keys)
+	return slices.Compact(keys), nil
+}
+
+func (m *KeyValueStoreMirror[T]) compareKey(ctx context.Context, key string) (*MirrorDivergence, error) {
+	m.core.writeMu.Lock()
+	defer m.core.writeMu.Unlock()
+	d, _, err := m.core.compareLocked(key,
+		func() (T, error) { return m.primary.Get(ctx, key) },
+		func() (T, error) { return m.secondary.Get(ctx, key) },
+	)
+	return d, err
+}
+
+func (m *KeyValueStoreMirror[T]) repairKey(ctx context.Context, key string) (bool, error) {
+	m.core.writeMu.Lock()
+	defer m.core.writeMu.Unlock()
+	d, value, err := m.core.compareLocked(key,
+		func() (T, error) { return m.primary.Get(ctx, key) },
+		func() (T, error) { return m.secondary.Get(ctx, key) },
+	)
+	if err != nil || d == nil {
+		return false, err
+	}
+	if d.Type == DivergenceExtra {
+		return true, m.secondary.Delete(ctx, key)
+	}
+	return true, m.secondary.Put(ctx, key, value)
+}
+
+// Like [KeyValueStoreMirror], but for a single value store. See [MirrorValue].
+type ValueStoreMirror[T any] struct {
+	core      *mirrorCore[T]
+	primary   storage.ValueStoreT[T]
+	secondary storage.ValueStoreT[T]
+}
+
+// Like [Mirror], but for a single value store.
+func MirrorValue[T any](
+	ctx context.Context,
+	primary, secondary storage.ValueStoreT[T],
+	equal func(T, T) bool,
+	opts ...MirrorOption,
+) *ValueStoreMirror[T] {
+	m := &ValueStoreMirror[T]{
+		core:      newMirrorCore(equal, opts...),
+		primary:   primary,
+		secondary: secondary,
+	}
+	m.core.runChecks(ctx, func(ctx context.Context) ([]MirrorDivergence, error) {
+		d, err := m.Check(ctx)
+		if err != nil || d == nil {
+			return nil, err
+		}
+		return []MirrorDivergence{*d}, nil
+	})
+	return m
+}
+
+func (m *ValueStoreMirror[T]) Put(ctx context.Context, value T, opts ...storage.PutOpt) error {
+	m.core.writeMu.Lock()
+	defer m.core.writeMu.Unlock()
+	if err := m.primary.Put(ctx, value, opts...); err != nil {
+		return err
+	}
+	if err := m.secondary.Put(ctx, value, secondaryPutOpts(opts)...); err != nil {
+		m.core.report(MirrorDivergence{Type: DivergenceWriteFailed, Err: err})
+	}
+	return nil
+}
+
+func (m *ValueStoreMirror[T]) Get(ctx context.Context, opts ...storage.GetOpt) (T, error) {
+	return m.primary.Get(ctx, opts...)
+}
+
+func (m *ValueStoreMirror[T]) Watch(ctx context.Context, opts ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error) {
+	return m.primary.Watch(ctx, opts...)
+}
+
+func (m *ValueStoreMirror[T]) Delete(ctx context.Context, opts ...storage.DeleteOpt) error {
+	m.core.writeMu.Lock()
+	defer m.core.writeMu.Unlock()
+	if err := m.primary.Delete(ctx, opts...); err != nil {
+		return err
+	}
+	if err := m.secondary.Delete(ctx); err != nil && !storage.IsNotFound(err) {
+		m.core.report(MirrorDivergence{Type: DivergenceWriteFailed, Err: err})
+	}
+	return nil
+}
+
+func (m *ValueStoreMirror[T]) History(ctx context.Context, opts ...storage.HistoryOpt) ([]storage.KeyRevision[T], error) {
+	return m.primary.History(ctx, opts...)
+}
+
+// Compares the latest value in both stores. Returns nil if they are equal.
+func (m *ValueStoreMirror[T]) Check(ctx context.Context) (*MirrorDivergence, error) {
+	m.core.writeMu.Lock()
+	defer m.core.writeMu.Unlock()
+	d, _, err := m.core.compareLocked("",
+		func() (T, error) { return m.primary.Get(ctx) },
+		func() (T, error) { return m.secondary.Get(ctx) },
+	)
+	return d, err
+}
+
+// Copies the latest value from the primary store to the secondary store if
+// they differ, or deletes the value from the secondary store if it does not
+// exist in the primary store. Reports whether the secondary store was
+// modified.
+func (m *ValueStoreMirror[T]) Resync(ctx context.Context) (bool, error) {
+	m.core.writeMu.Lock()
+	defer m.core.writeMu.Unlock()
+	d, value, err := m.core.compareLocked("",
+		func() (T, error) { return m.primary.Get(ctx) },
+		func() (T, error) { return m.secondary.Get(ctx) },
+	)
+	if err != nil || d == nil {
+		return false, err
+	}
+	if d.Type == DivergenceExtra {
+		return true, m.secondary.Delete(ctx)
+	}
+	return true, m.secondary.Put(ctx, value)
+}
@@ -0,0 +1,180 @@
+package kvutil_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/inmemory"
+	"github.com/kralicky/protoconfig/storage/kvutil"
+	"github.com/kralicky/protoconfig/test/testutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type failingPutStore struct {
+	storage.KeyValueStoreT[[]byte]
+}
+
+func (failingPutStore) Put(context.Context, string, []byte, ...storage.PutOpt) error {
+	return status.Error(codes.Unavailable, "unavailable")
+}
+
+type failingListStore struct {
+	storage.KeyValueStoreT[[]byte]
+}
+
+func (failingListStore) ListKeys(context.Context, string, ...storage.ListOpt) ([]string, error) {
+	return nil, status.Error(codes.Unavailable, "unavailable")
+}
+
+var _ = Describe("Mirror", Label("unit"), func() {
+	var primary, secondary storage.KeyValueStoreT[[]byte]
+	BeforeEach(func() {
+		primary = inmemory.NewKeyValueStore(bytes.Clone)
+		secondary = inmemory.NewKeyValueStore(bytes.Clone)
+	})
+
+	It("should write to both stores and read from the primary", func(ctx SpecContext) {
+		m := kvutil.Mirror(ctx, primary, secondary, bytes.Equal)
+
+		Expect(secondary.Put(ctx, "a", []byte("x"))).To(Succeed())
+
+		var rev int64
+		Expect(m.Put(ctx, "a", []byte("1"), storage.WithRevisionOut(&rev))).To(Succeed())
+		var primaryRev int64
+		_, err := primary.Get(ctx, "a", storage.WithRevisionOut(&primaryRev))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rev).To(Equal(primaryRev))
+
+		value, err := secondary.Get(ctx, "a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal([]byte("1")))
+
+		By("applying revision checks only to the primary store")
+		Expect(m.Put(ctx, "a", []byte("2"), storage.WithRevision(rev))).To(Succeed())
+		Expect(m.Put(ctx, "a", []byte("3"), storage.WithRevision(rev))).To(testutil.MatchStatusCode(storage.ErrConflict))
+		value, err = secondary.Get(ctx, "a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal([]byte("2")))
+
+		Expect(m.Delete(ctx, "a")).To(Succeed())
+		_, err = secondary.Get(ctx, "a")
+		Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+
+		By("deleting keys by prefix from both stores")
+		Expect(m.Put(ctx, "b/1", []byte("1"))).To(Succeed())
+		Expect(m.Put(ctx, "b/2", []byte("2"))).To(Succeed())
+		Expect(m.Delete(ctx, "b/", storage.WithPrefix())).To(Succeed())
+		keys, err := secondary.ListKeys(ctx, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(BeEmpty())
+
+		divergences, err := m.Check(ctx, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(divergences).To(BeEmpty())
+	})
+
+	It("should report and repair divergence", func(ctx SpecContext) {
+		var mu sync.Mutex
+		var reported []kvutil.MirrorDivergence
+		m := kvutil.Mirror(ctx, primary, secondary, bytes.Equal,
+			kvutil.WithCheckInterval(10*time.Millisecond),
+			kvutil.WithDivergenceHandler(func(d kvutil.MirrorDivergence) {
+				mu.Lock()
+				defer mu.Unlock()
+				reported = append(reported, d)
+			}),
+		)
+		Expect(m.Put(ctx, "a", []byte("1"))).To(Succeed())
+		Expect(m.Put(ctx, "b", []byte("2"))).To(Succeed())
+		Expect(primary.Put(ctx, "c", []byte("3"))).To(Succeed())
+		Expect(secondary.Put(ctx, "b", []byte("x"))).To(Succeed())
+		Expect(secondary.Put(ctx, "d", []byte("4"))).To(Succeed())
+
+		expected := []kvutil.MirrorDivergence{
+			{Key: "b", Type: kvutil.DivergenceMismatch},
+			{Key: "c", Type: kvutil.DivergenceMissing},
+			{Key: "d", Type: kvutil.DivergenceExtra},
+		}
+		divergences, err := m.Check(ctx, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(divergences).To(Equal(expected))
+
+		Eventually(func() []kvutil.MirrorDivergence {
+			mu.Lock()
+			defer mu.Unlock()
+			return reported
+		}).Should(ContainElements(expected))
+
+		repaired, err := m.Resync(ctx, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(repaired).To(Equal(3))
+
+		divergences, err = m.Check(ctx, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(divergences).To(BeEmpty())
+		keys, err := secondary.ListKeys(ctx, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(ConsistOf("a", "b", "c"))
+	})
+
+	It("should report failed writes to the secondary store", func(ctx SpecContext) {
+		var reported []kvutil.MirrorDivergence
+		m := kvutil.Mirror(ctx, primary, failingPutStore{secondary}, bytes.Equal,
+			kvutil.WithDivergenceHandler(func(d kvutil.MirrorDivergence) {
+				reported = append(reported, d)
+			}),
+		)
+		Expect(m.Put(ctx, "a", []byte("1"))).To(Succeed())
+		Expect(reported).To(HaveLen(1))
+		Expect(reported[0].Key).To(Equal("a"))
+		Expect(reported[0].Type).To(Equal(kvutil.DivergenceWriteFailed))
+		Expect(reported[0].Err).To(testutil.MatchStatusCode(codes.Unavailable))
+	})
+
+	It("should report failed background checks", func(ctx SpecContext) {
+		reported := make(chan kvutil.MirrorDivergence, 10)
+		kvutil.Mirror(ctx, primary, failingListStore{secondary}, bytes.Equal,
+			kvutil.WithCheckInterval(10*time.Millisecond),
+			kvutil.WithDivergenceHandler(func(d kvutil.MirrorDivergence) {
+				select {
+				case reported <- d:
+				default:
+				}
+			}),
+		)
+		var d kvutil.MirrorDivergence
+		Eventually(reported).Should(Receive(&d))
+		Expect(d.Key).To(BeEmpty())
+		Expect(d.Type).To(Equal(kvutil.DivergenceCheckFailed))
+		Expect(d.Err).To(testutil.MatchStatusCode(codes.Unavailable))
+	})
+
+	It("should mirror a single value store", func(ctx SpecContext) {
+		primaryValue := inmemory.NewValueStore(bytes.Clone)
+		secondaryValue := inmemory.NewValueStore(bytes.Clone)
+		m := kvutil.MirrorValue(ctx, primaryValue, secondaryValue, bytes.Equal)
+
+		Expect(m.Put(ctx, []byte("1"))).To(Succeed())
+		value, err := secondaryValue.Get(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal([]byte("1")))
+
+		Expect(secondaryValue.Put(ctx, []byte("x"))).To(Succeed())
+		d, err := m.Check(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d).To(Equal(&kvutil.MirrorDivergence{Type: kvutil.DivergenceMismatch}))
+
+		ok, err := m.Resync(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		d, err = m.Check(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d).To(BeNil())
+	})
+})
@@ -0,0 +1,76 @@
+package kvutil
+
+import "github.com/kralicky/protoconfig/storage"
+
+// Returns a store with the methods of impl, which wraps base. The returned
+// store implements each of the optional interfaces [storage.Txner],
+// [storage.BatchReader], and [storage.KeepAliver] if and only if both base
+// and impl implement it, so that wrappers do not advertise capabilities that
+// the underlying store does not have. Implementations of the optional methods
+// in impl can assume that base implements the corresponding interface.
+func WithOptionalInterfaces[T any](base, impl storage.KeyValueStoreT[T]) storage.KeyValueStoreT[T] {
+	txner, _ := impl.(storage.Txner[T])
+	if _, ok := base.(storage.Txner[T]); !ok {
+		txner = nil
+	}
+	reader, _ := impl.(storage.BatchReader[T])
+	if _, ok := base.(storage.BatchReader[T]); !ok {
+		reader = nil
+	}
+	keepAliver, _ := impl.(storage.KeepAliver)
+	if _, ok := base.(storage.KeepAliver); !ok {
+		keepAliver = nil
+	}
+
+	type (
+		kv  = storage.KeyValueStoreT[T]
+		txn = storage.Txner[T]
+		br  = storage.BatchReader[T]
+		ka  = storage.KeepAliver
+	)
+	switch {
+	case txner != nil && reader != nil && keepAliver != nil:
+		return struct {
+			kv
+			txn
+			br
+			ka
+		}{impl, txner, reader, keepAliver}
+	case txner != nil && reader != nil:
+		return struct {
+			kv
+			txn
+			br
+		}{impl, txner, reader}
+	case txner != nil && keepAliver != nil:
+		return struct {
+			kv
+			txn
+			ka
+		}{impl, txner, keepAliver}
+	case reader != nil && keepAliver != nil:
+		return struct {
+			kv
+			br
+			ka
+		}{impl, reader, keepAliver}
+	case txner != nil:
+		return struct {
+			kv
+			txn
+		}{impl, txner}
+	case reader != nil:
+		return struct {
+			kv
+			br
+		}{impl, reader}
+	case keepAliver != nil:
+		return struct {
+			kv
+			ka
+		}{impl, keepAliver}
+	default:
+		// hide any optional methods implemented by impl
+		return struct{ kv }{impl}
+	}
+}
@@ -0,0 +1,374 @@
+package kvutil
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/samber/lo"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type QuotaOptions struct {
+	maxValueSize int
+	maxKeys      map[string]int
+	maxWriteRate int
+}
+
+type QuotaOption func(*QuotaOptions)
+
+func (o *QuotaOptions) apply(opts ...QuotaOption) {
+	for _, op := range opts {
+		op(o)
+	}
+}
+
+// Limits the size of each value written, in bytes.
+func WithMaxValueSize(size int) QuotaOption {
+	if size <= 0 {
+		panic(fmt.Sprintf("bug: invalid max value size %d", size))
+	}
+	return func(o *QuotaOptions) {
+		o.maxValueSize = size
+	}
+}
+
+// Limits the number of keys starting with prefix. Can be given several
+// times for different prefixes; a key counts towards the limit of every
+// prefix it starts with. Writes which replace or delete existing keys are
+// always allowed.
+func WithMaxKeys(prefix string, count int) QuotaOption {
+	if count <= 0 {
+		panic(fmt.Sprintf("bug: invalid max key count %d", count))
+	}
+	return func(o *QuotaOptions) {
+		if o.maxKeys == nil {
+			o.maxKeys = map[string]int{}
+		}
+		o.maxKeys[prefix] = count
+	}
+}
+
+// Limits the number of writes to each key within any one second window.
+func WithMaxWriteRate(writesPerSecond int) QuotaOption {
+	if writesPerSecond <= 0 {
+		panic(fmt.Sprintf("bug: invalid max write rate %d", writesPerSecond))
+	}
+	return func(o *QuotaOptions) {
+		o.maxWriteRate = writesPerSecond
+	}
+}
+
+// Subjects of the violations reported in quota errors start with one of
+// these prefixes, followed by the key or prefix the quota applies to.
+const (
+	QuotaSubjectValueSize = "value-size:"
+	QuotaSubjectKeys      = "keys:"
+	QuotaSubjectWriteRate = "write-rate:"
+)
+
+// A snapshot of the usage of a store with quotas.
+type QuotaUsage struct {
+	// The number of keys starting with each prefix limited by [WithMaxKeys].
+	Keys map[string]int64
+	// The number of writes to each key in the last second, for keys which
+	// have been written in the last second. Only tracked if a write rate is
+	// limited by [WithMaxWriteRate].
+	Writes map[string]int
+	// The number of writes rejected because of each kind of quota, keyed by
+	// the subject prefix of the violations, e.g. [QuotaSubjectValueSize].
+	// A write violating several quotas is counted for each of them.
+	Rejected map[string]int
+}
+
+// Enforces the quotas of a store returned by [WithQuota], and reports its
+// usage.
+type Quota struct {
+	QuotaOptions
+	base storage.KeyValueStore
+	// sorted, so that violations are reported in a consistent order
+	keyPrefixes []string
+
+	mu        sync.Mutex
+	writes    map[string][]time.Time
+	lastPrune time.Time
+	rejected  map[string]int
+}
+
+// Returns a store which rejects writes exceeding the given quotas with a
+// ResourceExhausted error. The error has an [errdetails.QuotaFailure] detail
+// with one violation for each quota the write would have exceeded; see
+// [QuotaSubjectValueSize] for the format of their subjects. The returned
+// [Quota] reports the current usage of the store.
+//
+// Puts and the put operations of transactions are subject to all quotas.
+// Values are limited by their size in bytes, so to limit the encoded size of
+// typed values, wrap the underlying []byte store before applying a codec.
+//
+// Quotas are enforced by this wrapper only: writes made to the base store
+// by other clients are counted towards the key limits, but not the write
+// rates, and concurrent writes may exceed a key limit or a write rate. Only
+// writes which succeed count towards the write rates, so writes rejected by
+// the base store, such as transactions whose comparisons fail, do not.
+//
+// The returned store implements each of [storage.Txner],
+// [storage.BatchReader], and [storage.KeepAliver] if the base store does.
+func WithQuota(base storage.KeyValueStore, opts ...QuotaOption) (storage.KeyValueStore, *Quota) {
+	options := QuotaOptions{}
+	options.apply(opts...)
+	keyPrefixes := lo.Keys(options.maxKeys)
+	slices.Sort(keyPrefixes)
+	q := &Quota{
+		QuotaOptions: options,
+		base:         base,
+		keyPrefixes:  keyPrefixes,
+		writes:       map[string][]time.Time{},
+		rejected:     map[string]int{},
+	}
+	return WithOptionalInterfaces(base, &quotaStoreImpl{
+		base:  base,
+		quota: q,
+	}), q
+}
+
+// Returns the current usage of the store. Key counts are read from the base
+// store.
+func (q *Quota) Usage(ctx context.Context) (QuotaUsage, error) {
+	usage := QuotaUsage{
+		Keys: make(map[string]int64, len(q.keyPrefixes)),
+	}
+	for _, prefix := range q.keyPrefixes {
+		keys, err := q.base.ListKeys(ctx, prefix)
+		if err != nil {
+			return QuotaUsage{}, err
+		}
+		usage.Keys[prefix] = int64(len(keys))
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.pruneLocked(now)
+	usage.Writes = make(map[string]int, len(q.writes))
+	for key := range q.writes {
+		usage.Writes[key] = len(q.recentWritesLocked(key, now))
+	}
+	usage.Rejected = maps.Clone(q.rejected)
+	return usage, nil
+}
+
+type quotaWrite struct {
+	key    string
+	value  []byte
+	delete bool
+}
+
+// Checks the writes against all quotas. Allowed writes are recorded by
+// calling record once they succeed.
+func (q *Quota) check(ctx context.Context, writes ...quotaWrite) error {
+	var violations []*errdetails.QuotaFailure_Violation
+	if q.maxValueSize > 0 {
+		for _, w := range writes {
+			if !w.delete && len(w.value) > q.maxValueSize {
+				violations = append(violations, &errdetails.QuotaFailure_Violation{
+					Subject:     QuotaSubjectValueSize + w.key,
+					Description: fmt.Sprintf("value size %d exceeds the limit of %d bytes", len(w.value), q.maxValueSize),
+				})
+			}
+		}
+	}
+	keyViolations, err := q.checkKeys(ctx, writes)
+	if err != nil {
+		return err
+	}
+	violations = append(violations, keyViolations...)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.maxWriteRate > 0 {
+		now := time.Now()
+		for _, w := range writes {
+			if w.delete {
+				continue
+			}
+			if n := len(q.recentWritesLocked(w.key, now)); n >= q.maxWriteRate {
+				violations = append(violations, &errdetails.QuotaFailure_Violation{
+					Subject:     QuotaSubjectWriteRate + w.key,
+					Description: fmt.Sprintf("%d writes in the last second exceed the limit of %d per second", n+1, q.maxWriteRate),
+				})
+			}
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	kinds := lo.Uniq(lo.Map(violations, func(v *errdetails.QuotaFailure_Violation, _ int) string {
+		kind, _, _ := strings.Cut(v.Subject, ":")
+		return kind + ":"
+	}))
+	for _, kind := range kinds {
+		q.rejected[kind]++
+	}
+	return lo.Must(status.New(codes.ResourceExhausted, "quota exceeded: "+violations[0].Description).
+		WithDetails(&errdetails.QuotaFailure{Violations: violations})).Err()
+}
+
+// Records successful writes for the write rate quota.
+func (q *Quota) record(writes ...quotaWrite) {
+	if q.maxWriteRate == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for _, w := range writes {
+		if !w.delete {
+			q.writes[w.key] = append(q.recentWritesLocked(w.key, now), now)
+		}
+	}
+	q.pruneLocked(now)
+}
+
+// Returns a violation for each prefix whose key count would exceed its
+// limit after the writes.
+func (q *Quota) checkKeys(ctx context.Context, writes []quotaWrite) ([]*errdetails.QuotaFailure_Violation, error) {
+	var violations []*errdetails.QuotaFailure_Violation
+	exists := map[string]bool{}
+	for _, prefix := range q.keyPrefixes {
+		limit := q.maxKeys[prefix]
+		var created, deleted int
+		for _, w := range writes {
+			if !strings.HasPrefix(w.key, prefix) {
+				continue
+			}
+			ok, known := exists[w.key]
+			if !known {
+				_, err := q.base.Get(ctx, w.key)
+				if err != nil && !storage.IsNotFound(err) {
+					return nil, err
+				}
+				ok = err == nil
+				exists[w.key] = ok
+			}
+			switch {
+			case w.delete && ok:
+				deleted++
+			case !w.delete && !ok:
+				created++
+			}
+		}
+		if created <= deleted {
+			continue
+		}
+		keys, err := q.base.ListKeys(ctx, prefix, storage.WithLimit(int64(limit)))
+		if err != nil {
+			return nil, err
+		}
+		if count := len(keys) + created - deleted; count > limit {
+			violations = append(violations, &errdetails.QuotaFailure_Violation{
+				Subject:     QuotaSubjectKeys + prefix,
+				Description: fmt.Sprintf("%d keys with prefix %q exceed the limit of %d", count, prefix, limit),
+			})
+		}
+	}
+	return violations, nil
+}
+
+// Returns the times of the writes to the key in the last second.
+func (q *Quota) recentWritesLocked(key string, now time.Time) []time.Time {
+	times := q.writes[key]
+	i, _ := slices.BinarySearchFunc(times, now.Add(-time.Second), func(t, cutoff time.Time) int {
+		return t.Compare(cutoff)
+	})
+	return times[i:]
+}
+
+// Forgets keys which have not been written in the last second, at most once
+// per second.
+func (q *Quota) pruneLocked(now time.Time) {
+	if now.Sub(q.lastPrune) < time.Second {
+		return
+	}
+	q.lastPrune = now
+	for key := range q.writes {
+		if len(q.recentWritesLocked(key, now)) == 0 {
+			delete(q.writes, key)
+		}
+	}
+}
+
+type quotaStoreImpl struct {
+	base  storage.KeyValueStore
+	quota *Quota
+}
+
+func (s *quotaStoreImpl) Put(ctx context.Context, key string, value []byte, opts ...storage.PutOpt) error {
+	write := quotaWrite{key: key, value: value}
+	if err := s.quota.check(ctx, write); err != nil {
+		return err
+	}
+	if err := s.base.Put(ctx, key, value, opts...); err != nil {
+		return err
+	}
+	s.quota.record(write)
+	return nil
+}
+
+func (s *quotaStoreImpl) Get(ctx context.Context, key string, opts ...storage.GetOpt) ([]byte, error) {
+	return s.base.Get(ctx, key, opts...)
+}
+
+func (s *quotaStoreImpl) Watch(ctx context.Context, key string, opts ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[[]byte]], error) {
+	return s.base.Watch(ctx, key, opts...)
+}
+
+func (s *quotaStoreImpl) Delete(ctx context.Context, key string, opts ...storage.DeleteOpt) error {
+	return s.base.Delete(ctx, key, opts...)
+}
+
+func (s *quotaStoreImpl) ListKeys(ctx context.Context, prefix string, opts ...storage.ListOpt) ([]string, error) {
+	return s.base.ListKeys(ctx, prefix, opts...)
+}
+
+func (s *quotaStoreImpl) History(ctx context.Context, key string, opts ...storage.HistoryOpt) ([]storage.KeyRevision[[]byte], error) {
+	return s.base.History(ctx, key, opts...)
+}
+
+func (s *quotaStoreImpl) Txn(ctx context.Context, req storage.TxnRequest[[]byte]) (*storage.TxnResponse, error) {
+	writes := make([]quotaWrite, len(req.Ops))
+	for i, op := range req.Ops {
+		writes[i] = quotaWrite{
+			key:    op.Key,
+			value:  op.Value,
+			delete: op.Type == storage.TxnOpDelete,
+		}
+	}
+	if err := s.quota.check(ctx, writes...); err != nil {
+		return nil, err
+	}
+	resp, err := s.base.(storage.Txner[[]byte]).Txn(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	s.quota.record(writes...)
+	return resp, nil
+}
+
+func (s *quotaStoreImpl) List(ctx context.Context, prefix string, opts ...storage.ListOpt) ([]storage.KeyRevision[[]byte], error) {
+	return s.base.(storage.BatchReader[[]byte]).List(ctx, prefix, opts...)
+}
+
+func (s *quotaStoreImpl) GetMany(ctx context.Context, keys []string) ([]storage.KeyRevision[[]byte], error) {
+	return s.base.(storage.BatchReader[[]byte]).GetMany(ctx, keys)
+}
+
+func (s *quotaStoreImpl) KeepAlive(ctx context.Context, key string) error {
+	return s.base.(storage.KeepAliver).KeepAlive(ctx, key)
+}
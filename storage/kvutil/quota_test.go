@@ -0,0 +1,160 @@
+package kvutil_test
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/inmemory"
+	"github.com/kralicky/protoconfig/storage/kvutil"
+	"github.com/kralicky/protoconfig/test/testutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Returns the subjects of the quota violations of err.
+func violationSubjects(err error) []string {
+	var subjects []string
+	for _, detail := range status.Convert(err).Details() {
+		if failure, ok := detail.(*errdetails.QuotaFailure); ok {
+			for _, v := range failure.GetViolations() {
+				subjects = append(subjects, v.GetSubject())
+			}
+		}
+	}
+	return subjects
+}
+
+var _ = Describe("Quota", Label("unit"), func() {
+	var base storage.KeyValueStore
+	BeforeEach(func() {
+		base = inmemory.NewKeyValueStore(bytes.Clone)
+	})
+
+	It("should limit the size of values", func(ctx SpecContext) {
+		store, quota := kvutil.WithQuota(base, kvutil.WithMaxValueSize(4))
+		Expect(store.Put(ctx, "key", []byte("1234"))).To(Succeed())
+
+		err := store.Put(ctx, "key", []byte("12345"))
+		Expect(err).To(testutil.MatchStatusCode(codes.ResourceExhausted))
+		Expect(violationSubjects(err)).To(ConsistOf(kvutil.QuotaSubjectValueSize + "key"))
+		value, err := base.Get(ctx, "key")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(Equal([]byte("1234")))
+
+		usage, err := quota.Usage(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usage.Rejected).To(Equal(map[string]int{kvutil.QuotaSubjectValueSize: 1}))
+	})
+
+	It("should limit the number of keys with a prefix", func(ctx SpecContext) {
+		store, quota := kvutil.WithQuota(base, kvutil.WithMaxKeys("tenant/", 2))
+		Expect(store.Put(ctx, "tenant/a", []byte("a"))).To(Succeed())
+		Expect(store.Put(ctx, "tenant/b", []byte("b"))).To(Succeed())
+
+		err := store.Put(ctx, "tenant/c", []byte("c"))
+		Expect(err).To(testutil.MatchStatusCode(codes.ResourceExhausted))
+		Expect(violationSubjects(err)).To(ConsistOf(kvutil.QuotaSubjectKeys + "tenant/"))
+
+		By("allowing existing keys to be replaced, and keys outside the prefix")
+		Expect(store.Put(ctx, "tenant/a", []byte("a2"))).To(Succeed())
+		Expect(store.Put(ctx, "other", []byte("c"))).To(Succeed())
+
+		usage, err := quota.Usage(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usage.Keys).To(Equal(map[string]int64{"tenant/": 2}))
+
+		By("allowing new keys once others are deleted")
+		Expect(store.Delete(ctx, "tenant/b")).To(Succeed())
+		Expect(store.Put(ctx, "tenant/c", []byte("c"))).To(Succeed())
+	})
+
+	It("should count the keys created and deleted by transactions", func(ctx SpecContext) {
+		store, _ := kvutil.WithQuota(base, kvutil.WithMaxKeys("tenant/", 2))
+		txner := store.(storage.Txner[[]byte])
+		Expect(store.Put(ctx, "tenant/a", []byte("a"))).To(Succeed())
+
+		_, err := txner.Txn(ctx, storage.TxnRequest[[]byte]{
+			Ops: []storage.TxnOp[[]byte]{
+				storage.TxnPut("tenant/b", []byte("b")),
+				storage.TxnPut("tenant/c", []byte("c")),
+			},
+		})
+		Expect(err).To(testutil.MatchStatusCode(codes.ResourceExhausted))
+		keys, err := base.ListKeys(ctx, "tenant/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(ConsistOf("tenant/a"))
+
+		_, err = txner.Txn(ctx, storage.TxnRequest[[]byte]{
+			Ops: []storage.TxnOp[[]byte]{
+				storage.TxnDelete[[]byte]("tenant/a"),
+				storage.TxnPut("tenant/b", []byte("b")),
+				storage.TxnPut("tenant/c", []byte("c")),
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should limit the write rate of each key", func(ctx SpecContext) {
+		store, quota := kvutil.WithQuota(base, kvutil.WithMaxWriteRate(2))
+		Expect(store.Put(ctx, "a", []byte("1"))).To(Succeed())
+		Expect(store.Put(ctx, "a", []byte("2"))).To(Succeed())
+		err := store.Put(ctx, "a", []byte("3"))
+		Expect(err).To(testutil.MatchStatusCode(codes.ResourceExhausted))
+		Expect(violationSubjects(err)).To(ConsistOf(kvutil.QuotaSubjectWriteRate + "a"))
+		Expect(store.Put(ctx, "b", []byte("1"))).To(Succeed())
+
+		usage, err := quota.Usage(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usage.Writes).To(Equal(map[string]int{"a": 2, "b": 1}))
+
+		By("allowing writes again after a second")
+		Eventually(func() error {
+			return store.Put(ctx, "a", []byte("3"))
+		}).WithTimeout(2 * time.Second).WithPolling(100 * time.Millisecond).Should(Succeed())
+	})
+
+	It("should not count failed writes towards the write rate", func(ctx SpecContext) {
+		store, quota := kvutil.WithQuota(base, kvutil.WithMaxWriteRate(1))
+		txner := store.(storage.Txner[[]byte])
+		var rev int64
+		Expect(base.Put(ctx, "a", []byte("1"), storage.WithRevisionOut(&rev))).To(Succeed())
+
+		err := store.Put(ctx, "a", []byte("2"), storage.WithRevision(rev+1))
+		Expect(storage.IsConflict(err)).To(BeTrue(), "expected a conflict error, got %v", err)
+		_, err = txner.Txn(ctx, storage.TxnRequest[[]byte]{
+			Compare: []storage.TxnCompare{{Key: "a", Revision: rev + 1}},
+			Ops:     []storage.TxnOp[[]byte]{storage.TxnPut("a", []byte("2"))},
+		})
+		Expect(storage.IsConflict(err)).To(BeTrue(), "expected a conflict error, got %v", err)
+
+		usage, err := quota.Usage(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usage.Writes).To(BeEmpty())
+		Expect(store.Put(ctx, "a", []byte("2"))).To(Succeed())
+	})
+
+	It("should report every violated quota", func(ctx SpecContext) {
+		store, quota := kvutil.WithQuota(base,
+			kvutil.WithMaxValueSize(1),
+			kvutil.WithMaxKeys("", 1),
+			kvutil.WithMaxKeys("a", 1),
+		)
+		Expect(store.Put(ctx, "x", []byte("x"))).To(Succeed())
+		err := store.Put(ctx, "ab", []byte("ab"))
+		Expect(violationSubjects(err)).To(Equal([]string{
+			kvutil.QuotaSubjectValueSize + "ab",
+			kvutil.QuotaSubjectKeys,
+		}))
+
+		usage, err := quota.Usage(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usage.Rejected).To(Equal(map[string]int{
+			kvutil.QuotaSubjectValueSize: 1,
+			kvutil.QuotaSubjectKeys:      1,
+		}))
+	})
+})
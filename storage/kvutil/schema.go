@@ -0,0 +1,264 @@
+package kvutil
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const maxSchemaVersion = math.MaxInt32
+
+type messageSchema interface {
+	validate(target protoreflect.MessageDescriptor) error
+	latestVersion() int
+	upgrade(version int, stored storedMessage) (proto.Message, error)
+}
+
+type schemaUpgrade struct {
+	from protoreflect.MessageType
+	to   protoreflect.MessageDescriptor
+	fn   func(proto.Message) (proto.Message, error)
+}
+
+// A registry of functions which upgrade messages of type T stored with older
+// versions of a schema to the latest version. Version 1 is the initial
+// version of the schema, and each registered upgrade increments the latest
+// version by one. See [WithSchema] and [UpgradeSchema].
+type Schema[T proto.Message] struct {
+	mu       sync.Mutex
+	upgrades map[int]schemaUpgrade
+}
+
+func NewSchema[T proto.Message]() *Schema[T] {
+	return &Schema[T]{
+		upgrades: map[int]schemaUpgrade{},
+	}
+}
+
+// Registers a function which upgrades messages stored with the given version
+// of the schema to the next version. Messages stored with the given version
+// are decoded as type From before being passed to the function, so that
+// fields which have since been removed from T can still be read. From and To
+// can both be T if the message type itself is unchanged between versions.
+//
+// Upgrades must be registered for consecutive versions starting at 1, and the
+// To type of each upgrade must match the From type of the next; the To type
+// of the last upgrade must be T. Panics if an upgrade has already been
+// registered for the version, or if the types do not match.
+func RegisterUpgrade[T, From, To proto.Message](schema *Schema[T], version int, fn func(From) (To, error)) {
+	schema.mu.Lock()
+	defer schema.mu.Unlock()
+	if version < 1 || version >= maxSchemaVersion {
+		panic(fmt.Sprintf("invalid schema version %d", version))
+	}
+	if _, ok := schema.upgrades[version]; ok {
+		panic(fmt.Sprintf("an upgrade from schema version %d is already registered", version))
+	}
+	var from From
+	var to To
+	upgrade := schemaUpgrade{
+		from: from.ProtoReflect().Type(),
+		to:   to.ProtoReflect().Descriptor(),
+		fn: func(msg proto.Message) (proto.Message, error) {
+			return fn(msg.(From))
+		},
+	}
+	if prev, ok := schema.upgrades[version-1]; ok && prev.to.FullName() != upgrade.from.Descriptor().FullName() {
+		panic(fmt.Sprintf("upgrade from schema version %d accepts %s, but the previous upgrade returns %s",
+			version, upgrade.from.Descriptor().FullName(), prev.to.FullName()))
+	}
+	if next, ok := schema.upgrades[version+1]; ok && next.from.Descriptor().FullName() != upgrade.to.FullName() {
+		panic(fmt.Sprintf("upgrade from schema version %d returns %s, but the next upgrade accepts %s",
+			version, upgrade.to.FullName(), next.from.Descriptor().FullName()))
+	}
+	schema.upgrades[version] = upgrade
+}
+
+// Returns the latest version of the schema, which is the version stored
+// alongside newly written messages.
+func (s *Schema[T]) Version() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.latestVersionLocked()
+}
+
+func (s *Schema[T]) latestVersion() int {
+	return s.Version()
+}
+
+func (s *Schema[T]) latestVersionLocked() int {
+	return len(s.upgrades) + 1
+}
+
+func (s *Schema[T]) validate(target protoreflect.MessageDescriptor) error {
+	var t T
+	if name := t.ProtoReflect().Descriptor().FullName(); name != target.FullName() {
+		return fmt.Errorf("schema is for messages of type %s, not %s", name, target.FullName())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.validateLocked()
+}
+
+// Checks that upgrades are registered for every version up to the latest
+// version, and that the last upgrade returns T.
+func (s *Schema[T]) validateLocked() error {
+	latest := s.latestVersionLocked()
+	for version := 1; version < latest; version++ {
+		if _, ok := s.upgrades[version]; !ok {
+			return fmt.Errorf("schema is missing an upgrade from version %d", version)
+		}
+	}
+	var t T
+	if last, ok := s.upgrades[latest-1]; ok && last.to.FullName() != t.ProtoReflect().Descriptor().FullName() {
+		return fmt.Errorf("upgrade from schema version %d returns %s, expected %s",
+			latest-1, last.to.FullName(), t.ProtoReflect().Descriptor().FullName())
+	}
+	return nil
+}
+
+func (s *Schema[T]) upgrade(version int, stored storedMessage) (proto.Message, error) {
+	s.mu.Lock()
+	if err := s.validateLocked(); err != nil {
+		s.mu.Unlock()
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	latest := s.latestVersionLocked()
+	if version > latest {
+		s.mu.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"message was stored with schema version %d, but the latest known version is %d", version, latest)
+	}
+	chain := make([]schemaUpgrade, 0, latest-version)
+	for v := version; v < latest; v++ {
+		chain = append(chain, s.upgrades[v])
+	}
+	s.mu.Unlock()
+
+	var msg proto.Message
+	if len(chain) == 0 {
+		msg = util.NewMessage[T]()
+	} else {
+		msg = chain[0].from.New().Interface()
+	}
+	if err := stored.unmarshal(msg); err != nil {
+		return nil, err
+	}
+	for i, u := range chain {
+		upgraded, err := u.fn(msg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upgrade message from schema version %d: %w", version+i, err)
+		}
+		msg = upgraded
+	}
+	return msg, nil
+}
+
+// Rewrites all values under the given prefix in the base store which were
+// stored with an older version of the schema (or without a version), so that
+// they are stored with the latest version. The base store must contain
+// messages written by [WithMessageCodec]; values are rewritten using the
+// encoding set by the given options. Returns the number of values that were
+// rewritten.
+//
+// As with [ReEncrypt], values are rewritten using the revision they were read
+// at, and values which were modified or deleted concurrently are skipped.
+// Only the latest revision of each key is rewritten; earlier revisions are
+// upgraded each time they are read.
+func UpgradeSchema[T proto.Message](
+	ctx context.Context,
+	base storage.KeyValueStoreT[[]byte],
+	prefix string,
+	schema *Schema[T],
+	opts ...MessageCodecOption,
+) (int, error) {
+	codec := newMessageCodec[T](append(opts, WithSchema(schema))...)
+	if err := codec.validate(); err != nil {
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+	keys, err := base.ListKeys(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, key := range keys {
+		rewritten, err := upgradeStored(ctx, codec,
+			func(opts ...storage.GetOpt) ([]byte, error) { return base.Get(ctx, key, opts...) },
+			func(value []byte, opts ...storage.PutOpt) error { return base.Put(ctx, key, value, opts...) },
+		)
+		if err != nil {
+			return count, fmt.Errorf("failed to upgrade key %q: %w", key, err)
+		}
+		if rewritten {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Like [UpgradeSchema], but for a single value store. Reports whether the
+// value was rewritten.
+func UpgradeSchemaValue[T proto.Message](
+	ctx context.Context,
+	base storage.ValueStoreT[[]byte],
+	schema *Schema[T],
+	opts ...MessageCodecOption,
+) (bool, error) {
+	codec := newMessageCodec[T](append(opts, WithSchema(schema))...)
+	if err := codec.validate(); err != nil {
+		return false, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return upgradeStored(ctx, codec,
+		func(opts ...storage.GetOpt) ([]byte, error) { return base.Get(ctx, opts...) },
+		func(value []byte, opts ...storage.PutOpt) error { return base.Put(ctx, value, opts...) },
+	)
+}
+
+func upgradeStored[T proto.Message](
+	ctx context.Context,
+	codec messageCodec[T],
+	get func(...storage.GetOpt) ([]byte, error),
+	put func([]byte, ...storage.PutOpt) error,
+) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	var revision int64
+	data, err := get(storage.WithRevisionOut(&revision))
+	if err != nil {
+		if storage.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	stored, err := parseStoredMessage(data)
+	if err != nil {
+		return false, err
+	}
+	if stored.version == codec.schema.latestVersion() {
+		return false, nil
+	}
+	msg, err := codec.decode(data)
+	if err != nil {
+		return false, err
+	}
+	updated, err := codec.encode(msg)
+	if err != nil {
+		return false, err
+	}
+	if err := put(updated, storage.WithRevision(revision)); err != nil {
+		if storage.IsConflict(err) || storage.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,238 @@
+package kvutil_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/inmemory"
+	"github.com/kralicky/protoconfig/storage/kvutil"
+	"github.com/kralicky/protoconfig/test/ext"
+	"github.com/kralicky/protoconfig/test/testutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+)
+
+// Version 1 stores a single field. Version 2 moves it to field2 of a new
+// message type, multiplied by 10. Version 3 derives field1 from field2.
+func newTestSchema(versions int) *kvutil.Schema[*ext.Sample2FieldMsg] {
+	schema := kvutil.NewSchema[*ext.Sample2FieldMsg]()
+	if versions >= 2 {
+		kvutil.RegisterUpgrade(schema, 1, func(old *ext.Sample1FieldMsg) (*ext.Sample2FieldMsg, error) {
+			return &ext.Sample2FieldMsg{Field2: old.Field1 * 10}, nil
+		})
+	}
+	if versions >= 3 {
+		kvutil.RegisterUpgrade(schema, 2, func(msg *ext.Sample2FieldMsg) (*ext.Sample2FieldMsg, error) {
+			if msg.Field2 < 0 {
+				return nil, errors.New("negative field2")
+			}
+			msg.Field1 = msg.Field2 + 1
+			return msg, nil
+		})
+	}
+	return schema
+}
+
+var _ = Describe("Schema Upgrades", Label("unit"), func() {
+	var (
+		ctx  context.Context
+		kv   storage.KeyValueStore
+		base storage.ValueStoreT[[]byte]
+	)
+	BeforeEach(func() {
+		ctx = context.Background()
+		kv = inmemory.NewKeyValueStore(bytes.Clone)
+		base = kvutil.WithKey(kv, "config")
+	})
+
+	It("should upgrade values stored without a version", func() {
+		legacy := kvutil.WithMessageCodec[*ext.Sample1FieldMsg](base)
+		Expect(legacy.Put(ctx, &ext.Sample1FieldMsg{Field1: 1})).To(Succeed())
+		Expect(legacy.Put(ctx, &ext.Sample1FieldMsg{Field1: 2})).To(Succeed())
+
+		store := kvutil.WithMessageCodec[*ext.Sample2FieldMsg](base, kvutil.WithSchema(newTestSchema(3)))
+		value, err := store.Get(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(testutil.ProtoEqual(&ext.Sample2FieldMsg{Field1: 21, Field2: 20}))
+
+		hist, err := store.History(ctx, storage.IncludeValues(true))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hist).To(HaveLen(2))
+		Expect(hist[0].Value()).To(testutil.ProtoEqual(&ext.Sample2FieldMsg{Field1: 11, Field2: 10}))
+		Expect(hist[1].Value()).To(testutil.ProtoEqual(&ext.Sample2FieldMsg{Field1: 21, Field2: 20}))
+	})
+
+	It("should only apply upgrades from the stored version", func() {
+		v2 := kvutil.WithMessageCodec[*ext.Sample2FieldMsg](base, kvutil.WithSchema(newTestSchema(2)))
+		Expect(v2.Put(ctx, &ext.Sample2FieldMsg{Field1: 5, Field2: 50})).To(Succeed())
+
+		store := kvutil.WithMessageCodec[*ext.Sample2FieldMsg](base, kvutil.WithSchema(newTestSchema(3)))
+		value, err := store.Get(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(testutil.ProtoEqual(&ext.Sample2FieldMsg{Field1: 51, Field2: 50}))
+
+		By("not upgrading values stored with the latest version")
+		Expect(store.Put(ctx, &ext.Sample2FieldMsg{Field1: 7, Field2: 8})).To(Succeed())
+		value, err = store.Get(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(testutil.ProtoEqual(&ext.Sample2FieldMsg{Field1: 7, Field2: 8}))
+	})
+
+	DescribeTable("storing the schema version with each value",
+		func(encoding kvutil.Encoding, matchStored func([]byte)) {
+			store := kvutil.WithMessageCodec[*ext.Sample2FieldMsg](base,
+				kvutil.WithSchema(newTestSchema(3)),
+				kvutil.WithEncoding(encoding),
+			)
+			Expect(store.Put(ctx, &ext.Sample2FieldMsg{Field1: 1, Field2: 2})).To(Succeed())
+			stored, err := base.Get(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			matchStored(stored)
+
+			value, err := store.Get(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(testutil.ProtoEqual(&ext.Sample2FieldMsg{Field1: 1, Field2: 2}))
+
+			By("reading the value without a schema")
+			value, err = kvutil.WithMessageCodec[*ext.Sample2FieldMsg](base).Get(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(testutil.ProtoEqual(&ext.Sample2FieldMsg{Field1: 1, Field2: 2}))
+		},
+		Entry("binary", kvutil.EncodingBinary, func(stored []byte) {
+			Expect(stored[:2]).To(Equal([]byte{0, 3}))
+		}),
+		Entry("json", kvutil.EncodingJSON, func(stored []byte) {
+			Expect(string(stored)).To(ContainSubstring(`"@schemaVersion": 3`))
+		}),
+		Entry("yaml", kvutil.EncodingYAML, func(stored []byte) {
+			Expect(string(stored)).To(ContainSubstring("'@schemaVersion': 3\n"))
+		}),
+	)
+
+	It("should upgrade values edited by hand", func() {
+		store := kvutil.WithMessageCodec[*ext.Sample2FieldMsg](base, kvutil.WithSchema(newTestSchema(3)))
+		Expect(base.Put(ctx, []byte("'@schemaVersion': 2\nfield2: 3\n"))).To(Succeed())
+		value, err := store.Get(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(testutil.ProtoEqual(&ext.Sample2FieldMsg{Field1: 4, Field2: 3}))
+	})
+
+	It("should fail to read values stored with a newer version", func() {
+		v3 := kvutil.WithMessageCodec[*ext.Sample2FieldMsg](base, kvutil.WithSchema(newTestSchema(3)))
+		Expect(v3.Put(ctx, &ext.Sample2FieldMsg{})).To(Succeed())
+
+		v2 := kvutil.WithMessageCodec[*ext.Sample2FieldMsg](base, kvutil.WithSchema(newTestSchema(2)))
+		_, err := v2.Get(ctx)
+		Expect(err).To(testutil.MatchStatusCode(codes.FailedPrecondition))
+	})
+
+	It("should return errors from upgrade functions", func() {
+		v2 := kvutil.WithMessageCodec[*ext.Sample2FieldMsg](base, kvutil.WithSchema(newTestSchema(2)))
+		Expect(v2.Put(ctx, &ext.Sample2FieldMsg{Field2: -1})).To(Succeed())
+
+		store := kvutil.WithMessageCodec[*ext.Sample2FieldMsg](base, kvutil.WithSchema(newTestSchema(3)))
+		_, err := store.Get(ctx)
+		Expect(err).To(MatchError(ContainSubstring("failed to upgrade message from schema version 2: negative field2")))
+	})
+
+	It("should reject invalid schemas", func() {
+		Expect(func() {
+			kvutil.RegisterUpgrade(newTestSchema(2), 1, func(msg *ext.Sample1FieldMsg) (*ext.Sample2FieldMsg, error) {
+				return nil, nil
+			})
+		}).To(Panic())
+		Expect(func() {
+			kvutil.RegisterUpgrade(newTestSchema(2), 2, func(msg *ext.Sample1FieldMsg) (*ext.Sample2FieldMsg, error) {
+				return nil, nil
+			})
+		}).To(Panic())
+
+		missing := kvutil.NewSchema[*ext.Sample2FieldMsg]()
+		kvutil.RegisterUpgrade(missing, 2, func(msg *ext.Sample2FieldMsg) (*ext.Sample2FieldMsg, error) {
+			return msg, nil
+		})
+		Expect(func() {
+			kvutil.WithMessageCodec[*ext.Sample2FieldMsg](base, kvutil.WithSchema(missing))
+		}).To(Panic())
+
+		Expect(func() {
+			kvutil.WithMessageCodec[*ext.Sample1FieldMsg](base, kvutil.WithSchema(newTestSchema(3)))
+		}).To(Panic())
+	})
+
+	Context("upgrading values in place", func() {
+		It("should rewrite values stored with older versions", func() {
+			legacy := kvutil.WithMessageCodec[*ext.Sample1FieldMsg](kvutil.WithKey(kv, "active/a"))
+			Expect(legacy.Put(ctx, &ext.Sample1FieldMsg{Field1: 1})).To(Succeed())
+			v2 := kvutil.WithMessageCodec[*ext.Sample2FieldMsg](kvutil.WithKey(kv, "active/b"), kvutil.WithSchema(newTestSchema(2)))
+			Expect(v2.Put(ctx, &ext.Sample2FieldMsg{Field2: 2})).To(Succeed())
+			v3 := kvutil.WithMessageCodec[*ext.Sample2FieldMsg](kvutil.WithKey(kv, "active/c"), kvutil.WithSchema(newTestSchema(3)))
+			Expect(v3.Put(ctx, &ext.Sample2FieldMsg{Field1: 3})).To(Succeed())
+			Expect(legacy.Put(ctx, &ext.Sample1FieldMsg{Field1: 4})).To(Succeed())
+			Expect(kvutil.WithMessageCodec[*ext.Sample1FieldMsg](kvutil.WithKey(kv, "other")).Put(ctx, &ext.Sample1FieldMsg{Field1: 5})).To(Succeed())
+
+			schema := newTestSchema(3)
+			count, err := kvutil.UpgradeSchema(ctx, kv, "active/", schema, kvutil.WithEncoding(kvutil.EncodingYAML))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(2))
+
+			for key, expected := range map[string]*ext.Sample2FieldMsg{
+				"active/a": {Field1: 41, Field2: 40},
+				"active/b": {Field1: 3, Field2: 2},
+				"active/c": {Field1: 3},
+			} {
+				stored, err := kv.Get(ctx, key)
+				Expect(err).NotTo(HaveOccurred())
+				if key == "active/c" {
+					Expect(stored[:2]).To(Equal([]byte{0, 3}))
+				} else {
+					Expect(string(stored)).To(HavePrefix("'@schemaVersion': 3\n"))
+				}
+				value, err := kvutil.WithMessageCodec[*ext.Sample2FieldMsg](kvutil.WithKey(kv, key), kvutil.WithSchema(schema)).Get(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(testutil.ProtoEqual(expected))
+			}
+
+			By("preserving the history of each key")
+			hist, err := kvutil.WithMessageCodec[*ext.Sample2FieldMsg](kvutil.WithKey(kv, "active/a"), kvutil.WithSchema(schema)).
+				History(ctx, storage.IncludeValues(true))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hist).To(HaveLen(3))
+			Expect(hist[0].Value()).To(testutil.ProtoEqual(&ext.Sample2FieldMsg{Field1: 11, Field2: 10}))
+
+			By("not modifying keys outside the prefix")
+			stored, err := kv.Get(ctx, "other")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored).NotTo(HavePrefix("\x00"))
+
+			By("doing nothing when run again")
+			count, err = kvutil.UpgradeSchema(ctx, kv, "active/", schema)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeZero())
+		})
+
+		It("should rewrite a single value", func() {
+			legacy := kvutil.WithMessageCodec[*ext.Sample1FieldMsg](base)
+			Expect(legacy.Put(ctx, &ext.Sample1FieldMsg{Field1: 1})).To(Succeed())
+
+			rewritten, err := kvutil.UpgradeSchemaValue(ctx, base, newTestSchema(3))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rewritten).To(BeTrue())
+			stored, err := base.Get(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored[:2]).To(Equal([]byte{0, 3}))
+
+			rewritten, err = kvutil.UpgradeSchemaValue(ctx, base, newTestSchema(3))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rewritten).To(BeFalse())
+
+			By("skipping missing values")
+			rewritten, err = kvutil.UpgradeSchemaValue(ctx, kvutil.WithKey(kv, "missing"), newTestSchema(3))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rewritten).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,164 @@
+package kvutil
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/kralicky/protoconfig/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A function that starts a watch, such as the Watch method of a
+// [storage.ValueStoreT], or the Watch method of a [storage.KeyValueStoreT]
+// bound to a specific key.
+type WatchFunc[T any] func(ctx context.Context, opts ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error)
+
+// Variables so that tests can shorten them.
+var (
+	resumeWatchInitialBackoff = 100 * time.Millisecond
+	resumeWatchMaxBackoff     = 5 * time.Second
+	resumeWatchMaxAttempts    = 10
+)
+
+// Starts a watch using the given function, and transparently re-establishes
+// it whenever it is terminated by the backend. The new watch starts at the
+// revision following the last event (or bookmark) observed, and any events
+// that were already observed are not sent again. Error events are not sent
+// for watches which were successfully resumed.
+//
+// If the revision following the last observed event cannot be watched from,
+// because it does not exist (yet) for the watched key, the watch is resumed
+// from the current value instead. Values already observed are not sent again,
+// but intermediate changes may be missed. If bookmarks were requested, a
+// bookmark for the last observed revision is sent when this happens.
+//
+// The returned channel is only closed when the context is canceled, or when
+// the watch cannot be resumed, either because the revision it would resume
+// from has been compacted, or because it failed to be re-established after
+// several attempts. In both cases, the last error is sent in an error event
+// before the channel is closed.
+//
+// If the watch was started without a revision, and no events were observed
+// before it was terminated, events may be missed while it is re-established.
+// Use [storage.WithBookmarks] to keep track of the latest revision even when
+// there are no changes.
+func ResumeWatch[T any](ctx context.Context, watch WatchFunc[T], opts ...storage.WatchOpt) (<-chan storage.WatchEvent[storage.KeyRevision[T]], error) {
+	options := storage.WatchOptions{}
+	options.Apply(opts...)
+
+	wc, err := watch(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan storage.WatchEvent[storage.KeyRevision[T]], 64)
+	send := func(ev storage.WatchEvent[storage.KeyRevision[T]]) bool {
+		select {
+		case out <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	go func() {
+		defer close(out)
+		var lastRevision, resumedAt int64
+		if options.Revision != nil && *options.Revision > 0 {
+			lastRevision = *options.Revision - 1
+		}
+		for {
+			var failure error
+			for ev := range wc {
+				switch ev.EventType {
+				case storage.WatchEventError:
+					failure = ev.Err
+					continue
+				case storage.WatchEventBookmark:
+					lastRevision = max(lastRevision, ev.Revision)
+					if options.Bookmarks && !send(ev) {
+						return
+					}
+					continue
+				}
+				revision := eventRevision(ev)
+				if revision != 0 && revision <= resumedAt {
+					continue // already observed before the watch was resumed
+				}
+				lastRevision = max(lastRevision, revision)
+				if !send(ev) {
+					return
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if storage.IsCompacted(failure) {
+				send(storage.WatchEvent[storage.KeyRevision[T]]{
+					EventType: storage.WatchEventError,
+					Err:       failure,
+				})
+				return
+			}
+
+			resumeOpts := slices.Clone(opts)
+			if lastRevision > 0 {
+				resumeOpts = append(resumeOpts, storage.WithRevision(lastRevision+1))
+			}
+			backoff := resumeWatchInitialBackoff
+			fromCurrent := false
+			for attempt := 1; ; attempt++ {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				wc, err = watch(ctx, resumeOpts...)
+				if err == nil {
+					break
+				}
+				switch {
+				case storage.IsCompacted(err):
+					send(storage.WatchEvent[storage.KeyRevision[T]]{
+						EventType: storage.WatchEventError,
+						Err:       err,
+					})
+					return
+				case !fromCurrent && lastRevision > 0 && (storage.IsNotFound(err) || status.Code(err) == codes.OutOfRange):
+					// The next revision is a delete, or has not been written yet.
+					// Start from the current value instead; any value that was
+					// already observed is skipped below.
+					resumeOpts = append(slices.Clone(opts), storage.WithRevision(0))
+					fromCurrent = true
+					if options.Bookmarks && !send(storage.WatchEvent[storage.KeyRevision[T]]{
+						EventType: storage.WatchEventBookmark,
+						Revision:  lastRevision,
+					}) {
+						return
+					}
+					continue
+				case attempt >= resumeWatchMaxAttempts:
+					send(storage.WatchEvent[storage.KeyRevision[T]]{
+						EventType: storage.WatchEventError,
+						Err:       err,
+					})
+					return
+				}
+				backoff = min(backoff*2, resumeWatchMaxBackoff)
+			}
+			resumedAt = lastRevision
+		}
+	}()
+	return out, nil
+}
+
+func eventRevision[T any](ev storage.WatchEvent[storage.KeyRevision[T]]) int64 {
+	if ev.Revision != 0 {
+		return ev.Revision
+	}
+	if ev.Current != nil {
+		return ev.Current.Revision()
+	}
+	return 0
+}
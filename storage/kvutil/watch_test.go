@@ -0,0 +1,226 @@
+package kvutil_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/storage/kvutil"
+	"github.com/kralicky/protoconfig/test/testutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type watchEvent = storage.WatchEvent[storage.KeyRevision[string]]
+
+// A fake watch function which serves a predefined sequence of watches, and
+// records the options each watch was started with.
+type fakeWatcher struct {
+	mu      sync.Mutex
+	watches [][]watchEvent
+	// errors returned instead of starting a watch, by request index
+	errs     map[int]error
+	requests []storage.WatchOptions
+}
+
+func (f *fakeWatcher) Watch(ctx context.Context, opts ...storage.WatchOpt) (<-chan watchEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	options := storage.WatchOptions{}
+	options.Apply(opts...)
+	f.requests = append(f.requests, options)
+	if err, ok := f.errs[len(f.requests)-1]; ok {
+		return nil, err
+	}
+	if len(f.watches) == 0 {
+		// block until the context is canceled
+		ch := make(chan watchEvent)
+		context.AfterFunc(ctx, func() { close(ch) })
+		return ch, nil
+	}
+	events := f.watches[0]
+	f.watches = f.watches[1:]
+	ch := make(chan watchEvent, len(events))
+	for _, ev := range events {
+		ch <- ev
+	}
+	close(ch)
+	return ch, nil
+}
+
+func (f *fakeWatcher) Requests() []storage.WatchOptions {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+func put(value string, rev int64) watchEvent {
+	return watchEvent{
+		EventType: storage.WatchEventPut,
+		Current:   &storage.KeyRevisionImpl[string]{K: "key", V: value, Rev: rev},
+		Revision:  rev,
+	}
+}
+
+func watchErr(err error) watchEvent {
+	return watchEvent{
+		EventType: storage.WatchEventError,
+		Err:       err,
+	}
+}
+
+func receiveRevisions(ch <-chan watchEvent, n int) []int64 {
+	GinkgoHelper()
+	var revs []int64
+	for i := 0; i < n; i++ {
+		var ev watchEvent
+		Eventually(ch).Should(Receive(&ev))
+		Expect(ev.EventType).To(Equal(storage.WatchEventPut))
+		revs = append(revs, ev.Current.Revision())
+	}
+	return revs
+}
+
+var _ = Describe("ResumeWatch", Label("unit"), func() {
+	BeforeEach(func() {
+		initial, max := *kvutil.ResumeWatchInitialBackoff, *kvutil.ResumeWatchMaxBackoff
+		*kvutil.ResumeWatchInitialBackoff, *kvutil.ResumeWatchMaxBackoff = time.Millisecond, time.Millisecond
+		DeferCleanup(func() {
+			*kvutil.ResumeWatchInitialBackoff, *kvutil.ResumeWatchMaxBackoff = initial, max
+		})
+	})
+
+	It("should resume from the revision after the last observed event", func(ctx SpecContext) {
+		fw := &fakeWatcher{
+			watches: [][]watchEvent{
+				{put("a", 1), put("b", 2), watchErr(status.Error(codes.Unavailable, "unavailable"))},
+				{put("b", 2), put("c", 3)},
+				{put("d", 4)},
+			},
+		}
+		wc, err := kvutil.ResumeWatch(ctx, fw.Watch, storage.WithRevision(1))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(receiveRevisions(wc, 4)).To(Equal([]int64{1, 2, 3, 4}))
+		Consistently(wc).ShouldNot(Receive())
+
+		requests := fw.Requests()
+		Expect(requests).To(HaveLen(4))
+		Expect(*requests[0].Revision).To(BeEquivalentTo(1))
+		Expect(*requests[1].Revision).To(BeEquivalentTo(3))
+		Expect(*requests[2].Revision).To(BeEquivalentTo(4))
+		Expect(*requests[3].Revision).To(BeEquivalentTo(5))
+	})
+
+	It("should resume from the revision after the last bookmark", func(ctx SpecContext) {
+		fw := &fakeWatcher{
+			watches: [][]watchEvent{
+				{
+					put("a", 1),
+					{EventType: storage.WatchEventBookmark, Revision: 10},
+				},
+			},
+		}
+		wc, err := kvutil.ResumeWatch(ctx, fw.Watch, storage.WithPrefix(), storage.WithBookmarks())
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(receiveRevisions(wc, 1)).To(Equal([]int64{1}))
+		var ev watchEvent
+		Eventually(wc).Should(Receive(&ev))
+		Expect(ev.EventType).To(Equal(storage.WatchEventBookmark))
+		Expect(ev.Revision).To(BeEquivalentTo(10))
+
+		Eventually(fw.Requests).Should(HaveLen(2))
+		requests := fw.Requests()
+		Expect(requests[0].Revision).To(BeNil())
+		Expect(*requests[1].Revision).To(BeEquivalentTo(11))
+		Expect(requests[1].Prefix).To(BeTrue())
+	})
+
+	When("the watch is terminated because of compaction", func() {
+		It("should send the error and close the channel", func(ctx SpecContext) {
+			fw := &fakeWatcher{
+				watches: [][]watchEvent{
+					{put("a", 1), watchErr(storage.ErrCompacted)},
+				},
+			}
+			wc, err := kvutil.ResumeWatch(ctx, fw.Watch, storage.WithRevision(1))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(receiveRevisions(wc, 1)).To(Equal([]int64{1}))
+			var ev watchEvent
+			Eventually(wc).Should(Receive(&ev))
+			Expect(ev.EventType).To(Equal(storage.WatchEventError))
+			Expect(storage.IsCompacted(ev.Err)).To(BeTrue())
+			Eventually(wc).Should(BeClosed())
+			Expect(fw.Requests()).To(HaveLen(1))
+		})
+	})
+
+	When("the next revision cannot be watched from", func() {
+		It("should resume from the current value", func(ctx SpecContext) {
+			fw := &fakeWatcher{
+				watches: [][]watchEvent{
+					{put("a", 1), put("b", 2)},
+					{put("b", 2), put("c", 5)},
+				},
+				errs: map[int]error{
+					1: storage.ErrNotFound,
+				},
+			}
+			wc, err := kvutil.ResumeWatch(ctx, fw.Watch, storage.WithRevision(1), storage.WithBookmarks())
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(receiveRevisions(wc, 2)).To(Equal([]int64{1, 2}))
+			var ev watchEvent
+			Eventually(wc).Should(Receive(&ev))
+			Expect(ev.EventType).To(Equal(storage.WatchEventBookmark))
+			Expect(ev.Revision).To(BeEquivalentTo(2))
+			Expect(receiveRevisions(wc, 1)).To(Equal([]int64{5}))
+
+			Eventually(fw.Requests).Should(HaveLen(4))
+			requests := fw.Requests()
+			Expect(*requests[1].Revision).To(BeEquivalentTo(3))
+			Expect(*requests[2].Revision).To(BeEquivalentTo(0))
+			Expect(*requests[3].Revision).To(BeEquivalentTo(6))
+		})
+	})
+
+	When("the watch cannot be re-established", func() {
+		It("should send the last error and close the channel", func(ctx SpecContext) {
+			errs := map[int]error{}
+			for i := 1; i <= 10; i++ {
+				errs[i] = status.Error(codes.Unavailable, "unavailable")
+			}
+			fw := &fakeWatcher{
+				watches: [][]watchEvent{{put("a", 1)}},
+				errs:    errs,
+			}
+			wc, err := kvutil.ResumeWatch(ctx, fw.Watch)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(receiveRevisions(wc, 1)).To(Equal([]int64{1}))
+			var ev watchEvent
+			Eventually(wc).Should(Receive(&ev))
+			Expect(ev.EventType).To(Equal(storage.WatchEventError))
+			Expect(ev.Err).To(testutil.MatchStatusCode(codes.Unavailable))
+			Eventually(wc).Should(BeClosed())
+			Expect(fw.Requests()).To(HaveLen(11))
+		})
+	})
+
+	When("the context is canceled", func() {
+		It("should close the channel without sending an error", func(ctx SpecContext) {
+			fw := &fakeWatcher{}
+			wctx, cancel := context.WithCancel(ctx)
+			wc, err := kvutil.ResumeWatch(wctx, fw.Watch)
+			Expect(err).NotTo(HaveOccurred())
+			cancel()
+			Eventually(wc).Should(BeClosed())
+			Expect(fw.Requests()).To(HaveLen(1))
+		})
+	})
+})
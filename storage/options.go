@@ -1,5 +1,7 @@
 package storage
 
+import "time"
+
 // ================
 // KV Store Options
 // ================
@@ -29,6 +31,14 @@ type WatchOptions struct {
 	// Care should be taken when using this option, especially in combination
 	// with a past revision, as it could cause performance issues.
 	Prefix bool
+
+	// If true, the watch will periodically receive [WatchEventBookmark] events
+	// if the backend supports them.
+	Bookmarks bool
+
+	// Decides what happens when events are not read from the watch channel
+	// quickly enough. Defaults to [OverflowClose].
+	OverflowPolicy OverflowPolicy
 }
 
 type PutOptions struct {
@@ -39,16 +49,45 @@ type PutOptions struct {
 	// operation completes successfully. If an error occurs, no changes
 	// will be made to the value.
 	RevisionOut *int64
+
+	// If set, the key will be deleted automatically once the TTL elapses,
+	// unless it is renewed using [KeepAliver.KeepAlive]. Expired keys are
+	// reported to watchers as delete events. Subsequent puts without a TTL
+	// preserve the existing TTL of the key, while puts with a TTL replace it.
+	// Backends may round the TTL up to a coarser granularity, and will return
+	// an Unimplemented error if TTLs are not supported.
+	TTL *time.Duration
 }
 
 type DeleteOptions struct {
 	// Delete only if the latest Revision matches
 	Revision *int64
+
+	// Delete all keys starting with the given key, instead of a single key.
+	// Deleting a prefix which matches no keys is not an error, and the key
+	// can be empty to delete all keys in the store. Stores which support
+	// transactions delete all matching keys atomically, at a single revision.
+	// Cannot be combined with Revision.
+	Prefix bool
 }
 
 type ListKeysOptions struct {
 	// Maximum number of keys to return
 	Limit *int64
+
+	// Only return keys that sort lexically after this key. Used by
+	// [BatchReader.List] to resume a previous listing.
+	StartAfter *string
+
+	// If non-nil, will be set by [BatchReader.List] to the key which should be
+	// passed to StartAfter to retrieve the next page of results, or to the
+	// empty string if there are no more results.
+	ContinueOut *string
+
+	// Also list keys which are currently deleted, but whose history is still
+	// retained (see [HistoryOptions.IncludeDeleted]). Stores which cannot list
+	// deleted keys return an Unimplemented error. Ignored by [BatchReader.List].
+	IncludeDeleted bool
 }
 
 type HistoryOptions struct {
@@ -64,14 +103,25 @@ type HistoryOptions struct {
 	// Include the values in the response, not just the metadata. This could
 	// have performance implications, so use with caution.
 	IncludeValues bool
+	// Include all retained revisions of the key, instead of starting at its
+	// most recent creation revision. Each delete is included as a tombstone
+	// (see [KeyRevision.IsTombstone]), and the history of a deleted key ends
+	// with its tombstone instead of returning a NotFound error.
+	IncludeDeleted bool
 }
 
 type (
-	RevisionOpt      int64
-	RevisionOutOpt   struct{ *int64 }
-	LimitOpt         int64
-	IncludeValuesOpt bool
-	PrefixOpt        bool
+	RevisionOpt       int64
+	RevisionOutOpt    struct{ *int64 }
+	LimitOpt          int64
+	IncludeValuesOpt  bool
+	IncludeDeletedOpt bool
+	PrefixOpt         bool
+	BookmarksOpt      bool
+	StartAfterOpt     string
+	ContinueOutOpt    struct{ *string }
+	TTLOpt            time.Duration
+	OverflowPolicyOpt OverflowPolicy
 )
 
 // WithRevision can be used for [GetOptions], [PutOptions], [WatchOptions], or [DeleteOptions]
@@ -94,10 +144,40 @@ func IncludeValues(include bool) IncludeValuesOpt {
 	return IncludeValuesOpt(include)
 }
 
-func WithPrefix() WatchOpt {
+// IncludeDeleted can be used for [HistoryOptions] or [ListKeysOptions].
+func IncludeDeleted(include bool) IncludeDeletedOpt {
+	return IncludeDeletedOpt(include)
+}
+
+// WithStartAfter can be used for [ListKeysOptions]. An empty key is ignored.
+func WithStartAfter(key string) StartAfterOpt {
+	return StartAfterOpt(key)
+}
+
+// WithContinueOut can be used for [ListKeysOptions].
+func WithContinueOut(out *string) ContinueOutOpt {
+	return ContinueOutOpt{out}
+}
+
+// WithTTL can be used for [PutOptions].
+func WithTTL(ttl time.Duration) TTLOpt {
+	return TTLOpt(ttl)
+}
+
+// WithPrefix can be used for [WatchOptions] or [DeleteOptions].
+func WithPrefix() PrefixOpt {
 	return PrefixOpt(true)
 }
 
+func WithBookmarks() WatchOpt {
+	return BookmarksOpt(true)
+}
+
+// WithOverflowPolicy can be used for [WatchOptions].
+func WithOverflowPolicy(policy OverflowPolicy) OverflowPolicyOpt {
+	return OverflowPolicyOpt(policy)
+}
+
 func (r RevisionOpt) ApplyGetOption(opts *GetOptions)         { opts.Revision = (*int64)(&r) }
 func (r RevisionOpt) ApplyWatchOption(opts *WatchOptions)     { opts.Revision = (*int64)(&r) }
 func (r RevisionOpt) ApplyPutOption(opts *PutOptions)         { opts.Revision = (*int64)(&r) }
@@ -107,11 +187,31 @@ func (r RevisionOpt) ApplyHistoryOption(opts *HistoryOptions) { opts.Revision =
 func (r RevisionOutOpt) ApplyPutOption(opts *PutOptions) { opts.RevisionOut = r.int64 }
 func (r RevisionOutOpt) ApplyGetOption(opts *GetOptions) { opts.RevisionOut = r.int64 }
 
+func (t TTLOpt) ApplyPutOption(opts *PutOptions) { opts.TTL = (*time.Duration)(&t) }
+
 func (l LimitOpt) ApplyListOption(opts *ListKeysOptions) { opts.Limit = (*int64)(&l) }
 
+func (s StartAfterOpt) ApplyListOption(opts *ListKeysOptions) {
+	if s != "" {
+		opts.StartAfter = (*string)(&s)
+	}
+}
+
+func (c ContinueOutOpt) ApplyListOption(opts *ListKeysOptions) { opts.ContinueOut = c.string }
+
 func (i IncludeValuesOpt) ApplyHistoryOption(opts *HistoryOptions) { opts.IncludeValues = bool(i) }
 
-func (p PrefixOpt) ApplyWatchOption(opts *WatchOptions) { opts.Prefix = bool(p) }
+func (i IncludeDeletedOpt) ApplyHistoryOption(opts *HistoryOptions) { opts.IncludeDeleted = bool(i) }
+func (i IncludeDeletedOpt) ApplyListOption(opts *ListKeysOptions)   { opts.IncludeDeleted = bool(i) }
+
+func (p PrefixOpt) ApplyWatchOption(opts *WatchOptions)   { opts.Prefix = bool(p) }
+func (p PrefixOpt) ApplyDeleteOption(opts *DeleteOptions) { opts.Prefix = bool(p) }
+
+func (b BookmarksOpt) ApplyWatchOption(opts *WatchOptions) { opts.Bookmarks = bool(b) }
+
+func (p OverflowPolicyOpt) ApplyWatchOption(opts *WatchOptions) {
+	opts.OverflowPolicy = OverflowPolicy(p)
+}
 
 type (
 	GetOpt     interface{ ApplyGetOption(*GetOptions) }
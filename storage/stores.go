@@ -22,13 +22,30 @@ type KeyRevision[T any] interface {
 	// Returns the timestamp of this revision. This may or may not always be
 	// available, depending on if the underlying store supports it.
 	Timestamp() time.Time
+	// Returns the revision at which the key was created, i.e. the revision of
+	// the first put after the key last did not exist. For tombstones, returns
+	// the creation revision of the value that was deleted. May be 0 if the
+	// underlying store does not track it.
+	CreateRevision() int64
+	// Returns the number of puts made to the key since it was created,
+	// starting at 1 for the put which created it. Deleting the key resets its
+	// version, so tombstones have version 0. May be 0 if the underlying store
+	// does not track it.
+	Version() int64
+	// Reports whether this revision records the deletion of the key, rather
+	// than a value. Tombstones are only returned by History when requested
+	// using [IncludeDeleted].
+	IsTombstone() bool
 }
 
 type KeyRevisionImpl[T any] struct {
-	K    string
-	V    T
-	Rev  int64
-	Time time.Time
+	K         string
+	V         T
+	Rev       int64
+	Time      time.Time
+	CreateRev int64
+	Ver       int64
+	Tombstone bool
 }
 
 func (k *KeyRevisionImpl[T]) Key() string {
@@ -51,6 +68,32 @@ func (k *KeyRevisionImpl[T]) Timestamp() time.Time {
 	return k.Time
 }
 
+func (k *KeyRevisionImpl[T]) CreateRevision() int64 {
+	return k.CreateRev
+}
+
+func (k *KeyRevisionImpl[T]) Version() int64 {
+	return k.Ver
+}
+
+func (k *KeyRevisionImpl[T]) IsTombstone() bool {
+	return k.Tombstone
+}
+
+// Returns a copy of the metadata of kr with the given value, for wrappers
+// which transform the values of another store.
+func CopyKeyRevision[T, U any](kr KeyRevision[U], value T) *KeyRevisionImpl[T] {
+	return &KeyRevisionImpl[T]{
+		K:         kr.Key(),
+		V:         value,
+		Rev:       kr.Revision(),
+		Time:      kr.Timestamp(),
+		CreateRev: kr.CreateRevision(),
+		Ver:       kr.Version(),
+		Tombstone: kr.IsTombstone(),
+	}
+}
+
 type KeyValueStoreT[T any] interface {
 	Put(ctx context.Context, key string, value T, opts ...PutOpt) error
 	Get(ctx context.Context, key string, opts ...GetOpt) (T, error)
@@ -60,6 +103,11 @@ type KeyValueStoreT[T any] interface {
 	// channel will be closed. This function does not block. An error will only
 	// be returned if the key is invalid or the watch fails to start.
 	//
+	// If the watch is terminated by the backend for any reason other than the
+	// context being canceled, a [WatchEventError] event will be sent before
+	// the channel is closed. See kvutil.ResumeWatch for a helper that will
+	// automatically re-establish such watches.
+	//
 	// When the watch is started, the current value of the key will be sent
 	// if and only if both of the following conditions are met:
 	// 1. A revision is explicitly set in the watch options. If no revision is
@@ -76,16 +124,112 @@ type KeyValueStoreT[T any] interface {
 	// overlapping prefixes. Each call will initiate a separate watch, and events
 	// are always replicated to all active watches.
 	//
-	// The channels are buffered to hold at least 64 events. Ensure that events
-	// are read from the channel in a timely manner if a large volume of events
-	// are expected; otherwise it will block and events may be delayed, or be
-	// dropped by the backend.
+	// The channels buffer [WatchBufferSize] events. If events are not read
+	// from the channel quickly enough, the watch's [OverflowPolicy] decides
+	// whether further events are queued, dropped, coalesced, or end the watch;
+	// see [WithOverflowPolicy]. By default, the watch ends with
+	// [ErrWatchOverflow], and can be resumed from the last revision received.
+	// Writes never wait for watches to receive their events.
 	Watch(ctx context.Context, key string, opts ...WatchOpt) (<-chan WatchEvent[KeyRevision[T]], error)
 	Delete(ctx context.Context, key string, opts ...DeleteOpt) error
 	ListKeys(ctx context.Context, prefix string, opts ...ListOpt) ([]string, error)
 	History(ctx context.Context, key string, opts ...HistoryOpt) ([]KeyRevision[T], error)
 }
 
+// Txner is an optional interface implemented by key-value stores that
+// support atomic multi-key transactions. Use a type assertion to check if a
+// store supports transactions:
+//
+//	if txner, ok := store.(storage.Txner[T]); ok { ... }
+type Txner[T any] interface {
+	// Atomically applies all operations in the request if and only if all of
+	// its comparisons succeed. If any comparison fails, no operations are
+	// applied and a conflict error is returned.
+	//
+	// Operations are applied as a single write: watchers will observe one
+	// event per operation, but no reader can observe a state in which only
+	// some of the operations have been applied.
+	Txn(ctx context.Context, req TxnRequest[T]) (*TxnResponse, error)
+}
+
+// BatchReader is an optional interface implemented by key-value stores that
+// can read multiple keys and their values in a single request. Use a type
+// assertion to check if a store supports batch reads.
+type BatchReader[T any] interface {
+	// Returns the latest revision of all keys matching the prefix, including
+	// their values, sorted by key. Deleted keys are not included.
+	//
+	// Use [WithLimit] to limit the number of results, and [WithContinueOut]
+	// together with [WithStartAfter] to page through the results:
+	//
+	//	var next string
+	//	for {
+	//		page, err := store.List(ctx, prefix, storage.WithLimit(100),
+	//			storage.WithStartAfter(next), storage.WithContinueOut(&next))
+	//		...
+	//		if next == "" {
+	//			break
+	//		}
+	//	}
+	List(ctx context.Context, prefix string, opts ...ListOpt) ([]KeyRevision[T], error)
+
+	// Returns the latest revision of each of the given keys, including their
+	// values, in the same order as the keys were requested. Keys which do not
+	// exist are omitted from the results. All keys are read from a consistent
+	// snapshot of the store.
+	GetMany(ctx context.Context, keys []string) ([]KeyRevision[T], error)
+}
+
+// KeepAliver is an optional interface implemented by key-value stores that
+// support expiring keys using [WithTTL].
+type KeepAliver interface {
+	// Resets the remaining time-to-live of the key to its full TTL. Returns a
+	// NotFound error if the key does not exist or has already expired, and a
+	// FailedPrecondition error if the key was not written with a TTL.
+	KeepAlive(ctx context.Context, key string) error
+}
+
+type TxnOpType int
+
+const (
+	TxnOpPut TxnOpType = iota
+	TxnOpDelete
+)
+
+type TxnCompare struct {
+	Key string
+	// The latest revision of the key must be equal to this revision. Revision 0
+	// requires that the key does not exist, or has been deleted.
+	Revision int64
+}
+
+type TxnOp[T any] struct {
+	Type  TxnOpType
+	Key   string
+	Value T
+}
+
+type TxnRequest[T any] struct {
+	Compare []TxnCompare
+	// Each key may appear at most once. Deleting a key that does not exist
+	// is not an error; use a comparison to require that the key exists.
+	Ops []TxnOp[T]
+}
+
+type TxnResponse struct {
+	// The revision at which the transaction was committed. All keys written
+	// by the transaction share this revision.
+	Revision int64
+}
+
+func TxnPut[T any](key string, value T) TxnOp[T] {
+	return TxnOp[T]{Type: TxnOpPut, Key: key, Value: value}
+}
+
+func TxnDelete[T any](key string) TxnOp[T] {
+	return TxnOp[T]{Type: TxnOpDelete, Key: key}
+}
+
 type ValueStoreT[T any] interface {
 	Put(ctx context.Context, value T, opts ...PutOpt) error
 	Get(ctx context.Context, opts ...GetOpt) (T, error)
@@ -104,6 +248,28 @@ type KeyValueStoreTBroker[T any] interface {
 	KeyValueStore(namespace string) KeyValueStoreT[T]
 }
 
+// NamespaceManager is an optional interface implemented by brokers which can
+// enumerate and delete their namespaces. Use a type assertion to check if a
+// broker supports it.
+type NamespaceManager interface {
+	// Returns the namespaces containing at least one key, in sorted order.
+	ListNamespaces(ctx context.Context) ([]string, error)
+	// Deletes all keys in the namespace. Stores previously obtained for the
+	// namespace remain usable, and their watches receive a delete event for
+	// each key. Deleting an empty namespace is not an error.
+	DeleteNamespace(ctx context.Context, namespace string) error
+	// Returns statistics about the keys currently in the namespace.
+	NamespaceStats(ctx context.Context, namespace string) (NamespaceStats, error)
+}
+
+type NamespaceStats struct {
+	// The number of keys in the namespace.
+	Keys int64
+	// The revision at which a key in the namespace was last written, or 0 if
+	// the namespace is empty. Deleted keys are not taken into account.
+	Revision int64
+}
+
 type WatchEventType string
 
 // Lock is a distributed lock that can be used to coordinate access to a resource or interest in
@@ -133,19 +299,23 @@ type Lock interface {
 	Unlock() error
 }
 
+type LockManager interface {
+	// Locker returns a new Lock for the given key. Each Lock returned by this
+	// method is an independent contender for the key; two Locks for the same
+	// key obtained from one or more LockManagers backed by the same store
+	// will exclude each other.
+	Locker(key string) Lock
+}
+
 const (
 	// An operation that creates a new key OR modifies an existing key.
 	//
-	// NB: The Watch API does not distinguish between create and modify events.
-	// It is not practical (nor desired, in most cases) to provide this info
-	// to the caller, because it cannot be guaranteed to be accurate in all cases.
-	// Because of the inability to make this guarantee, any client code that
-	// relies on this distinction would be highly likely to end up in an invalid
-	// state after a sufficient amount of time, or after issuing a watch request
-	// on a key that has a complex and/or truncated history. However, in certain
-	// cases, clients may be able to correlate events with out-of-band information
-	// to reliably disambiguate Put events. This is necessarily an implementation
-	// detail and may not always be possible.
+	// The Watch API does not use separate event types for create and modify
+	// events. Instead, a Put event creates the key if the Version of Current
+	// is 1 (equivalently, if its CreateRevision equals its Revision), in
+	// stores which track versions. Clients should not rely on the Previous
+	// field for this, since it may be missing for events replayed from a
+	// truncated history.
 	WatchEventPut WatchEventType = "Put"
 
 	// An operation that removes an existing key.
@@ -158,20 +328,51 @@ const (
 	// on implementation details of the backend (they will always contain a
 	// current revision value, though).
 	WatchEventDelete WatchEventType = "Delete"
+
+	// A progress notification that does not correspond to any change. The
+	// Revision field of the event contains the latest revision known to be
+	// observed by the watch; events at or before this revision will not be
+	// sent. Bookmarks are only sent if requested using [WithBookmarks], and
+	// only by backends which support them.
+	WatchEventBookmark WatchEventType = "Bookmark"
+
+	// The watch was terminated by the backend. The Err field of the event
+	// contains the reason. This is always the last event sent before the
+	// channel is closed, and is not sent if the watch's context was canceled.
+	//
+	// If the watch was terminated because its starting revision (or the last
+	// revision it observed) has been compacted, [IsCompacted] will return
+	// true for the error, and the watch cannot be resumed without missing
+	// events.
+	WatchEventError WatchEventType = "Error"
 )
 
 type WatchEvent[T any] struct {
 	EventType WatchEventType
 	Current   T
 	Previous  T
+
+	// The revision at which the event occurred. For put events, this is the
+	// revision of Current. For delete events, this is the revision of the
+	// delete operation itself, if known. For bookmark events, this is the
+	// latest revision observed by the watch. May be 0 if the backend does not
+	// report it.
+	Revision int64
+
+	// For error events, the reason the watch was terminated.
+	Err error
 }
 
 var storeBuilderCache = map[string]func(...any) (any, error){}
 
+// Deprecated: register a [Driver] with [KeyValueStoreDrivers] or
+// [ValueStoreDrivers] instead.
 func RegisterStoreBuilder[T ~string](name T, builder func(...any) (any, error)) {
 	storeBuilderCache[strings.ToLower(string(name))] = builder
 }
 
+// Deprecated: open stores from a URI with [KeyValueStoreDrivers] or
+// [ValueStoreDrivers] instead.
 func GetStoreBuilder[T ~string](name T) func(...any) (any, error) {
 	return storeBuilderCache[strings.ToLower(string(name))]
 }
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// The number of events buffered by watch channels before the watch's
+// [OverflowPolicy] applies.
+const WatchBufferSize = 64
+
+// Decides what happens to a watch when its channel buffer is full and another
+// event occurs, i.e. when events are read from the channel more slowly than
+// they are written to the store. Regardless of the policy, writes to the store
+// never wait for watches to receive their events.
+type OverflowPolicy int
+
+const (
+	// Terminates the watch with a [WatchEventError] event whose error is
+	// [ErrWatchOverflow], once the reader has received the buffered events.
+	// The watch can then be resumed from the last revision received, for
+	// example by kvutil.ResumeWatch. This is the default policy.
+	OverflowClose OverflowPolicy = iota
+	// Discards the oldest buffered event to make room for each new event.
+	// Events are still received in order, but some may be missing.
+	OverflowDropOldest
+	// Replaces queued events for a key with the latest event for that key.
+	// The reader always eventually receives the latest event for each key,
+	// but may not receive intermediate events. The Previous field of a
+	// coalesced event is taken from the oldest event it replaced.
+	OverflowCoalesce
+	// Queues events until the reader catches up. No events are lost, but the
+	// queue is unbounded, so a reader which never catches up will cause memory
+	// usage to grow without bound.
+	OverflowUnbounded
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowClose:
+		return "Close"
+	case OverflowDropOldest:
+		return "DropOldest"
+	case OverflowCoalesce:
+		return "Coalesce"
+	case OverflowUnbounded:
+		return "Unbounded"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+}
+
+// Delivers the events of a single watch to its channel, applying the watch's
+// [OverflowPolicy]. Drivers send events to the queue while notifying watches,
+// without waiting for them to be received.
+type WatchQueue[T any] struct {
+	policy OverflowPolicy
+	ch     chan WatchEvent[KeyRevision[T]]
+	notify chan struct{}
+	done   chan struct{}
+
+	mu         sync.Mutex
+	pending    []WatchEvent[KeyRevision[T]]
+	terminated bool
+}
+
+// Returns a new queue and the channel its events are delivered to. The
+// initial events are buffered in the channel, regardless of their number or
+// the overflow policy; they are typically the events replayed from a past
+// revision. The channel is closed once the context is canceled, or after the
+// watch is terminated and the final error event has been received.
+func NewWatchQueue[T any](
+	ctx context.Context,
+	policy OverflowPolicy,
+	initial ...WatchEvent[KeyRevision[T]],
+) (*WatchQueue[T], <-chan WatchEvent[KeyRevision[T]]) {
+	q := &WatchQueue[T]{
+		policy: policy,
+		ch:     make(chan WatchEvent[KeyRevision[T]], max(WatchBufferSize, len(initial))),
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	for _, ev := range initial {
+		q.ch <- ev
+	}
+	go q.run(ctx)
+	return q, q.ch
+}
+
+// Queues the event without blocking. Events sent after the watch has stopped
+// are ignored.
+func (q *WatchQueue[T]) Send(ev WatchEvent[KeyRevision[T]]) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.terminated {
+		return
+	}
+	if ev.EventType == WatchEventError {
+		q.terminateLocked(ev)
+		return
+	}
+	// events waiting to be delivered count towards the buffer size, since
+	// they may be sent faster than they can be moved to the channel
+	if len(q.ch)+len(q.pending) >= cap(q.ch) {
+		switch q.policy {
+		case OverflowDropOldest:
+			select {
+			case <-q.ch:
+			default:
+				if len(q.pending) > 0 {
+					q.pending = q.pending[1:]
+				}
+			}
+		case OverflowCoalesce:
+			for i := len(q.pending) - 1; i >= 0; i-- {
+				if coalescable(q.pending[i], ev) {
+					if ev.EventType != WatchEventBookmark {
+						ev.Previous = q.pending[i].Previous
+					}
+					q.pending = slices.Delete(q.pending, i, i+1)
+					break
+				}
+			}
+		case OverflowClose:
+			q.terminateLocked(WatchEvent[KeyRevision[T]]{
+				EventType: WatchEventError,
+				Err:       ErrWatchOverflow,
+			})
+			return
+		}
+	}
+	q.pending = append(q.pending, ev)
+	q.signal()
+}
+
+// Queues a final error event, after which the watch stops. Has no effect if
+// the watch has already stopped.
+func (q *WatchQueue[T]) Terminate(err error) {
+	q.Send(WatchEvent[KeyRevision[T]]{
+		EventType: WatchEventError,
+		Err:       err,
+	})
+}
+
+// Returns a channel which is closed once the watch has stopped and its
+// channel has been closed.
+func (q *WatchQueue[T]) Done() <-chan struct{} {
+	return q.done
+}
+
+func (q *WatchQueue[T]) terminateLocked(ev WatchEvent[KeyRevision[T]]) {
+	q.pending = append(q.pending, ev)
+	q.terminated = true
+	q.signal()
+}
+
+func (q *WatchQueue[T]) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *WatchQueue[T]) run(ctx context.Context) {
+	defer close(q.done)
+	defer close(q.ch)
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			terminated := q.terminated
+			q.mu.Unlock()
+			if terminated {
+				return
+			}
+			select {
+			case <-q.notify:
+				continue
+			case <-ctx.Done():
+				q.stop()
+				return
+			}
+		}
+		ev := q.pending[0]
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+		select {
+		case q.ch <- ev:
+		case <-ctx.Done():
+			q.mu.Lock()
+			q.pending = append([]WatchEvent[KeyRevision[T]]{ev}, q.pending...)
+			q.mu.Unlock()
+			q.stop()
+			return
+		}
+	}
+}
+
+// Called once the context is canceled. Events sent before the watch stopped
+// are still delivered if there is room for them in the channel.
+func (q *WatchQueue[T]) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.terminated = true
+	for _, ev := range q.pending {
+		select {
+		case q.ch <- ev:
+			continue
+		default:
+		}
+		break
+	}
+	q.pending = nil
+}
+
+func eventKey[T any](ev WatchEvent[KeyRevision[T]]) string {
+	switch {
+	case ev.Current != nil:
+		return ev.Current.Key()
+	case ev.Previous != nil:
+		return ev.Previous.Key()
+	default:
+		return ""
+	}
+}
+
+// Reports whether b can replace a in a queue using [OverflowCoalesce].
+// Bookmarks replace bookmarks, and put and delete events replace put and
+// delete events for the same key.
+func coalescable[T any](a, b WatchEvent[KeyRevision[T]]) bool {
+	if (a.EventType == WatchEventBookmark) != (b.EventType == WatchEventBookmark) {
+		return false
+	}
+	return a.EventType == WatchEventBookmark || eventKey(a) == eventKey(b)
+}
@@ -0,0 +1,194 @@
+package conformance_storage
+
+import (
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/test/testutil"
+	"github.com/kralicky/protoconfig/util/future"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/types"
+	"google.golang.org/grpc/codes"
+)
+
+// Tests that the namespaces of a broker are isolated from each other and, if
+// the broker implements [storage.NamespaceManager], that namespaces can be
+// listed, deleted, and inspected. Other namespaces may exist in the broker
+// while the suite runs.
+func KeyValueStoreBrokerTestSuite[B storage.KeyValueStoreTBroker[T], T any](
+	brokerF future.Future[B],
+	newT func(seed ...int64) T,
+	match func(any) types.GomegaMatcher,
+) func() {
+	checkNewT(newT)
+
+	return func() {
+		var broker B
+		BeforeAll(func() {
+			broker = brokerF.Get()
+		})
+
+		// ns2 starts with ns1, so that brokers mapping namespaces to key
+		// prefixes are checked for keys leaking into sibling prefixes
+		var ns1, ns2 string
+		var s1, s2 storage.KeyValueStoreT[T]
+		BeforeEach(func() {
+			ns1 = uuid.NewString()
+			ns2 = ns1 + "x"
+			s1 = broker.KeyValueStore(ns1)
+			s2 = broker.KeyValueStore(ns2)
+		})
+
+		Context("isolation", func() {
+			It("should return stores sharing the keys of the same namespace", func(ctx SpecContext) {
+				Expect(s1.Put(ctx, "key", newT(1))).To(Succeed())
+				value, err := broker.KeyValueStore(ns1).Get(ctx, "key")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(match(newT(1)))
+			})
+
+			It("should not share keys between namespaces", func(ctx SpecContext) {
+				Expect(s1.Put(ctx, "key", newT(1))).To(Succeed())
+				_, err := s2.Get(ctx, "key")
+				Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+				keys, err := s2.ListKeys(ctx, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(keys).To(BeEmpty())
+
+				Expect(s2.Put(ctx, "key", newT(2))).To(Succeed())
+				value, err := s1.Get(ctx, "key")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(match(newT(1)))
+				keys, err = s1.ListKeys(ctx, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(keys).To(ConsistOf("key"))
+			})
+
+			It("should not send events for other namespaces", func(ctx SpecContext) {
+				wc, err := s2.Watch(ctx, "", storage.WithPrefix())
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(s1.Put(ctx, "key", newT(1))).To(Succeed())
+				Consistently(wc).WithTimeout(100 * time.Millisecond).ShouldNot(Receive())
+
+				Expect(s2.Put(ctx, "key", newT(2))).To(Succeed())
+				var event storage.WatchEvent[storage.KeyRevision[T]]
+				Eventually(wc).Should(Receive(&event))
+				Expect(event.EventType).To(Equal(storage.WatchEventPut))
+				Expect(event.Current.Key()).To(Equal("key"))
+				Expect(event.Current.Value()).To(match(newT(2)))
+			})
+
+			It("should not delete keys in other namespaces", func(ctx SpecContext) {
+				Expect(s1.Put(ctx, "key", newT(1))).To(Succeed())
+				Expect(s2.Put(ctx, "key", newT(2))).To(Succeed())
+
+				Expect(s1.Delete(ctx, "", storage.WithPrefix())).To(Succeed())
+				value, err := s2.Get(ctx, "key")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(match(newT(2)))
+			})
+
+			It("should reject invalid namespaces", func() {
+				Expect(func() { broker.KeyValueStore("") }).To(Panic())
+				Expect(func() { broker.KeyValueStore("a/b") }).To(Panic())
+			})
+		})
+
+		Context("namespace management", func() {
+			var nm storage.NamespaceManager
+			BeforeEach(func() {
+				var ok bool
+				nm, ok = any(broker).(storage.NamespaceManager)
+				if !ok {
+					Skip("broker does not implement storage.NamespaceManager")
+				}
+			})
+
+			It("should list namespaces containing keys", func(ctx SpecContext) {
+				empty := uuid.NewString()
+				broker.KeyValueStore(empty)
+				Expect(s1.Put(ctx, "key", newT(1))).To(Succeed())
+				Expect(s2.Put(ctx, "nested/key", newT(2))).To(Succeed())
+
+				namespaces, err := nm.ListNamespaces(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(namespaces).To(ContainElements(ns1, ns2))
+				Expect(namespaces).NotTo(ContainElement(empty))
+				Expect(slices.IsSorted(namespaces)).To(BeTrue())
+				Expect(namespaces).To(HaveLen(len(slices.Compact(slices.Clone(namespaces)))))
+			})
+
+			It("should delete all keys in a namespace", func(ctx SpecContext) {
+				Expect(s1.Put(ctx, "a", newT(1))).To(Succeed())
+				Expect(s1.Put(ctx, "b/c", newT(2))).To(Succeed())
+				Expect(s2.Put(ctx, "a", newT(3))).To(Succeed())
+				wc, err := s1.Watch(ctx, "", storage.WithPrefix())
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(nm.DeleteNamespace(ctx, ns1)).To(Succeed())
+
+				var deleted []string
+				for i := 0; i < 2; i++ {
+					var event storage.WatchEvent[storage.KeyRevision[T]]
+					Eventually(wc).Should(Receive(&event))
+					Expect(event.EventType).To(Equal(storage.WatchEventDelete))
+					deleted = append(deleted, event.Previous.Key())
+				}
+				Expect(deleted).To(ConsistOf("a", "b/c"))
+
+				keys, err := s1.ListKeys(ctx, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(keys).To(BeEmpty())
+				value, err := s2.Get(ctx, "a")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(match(newT(3)))
+
+				namespaces, err := nm.ListNamespaces(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(namespaces).NotTo(ContainElement(ns1))
+				Expect(namespaces).To(ContainElement(ns2))
+
+				By("reusing the namespace")
+				Expect(s1.Put(ctx, "a", newT(4))).To(Succeed())
+				value, err = broker.KeyValueStore(ns1).Get(ctx, "a")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(match(newT(4)))
+			})
+
+			It("should not fail when deleting an empty namespace", func(ctx SpecContext) {
+				Expect(nm.DeleteNamespace(ctx, ns1)).To(Succeed())
+				Expect(nm.DeleteNamespace(ctx, uuid.NewString())).To(Succeed())
+			})
+
+			It("should report namespace stats", func(ctx SpecContext) {
+				stats, err := nm.NamespaceStats(ctx, ns1)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(stats).To(Equal(storage.NamespaceStats{}))
+
+				var rev1, rev2 int64
+				Expect(s1.Put(ctx, "a", newT(1), storage.WithRevisionOut(&rev1))).To(Succeed())
+				Expect(s1.Put(ctx, "b", newT(2), storage.WithRevisionOut(&rev2))).To(Succeed())
+				Expect(s2.Put(ctx, "c", newT(3))).To(Succeed())
+				stats, err = nm.NamespaceStats(ctx, ns1)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(stats).To(Equal(storage.NamespaceStats{Keys: 2, Revision: max(rev1, rev2)}))
+
+				Expect(s1.Delete(ctx, "b")).To(Succeed())
+				stats, err = nm.NamespaceStats(ctx, ns1)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(stats).To(Equal(storage.NamespaceStats{Keys: 1, Revision: rev1}))
+			})
+
+			It("should reject invalid namespaces", func(ctx SpecContext) {
+				Expect(nm.DeleteNamespace(ctx, "")).To(testutil.MatchStatusCode(codes.InvalidArgument))
+				Expect(nm.DeleteNamespace(ctx, "a/b")).To(testutil.MatchStatusCode(codes.InvalidArgument))
+				_, err := nm.NamespaceStats(ctx, "a/b")
+				Expect(err).To(testutil.MatchStatusCode(codes.InvalidArgument))
+			})
+		})
+	}
+}
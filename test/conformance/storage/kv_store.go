@@ -6,11 +6,13 @@ import (
 	"fmt"
 	mathrand "math/rand"
 	"reflect"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/test/ext"
 	"github.com/kralicky/protoconfig/test/testutil"
 	"github.com/kralicky/protoconfig/util/future"
 	. "github.com/onsi/ginkgo/v2"
@@ -20,6 +22,7 @@ import (
 	"github.com/samber/lo"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 func NewBytes(seed ...int64) []byte {
@@ -34,16 +37,24 @@ func NewBytes(seed ...int64) []byte {
 	return bytes
 }
 
-// The function [newT] must return a new T according to the following rules:
-// 1. newT(a) == newT(a)
-// 2. newT(a) != newT(b)
-// 3. newT() == zero
-func KeyValueStoreTestSuite[B storage.KeyValueStoreTBroker[T], T any](
-	tsF future.Future[B],
-	newT func(seed ...int64) T,
-	match func(any) types.GomegaMatcher,
-) func() {
-	// sanity-check the newT function
+// Can be used as the newT function for test suites storing configuration
+// messages.
+func NewSampleConfiguration(seed ...int64) *ext.SampleConfiguration {
+	if len(seed) == 0 {
+		return nil
+	}
+	return &ext.SampleConfiguration{
+		StringField: lo.ToPtr(fmt.Sprint(seed[0])),
+	}
+}
+
+// Can be used as the match function for test suites storing proto messages.
+func ProtoEqual(expected any) types.GomegaMatcher {
+	return testutil.ProtoEqual(expected.(proto.Message))
+}
+
+// Panics if newT does not follow the rules documented on the test suites.
+func checkNewT[T any](newT func(seed ...int64) T) {
 	values := map[string]int64{}
 	for i := 0; i < 100; i++ {
 		t := newT(int64(i))
@@ -59,6 +70,42 @@ func KeyValueStoreTestSuite[B storage.KeyValueStoreTBroker[T], T any](
 	if !reflect.DeepEqual(newT(), lo.Empty[T]()) {
 		panic("newT() != nil")
 	}
+}
+
+type KeyValueStoreTestSuiteOptions struct {
+	noDeletedKeyListing bool
+}
+
+type KeyValueStoreTestSuiteOption func(*KeyValueStoreTestSuiteOptions)
+
+func (o *KeyValueStoreTestSuiteOptions) apply(opts ...KeyValueStoreTestSuiteOption) {
+	for _, op := range opts {
+		op(o)
+	}
+}
+
+// Declares that the store cannot list deleted keys. Instead of listing them,
+// the suite then checks that using [storage.IncludeDeleted] with ListKeys
+// returns an Unimplemented error.
+func WithoutDeletedKeyListing() KeyValueStoreTestSuiteOption {
+	return func(o *KeyValueStoreTestSuiteOptions) {
+		o.noDeletedKeyListing = true
+	}
+}
+
+// The function [newT] must return a new T according to the following rules:
+// 1. newT(a) == newT(a)
+// 2. newT(a) != newT(b)
+// 3. newT() == zero
+func KeyValueStoreTestSuite[B storage.KeyValueStoreTBroker[T], T any](
+	tsF future.Future[B],
+	newT func(seed ...int64) T,
+	match func(any) types.GomegaMatcher,
+	opts ...KeyValueStoreTestSuiteOption,
+) func() {
+	checkNewT(newT)
+	options := KeyValueStoreTestSuiteOptions{}
+	options.apply(opts...)
 
 	return func() {
 		Context("basic operations", func() {
@@ -196,6 +243,7 @@ func KeyValueStoreTestSuite[B storage.KeyValueStoreTBroker[T], T any](
 					Expect(event.Current.Key()).To(Equal(key), note)
 					Expect(event.Current.Value()).To(match(current), note)
 					Expect(event.Current.Revision()).To(Equal(currentRev), note)
+					Expect(event.Revision).To(Equal(currentRev), note)
 					if !reflect.ValueOf(prev).IsNil() {
 						Expect(event.Previous).NotTo(BeNil(), note)
 						Expect(event.Previous.Key()).To(Equal(key), note)
@@ -208,6 +256,9 @@ func KeyValueStoreTestSuite[B storage.KeyValueStoreTBroker[T], T any](
 					Expect(event.Previous.Key()).To(Equal(key), note)
 					Expect(event.Previous.Value()).To(match(prev), note)
 					Expect(event.Previous.Revision()).To(Equal(prevRev), note)
+					if event.Revision != 0 {
+						Expect(event.Revision).To(BeNumerically(">", prevRev), note)
+					}
 				}
 			}
 			var none T
@@ -239,6 +290,37 @@ func KeyValueStoreTestSuite[B storage.KeyValueStoreTBroker[T], T any](
 				matchEvent(updateC, storage.WatchEventPut, "key", newT(4), revisions[2], newT(5), revisions[3])
 			})
 
+			It("should report whether put events created the key", func(ctx SpecContext) {
+				updateC, err := ts.Watch(ctx, "key")
+				Expect(err).NotTo(HaveOccurred())
+
+				var revisions [3]int64
+				Expect(ts.Put(ctx, "key", newT(1), storage.WithRevisionOut(&revisions[0]))).To(Succeed())
+				var event storage.WatchEvent[storage.KeyRevision[T]]
+				Eventually(updateC).Should(Receive(&event))
+				if event.Current.Version() == 0 {
+					Skip("store does not track versions")
+				}
+				Expect(event.Current.Version()).To(BeEquivalentTo(1))
+				Expect(event.Current.CreateRevision()).To(Equal(revisions[0]))
+
+				Expect(ts.Put(ctx, "key", newT(2), storage.WithRevisionOut(&revisions[1]))).To(Succeed())
+				Eventually(updateC).Should(Receive(&event))
+				Expect(event.Current.Version()).To(BeEquivalentTo(2))
+				Expect(event.Current.CreateRevision()).To(Equal(revisions[0]))
+				Expect(event.Previous.Version()).To(BeEquivalentTo(1))
+
+				Expect(ts.Delete(ctx, "key")).To(Succeed())
+				Eventually(updateC).Should(Receive(&event))
+				Expect(event.EventType).To(Equal(storage.WatchEventDelete))
+				Expect(event.Previous.Version()).To(BeEquivalentTo(2))
+
+				Expect(ts.Put(ctx, "key", newT(3), storage.WithRevisionOut(&revisions[2]))).To(Succeed())
+				Eventually(updateC).Should(Receive(&event))
+				Expect(event.Current.Version()).To(BeEquivalentTo(1))
+				Expect(event.Current.CreateRevision()).To(Equal(revisions[2]))
+			})
+
 			It("should watch for changes to keys by prefix", func(ctx SpecContext) {
 				updateC, err := ts.Watch(ctx, "prefix", storage.WithPrefix())
 				Expect(err).NotTo(HaveOccurred())
@@ -338,6 +420,103 @@ func KeyValueStoreTestSuite[B storage.KeyValueStoreTBroker[T], T any](
 				Eventually(updateC1).Should(BeClosed())
 				matchEvent(updateC2, storage.WatchEventPut, "key", newT(1), revisions[0], newT(2), revisions[1])
 			})
+
+			When("events are not read quickly enough", func() {
+				const numEvents = 3 * storage.WatchBufferSize
+				// Writes must not wait for the watch to be read, so all of the
+				// events are written before any of them are received.
+				writeAll := func(ctx context.Context) []int64 {
+					revisions := make([]int64, numEvents)
+					for i := range revisions {
+						Expect(ts.Put(ctx, "key", newT(int64(i)), storage.WithRevisionOut(&revisions[i]))).To(Succeed())
+					}
+					return revisions
+				}
+				receiveAll := func(eventC <-chan storage.WatchEvent[storage.KeyRevision[T]]) []storage.WatchEvent[storage.KeyRevision[T]] {
+					var events []storage.WatchEvent[storage.KeyRevision[T]]
+					for {
+						select {
+						case ev, ok := <-eventC:
+							if !ok {
+								return events
+							}
+							events = append(events, ev)
+						case <-time.After(time.Second):
+							return events
+						}
+					}
+				}
+				putRevisions := func(events []storage.WatchEvent[storage.KeyRevision[T]]) []int64 {
+					return lo.FilterMap(events, func(ev storage.WatchEvent[storage.KeyRevision[T]], _ int) (int64, bool) {
+						return ev.Revision, ev.EventType == storage.WatchEventPut
+					})
+				}
+
+				It("should queue all events with the unbounded policy", func(ctx SpecContext) {
+					eventC, err := ts.Watch(ctx, "key", storage.WithOverflowPolicy(storage.OverflowUnbounded))
+					Expect(err).NotTo(HaveOccurred())
+					revisions := writeAll(ctx)
+					Expect(putRevisions(receiveAll(eventC))).To(Equal(revisions))
+				})
+
+				It("should drop the oldest events with the drop-oldest policy", func(ctx SpecContext) {
+					eventC, err := ts.Watch(ctx, "key", storage.WithOverflowPolicy(storage.OverflowDropOldest))
+					Expect(err).NotTo(HaveOccurred())
+					revisions := writeAll(ctx)
+					received := putRevisions(receiveAll(eventC))
+					Expect(len(received)).To(BeNumerically("<", numEvents))
+					Expect(revisions).To(ContainElements(received))
+					Expect(slices.IsSorted(received)).To(BeTrue())
+					Expect(received).To(HaveExactElements(lo.Uniq(received)))
+					Expect(received[len(received)-1]).To(Equal(revisions[numEvents-1]))
+				})
+
+				It("should coalesce events with the coalesce policy", func(ctx SpecContext) {
+					eventC, err := ts.Watch(ctx, "key", storage.WithOverflowPolicy(storage.OverflowCoalesce))
+					Expect(err).NotTo(HaveOccurred())
+					revisions := writeAll(ctx)
+					events := receiveAll(eventC)
+					received := putRevisions(events)
+					Expect(len(received)).To(BeNumerically("<", numEvents))
+					Expect(revisions).To(ContainElements(received))
+					Expect(slices.IsSorted(received)).To(BeTrue())
+					Expect(received).To(HaveExactElements(lo.Uniq(received)))
+					Expect(received[len(received)-1]).To(Equal(revisions[numEvents-1]))
+					Expect(events[len(events)-1].Current.Value()).To(match(newT(numEvents - 1)))
+					By("checking that each event follows the previous one")
+					for i := 1; i < len(events); i++ {
+						Expect(events[i].Previous).NotTo(BeNil())
+						Expect(events[i].Previous.Revision()).To(Equal(events[i-1].Current.Revision()))
+					}
+				})
+
+				It("should end the watch with the close policy", func(ctx SpecContext) {
+					eventC, err := ts.Watch(ctx, "key", storage.WithOverflowPolicy(storage.OverflowClose))
+					Expect(err).NotTo(HaveOccurred())
+					revisions := writeAll(ctx)
+					events := receiveAll(eventC)
+					Expect(eventC).To(BeClosed())
+					Expect(events).NotTo(BeEmpty())
+					last := events[len(events)-1]
+					Expect(last.EventType).To(Equal(storage.WatchEventError))
+					Expect(last.Err).To(testutil.MatchStatusCode(storage.ErrWatchOverflow))
+					received := putRevisions(events)
+					Expect(len(received)).To(BeNumerically("<", numEvents))
+					Expect(received).To(Equal(revisions[:len(received)]))
+				})
+
+				It("should end the watch by default", func(ctx SpecContext) {
+					eventC, err := ts.Watch(ctx, "key")
+					Expect(err).NotTo(HaveOccurred())
+					writeAll(ctx)
+					events := receiveAll(eventC)
+					Expect(eventC).To(BeClosed())
+					Expect(events).NotTo(BeEmpty())
+					last := events[len(events)-1]
+					Expect(last.EventType).To(Equal(storage.WatchEventError))
+					Expect(last.Err).To(testutil.MatchStatusCode(storage.ErrWatchOverflow))
+				})
+			})
 		})
 		Context("key revisions", func() {
 			var ts storage.KeyValueStoreT[T]
@@ -481,6 +660,31 @@ func KeyValueStoreTestSuite[B storage.KeyValueStoreTBroker[T], T any](
 					Expect(keys).To(HaveLen(10))
 				})
 			})
+			When("listing deleted keys", func() {
+				It("should include keys which are currently deleted", func(ctx SpecContext) {
+					Expect(ts.Put(ctx, "deleted/a", newT(1))).To(Succeed())
+					Expect(ts.Put(ctx, "deleted/b", newT(2))).To(Succeed())
+					Expect(ts.Delete(ctx, "deleted/b")).To(Succeed())
+
+					keys, err := ts.ListKeys(ctx, "deleted/")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(keys).To(ConsistOf("deleted/a"))
+
+					keys, err = ts.ListKeys(ctx, "deleted/", storage.IncludeDeleted(true))
+					if options.noDeletedKeyListing {
+						Expect(err).To(testutil.MatchStatusCode(codes.Unimplemented))
+						return
+					}
+					Expect(err).NotTo(HaveOccurred())
+					Expect(keys).To(ConsistOf("deleted/a", "deleted/b"))
+
+					By("recreating the key")
+					Expect(ts.Put(ctx, "deleted/b", newT(3))).To(Succeed())
+					keys, err = ts.ListKeys(ctx, "deleted/", storage.IncludeDeleted(true))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(keys).To(ConsistOf("deleted/a", "deleted/b"))
+				})
+			})
 			Context("History", func() {
 				It("should store key history", SpecTimeout(1*time.Minute), func(ctx context.Context) {
 					wg := sync.WaitGroup{}
@@ -573,6 +777,71 @@ func KeyValueStoreTestSuite[B storage.KeyValueStoreTBroker[T], T any](
 						Expect(err).To(testutil.MatchStatusCode(codes.InvalidArgument))
 					})
 				})
+				It("should report the creation revision and version of each revision", func(ctx SpecContext) {
+					revisions := make([]int64, 3)
+					for i := range revisions {
+						Expect(ts.Put(ctx, "key1", newT(int64(i)), storage.WithRevisionOut(&revisions[i]))).To(Succeed())
+					}
+					Expect(ts.Delete(ctx, "key1")).To(Succeed())
+					var recreated int64
+					Expect(ts.Put(ctx, "key1", newT(3), storage.WithRevisionOut(&recreated))).To(Succeed())
+
+					revs, err := ts.History(ctx, "key1", storage.WithRevision(revisions[2]))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(revs).To(HaveLen(3))
+					for i, rev := range revs {
+						Expect(rev.CreateRevision()).To(Or(BeZero(), Equal(revisions[0])))
+						Expect(rev.Version()).To(Or(BeZero(), BeEquivalentTo(i+1)))
+						Expect(rev.IsTombstone()).To(BeFalse())
+					}
+
+					By("resetting them when the key is recreated")
+					revs, err = ts.History(ctx, "key1")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(revs).To(HaveLen(1))
+					Expect(revs[0].CreateRevision()).To(Or(BeZero(), Equal(recreated)))
+					Expect(revs[0].Version()).To(Or(BeZero(), BeEquivalentTo(1)))
+				})
+				When("deleted revisions are requested", func() {
+					It("should include previous generations of the key and their tombstones", func(ctx SpecContext) {
+						revisions := make([]int64, 2)
+						for i := range revisions {
+							Expect(ts.Put(ctx, "key1", newT(int64(i)), storage.WithRevisionOut(&revisions[i]))).To(Succeed())
+						}
+						Expect(ts.Delete(ctx, "key1")).To(Succeed())
+
+						revs, err := ts.History(ctx, "key1", storage.IncludeDeleted(true), storage.IncludeValues(true))
+						if status.Code(err) == codes.Unimplemented {
+							Skip(status.Convert(err).Message())
+						}
+						Expect(err).NotTo(HaveOccurred())
+						Expect(revs).To(HaveLen(3))
+						Expect(revs[0].Value()).To(match(newT(0)))
+						Expect(revs[1].Value()).To(match(newT(1)))
+						Expect(revs[2].IsTombstone()).To(BeTrue())
+						Expect(revs[2].Revision()).To(BeNumerically(">", revisions[1]))
+						Expect(revs[2].Version()).To(BeZero())
+						Expect(revs[2].CreateRevision()).To(Or(BeZero(), Equal(revisions[0])))
+
+						By("recreating the key")
+						var recreated int64
+						Expect(ts.Put(ctx, "key1", newT(2), storage.WithRevisionOut(&recreated))).To(Succeed())
+						revs, err = ts.History(ctx, "key1", storage.IncludeDeleted(true))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(revs).To(HaveLen(4))
+						Expect(lo.Map(revs, func(rev storage.KeyRevision[T], _ int) bool {
+							return rev.IsTombstone()
+						})).To(Equal([]bool{false, false, true, false}))
+						Expect(revs[3].Revision()).To(Equal(recreated))
+						Expect(revs[3].CreateRevision()).To(Or(BeZero(), Equal(recreated)))
+
+						By("ending the history at a tombstone")
+						revs, err = ts.History(ctx, "key1", storage.IncludeDeleted(true), storage.WithRevision(revs[2].Revision()))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(revs).To(HaveLen(3))
+						Expect(revs[2].IsTombstone()).To(BeTrue())
+					})
+				})
 				When("a key has history and is deleted", func() {
 					It("should allow accessing history using an older revision", func() {
 						var revision int64
@@ -594,5 +863,489 @@ func KeyValueStoreTestSuite[B storage.KeyValueStoreTBroker[T], T any](
 				})
 			})
 		})
+		Context("Batch reads", func() {
+			var ts storage.KeyValueStoreT[T]
+			var reader storage.BatchReader[T]
+			BeforeEach(func() {
+				ts = tsF.Get().KeyValueStore(uuid.NewString())
+				var ok bool
+				reader, ok = ts.(storage.BatchReader[T])
+				if !ok {
+					Skip("store does not support batch reads")
+				}
+			})
+
+			Context("List", func() {
+				It("should list all keys matching the prefix with their values", func(ctx SpecContext) {
+					revisions := map[string]int64{}
+					for i, key := range []string{"prefix/c", "prefix/a", "prefix/b", "prefix/d", "other/a"} {
+						var rev int64
+						Expect(ts.Put(ctx, key, newT(int64(i)), storage.WithRevisionOut(&rev))).To(Succeed())
+						revisions[key] = rev
+					}
+					Expect(ts.Delete(ctx, "prefix/d")).To(Succeed())
+
+					results, err := reader.List(ctx, "prefix/")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(results).To(HaveLen(3))
+					for i, key := range []string{"prefix/a", "prefix/b", "prefix/c"} {
+						Expect(results[i].Key()).To(Equal(key))
+						Expect(results[i].Revision()).To(Equal(revisions[key]))
+					}
+					Expect(results[0].Value()).To(match(newT(1)))
+					Expect(results[1].Value()).To(match(newT(2)))
+					Expect(results[2].Value()).To(match(newT(0)))
+
+					results, err = reader.List(ctx, "")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(results).To(HaveLen(4))
+
+					results, err = reader.List(ctx, "nonexistent/")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(results).To(BeEmpty())
+				})
+
+				It("should page through results", func(ctx SpecContext) {
+					var keys []string
+					for i := 0; i < 25; i++ {
+						key := fmt.Sprintf("key%02d", i)
+						keys = append(keys, key)
+						Expect(ts.Put(ctx, key, newT(int64(i)))).To(Succeed())
+					}
+
+					var listed []string
+					var pages int
+					next := "sentinel"
+					startAfter := ""
+					for next != "" {
+						results, err := reader.List(ctx, "key", storage.WithLimit(10), storage.WithStartAfter(startAfter), storage.WithContinueOut(&next))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(len(results)).To(BeNumerically("<=", 10))
+						for _, r := range results {
+							listed = append(listed, r.Key())
+						}
+						pages++
+						startAfter = next
+						Expect(pages).To(BeNumerically("<=", 3))
+					}
+					Expect(listed).To(Equal(keys))
+
+					By("starting after a key that does not exist")
+					results, err := reader.List(ctx, "key", storage.WithStartAfter("key19a"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(results).To(HaveLen(5))
+					Expect(results[0].Key()).To(Equal("key20"))
+
+					By("setting the continuation key to empty when the limit is not reached")
+					next = "sentinel"
+					results, err = reader.List(ctx, "key", storage.WithLimit(25), storage.WithContinueOut(&next))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(results).To(HaveLen(25))
+					Expect(next).To(BeEmpty())
+				})
+			})
+
+			Context("GetMany", func() {
+				It("should return existing keys in the requested order", func(ctx SpecContext) {
+					var revA, revC int64
+					Expect(ts.Put(ctx, "a", newT(1), storage.WithRevisionOut(&revA))).To(Succeed())
+					Expect(ts.Put(ctx, "b", newT(2))).To(Succeed())
+					Expect(ts.Put(ctx, "c", newT(3), storage.WithRevisionOut(&revC))).To(Succeed())
+					Expect(ts.Delete(ctx, "b")).To(Succeed())
+
+					results, err := reader.GetMany(ctx, []string{"c", "missing", "b", "a"})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(results).To(HaveLen(2))
+					Expect(results[0].Key()).To(Equal("c"))
+					Expect(results[0].Value()).To(match(newT(3)))
+					Expect(results[0].Revision()).To(Equal(revC))
+					Expect(results[1].Key()).To(Equal("a"))
+					Expect(results[1].Value()).To(match(newT(1)))
+					Expect(results[1].Revision()).To(Equal(revA))
+
+					results, err = reader.GetMany(ctx, nil)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(results).To(BeEmpty())
+				})
+
+				It("should handle a large number of keys", func(ctx SpecContext) {
+					var keys []string
+					for i := 0; i < 300; i++ {
+						key := fmt.Sprintf("key%03d", i)
+						keys = append(keys, key)
+						Expect(ts.Put(ctx, key, newT(int64(i)))).To(Succeed())
+					}
+					results, err := reader.GetMany(ctx, keys)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(results).To(HaveLen(len(keys)))
+					for i, r := range results {
+						Expect(r.Key()).To(Equal(keys[i]))
+						Expect(r.Value()).To(match(newT(int64(i))))
+					}
+				})
+
+				When("an invalid key is used", func() {
+					It("should return an InvalidArgument error", func(ctx SpecContext) {
+						_, err := reader.GetMany(ctx, []string{"a", ""})
+						Expect(err).To(testutil.MatchStatusCode(codes.InvalidArgument))
+					})
+				})
+			})
+		})
+		Context("TTL", func() {
+			var ts storage.KeyValueStoreT[T]
+			var keepAliver storage.KeepAliver
+			BeforeEach(func() {
+				ts = tsF.Get().KeyValueStore(uuid.NewString())
+				keepAliver, _ = ts.(storage.KeepAliver)
+			})
+
+			When("the store does not support TTLs", func() {
+				It("should return an Unimplemented error", func(ctx SpecContext) {
+					if keepAliver != nil {
+						Skip("store supports TTLs")
+					}
+					err := ts.Put(ctx, "key", newT(1), storage.WithTTL(time.Minute))
+					Expect(err).To(testutil.MatchStatusCode(codes.Unimplemented))
+					_, err = ts.Get(ctx, "key")
+					Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+				})
+			})
+
+			When("the store supports TTLs", func() {
+				BeforeEach(func() {
+					if keepAliver == nil {
+						Skip("store does not support TTLs")
+					}
+				})
+
+				It("should delete keys once they are no longer kept alive", SpecTimeout(1*time.Minute), func(ctx SpecContext) {
+					updateC, err := ts.Watch(ctx, "key")
+					Expect(err).NotTo(HaveOccurred())
+
+					var revisions [2]int64
+					Expect(ts.Put(ctx, "key", newT(1), storage.WithTTL(2*time.Second), storage.WithRevisionOut(&revisions[0]))).To(Succeed())
+
+					By("keeping the key alive past its original TTL")
+					for i := 0; i < 3; i++ {
+						time.Sleep(1 * time.Second)
+						Expect(keepAliver.KeepAlive(ctx, "key")).To(Succeed())
+					}
+					_, err = ts.Get(ctx, "key")
+					Expect(err).NotTo(HaveOccurred())
+
+					By("preserving the TTL when the key is updated without one")
+					Expect(ts.Put(ctx, "key", newT(2), storage.WithRevisionOut(&revisions[1]))).To(Succeed())
+					Expect(keepAliver.KeepAlive(ctx, "key")).To(Succeed())
+
+					By("waiting for the key to expire")
+					Eventually(func() error {
+						_, err := ts.Get(ctx, "key")
+						return err
+					}).WithTimeout(10 * time.Second).WithPolling(100 * time.Millisecond).Should(testutil.MatchStatusCode(codes.NotFound))
+
+					var events []storage.WatchEvent[storage.KeyRevision[T]]
+					Eventually(func() int {
+						select {
+						case ev := <-updateC:
+							events = append(events, ev)
+						default:
+						}
+						return len(events)
+					}).Should(Equal(3))
+					Expect(events[0].EventType).To(Equal(storage.WatchEventPut))
+					Expect(events[0].Current.Revision()).To(Equal(revisions[0]))
+					Expect(events[1].EventType).To(Equal(storage.WatchEventPut))
+					Expect(events[1].Current.Revision()).To(Equal(revisions[1]))
+					Expect(events[2].EventType).To(Equal(storage.WatchEventDelete))
+					Expect(events[2].Previous.Key()).To(Equal("key"))
+					Expect(events[2].Previous.Value()).To(match(newT(2)))
+					Expect(events[2].Previous.Revision()).To(Equal(revisions[1]))
+
+					Expect(keepAliver.KeepAlive(ctx, "key")).To(testutil.MatchStatusCode(codes.NotFound))
+				})
+
+				It("should not expire keys written without a TTL", func(ctx SpecContext) {
+					Expect(ts.Put(ctx, "key", newT(1))).To(Succeed())
+					Expect(keepAliver.KeepAlive(ctx, "key")).To(testutil.MatchStatusCode(codes.FailedPrecondition))
+					Expect(keepAliver.KeepAlive(ctx, "missing")).To(testutil.MatchStatusCode(codes.NotFound))
+					Expect(keepAliver.KeepAlive(ctx, "")).To(testutil.MatchStatusCode(codes.InvalidArgument))
+				})
+
+				It("should reject non-positive TTLs", func(ctx SpecContext) {
+					err := ts.Put(ctx, "key", newT(1), storage.WithTTL(0))
+					Expect(err).To(testutil.MatchStatusCode(codes.InvalidArgument))
+				})
+
+				It("should preserve the TTL when the key is updated in a transaction", func(ctx SpecContext) {
+					txner, ok := ts.(storage.Txner[T])
+					if !ok {
+						Skip("store does not support transactions")
+					}
+					Expect(ts.Put(ctx, "key", newT(1), storage.WithTTL(time.Minute))).To(Succeed())
+					_, err := txner.Txn(ctx, storage.TxnRequest[T]{
+						Ops: []storage.TxnOp[T]{
+							storage.TxnPut("key", newT(2)),
+							storage.TxnPut("other", newT(2)),
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(keepAliver.KeepAlive(ctx, "key")).To(Succeed())
+					Expect(keepAliver.KeepAlive(ctx, "other")).To(testutil.MatchStatusCode(codes.FailedPrecondition))
+				})
+
+				It("should remove the TTL when the key is deleted", func(ctx SpecContext) {
+					Expect(ts.Put(ctx, "key", newT(1), storage.WithTTL(time.Minute))).To(Succeed())
+					Expect(ts.Delete(ctx, "key")).To(Succeed())
+					Expect(ts.Put(ctx, "key", newT(2))).To(Succeed())
+					Expect(keepAliver.KeepAlive(ctx, "key")).To(testutil.MatchStatusCode(codes.FailedPrecondition))
+				})
+			})
+		})
+		Context("Prefix deletes", func() {
+			var ts storage.KeyValueStoreT[T]
+			BeforeEach(func(ctx SpecContext) {
+				ts = tsF.Get().KeyValueStore(uuid.NewString())
+				for i, key := range []string{"tenant/a", "tenant/b", "tenant/c/d", "tenantx", "other"} {
+					Expect(ts.Put(ctx, key, newT(int64(i)))).To(Succeed())
+				}
+			})
+
+			It("should delete all keys starting with the prefix", func(ctx SpecContext) {
+				Expect(ts.Delete(ctx, "tenant/", storage.WithPrefix())).To(Succeed())
+
+				keys, err := ts.ListKeys(ctx, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(keys).To(ConsistOf("tenantx", "other"))
+				for _, key := range []string{"tenant/a", "tenant/b", "tenant/c/d"} {
+					_, err := ts.Get(ctx, key)
+					Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+				}
+			})
+
+			It("should send delete events for each deleted key", func(ctx SpecContext) {
+				eventC, err := ts.Watch(ctx, "tenant", storage.WithPrefix())
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(ts.Delete(ctx, "tenant/", storage.WithPrefix())).To(Succeed())
+
+				var deleted []string
+				for i := 0; i < 3; i++ {
+					var event storage.WatchEvent[storage.KeyRevision[T]]
+					Eventually(eventC).Should(Receive(&event))
+					Expect(event.EventType).To(Equal(storage.WatchEventDelete))
+					Expect(event.Previous).NotTo(BeNil())
+					deleted = append(deleted, event.Previous.Key())
+				}
+				Expect(deleted).To(ConsistOf("tenant/a", "tenant/b", "tenant/c/d"))
+				Consistently(eventC).WithTimeout(10 * time.Millisecond).ShouldNot(Receive())
+			})
+
+			It("should keep the history of deleted keys", func(ctx SpecContext) {
+				var revision int64
+				Expect(ts.Put(ctx, "tenant/a", newT(10), storage.WithRevisionOut(&revision))).To(Succeed())
+				Expect(ts.Delete(ctx, "tenant/", storage.WithPrefix())).To(Succeed())
+
+				value, err := ts.Get(ctx, "tenant/a", storage.WithRevision(revision))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(match(newT(10)))
+			})
+
+			It("should delete all keys if the prefix is empty", func(ctx SpecContext) {
+				Expect(ts.Delete(ctx, "", storage.WithPrefix())).To(Succeed())
+
+				keys, err := ts.ListKeys(ctx, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(keys).To(BeEmpty())
+			})
+
+			When("no keys start with the prefix", func() {
+				It("should succeed without deleting any keys", func(ctx SpecContext) {
+					Expect(ts.Delete(ctx, "missing/", storage.WithPrefix())).To(Succeed())
+
+					keys, err := ts.ListKeys(ctx, "")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(keys).To(HaveLen(5))
+				})
+			})
+
+			When("a revision is specified", func() {
+				It("should return an InvalidArgument error", func(ctx SpecContext) {
+					var revision int64
+					_, err := ts.Get(ctx, "tenant/a", storage.WithRevisionOut(&revision))
+					Expect(err).NotTo(HaveOccurred())
+
+					err = ts.Delete(ctx, "tenant/", storage.WithPrefix(), storage.WithRevision(revision))
+					Expect(err).To(testutil.MatchStatusCode(codes.InvalidArgument))
+
+					keys, err := ts.ListKeys(ctx, "tenant/")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(keys).To(HaveLen(3))
+				})
+			})
+		})
+		Context("Txn", func() {
+			var ts storage.KeyValueStoreT[T]
+			var txner storage.Txner[T]
+			BeforeEach(func() {
+				ts = tsF.Get().KeyValueStore(uuid.NewString())
+				var ok bool
+				txner, ok = ts.(storage.Txner[T])
+				if !ok {
+					Skip("store does not support transactions")
+				}
+			})
+
+			It("should apply all operations at a single revision", func(ctx SpecContext) {
+				var revA, revB int64
+				Expect(ts.Put(ctx, "a", newT(1), storage.WithRevisionOut(&revA))).To(Succeed())
+				Expect(ts.Put(ctx, "b", newT(2), storage.WithRevisionOut(&revB))).To(Succeed())
+
+				resp, err := txner.Txn(ctx, storage.TxnRequest[T]{
+					Compare: []storage.TxnCompare{
+						{Key: "a", Revision: revA},
+						{Key: "b", Revision: revB},
+						{Key: "c", Revision: 0},
+					},
+					Ops: []storage.TxnOp[T]{
+						storage.TxnPut("a", newT(2)),
+						storage.TxnPut("c", newT(1)),
+						storage.TxnDelete[T]("b"),
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.Revision).To(BeNumerically(">", max(revA, revB)))
+
+				var rev int64
+				value, err := ts.Get(ctx, "a", storage.WithRevisionOut(&rev))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(match(newT(2)))
+				Expect(rev).To(Equal(resp.Revision))
+
+				value, err = ts.Get(ctx, "c", storage.WithRevisionOut(&rev))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(match(newT(1)))
+				Expect(rev).To(Equal(resp.Revision))
+
+				_, err = ts.Get(ctx, "b")
+				Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+			})
+
+			When("any comparison fails", func() {
+				It("should not apply any operations", func(ctx SpecContext) {
+					var revA, revB int64
+					Expect(ts.Put(ctx, "a", newT(1), storage.WithRevisionOut(&revA))).To(Succeed())
+					Expect(ts.Put(ctx, "b", newT(2), storage.WithRevisionOut(&revB))).To(Succeed())
+					Expect(ts.Put(ctx, "b", newT(3))).To(Succeed())
+
+					_, err := txner.Txn(ctx, storage.TxnRequest[T]{
+						Compare: []storage.TxnCompare{
+							{Key: "a", Revision: revA},
+							{Key: "b", Revision: revB},
+						},
+						Ops: []storage.TxnOp[T]{
+							storage.TxnPut("a", newT(4)),
+							storage.TxnPut("b", newT(4)),
+						},
+					})
+					Expect(storage.IsConflict(err)).To(BeTrue(), "expected conflict error, got %v", err)
+
+					var rev int64
+					value, err := ts.Get(ctx, "a", storage.WithRevisionOut(&rev))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(value).To(match(newT(1)))
+					Expect(rev).To(Equal(revA))
+					value, err = ts.Get(ctx, "b")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(value).To(match(newT(3)))
+
+					By("requiring a key which exists to not exist")
+					_, err = txner.Txn(ctx, storage.TxnRequest[T]{
+						Compare: []storage.TxnCompare{{Key: "a", Revision: 0}},
+						Ops:     []storage.TxnOp[T]{storage.TxnPut("c", newT(1))},
+					})
+					Expect(storage.IsConflict(err)).To(BeTrue(), "expected conflict error, got %v", err)
+					_, err = ts.Get(ctx, "c")
+					Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+				})
+			})
+
+			It("should treat deleted keys as nonexistent in comparisons", func(ctx SpecContext) {
+				Expect(ts.Put(ctx, "a", newT(1))).To(Succeed())
+				Expect(ts.Delete(ctx, "a")).To(Succeed())
+				_, err := txner.Txn(ctx, storage.TxnRequest[T]{
+					Compare: []storage.TxnCompare{{Key: "a", Revision: 0}},
+					Ops:     []storage.TxnOp[T]{storage.TxnPut("a", newT(2))},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				value, err := ts.Get(ctx, "a")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(match(newT(2)))
+			})
+
+			It("should ignore deletes of keys that do not exist", func(ctx SpecContext) {
+				_, err := txner.Txn(ctx, storage.TxnRequest[T]{
+					Ops: []storage.TxnOp[T]{
+						storage.TxnDelete[T]("missing"),
+						storage.TxnPut("a", newT(1)),
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				value, err := ts.Get(ctx, "a")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(match(newT(1)))
+			})
+
+			It("should send watch events for each operation", func(ctx SpecContext) {
+				Expect(ts.Put(ctx, "prefix/b", newT(1))).To(Succeed())
+				updateC, err := ts.Watch(ctx, "prefix", storage.WithPrefix())
+				Expect(err).NotTo(HaveOccurred())
+
+				resp, err := txner.Txn(ctx, storage.TxnRequest[T]{
+					Ops: []storage.TxnOp[T]{
+						storage.TxnPut("prefix/a", newT(2)),
+						storage.TxnDelete[T]("prefix/b"),
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				events := map[storage.WatchEventType]storage.WatchEvent[storage.KeyRevision[T]]{}
+				for i := 0; i < 2; i++ {
+					var event storage.WatchEvent[storage.KeyRevision[T]]
+					Eventually(updateC).Should(Receive(&event))
+					events[event.EventType] = event
+				}
+				Expect(events).To(HaveKey(storage.WatchEventPut))
+				Expect(events).To(HaveKey(storage.WatchEventDelete))
+				Expect(events[storage.WatchEventPut].Current.Key()).To(Equal("prefix/a"))
+				Expect(events[storage.WatchEventPut].Current.Revision()).To(Equal(resp.Revision))
+				Expect(events[storage.WatchEventDelete].Previous.Key()).To(Equal("prefix/b"))
+			})
+
+			When("the request is invalid", func() {
+				It("should return an InvalidArgument error", func(ctx SpecContext) {
+					_, err := txner.Txn(ctx, storage.TxnRequest[T]{
+						Ops: []storage.TxnOp[T]{storage.TxnPut("", newT(1))},
+					})
+					Expect(err).To(testutil.MatchStatusCode(codes.InvalidArgument))
+
+					_, err = txner.Txn(ctx, storage.TxnRequest[T]{
+						Compare: []storage.TxnCompare{{Key: "", Revision: 0}},
+					})
+					Expect(err).To(testutil.MatchStatusCode(codes.InvalidArgument))
+
+					_, err = txner.Txn(ctx, storage.TxnRequest[T]{
+						Ops: []storage.TxnOp[T]{
+							storage.TxnPut("a", newT(1)),
+							storage.TxnDelete[T]("a"),
+						},
+					})
+					Expect(err).To(testutil.MatchStatusCode(codes.InvalidArgument))
+
+					_, err = ts.Get(ctx, "a")
+					Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+				})
+			})
+		})
 	}
 }
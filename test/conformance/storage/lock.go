@@ -0,0 +1,193 @@
+package conformance_storage
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/util/future"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// Every Lock obtained from the lock manager must be an independent contender
+// for its key, even if the same key is passed to Locker multiple times.
+func LockManagerTestSuite[T storage.LockManager](
+	lmF future.Future[T],
+) func() {
+	return func() {
+		var lm T
+		BeforeAll(func() {
+			lm = lmF.Get()
+		})
+
+		Context("Lock", func() {
+			It("should acquire and release a lock", func(ctx SpecContext) {
+				lock := lm.Locker(uuid.NewString())
+				expired, err := lock.Lock(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(expired).NotTo(BeNil())
+				Consistently(expired).WithTimeout(10 * time.Millisecond).ShouldNot(BeClosed())
+
+				Expect(lock.Unlock()).To(Succeed())
+				Eventually(expired).Should(BeClosed())
+			})
+
+			It("should be reusable after being released", func(ctx SpecContext) {
+				lock := lm.Locker(uuid.NewString())
+				for i := 0; i < 3; i++ {
+					expired, err := lock.Lock(ctx)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(lock.Unlock()).To(Succeed())
+					Eventually(expired).Should(BeClosed())
+				}
+			})
+
+			It("should block until the lock is released by another holder", func(ctx SpecContext) {
+				key := uuid.NewString()
+				lock1 := lm.Locker(key)
+				lock2 := lm.Locker(key)
+
+				expired1, err := lock1.Lock(ctx)
+				Expect(err).NotTo(HaveOccurred())
+
+				acquired := make(chan chan struct{})
+				go func() {
+					defer GinkgoRecover()
+					expired2, err := lock2.Lock(ctx)
+					Expect(err).NotTo(HaveOccurred())
+					acquired <- expired2
+				}()
+				Consistently(acquired).WithTimeout(100 * time.Millisecond).ShouldNot(Receive())
+
+				Expect(lock1.Unlock()).To(Succeed())
+				Eventually(expired1).Should(BeClosed())
+
+				var expired2 chan struct{}
+				Eventually(acquired).WithTimeout(10 * time.Second).Should(Receive(&expired2))
+				Consistently(expired2).WithTimeout(10 * time.Millisecond).ShouldNot(BeClosed())
+				Expect(lock2.Unlock()).To(Succeed())
+				Eventually(expired2).Should(BeClosed())
+			})
+
+			It("should return an error if the context is canceled while waiting", func(ctx SpecContext) {
+				key := uuid.NewString()
+				lock1 := lm.Locker(key)
+				lock2 := lm.Locker(key)
+
+				_, err := lock1.Lock(ctx)
+				Expect(err).NotTo(HaveOccurred())
+
+				tctx, ca := context.WithTimeout(ctx, 100*time.Millisecond)
+				defer ca()
+				_, err = lock2.Lock(tctx)
+				Expect(err).To(HaveOccurred())
+
+				By("ensuring the lock can be acquired after the failed attempt")
+				Expect(lock1.Unlock()).To(Succeed())
+				_, err = lock2.Lock(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lock2.Unlock()).To(Succeed())
+			})
+
+			It("should not block locks on other keys", func(ctx SpecContext) {
+				lock1 := lm.Locker(uuid.NewString())
+				lock2 := lm.Locker(uuid.NewString())
+
+				_, err := lock1.Lock(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = lock2.Lock(ctx)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(lock1.Unlock()).To(Succeed())
+				Expect(lock2.Unlock()).To(Succeed())
+			})
+		})
+
+		Context("TryLock", func() {
+			It("should acquire the lock if it is not held", func(ctx SpecContext) {
+				lock := lm.Locker(uuid.NewString())
+				acquired, expired, err := lock.TryLock(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(acquired).To(BeTrue())
+				Expect(expired).NotTo(BeNil())
+
+				Expect(lock.Unlock()).To(Succeed())
+				Eventually(expired).Should(BeClosed())
+			})
+
+			It("should not acquire the lock if it is held by someone else", func(ctx SpecContext) {
+				key := uuid.NewString()
+				lock1 := lm.Locker(key)
+				lock2 := lm.Locker(key)
+
+				_, err := lock1.Lock(ctx)
+				Expect(err).NotTo(HaveOccurred())
+
+				acquired, expired, err := lock2.TryLock(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(acquired).To(BeFalse())
+				Expect(expired).To(BeNil())
+
+				Expect(lock1.Unlock()).To(Succeed())
+
+				Eventually(func() bool {
+					acquired, _, err := lock2.TryLock(ctx)
+					Expect(err).NotTo(HaveOccurred())
+					return acquired
+				}).WithTimeout(10 * time.Second).Should(BeTrue())
+				Expect(lock2.Unlock()).To(Succeed())
+			})
+		})
+
+		Context("Unlock", func() {
+			It("should return an error if the lock is not held", func(ctx SpecContext) {
+				lock := lm.Locker(uuid.NewString())
+				Expect(lock.Unlock()).To(MatchError(storage.ErrLockNotHeld))
+
+				_, err := lock.Lock(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lock.Unlock()).To(Succeed())
+				Expect(lock.Unlock()).To(MatchError(storage.ErrLockNotHeld))
+			})
+		})
+
+		Context("Atomicity", func() {
+			It("should never allow two holders in the critical section", SpecTimeout(1*time.Minute), func(ctx SpecContext) {
+				key := uuid.NewString()
+				var (
+					holders atomic.Int32
+					counter int
+					wg      sync.WaitGroup
+				)
+				const workers, iterations = 5, 10
+				for i := 0; i < workers; i++ {
+					wg.Add(1)
+					go func() {
+						defer GinkgoRecover()
+						defer wg.Done()
+						lock := lm.Locker(key)
+						for j := 0; j < iterations; j++ {
+							_, err := lock.Lock(ctx)
+							Expect(err).NotTo(HaveOccurred())
+							Expect(holders.Add(1)).To(BeEquivalentTo(1))
+							counter++
+							Expect(holders.Add(-1)).To(BeEquivalentTo(0))
+							Expect(lock.Unlock()).To(Succeed())
+						}
+					}()
+				}
+				done := make(chan struct{})
+				go func() {
+					wg.Wait()
+					close(done)
+				}()
+				Eventually(ctx, done).WithTimeout(1 * time.Minute).Should(BeClosed())
+				Expect(counter).To(Equal(workers * iterations))
+			})
+		})
+	}
+}
@@ -0,0 +1,555 @@
+package conformance_storage
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/kralicky/protoconfig/storage"
+	"github.com/kralicky/protoconfig/test/testutil"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/types"
+
+	"google.golang.org/grpc/codes"
+)
+
+type ValueStoreTestSuiteOptions struct {
+	noDeletedHistory bool
+}
+
+type ValueStoreTestSuiteOption func(*ValueStoreTestSuiteOptions)
+
+func (o *ValueStoreTestSuiteOptions) apply(opts ...ValueStoreTestSuiteOption) {
+	for _, op := range opts {
+		op(o)
+	}
+}
+
+// Declares that the store does not retain the history of a value once it is
+// deleted. Instead of reading the history of deleted values, the suite then
+// checks that requesting their revisions returns an error for which
+// [storage.IsCompacted] returns true, and that histories including deleted
+// revisions only contain the current value.
+func WithoutDeletedHistory() ValueStoreTestSuiteOption {
+	return func(o *ValueStoreTestSuiteOptions) {
+		o.noDeletedHistory = true
+	}
+}
+
+// Each call to [newStore] must return a new, empty value store.
+//
+// The function [newT] must follow the same rules as in [KeyValueStoreTestSuite].
+func ValueStoreTestSuite[T any](
+	newStore func() storage.ValueStoreT[T],
+	newT func(seed ...int64) T,
+	match func(any) types.GomegaMatcher,
+	opts ...ValueStoreTestSuiteOption,
+) func() {
+	checkNewT(newT)
+	options := ValueStoreTestSuiteOptions{}
+	options.apply(opts...)
+
+	isNil := func(t T) bool {
+		val := reflect.ValueOf(t)
+		return !val.IsValid() || val.IsNil()
+	}
+
+	return func() {
+		var vs storage.ValueStoreT[T]
+		BeforeEach(func() {
+			vs = newStore()
+		})
+
+		Context("basic operations", func() {
+			It("should initially be empty", func(ctx SpecContext) {
+				value, err := vs.Get(ctx)
+				Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+				Expect(isNil(value)).To(BeTrue())
+
+				Expect(vs.Delete(ctx)).To(testutil.MatchStatusCode(codes.NotFound))
+
+				hist, err := vs.History(ctx)
+				Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+				Expect(hist).To(BeEmpty())
+			})
+			It("should store and retrieve values", func(ctx SpecContext) {
+				var putRev int64
+				Expect(vs.Put(ctx, newT(1), storage.WithRevisionOut(&putRev))).To(Succeed())
+				Expect(putRev).To(BeNumerically(">", 0))
+
+				var getRev int64
+				value, err := vs.Get(ctx, storage.WithRevisionOut(&getRev))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(match(newT(1)))
+				Expect(getRev).To(Equal(putRev))
+
+				var putRev2 int64
+				Expect(vs.Put(ctx, newT(2), storage.WithRevisionOut(&putRev2))).To(Succeed())
+				Expect(putRev2).To(BeNumerically(">", putRev))
+
+				value, err = vs.Get(ctx, storage.WithRevisionOut(&getRev))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(match(newT(2)))
+				Expect(getRev).To(Equal(putRev2))
+			})
+			When("putting a nil value", func() {
+				It("should treat it as the zero value for that type", func(ctx SpecContext) {
+					Expect(vs.Put(ctx, newT())).To(Succeed())
+
+					value, err := vs.Get(ctx)
+					Expect(err).NotTo(HaveOccurred())
+					var zero T
+					if val := reflect.ValueOf(newT()); val.IsNil() {
+						if val.Kind() == reflect.Ptr {
+							zero = reflect.New(val.Type().Elem()).Interface().(T)
+						} else {
+							zero = reflect.Zero(val.Type()).Interface().(T)
+						}
+					}
+					Expect(value).To(match(zero))
+				})
+			})
+			When("the value is deleted", func() {
+				It("should behave as if the value does not exist", func(ctx SpecContext) {
+					Expect(vs.Put(ctx, newT(1))).To(Succeed())
+					Expect(vs.Delete(ctx)).To(Succeed())
+
+					value, err := vs.Get(ctx)
+					Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+					Expect(isNil(value)).To(BeTrue())
+
+					Expect(vs.Delete(ctx)).To(testutil.MatchStatusCode(codes.NotFound))
+
+					hist, err := vs.History(ctx)
+					Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+					Expect(hist).To(BeEmpty())
+				})
+				It("should be possible to recreate the value", func(ctx SpecContext) {
+					Expect(vs.Put(ctx, newT(1))).To(Succeed())
+					Expect(vs.Delete(ctx)).To(Succeed())
+					Expect(vs.Put(ctx, newT(2))).To(Succeed())
+
+					value, err := vs.Get(ctx)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(value).To(match(newT(2)))
+				})
+			})
+		})
+
+		Context("revisions", func() {
+			When("using revision with Put", func() {
+				It("should only put if the revision matches", func(ctx SpecContext) {
+					var revision1, revision2 int64
+					Expect(vs.Put(ctx, newT(1), storage.WithRevisionOut(&revision1))).To(Succeed())
+					Expect(vs.Put(ctx, newT(2), storage.WithRevisionOut(&revision2))).To(Succeed())
+
+					Expect(vs.Put(ctx, newT(3), storage.WithRevision(revision1))).To(testutil.MatchStatusCode(storage.ErrConflict))
+					Expect(vs.Put(ctx, newT(3), storage.WithRevision(revision2+1))).To(testutil.MatchStatusCode(storage.ErrConflict))
+
+					value, err := vs.Get(ctx)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(value).To(match(newT(2)))
+
+					Expect(vs.Put(ctx, newT(3), storage.WithRevision(revision2))).To(Succeed())
+
+					value, err = vs.Get(ctx)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(value).To(match(newT(3)))
+				})
+				When("revision 0 is provided", func() {
+					It("should only put if the value does not exist or has been deleted", func(ctx SpecContext) {
+						Expect(vs.Put(ctx, newT(1), storage.WithRevision(0))).To(Succeed())
+
+						err := vs.Put(ctx, newT(2), storage.WithRevision(0))
+						Expect(storage.IsConflict(err)).To(BeTrue(), fmt.Sprint(err))
+
+						Expect(vs.Delete(ctx)).To(Succeed())
+						Expect(vs.Put(ctx, newT(2), storage.WithRevision(0))).To(Succeed())
+
+						value, err := vs.Get(ctx)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(value).To(match(newT(2)))
+					})
+				})
+			})
+
+			When("using revision with Get", func() {
+				It("should retrieve the value at the specific revision", func(ctx SpecContext) {
+					revisions := make([]int64, 5)
+					for i := range revisions {
+						Expect(vs.Put(ctx, newT(int64(i)), storage.WithRevisionOut(&revisions[i]))).To(Succeed())
+					}
+					for i := range revisions {
+						var revOut int64
+						value, err := vs.Get(ctx, storage.WithRevision(revisions[i]), storage.WithRevisionOut(&revOut))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(value).To(match(newT(int64(i))))
+						Expect(revOut).To(Equal(revisions[i]))
+					}
+				})
+				When("the revision is a future revision", func() {
+					It("should return an OutOfRange error", func(ctx SpecContext) {
+						var revision int64
+						Expect(vs.Put(ctx, newT(1), storage.WithRevisionOut(&revision))).To(Succeed())
+						_, err := vs.Get(ctx, storage.WithRevision(revision+1))
+						Expect(err).To(testutil.MatchStatusCode(codes.OutOfRange))
+					})
+				})
+				When("the revision is a past revision", func() {
+					It("should return a NotFound error", func(ctx SpecContext) {
+						var revision int64
+						Expect(vs.Put(ctx, newT(1), storage.WithRevisionOut(&revision))).To(Succeed())
+						_, err := vs.Get(ctx, storage.WithRevision(revision-1))
+						Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+					})
+				})
+			})
+
+			When("using revision with Delete", func() {
+				It("should only delete if the revision matches", func(ctx SpecContext) {
+					var revision1, revision2 int64
+					Expect(vs.Put(ctx, newT(1), storage.WithRevisionOut(&revision1))).To(Succeed())
+					Expect(vs.Put(ctx, newT(2), storage.WithRevisionOut(&revision2))).To(Succeed())
+
+					Expect(vs.Delete(ctx, storage.WithRevision(revision1))).To(testutil.MatchStatusCode(storage.ErrConflict))
+
+					value, err := vs.Get(ctx)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(value).To(match(newT(2)))
+
+					Expect(vs.Delete(ctx, storage.WithRevision(revision2))).To(Succeed())
+
+					_, err = vs.Get(ctx)
+					Expect(err).To(testutil.MatchStatusCode(codes.NotFound))
+				})
+			})
+		})
+
+		Context("History", func() {
+			putAll := func(ctx context.Context, seeds ...int64) []int64 {
+				GinkgoHelper()
+				revisions := make([]int64, len(seeds))
+				for i, seed := range seeds {
+					Expect(vs.Put(ctx, newT(seed), storage.WithRevisionOut(&revisions[i]))).To(Succeed())
+				}
+				return revisions
+			}
+
+			It("should return all revisions in order", func(ctx SpecContext) {
+				revisions := putAll(ctx, 1, 2, 3)
+
+				revs, err := vs.History(ctx, storage.IncludeValues(true))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(revs).To(HaveLen(3))
+				for i, rev := range revs {
+					Expect(rev.Value()).To(match(newT(int64(i + 1))))
+					Expect(rev.Revision()).To(Equal(revisions[i]))
+					if i > 0 {
+						Expect(rev.Timestamp()).To(Or(
+							BeZero(),
+							BeTemporally(">=", revs[i-1].Timestamp()),
+						))
+					}
+				}
+			})
+			When("values are not requested", func() {
+				It("should return the zero value for each revision", func(ctx SpecContext) {
+					revisions := putAll(ctx, 1, 2, 3)
+
+					revs, err := vs.History(ctx)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(revs).To(HaveLen(3))
+					for i, rev := range revs {
+						Expect(isNil(rev.Value())).To(BeTrue())
+						Expect(rev.Revision()).To(Equal(revisions[i]))
+					}
+				})
+			})
+			When("a revision is specified", func() {
+				It("should end the history at that revision", func(ctx SpecContext) {
+					revisions := putAll(ctx, 1, 2, 3)
+
+					for i := range revisions {
+						revs, err := vs.History(ctx, storage.WithRevision(revisions[i]), storage.IncludeValues(true))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(revs).To(HaveLen(i + 1))
+						for j, rev := range revs {
+							Expect(rev.Value()).To(match(newT(int64(j + 1))))
+							Expect(rev.Revision()).To(Equal(revisions[j]))
+						}
+					}
+				})
+			})
+			When("the value has been recreated", func() {
+				It("should start the history at the most recent creation revision", func(ctx SpecContext) {
+					putAll(ctx, 1, 2)
+					Expect(vs.Delete(ctx)).To(Succeed())
+					revisions := putAll(ctx, 3, 4)
+
+					revs, err := vs.History(ctx, storage.IncludeValues(true))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(revs).To(HaveLen(2))
+					Expect(revs[0].Value()).To(match(newT(3)))
+					Expect(revs[0].Revision()).To(Equal(revisions[0]))
+					Expect(revs[1].Value()).To(match(newT(4)))
+					Expect(revs[1].Revision()).To(Equal(revisions[1]))
+				})
+				It("should start the history at the creation revision preceding the specified revision", func(ctx SpecContext) {
+					revisions := putAll(ctx, 1, 2)
+					Expect(vs.Delete(ctx)).To(Succeed())
+					putAll(ctx, 3)
+
+					revs, err := vs.History(ctx, storage.WithRevision(revisions[1]), storage.IncludeValues(true))
+					if options.noDeletedHistory {
+						Expect(storage.IsCompacted(err)).To(BeTrue(), "expected a compacted error, got %v", err)
+						return
+					}
+					Expect(err).NotTo(HaveOccurred())
+					Expect(revs).To(HaveLen(2))
+					Expect(revs[0].Value()).To(match(newT(1)))
+					Expect(revs[1].Value()).To(match(newT(2)))
+				})
+			})
+			It("should report the creation revision and version of each revision", func(ctx SpecContext) {
+				revisions := putAll(ctx, 1, 2, 3)
+
+				revs, err := vs.History(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(revs).To(HaveLen(3))
+				for i, rev := range revs {
+					Expect(rev.CreateRevision()).To(Or(BeZero(), Equal(revisions[0])))
+					Expect(rev.Version()).To(Or(BeZero(), BeEquivalentTo(i+1)))
+					Expect(rev.IsTombstone()).To(BeFalse())
+				}
+
+				By("resetting them when the value is recreated")
+				Expect(vs.Delete(ctx)).To(Succeed())
+				revisions = putAll(ctx, 4)
+				revs, err = vs.History(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(revs).To(HaveLen(1))
+				Expect(revs[0].CreateRevision()).To(Or(BeZero(), Equal(revisions[0])))
+				Expect(revs[0].Version()).To(Or(BeZero(), BeEquivalentTo(1)))
+			})
+			When("deleted revisions are requested", func() {
+				It("should include previous generations of the value and their tombstones", func(ctx SpecContext) {
+					revisions := putAll(ctx, 1, 2)
+					Expect(vs.Delete(ctx)).To(Succeed())
+					recreated := putAll(ctx, 3)
+
+					revs, err := vs.History(ctx, storage.IncludeDeleted(true), storage.IncludeValues(true))
+					Expect(err).NotTo(HaveOccurred())
+					if options.noDeletedHistory {
+						Expect(revs).To(HaveLen(1))
+						Expect(revs[0].Value()).To(match(newT(3)))
+						Expect(revs[0].Revision()).To(Equal(recreated[0]))
+						return
+					}
+					Expect(revs).To(HaveLen(4))
+					Expect(revs[0].Value()).To(match(newT(1)))
+					Expect(revs[1].Value()).To(match(newT(2)))
+					Expect(revs[2].IsTombstone()).To(BeTrue())
+					Expect(revs[2].Revision()).To(BeNumerically(">", revisions[1]))
+					Expect(revs[2].Version()).To(BeZero())
+					Expect(revs[3].Value()).To(match(newT(3)))
+					Expect(revs[3].Revision()).To(Equal(recreated[0]))
+				})
+			})
+			When("the value has been deleted", func() {
+				It("should allow accessing history using an older revision", func(ctx SpecContext) {
+					revisions := putAll(ctx, 1, 2, 3)
+					Expect(vs.Delete(ctx)).To(Succeed())
+
+					revs, err := vs.History(ctx, storage.WithRevision(revisions[2]), storage.IncludeValues(true))
+					if options.noDeletedHistory {
+						Expect(storage.IsCompacted(err)).To(BeTrue(), "expected a compacted error, got %v", err)
+						return
+					}
+					Expect(err).NotTo(HaveOccurred())
+					Expect(revs).To(HaveLen(3))
+					for i, rev := range revs {
+						Expect(rev.Value()).To(match(newT(int64(i + 1))))
+					}
+				})
+			})
+		})
+
+		Context("Watch", func() {
+			nextEvent := func(eventC <-chan storage.WatchEvent[storage.KeyRevision[T]]) storage.WatchEvent[storage.KeyRevision[T]] {
+				GinkgoHelper()
+				var event storage.WatchEvent[storage.KeyRevision[T]]
+				Eventually(eventC).Should(Receive(&event))
+				return event
+			}
+			expectPut := func(event storage.WatchEvent[storage.KeyRevision[T]], prev T, prevRev int64, current T, currentRev int64) {
+				GinkgoHelper()
+				Expect(event.EventType).To(Equal(storage.WatchEventPut))
+				Expect(event.Current).NotTo(BeNil())
+				Expect(event.Current.Value()).To(match(current))
+				Expect(event.Current.Revision()).To(Equal(currentRev))
+				Expect(event.Revision).To(Equal(currentRev))
+				if isNil(prev) {
+					Expect(event.Previous).To(BeNil())
+				} else {
+					Expect(event.Previous).NotTo(BeNil())
+					Expect(event.Previous.Value()).To(match(prev))
+					Expect(event.Previous.Revision()).To(Equal(prevRev))
+				}
+			}
+			expectDelete := func(event storage.WatchEvent[storage.KeyRevision[T]], prev T, prevRev int64) {
+				GinkgoHelper()
+				Expect(event.EventType).To(Equal(storage.WatchEventDelete))
+				Expect(event.Current).To(BeNil())
+				Expect(event.Previous).NotTo(BeNil())
+				Expect(event.Previous.Value()).To(match(prev))
+				Expect(event.Previous.Revision()).To(Equal(prevRev))
+				if event.Revision != 0 {
+					Expect(event.Revision).To(BeNumerically(">", prevRev))
+				}
+			}
+			var none T
+
+			It("should watch for changes to the value", func(ctx SpecContext) {
+				eventC, err := vs.Watch(ctx)
+				Expect(err).NotTo(HaveOccurred())
+
+				var revisions [3]int64
+				By("creating the value")
+				Expect(vs.Put(ctx, newT(1), storage.WithRevisionOut(&revisions[0]))).To(Succeed())
+				expectPut(nextEvent(eventC), none, 0, newT(1), revisions[0])
+
+				By("updating the value")
+				Expect(vs.Put(ctx, newT(2), storage.WithRevisionOut(&revisions[1]))).To(Succeed())
+				expectPut(nextEvent(eventC), newT(1), revisions[0], newT(2), revisions[1])
+
+				By("deleting the value")
+				Expect(vs.Delete(ctx)).To(Succeed())
+				expectDelete(nextEvent(eventC), newT(2), revisions[1])
+
+				By("recreating the value")
+				Expect(vs.Put(ctx, newT(3), storage.WithRevisionOut(&revisions[2]))).To(Succeed())
+				expectPut(nextEvent(eventC), none, 0, newT(3), revisions[2])
+			})
+			It("should report whether put events created the value", func(ctx SpecContext) {
+				eventC, err := vs.Watch(ctx)
+				Expect(err).NotTo(HaveOccurred())
+
+				var revisions [3]int64
+				Expect(vs.Put(ctx, newT(1), storage.WithRevisionOut(&revisions[0]))).To(Succeed())
+				event := nextEvent(eventC)
+				if event.Current.Version() == 0 {
+					Skip("store does not track versions")
+				}
+				Expect(event.Current.Version()).To(BeEquivalentTo(1))
+				Expect(event.Current.CreateRevision()).To(Equal(revisions[0]))
+
+				Expect(vs.Put(ctx, newT(2), storage.WithRevisionOut(&revisions[1]))).To(Succeed())
+				event = nextEvent(eventC)
+				Expect(event.Current.Version()).To(BeEquivalentTo(2))
+				Expect(event.Current.CreateRevision()).To(Equal(revisions[0]))
+
+				Expect(vs.Delete(ctx)).To(Succeed())
+				event = nextEvent(eventC)
+				Expect(event.Previous.Version()).To(BeEquivalentTo(2))
+
+				Expect(vs.Put(ctx, newT(3), storage.WithRevisionOut(&revisions[2]))).To(Succeed())
+				event = nextEvent(eventC)
+				Expect(event.Current.Version()).To(BeEquivalentTo(1))
+				Expect(event.Current.CreateRevision()).To(Equal(revisions[2]))
+			})
+			When("no revision is specified", func() {
+				It("should only send future events", func(ctx SpecContext) {
+					Expect(vs.Put(ctx, newT(1))).To(Succeed())
+
+					eventC, err := vs.Watch(ctx)
+					Expect(err).NotTo(HaveOccurred())
+					Consistently(eventC).WithTimeout(100 * time.Millisecond).ShouldNot(Receive())
+				})
+			})
+			When("revision 0 is specified", func() {
+				It("should send the current value first", func(ctx SpecContext) {
+					var revisions [2]int64
+					Expect(vs.Put(ctx, newT(1), storage.WithRevisionOut(&revisions[0]))).To(Succeed())
+					Expect(vs.Put(ctx, newT(2), storage.WithRevisionOut(&revisions[1]))).To(Succeed())
+
+					eventC, err := vs.Watch(ctx, storage.WithRevision(0))
+					Expect(err).NotTo(HaveOccurred())
+					event := nextEvent(eventC)
+					Expect(event.EventType).To(Equal(storage.WatchEventPut))
+					Expect(event.Current.Value()).To(match(newT(2)))
+					Expect(event.Current.Revision()).To(Equal(revisions[1]))
+					Consistently(eventC).WithTimeout(100 * time.Millisecond).ShouldNot(Receive())
+				})
+			})
+			When("a past revision is specified", func() {
+				It("should replay events starting at that revision", func(ctx SpecContext) {
+					var revisions [3]int64
+					for i := range revisions {
+						Expect(vs.Put(ctx, newT(int64(i+1)), storage.WithRevisionOut(&revisions[i]))).To(Succeed())
+					}
+
+					eventC, err := vs.Watch(ctx, storage.WithRevision(revisions[1]))
+					Expect(err).NotTo(HaveOccurred())
+					expectPut(nextEvent(eventC), newT(1), revisions[0], newT(2), revisions[1])
+					expectPut(nextEvent(eventC), newT(2), revisions[1], newT(3), revisions[2])
+					Consistently(eventC).WithTimeout(100 * time.Millisecond).ShouldNot(Receive())
+				})
+			})
+			It("should stop watching when the context is canceled", func(ctx SpecContext) {
+				wctx, cancel := context.WithCancel(ctx)
+				eventC, err := vs.Watch(wctx)
+				Expect(err).NotTo(HaveOccurred())
+				cancel()
+				Eventually(eventC).Should(BeClosed())
+			})
+			When("events are not read quickly enough", func() {
+				const numEvents = 3 * storage.WatchBufferSize
+				writeAll := func(ctx context.Context) []int64 {
+					revisions := make([]int64, numEvents)
+					for i := range revisions {
+						Expect(vs.Put(ctx, newT(int64(i)), storage.WithRevisionOut(&revisions[i]))).To(Succeed())
+					}
+					return revisions
+				}
+				receiveAll := func(eventC <-chan storage.WatchEvent[storage.KeyRevision[T]]) []storage.WatchEvent[storage.KeyRevision[T]] {
+					var events []storage.WatchEvent[storage.KeyRevision[T]]
+					for {
+						select {
+						case ev, ok := <-eventC:
+							if !ok {
+								return events
+							}
+							events = append(events, ev)
+						case <-time.After(time.Second):
+							return events
+						}
+					}
+				}
+				It("should queue all events with the unbounded policy", func(ctx SpecContext) {
+					eventC, err := vs.Watch(ctx, storage.WithOverflowPolicy(storage.OverflowUnbounded))
+					Expect(err).NotTo(HaveOccurred())
+					revisions := writeAll(ctx)
+					events := receiveAll(eventC)
+					Expect(events).To(HaveLen(numEvents))
+					for i, ev := range events {
+						Expect(ev.EventType).To(Equal(storage.WatchEventPut))
+						Expect(ev.Revision).To(Equal(revisions[i]))
+					}
+				})
+				It("should end the watch with the close policy", func(ctx SpecContext) {
+					eventC, err := vs.Watch(ctx, storage.WithOverflowPolicy(storage.OverflowClose))
+					Expect(err).NotTo(HaveOccurred())
+					writeAll(ctx)
+					events := receiveAll(eventC)
+					Expect(eventC).To(BeClosed())
+					Expect(len(events)).To(BeNumerically("<=", numEvents))
+					last := events[len(events)-1]
+					Expect(last.EventType).To(Equal(storage.WatchEventError))
+					Expect(last.Err).To(testutil.MatchStatusCode(storage.ErrWatchOverflow))
+				})
+			})
+		})
+	}
+}